@@ -0,0 +1,48 @@
+package kcp
+
+import (
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestAuthenticators(t *testing.T) {
+	auths := map[string]PacketAuthenticator{
+		"crc32": NewCRC32Authenticator(),
+		"hmac":  NewHMACAuthenticator(pass),
+		"nop":   NewNopAuthenticator(),
+	}
+	for name, auth := range auths {
+		p := make([]byte, auth.Overhead()+mtuLimit/2)
+		io.ReadFull(rand.Reader, p[auth.Overhead():])
+		auth.Sign(p)
+		if !auth.Verify(p) {
+			t.Fatal(name, "signed packet rejected")
+		}
+		if auth.Overhead() == 0 {
+			continue
+		}
+		p[len(p)-1]++
+		if auth.Verify(p) {
+			t.Fatal(name, "tampered packet accepted")
+		}
+	}
+
+	// a different key is a forgery
+	p := make([]byte, hmacSize+64)
+	NewHMACAuthenticator(pass).Sign(p)
+	if NewHMACAuthenticator(pass[:16]).Verify(p) {
+		t.Fatal("forged packet accepted")
+	}
+}
+
+func BenchmarkHMACAuthenticator(b *testing.B) {
+	auth := NewHMACAuthenticator(pass)
+	p := make([]byte, mtuLimit)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(p)))
+	for i := 0; i < b.N; i++ {
+		auth.Sign(p)
+		auth.Verify(p)
+	}
+}
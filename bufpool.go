@@ -0,0 +1,59 @@
+package kcp
+
+import "sync"
+
+// bufferClasses are the capacities of the pooled packet and segment buffers
+var bufferClasses = [...]int{256, 512, 1024, mtuLimit}
+
+// bufferClass returns the smallest class holding 'size' bytes, -1 if none
+func bufferClass(size int) int {
+	for k := range bufferClasses {
+		if size <= bufferClasses[k] {
+			return k
+		}
+	}
+	return -1
+}
+
+// bufferPool pools the packet buffers by size class, so a small packet doesn't
+// take a buffer of mtuLimit. A buffer is taken from the class holding the size
+// requested, and returned to the largest class its capacity holds, so a buffer
+// never lands in a class larger than itself, whoever allocated it.
+//
+// The buffers are pooled as pointers like segmentPools, and the pointers emptied
+// by Get are pooled in turn for Put, so that recycling a buffer doesn't allocate.
+type bufferPool struct {
+	classes [len(bufferClasses)]sync.Pool
+	holders sync.Pool
+}
+
+// Get returns a buffer of 'size' bytes, its capacity is that of its class, and
+// extending it beyond that is up to the caller to request upfront.
+func (p *bufferPool) Get(size int) []byte {
+	class := bufferClass(size)
+	if class < 0 {
+		return make([]byte, size)
+	}
+	if h, ok := p.classes[class].Get().(*[]byte); ok {
+		buf := *h
+		*h = nil
+		p.holders.Put(h)
+		return buf[:size]
+	}
+	return make([]byte, size, bufferClasses[class])
+}
+
+// Put recycles a buffer, the ones smaller than any class are left to GC
+func (p *bufferPool) Put(buf []byte) {
+	for k := len(bufferClasses) - 1; k >= 0; k-- {
+		if cap(buf) >= bufferClasses[k] {
+			h, ok := p.holders.Get().(*[]byte)
+			if !ok {
+				h = new([]byte)
+			}
+			*h = buf[:0]
+			p.classes[k].Put(h)
+			return
+		}
+	}
+}
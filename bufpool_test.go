@@ -0,0 +1,59 @@
+package kcp
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// checkPool drains the classes of 'p', failing on a buffer smaller than its class
+func checkPool(t *testing.T, p *bufferPool) {
+	for k := range p.classes {
+		for {
+			h, ok := p.classes[k].Get().(*[]byte)
+			if !ok {
+				break
+			}
+			if cap(*h) < bufferClasses[k] {
+				t.Fatalf("a buffer of %v bytes in the class of %v", cap(*h), bufferClasses[k])
+			}
+		}
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	var p bufferPool
+	for _, size := range []int{0, 1, 30, 256, 257, 600, 1024, 1400, mtuLimit, mtuLimit + 1} {
+		buf := p.Get(size)
+		if len(buf) != size {
+			t.Fatal("size mismatch", size, len(buf))
+		}
+		if class := bufferClass(size); class >= 0 && cap(buf) != bufferClasses[class] {
+			t.Fatal("not of the class", size, cap(buf))
+		}
+		p.Put(buf)
+	}
+
+	// the buffers allocated elsewhere land in the largest class they hold
+	for i := 0; i < 1000; i++ {
+		p.Put(make([]byte, rand.Intn(2*mtuLimit)))
+	}
+	checkPool(t, &p)
+	for _, size := range []int{30, 300, 700, 1400} {
+		if buf := p.Get(size); cap(buf) < size {
+			t.Fatal("a buffer smaller than requested", size, cap(buf))
+		}
+	}
+}
+
+func TestBufferPoolAllocs(t *testing.T) {
+	var p bufferPool
+	p.Put(p.Get(mtuLimit))
+	// sync.Pool drops some of the buffers randomly with the race detector, so only
+	// the allocation of every Put, as by boxing the slices, fails it
+	allocs := testing.AllocsPerRun(1000, func() {
+		p.Put(p.Get(mtuLimit))
+	})
+	if allocs >= 1 {
+		t.Fatal("allocations per recycling", allocs)
+	}
+}
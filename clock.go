@@ -0,0 +1,61 @@
+package kcp
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Clock is the time source of a KCP state machine, see KCP.SetClock
+type Clock interface {
+	Now() time.Time
+}
+
+// ManualClock is a virtual Clock moved only by Advance, with a scheduler of the
+// functions due on it in place of TimedSched, to drive KCP state machines over an
+// in-memory link deterministically, e.g. to test the retransmissions of a lossy
+// link for a minute in no time.
+type ManualClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	tasks timedFuncHeap
+}
+
+// NewManualClock creates a ManualClock starting at 'start'
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+// Now returns the time of the clock
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Put schedules a function 'f' to be executed by Advance at 'deadline' of the clock
+func (c *ManualClock) Put(f func(), deadline time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if deadline.Before(c.now) {
+		deadline = c.now
+	}
+	heap.Push(&c.tasks, timedFunc{execute: f, ts: deadline})
+}
+
+// Advance moves the clock forward by 'd', executing the functions due meanwhile
+// in the order of their deadlines, with the clock set to each deadline. The
+// functions may put more functions, executed as well if due within 'd'.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	for len(c.tasks) > 0 && !c.tasks[0].ts.After(target) {
+		task := heap.Pop(&c.tasks).(timedFunc)
+		c.now = task.ts
+		c.mu.Unlock()
+		task.execute()
+		c.mu.Lock()
+	}
+	c.now = target
+	c.mu.Unlock()
+}
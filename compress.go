@@ -0,0 +1,287 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// the byte leading the KCP frames of the sessions with compression, the first
+	// segment header follows, and then the rest of the frame, compressed or not
+	// | MAGIC(1B) | SEGMENT HEADER | REST |
+	compressRaw        = 0xc0
+	compressed         = 0xc1
+	compressHeaderSize = 1
+
+	snappyHashBits = 11
+)
+
+var errSnappyCorrupt = errors.New("snappy: corrupt input")
+
+// Compressor compresses the KCP frames before encryption, it must be safe for
+// concurrent use if it's shared by the sessions of a Listener.
+type Compressor interface {
+	// Compress returns the compressed form of src.
+	Compress(src []byte) []byte
+
+	// Decompress returns the original form of src.
+	Decompress(src []byte) ([]byte, error)
+}
+
+type snappyCompressor struct{}
+
+// NewSnappyCompressor compresses with the block format of Snappy.
+func NewSnappyCompressor() Compressor {
+	return new(snappyCompressor)
+}
+
+func (c *snappyCompressor) Compress(src []byte) []byte { return snappyEncode(src) }
+
+func (c *snappyCompressor) Decompress(src []byte) ([]byte, error) { return snappyDecode(nil, src) }
+
+// isCompressMagic returns true if 'b' is the magic byte of a frame with compression
+func isCompressMagic(b byte) bool {
+	return b == compressRaw || b == compressed
+}
+
+// rawFrame marks the KCP frame at 'offset' of a packet built aside from KCP output
+// uncompressed
+func (s *UDPSession) rawFrame(buf []byte, offset int) {
+	if s.compressor != nil {
+		buf[offset-compressHeaderSize] = compressRaw
+	}
+}
+
+// compress compresses a KCP frame at 'offset' of the packet in place, the magic
+// byte before the frame tells whether it's compressed. It returns the packet,
+// which is shorter if compressed.
+func (s *UDPSession) compress(buf []byte, offset int) []byte {
+	buf[offset-compressHeaderSize] = compressRaw
+	rest := buf[offset+s.kcp.overhead:]
+	if len(rest) == 0 {
+		return buf
+	}
+	if c := s.compressor.Compress(rest); len(c) < len(rest) {
+		buf[offset-compressHeaderSize] = compressed
+		return buf[:offset+s.kcp.overhead+copy(rest, c)]
+	}
+	return buf
+}
+
+// frameInput feeds a KCP frame to KCP, after decompression if enabled, s.mu held.
+// The frames of a mismatched peer are dropped and counted in CompressErrors.
+func (s *UDPSession) frameInput(frame []byte, regular bool) int {
+	if s.compressor == nil {
+		return s.kcp.Input(frame, regular, s.ackNoDelay)
+	}
+
+	if len(frame) > compressHeaderSize {
+		switch frame[0] {
+		case compressRaw:
+			return s.kcp.Input(frame[compressHeaderSize:], regular, s.ackNoDelay)
+		case compressed:
+			frame = frame[compressHeaderSize:]
+			if len(frame) > s.kcp.overhead {
+				// KCP copies the data out, so the frame is decoded into a pooled buffer
+				pooled := xmitBuf.Get(mtuLimit)
+				buf := append(pooled[:0], frame[:s.kcp.overhead]...)
+				var err error
+				if _, ok := s.compressor.(*snappyCompressor); ok {
+					buf, err = snappyDecode(buf, frame[s.kcp.overhead:])
+				} else {
+					var rest []byte
+					if rest, err = s.compressor.Decompress(frame[s.kcp.overhead:]); err == nil {
+						buf = append(buf, rest...)
+					}
+				}
+				if err == nil {
+					ret := s.kcp.Input(buf, regular, s.ackNoDelay)
+					xmitBuf.Put(buf)
+					return ret
+				}
+				xmitBuf.Put(pooled)
+			}
+		}
+	}
+	atomic.AddUint64(&DefaultSnmp.CompressErrors, 1)
+	atomic.AddUint64(&s.snmp.CompressErrors, 1)
+	return -1
+}
+
+// SetCompression compresses the KCP frames before encryption with 'c', nil to
+// disable. It changes the packet format, so it must be enabled on both sides
+// before any data is exchanged, the accepted sessions follow Listener.SetCompression.
+func (s *UDPSession) SetCompression(c Compressor) error {
+	if s.l != nil {
+		return errors.WithStack(ErrInvalidOperation)
+	}
+	s.setCompression(c)
+	return nil
+}
+
+func (s *UDPSession) setCompression(c Compressor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if (c != nil) != (s.compressor != nil) {
+		if c != nil {
+			s.headerSize += compressHeaderSize
+		} else {
+			s.headerSize -= compressHeaderSize
+		}
+		s.kcp.ReserveBytes(s.headerSize)
+	}
+	s.compressor = c
+}
+
+// SetCompression sets the compression for the sessions accepted afterwards, see
+// UDPSession.SetCompression.
+func (l *Listener) SetCompression(c Compressor) {
+	l.keyLock.Lock()
+	l.compressor = c
+	l.keyLock.Unlock()
+}
+
+// snappyEncode encodes a block of the Snappy format by greedy matching
+func snappyEncode(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(src)+len(src)/60+8)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+
+	var table [1 << snappyHashBits]int32
+	lit := 0
+	for i := 0; i+4 <= len(src); {
+		x := binary.LittleEndian.Uint32(src[i:])
+		h := (x * 0x1e35a7bd) >> (32 - snappyHashBits)
+		cand := int(table[h])
+		table[h] = int32(i)
+		if cand >= i || i-cand > 0xffff || binary.LittleEndian.Uint32(src[cand:]) != x {
+			i++
+			continue
+		}
+
+		length := 4
+		for i+length < len(src) && src[cand+length] == src[i+length] {
+			length++
+		}
+		dst = snappyLiteral(dst, src[lit:i])
+		dst = snappyCopy(dst, i-cand, length)
+		i += length
+		lit = i
+	}
+	return snappyLiteral(dst, src[lit:])
+}
+
+func snappyLiteral(dst, lit []byte) []byte {
+	n := len(lit) - 1
+	switch {
+	case n < 0:
+		return dst
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// snappyCopy emits the copies of 'length' bytes at 'offset' back, offset < 65536
+func snappyCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|1, byte(offset))
+}
+
+// snappyDecode appends the decoded block of the Snappy format to dst, the blocks
+// declared beyond mtuLimit are rejected before allocation, as no frame is larger.
+func snappyDecode(dst, src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 || size > mtuLimit {
+		return dst, errors.WithStack(errSnappyCorrupt)
+	}
+	base := len(dst)
+	if cap(dst)-base < int(size) {
+		grown := make([]byte, base, base+int(size))
+		copy(grown, dst)
+		dst = grown
+	}
+	out := dst[base : base+int(size)]
+
+	d := 0
+	for s := n; s < len(src); {
+		var offset, length int
+		tag := src[s]
+		switch tag & 3 {
+		case 0:
+			length = int(tag >> 2)
+			s++
+			if length >= 60 {
+				nb := length - 59
+				if s+nb > len(src) {
+					return dst[:base], errors.WithStack(errSnappyCorrupt)
+				}
+				length = 0
+				for k := 0; k < nb; k++ {
+					length |= int(src[s+k]) << (8 * k)
+				}
+				s += nb
+			}
+			length++
+			if length <= 0 || length > len(src)-s || length > len(out)-d {
+				return dst[:base], errors.WithStack(errSnappyCorrupt)
+			}
+			d += copy(out[d:], src[s:s+length])
+			s += length
+			continue
+		case 1:
+			if s+2 > len(src) {
+				return dst[:base], errors.WithStack(errSnappyCorrupt)
+			}
+			length = 4 + int(tag>>2)&7
+			offset = int(tag>>5)<<8 | int(src[s+1])
+			s += 2
+		case 2:
+			if s+3 > len(src) {
+				return dst[:base], errors.WithStack(errSnappyCorrupt)
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+		case 3:
+			if s+5 > len(src) {
+				return dst[:base], errors.WithStack(errSnappyCorrupt)
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+		}
+
+		if offset <= 0 || offset > d || length > len(out)-d {
+			return dst[:base], errors.WithStack(errSnappyCorrupt)
+		}
+		for k := 0; k < length; k++ { // the copies may overlap
+			out[d+k] = out[d-offset+k]
+		}
+		d += length
+	}
+
+	if d != len(out) {
+		return dst[:base], errors.WithStack(errSnappyCorrupt)
+	}
+	return dst[:base+d], nil
+}
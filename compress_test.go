@@ -0,0 +1,56 @@
+package kcp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestSnappy(t *testing.T) {
+	// "abc" and a copy of 8 bytes at offset 3
+	dst, err := snappyDecode([]byte("kcp"), []byte{0x0b, 0x08, 'a', 'b', 'c', 0x11, 0x03})
+	if err != nil || string(dst) != "kcpabcabcabcab" {
+		t.Fatal("decoding", string(dst), err)
+	}
+
+	random := make([]byte, 70000)
+	io.ReadFull(rand.Reader, random)
+	text := bytes.Repeat([]byte("kcp-go compresses the frames before encryption. "), 1500)
+	for _, src := range [][]byte{nil, []byte("abc"), random[:mtuLimit], text[:mtuLimit], append(text[:700:700], random[:800]...)} {
+		c := NewSnappyCompressor()
+		enc := c.Compress(src)
+		dec, err := c.Decompress(enc)
+		if err != nil || !bytes.Equal(dec, src) {
+			t.Fatal("round trip", len(src), err)
+		}
+		if len(src) > 0 && bytes.Equal(src, text[:len(src)]) && len(enc) >= len(src)/4 {
+			t.Fatal("text not compressed", len(src), len(enc))
+		}
+	}
+
+	// truncated or corrupted blocks are rejected
+	enc := NewSnappyCompressor().Compress(text[:mtuLimit])
+	for _, bad := range [][]byte{enc[:len(enc)-1], enc[:1], {0x05, 0x01, 0x10}, {0x80}} {
+		if _, err := snappyDecode(nil, bad); err == nil {
+			t.Fatal("corrupt block accepted", bad)
+		}
+	}
+
+	// no frame decodes beyond mtuLimit
+	for _, src := range [][]byte{random, text} {
+		if _, err := NewSnappyCompressor().Decompress(snappyEncode(src)); err == nil {
+			t.Fatal("oversized block accepted", len(src))
+		}
+	}
+}
+
+func BenchmarkSnappyCompress(b *testing.B) {
+	src := bytes.Repeat([]byte("kcp-go compresses the frames before encryption. "), 40)[:mtuLimit]
+	c := NewSnappyCompressor()
+	b.SetBytes(int64(len(src)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.Compress(src)
+	}
+}
@@ -0,0 +1,207 @@
+package kcp
+
+import (
+	"sync"
+	"time"
+)
+
+// CongestionController decides the congestion window of a KCP connection,
+// the hooks are called from the KCP state machine with the session locked,
+// and are bypassed if congestion control is disabled by NoDelay.
+type CongestionController interface {
+	// OnAck is called when 'acked' segments are newly acknowledged cumulatively,
+	// 'rtt' is the latest round-trip time sample, or the smoothed one if absent.
+	OnAck(rtt time.Duration, acked uint32)
+	// OnLoss is called on a flush that retransmits segments, 'timeouts' for the
+	// segments that have reached their RTO, 'fast' for fast and early retransmissions.
+	OnLoss(timeouts, fast uint32)
+	// Window returns the congestion window in number of segments.
+	Window() uint32
+}
+
+// lossController is the default loss-based congestion control of KCP,
+// with slow start, congestion avoidance and rate halving.
+type lossController struct {
+	kcp *KCP
+}
+
+func (c *lossController) OnAck(rtt time.Duration, acked uint32) {
+	kcp := c.kcp
+	if kcp.cwnd < kcp.rmt_wnd {
+		mss := kcp.mss
+		if kcp.cwnd < kcp.ssthresh {
+			kcp.cwnd++
+			kcp.incr += mss
+		} else {
+			if kcp.incr < mss {
+				kcp.incr = mss
+			}
+			kcp.incr += (mss*mss)/kcp.incr + (mss / 16)
+			if (kcp.cwnd+1)*mss <= kcp.incr {
+				if mss > 0 {
+					kcp.cwnd = (kcp.incr + mss - 1) / mss
+				} else {
+					kcp.cwnd = kcp.incr + mss - 1
+				}
+			}
+		}
+		if kcp.cwnd > kcp.rmt_wnd {
+			kcp.cwnd = kcp.rmt_wnd
+			kcp.incr = kcp.rmt_wnd * mss
+		}
+	}
+}
+
+func (c *lossController) OnLoss(timeouts, fast uint32) {
+	kcp := c.kcp
+	// the window used by the flush
+	cwnd := _imin_(kcp.cwnd, _imin_(kcp.snd_wnd, kcp.rmt_wnd))
+
+	// update ssthresh
+	// rate halving, https://tools.ietf.org/html/rfc6937
+	if fast > 0 {
+		resent := uint32(kcp.fastresend)
+		if kcp.fastresend <= 0 {
+			resent = 0xffffffff
+		}
+		inflight := kcp.snd_nxt - kcp.snd_una
+		kcp.ssthresh = inflight / 2
+		if kcp.ssthresh < IKCP_THRESH_MIN {
+			kcp.ssthresh = IKCP_THRESH_MIN
+		}
+		kcp.cwnd = kcp.ssthresh + resent
+		kcp.incr = kcp.cwnd * kcp.mss
+	}
+
+	// congestion control, https://tools.ietf.org/html/rfc5681
+	if timeouts > 0 {
+		kcp.ssthresh = cwnd / 2
+		if kcp.ssthresh < IKCP_THRESH_MIN {
+			kcp.ssthresh = IKCP_THRESH_MIN
+		}
+		kcp.cwnd = 1
+		kcp.incr = kcp.mss
+	}
+}
+
+// Window returns the window of KCP, which starts from 0 and opens after the first flush
+func (c *lossController) Window() uint32 { return c.kcp.cwnd }
+
+const (
+	bbrBwRounds     = 10               // the rounds of the max bandwidth filter
+	bbrMinRTTExpiry = 10 * time.Second // the lifetime of a min RTT sample
+	bbrStartupGain  = 2.89             // 2/ln2, doubles the delivery rate per round
+	bbrCwndGain     = 2                // the window in BDPs after startup
+	bbrMinWindow    = 4                // the window floor in segments
+	bbrFullBwRounds = 3                // startup ends after the bandwidth plateaus for these rounds
+)
+
+// BBRController is a congestion control following BBR, which estimates the
+// bottleneck bandwidth by the delivery rate of the acknowledged segments and the
+// propagation delay by the min RTT, and keeps the window around their product,
+// so random loss doesn't collapse the throughput like the loss-based control.
+type BBRController struct {
+	mu sync.Mutex
+
+	// the round being measured
+	roundStart time.Time
+	delivered  uint32 // segments acknowledged in the round
+
+	// the max filter of the delivery rates in segments per second
+	bwSamples [bbrBwRounds]float64
+	round     int
+	bw        float64
+
+	minRTT     time.Duration
+	minRTTTime time.Time
+
+	// startup
+	startup     bool
+	fullBw      float64
+	fullBwCount int
+
+	now func() time.Time
+}
+
+// NewBBRController creates a BBR congestion control for UDPSession.SetCongestionController,
+// it requires congestion control to be enabled by SetNoDelay.
+func NewBBRController() *BBRController {
+	return &BBRController{startup: true, now: time.Now}
+}
+
+func (c *BBRController) OnAck(rtt time.Duration, acked uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+
+	// min RTT, a stale one is replaced by the current sample
+	if rtt > 0 && (c.minRTT == 0 || rtt <= c.minRTT || now.Sub(c.minRTTTime) > bbrMinRTTExpiry) {
+		c.minRTT = rtt
+		c.minRTTTime = now
+	}
+
+	if c.roundStart.IsZero() {
+		c.roundStart = now
+		return
+	}
+	c.delivered += acked
+
+	// a round lasts for a min RTT
+	elapsed := now.Sub(c.roundStart)
+	if elapsed < c.minRTT || elapsed <= 0 {
+		return
+	}
+	c.bwSamples[c.round%bbrBwRounds] = float64(c.delivered) / elapsed.Seconds()
+	c.round++
+	c.roundStart = now
+	c.delivered = 0
+
+	c.bw = 0
+	for _, bw := range c.bwSamples {
+		if bw > c.bw {
+			c.bw = bw
+		}
+	}
+
+	// leave startup once the bandwidth stops growing by 25%
+	if c.startup {
+		if c.bw >= c.fullBw*1.25 {
+			c.fullBw = c.bw
+			c.fullBwCount = 0
+		} else if c.fullBwCount++; c.fullBwCount >= bbrFullBwRounds {
+			c.startup = false
+		}
+	}
+}
+
+// OnLoss ignores the loss, which is not taken as a signal of congestion.
+func (c *BBRController) OnLoss(timeouts, fast uint32) {}
+
+func (c *BBRController) Window() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	gain := float64(bbrCwndGain)
+	if c.startup {
+		gain = bbrStartupGain
+	}
+	// the window grows from the floor by the gain of startup per round
+	window := uint32(gain * c.bw * c.minRTT.Seconds())
+	if window < bbrMinWindow {
+		window = bbrMinWindow
+	}
+	return window
+}
+
+// Bandwidth returns the estimated bottleneck bandwidth in segments per second.
+func (c *BBRController) Bandwidth() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bw
+}
+
+// MinRTT returns the min round-trip time observed recently.
+func (c *BBRController) MinRTT() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.minRTT
+}
@@ -5,13 +5,17 @@ import (
 	"crypto/cipher"
 	"crypto/des"
 	"crypto/sha1"
+	"encoding/binary"
+	"sync/atomic"
 	"unsafe"
 
+	"github.com/pkg/errors"
 	xor "github.com/templexxx/xorsimd"
 	"github.com/tjfoc/gmsm/sm4"
 
 	"golang.org/x/crypto/blowfish"
 	"golang.org/x/crypto/cast5"
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/pbkdf2"
 	"golang.org/x/crypto/salsa20"
 	"golang.org/x/crypto/tea"
@@ -22,6 +26,19 @@ import (
 var (
 	initialVector = []byte{167, 115, 79, 156, 18, 172, 27, 1, 164, 21, 242, 193, 252, 120, 230, 107}
 	saltxor       = `sH3CIVoF#rWLtJo6`
+
+	errNonceSize = errors.New("unsupported AEAD nonce size")
+)
+
+const (
+	// the shortest AEAD nonce, 96 bits
+	aeadMinNonceSize = 12
+
+	// the 8-byte packet counter at the end of the AEAD nonce
+	aeadCounterSize = 8
+
+	// the packets an AEAD instance seals under its key
+	aeadPacketLimit = 1 << 32
 )
 
 // BlockCrypt defines encryption/decryption methods for a given byte slice.
@@ -37,6 +54,135 @@ type BlockCrypt interface {
 	Decrypt(dst, src []byte)
 }
 
+// AEADCrypt is implemented by the BlockCrypts with authenticated encryption,
+// a sealed packet carries an authentication tag of Overhead() bytes at the end,
+// and the nonce at the first 16 bytes is authenticated as additional data.
+//
+// It's incompatible on the wire with the unauthenticated BlockCrypts.
+type AEADCrypt interface {
+	BlockCrypt
+
+	// Overhead returns the size of the authentication tag.
+	Overhead() int
+
+	// Seal encrypts and authenticates src into dst, dst must be Overhead() bytes
+	// longer than src, and must not overlap with src.
+	Seal(dst, src []byte)
+
+	// Open authenticates and decrypts src into dst, dst must be Overhead() bytes
+	// shorter than src, and may be src[:len(src)-Overhead()].
+	// Returns false if src has been forged or tampered with.
+	Open(dst, src []byte) bool
+}
+
+// aeadCrypt seals each packet with a nonce of its own counter, instead of the nonce
+// filled by the session. The counter starts at a random point of the nonce space
+// drawn from the entropy, so the instances sharing a key start far apart, and it's
+// incremented in the last 8 bytes of the nonce, so an instance never repeats one.
+//
+// An instance seals up to aeadPacketLimit packets, which keeps the chance that the
+// nonces of any two instances sharing the key overlap negligible. The packets
+// beyond are refused, and the key must be replaced before, see SetBlockCrypt.
+type aeadCrypt struct {
+	sealed uint64 // packets sealed, first for 64bit alignment
+	start  [nonceSize]byte
+	aead   cipher.AEAD
+}
+
+func newAEADCrypt(aead cipher.AEAD) (*aeadCrypt, error) {
+	size := aead.NonceSize()
+	if size < aeadMinNonceSize || size > nonceSize {
+		return nil, errors.WithStack(errNonceSize)
+	}
+
+	entropy := new(nonceAES128)
+	entropy.Init()
+	c := &aeadCrypt{aead: aead}
+	entropy.Fill(c.start[:])
+	return c, nil
+}
+
+// NewAEADCrypt turns any AEAD into a BlockCrypt, with the nonce and the tag of each
+// packet handled as NewAESGCMBlockCrypt does. The nonce of 'nonceSize' bytes is a
+// packet counter in its last 8 bytes, from a random start drawn from the entropy
+// generator, so it must be between 12 and 16 bytes to fit the packet header, and
+// must be the NonceSize of 'aead'. The BlockCrypt seals up to 2^32 packets, and
+// its key must be replaced before, see SetKeyRotation.
+func NewAEADCrypt(aead cipher.AEAD, nonceSize int) (BlockCrypt, error) {
+	if aead == nil || nonceSize != aead.NonceSize() {
+		return nil, errors.WithStack(errNonceSize)
+	}
+	return newAEADCrypt(aead)
+}
+
+func (c *aeadCrypt) Overhead() int { return c.aead.Overhead() }
+
+// Seal seals with the next nonce of the counter, beyond aeadPacketLimit dst is
+// zeroed instead, which the remote drops as forged.
+func (c *aeadCrypt) Seal(dst, src []byte) {
+	n := atomic.AddUint64(&c.sealed, 1)
+	if n > aeadPacketLimit {
+		out := dst[:len(src)+c.aead.Overhead()]
+		for k := range out {
+			out[k] = 0
+		}
+		return
+	}
+
+	size := c.aead.NonceSize()
+	nonce := dst[:nonceSize]
+	copy(nonce, src[:nonceSize])
+	copy(nonce, c.start[:size])
+	counter := nonce[size-aeadCounterSize : size]
+	binary.LittleEndian.PutUint64(counter, binary.LittleEndian.Uint64(counter)+n)
+	c.aead.Seal(dst[nonceSize:nonceSize], nonce[:size], src[nonceSize:], nonce)
+}
+
+// exhausted returns true once a packet has been refused by aeadPacketLimit
+func (c *aeadCrypt) exhausted() bool {
+	return atomic.LoadUint64(&c.sealed) > aeadPacketLimit
+}
+
+func (c *aeadCrypt) Open(dst, src []byte) bool {
+	_, err := c.aead.Open(dst[nonceSize:nonceSize], src[:c.aead.NonceSize()], src[nonceSize:], src[:nonceSize])
+	copy(dst[:nonceSize], src[:nonceSize])
+	return err == nil
+}
+
+// Encrypt is the same as Seal
+func (c *aeadCrypt) Encrypt(dst, src []byte) { c.Seal(dst, src) }
+
+// Decrypt is the same as Open
+func (c *aeadCrypt) Decrypt(dst, src []byte) { c.Open(dst, src) }
+
+// NewAESGCMBlockCrypt https://en.wikipedia.org/wiki/Galois/Counter_Mode
+//
+// The 12-byte nonce is a packet counter from a random start, a key seals up to 2^32
+// packets, and must be replaced before, see SetKeyRotation.
+func NewAESGCMBlockCrypt(key []byte) (BlockCrypt, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return newAEADCrypt(aead)
+}
+
+// NewChaCha20Poly1305Crypt https://en.wikipedia.org/wiki/ChaCha20-Poly1305
+//
+// The 12-byte nonce is a packet counter from a random start, a key seals up to 2^32
+// packets, and must be replaced before, see SetKeyRotation. 'key' must be 32 bytes.
+func NewChaCha20Poly1305Crypt(key []byte) (BlockCrypt, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return newAEADCrypt(aead)
+}
+
 type salsa20BlockCrypt struct {
 	key [32]byte
 }
@@ -3,12 +3,16 @@ package kcp
 import (
 	"bytes"
 	"crypto/aes"
+	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha1"
+	"encoding/binary"
 	"hash/crc32"
 	"io"
 	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 func TestSM4(t *testing.T) {
@@ -99,6 +103,82 @@ func TestSalsa20(t *testing.T) {
 	cryptTest(t, bc)
 }
 
+func TestAESGCM(t *testing.T) {
+	bc, err := NewAESGCMBlockCrypt(pass[:32])
+	if err != nil {
+		t.Fatal(err)
+	}
+	aeadTest(t, bc.(AEADCrypt))
+}
+
+func TestChaCha20Poly1305(t *testing.T) {
+	bc, err := NewChaCha20Poly1305Crypt(pass[:32])
+	if err != nil {
+		t.Fatal(err)
+	}
+	aeadTest(t, bc.(AEADCrypt))
+}
+
+func TestAEADPacketLimit(t *testing.T) {
+	bc, _ := NewAESGCMBlockCrypt(pass[:32])
+	c := bc.(*aeadCrypt)
+	data := make([]byte, 64)
+	enc := make([]byte, len(data)+c.Overhead())
+	dec := make([]byte, len(data))
+
+	// the counter in the nonce follows the packets sealed
+	c.Seal(enc, data)
+	first := binary.LittleEndian.Uint64(enc[4:12])
+	c.Seal(enc, data)
+	if next := binary.LittleEndian.Uint64(enc[4:12]); next != first+1 {
+		t.Fatal("nonce not counted", first, next)
+	}
+
+	// the last packet of the key is sealed, and the next refused
+	c.sealed = aeadPacketLimit - 1
+	c.Seal(enc, data)
+	if !c.Open(dec, enc) || c.exhausted() {
+		t.Fatal("the last packet of the key refused")
+	}
+	c.Seal(enc, data)
+	if c.Open(dec, enc) || !c.exhausted() {
+		t.Fatal("packet sealed beyond the limit")
+	}
+}
+
+func aeadTest(t *testing.T, c AEADCrypt) {
+	data := make([]byte, mtuLimit-c.Overhead())
+	io.ReadFull(rand.Reader, data)
+	enc := make([]byte, mtuLimit)
+	dec := make([]byte, len(data))
+	c.Seal(enc, data)
+	if !c.Open(dec, enc) || !bytes.Equal(data[nonceSize:], dec[nonceSize:]) {
+		t.Fatal("open failed")
+	}
+
+	// tampered payload and nonce
+	for _, pos := range []int{0, nonceSize, len(enc) - 1} {
+		enc[pos] ^= 1
+		if c.Open(dec, enc) {
+			t.Fatal("tampered packet accepted at", pos)
+		}
+		enc[pos] ^= 1
+	}
+
+	// in-place
+	if !c.Open(enc[:len(data)], enc) || !bytes.Equal(data[nonceSize:], enc[nonceSize:len(data)]) {
+		t.Fatal("in-place open failed")
+	}
+
+	// unique nonces for the same packet
+	enc2 := make([]byte, mtuLimit)
+	c.Seal(enc, data)
+	c.Seal(enc2, data)
+	if bytes.Equal(enc[:nonceSize], enc2[:nonceSize]) {
+		t.Fatal("nonce reused")
+	}
+}
+
 func cryptTest(t *testing.T, bc BlockCrypt) {
 	data := make([]byte, mtuLimit)
 	io.ReadFull(rand.Reader, data)
@@ -210,6 +290,36 @@ func BenchmarkXTEA(b *testing.B) {
 	benchCrypt(b, bc)
 }
 
+func BenchmarkAESGCM(b *testing.B) {
+	bc, err := NewAESGCMBlockCrypt(pass[:32])
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchAEAD(b, bc.(AEADCrypt))
+}
+
+func BenchmarkChaCha20Poly1305(b *testing.B) {
+	bc, err := NewChaCha20Poly1305Crypt(pass[:32])
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchAEAD(b, bc.(AEADCrypt))
+}
+
+func benchAEAD(b *testing.B, c AEADCrypt) {
+	data := make([]byte, mtuLimit-c.Overhead())
+	io.ReadFull(rand.Reader, data)
+	enc := make([]byte, mtuLimit)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data) * 2))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Seal(enc, data)
+		c.Open(data, enc)
+	}
+}
+
 func BenchmarkSalsa20(b *testing.B) {
 	bc, err := NewSalsa20BlockCrypt(pass[:32])
 	if err != nil {
@@ -287,3 +397,55 @@ func BenchmarkCsprngNonceAES128(b *testing.B) {
 		ng.Fill(data)
 	}
 }
+
+func TestAEADCrypt(t *testing.T) {
+	block, _ := aes.NewCipher(pass[:32])
+	for _, size := range []int{12, 16} {
+		aead, _ := cipher.NewGCMWithNonceSize(block, size)
+		bc, err := NewAEADCrypt(aead, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aeadTest(t, bc.(AEADCrypt))
+	}
+
+	// the counter takes the last 8 bytes of a 16-byte nonce, up to the limit
+	aead, _ := cipher.NewGCMWithNonceSize(block, 16)
+	bc, _ := NewAEADCrypt(aead, 16)
+	c := bc.(*aeadCrypt)
+	data := make([]byte, 64)
+	enc := make([]byte, len(data)+c.Overhead())
+	c.Seal(enc, data)
+	first := binary.LittleEndian.Uint64(enc[8:16])
+	c.Seal(enc, data)
+	if next := binary.LittleEndian.Uint64(enc[8:16]); next != first+1 {
+		t.Fatal("nonce not counted", first, next)
+	}
+	c.sealed = aeadPacketLimit
+	c.Seal(enc, data)
+	if c.Open(make([]byte, len(data)), enc) || !c.exhausted() {
+		t.Fatal("packet sealed beyond the limit")
+	}
+
+	// the instances sharing a key draw their nonces independently
+	nonces := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		bc, _ := NewAESGCMBlockCrypt(pass[:32])
+		enc := make([]byte, len(data)+bc.(AEADCrypt).Overhead())
+		bc.(AEADCrypt).Seal(enc, data)
+		if nonces[string(enc[:12])] {
+			t.Fatal("nonce reused across the instances")
+		}
+		nonces[string(enc[:12])] = true
+	}
+
+	// the nonce must fit the packet header
+	xchacha, _ := chacha20poly1305.NewX(pass[:32])
+	if _, err := NewAEADCrypt(xchacha, xchacha.NonceSize()); err == nil {
+		t.Fatal("24-byte nonce accepted")
+	}
+	gcm, _ := cipher.NewGCM(block)
+	if _, err := NewAEADCrypt(gcm, 16); err == nil {
+		t.Fatal("mismatched nonce size accepted")
+	}
+}
@@ -0,0 +1,124 @@
+package kcp
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// the datagrams held for ReadUnreliable at most, the later ones are dropped
+const dgramQueue = 128
+
+// SetUnreliable toggles the unreliable datagrams alongside the reliable data, see
+// WriteUnreliable. Peers without this option drop the datagrams, so it must be
+// enabled on both sides, see also Listener.SetUnreliable.
+func (s *UDPSession) SetUnreliable(enable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if enable {
+		s.kcp.dgram = 1
+	} else {
+		s.kcp.dgram = 0
+		s.kcp.dgrams = nil
+	}
+}
+
+// WriteUnreliable sends 'p' as a datagram at once, without ordering or
+// retransmission, it goes through the same FEC and encryption as the reliable data.
+// 'p' must fit in a segment, or ErrMessageTooLarge is returned.
+func (s *UDPSession) WriteUnreliable(p []byte) error {
+	select {
+	case <-s.chSocketWriteError:
+		return s.socketWriteError.Load().(error)
+	case <-s.die:
+		return s.closedError()
+	default:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.kcp.dgram == 0 {
+		return errors.WithStack(ErrInvalidOperation)
+	}
+	if len(p) > int(s.kcp.mss) {
+		return errors.WithStack(ErrMessageTooLarge)
+	}
+
+	// laid out as a KCP output, with the room of the headers in front
+	buf := xmitBuf.Get(s.headerSize + s.kcp.overhead + len(p))
+	size := s.headerSize + s.kcp.datagram(buf[s.headerSize:], p)
+	s.output(buf[s.trailerSize+s.fecPad : size])
+	xmitBuf.Put(buf)
+	s.uncork()
+
+	atomic.AddUint64(&DefaultSnmp.OutDgrams, 1)
+	atomic.AddUint64(&s.snmp.OutDgrams, 1)
+	return nil
+}
+
+// ReadUnreliable reads the next datagram into 'p' and returns its size. If the
+// datagram doesn't fit, it returns the size of the datagram with io.ErrShortBuffer
+// and the datagram is kept for the next read.
+func (s *UDPSession) ReadUnreliable(p []byte) (n int, err error) {
+	var timeout deadlineTimer
+	var c <-chan time.Time
+	var changed <-chan struct{}
+	defer timeout.stop()
+
+	for {
+		s.mu.Lock()
+		if s.kcp.dgram == 0 {
+			s.mu.Unlock()
+			return 0, errors.WithStack(ErrInvalidOperation)
+		}
+		c, changed = timeout.reset(s.rd), s.rdChanged.wait()
+		if timeout.expired() {
+			s.mu.Unlock()
+			return 0, ErrTimeout
+		}
+
+		if len(s.kcp.dgrams) > 0 {
+			dgram := s.kcp.dgrams[0]
+			if len(p) < len(dgram) {
+				s.mu.Unlock()
+				return len(dgram), io.ErrShortBuffer
+			}
+			n = copy(p, dgram)
+			s.kcp.dgrams[0] = nil
+			s.kcp.dgrams = s.kcp.dgrams[1:]
+			s.mu.Unlock()
+			return n, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.chDgramEvent:
+		case <-changed:
+		case <-c:
+			return 0, ErrTimeout
+		case <-s.chSocketReadError:
+			return 0, s.socketReadError.Load().(error)
+		case <-s.die:
+			return 0, s.closedError()
+		}
+	}
+}
+
+func (s *UDPSession) notifyDgramEvent() {
+	select {
+	case s.chDgramEvent <- struct{}{}:
+	default:
+	}
+}
+
+// SetUnreliable toggles the unreliable datagrams for the sessions accepted
+// afterwards, see UDPSession.SetUnreliable.
+func (l *Listener) SetUnreliable(enable bool) {
+	if enable {
+		atomic.StoreInt32(&l.unreliable, 1)
+	} else {
+		atomic.StoreInt32(&l.unreliable, 0)
+	}
+}
@@ -0,0 +1,87 @@
+package kcp
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// Dialer holds the options to dial the sessions with, like net.Dialer, so they're
+// given once and applied to each session before it's returned. The zero value
+// dials like Dial, without encryption and FEC, and the zero fields keep the
+// defaults of the session.
+type Dialer struct {
+	Block        BlockCrypt // the packet encryption, see DialWithOptions
+	DataShards   int        // the FEC data shards, see DialWithOptions
+	ParityShards int        // the FEC parity shards, see DialWithOptions
+	Negotiate    bool       // request the conv from the Listener, see DialNegotiated
+
+	// passed to SetNoDelay if Interval is set
+	NoDelay, Interval, Resend, NoCongestion int
+
+	SndWnd, RcvWnd int  // the window sizes in segments, see SetWindowSize
+	MTU            int  // see SetMtu
+	StreamMode     bool // see SetStreamMode
+	ACKNoDelay     bool // see SetACKNoDelay
+	WriteDelay     bool // see SetWriteDelay
+
+	DSCP        int // see SetDSCP
+	ReadBuffer  int // the socket read buffer in bytes, see SetReadBuffer
+	WriteBuffer int // the socket write buffer in bytes, see SetWriteBuffer
+}
+
+// Dial connects to the remote address "raddr" with the options of the Dialer
+func (d *Dialer) Dial(raddr string) (*UDPSession, error) {
+	return d.DialContext(context.Background(), raddr)
+}
+
+// DialContext acts like Dial with 'ctx' in effect as in DialContext. It fails with
+// ErrInvalidOperation for an MTU out of range, and the session is closed if an
+// option fails to apply.
+func (d *Dialer) DialContext(ctx context.Context, raddr string) (*UDPSession, error) {
+	sess, err := dial(ctx, raddr, d.Block, d.DataShards, d.ParityShards, d.Negotiate)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.apply(sess); err != nil {
+		sess.closeNow()
+		return nil, err
+	}
+	return sess, nil
+}
+
+// apply sets the options on a session not returned yet, the KCP options at once
+func (d *Dialer) apply(s *UDPSession) error {
+	s.mu.Lock()
+	if d.Interval > 0 {
+		s.kcp.NoDelay(d.NoDelay, d.Interval, d.Resend, d.NoCongestion)
+	}
+	s.kcp.WndSize(d.SndWnd, d.RcvWnd)
+	if d.MTU != 0 && (d.MTU > mtuLimit || s.kcp.SetMtu(d.MTU) < 0) {
+		s.mu.Unlock()
+		return errors.WithStack(ErrInvalidOperation)
+	}
+	if d.StreamMode {
+		s.kcp.stream = 1
+	}
+	s.ackNoDelay = d.ACKNoDelay
+	s.writeDelay = d.WriteDelay
+	s.mu.Unlock()
+
+	if d.DSCP > 0 {
+		if err := s.SetDSCP(d.DSCP); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if d.ReadBuffer > 0 {
+		if err := s.SetReadBuffer(d.ReadBuffer); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if d.WriteBuffer > 0 {
+		if err := s.SetWriteBuffer(d.WriteBuffer); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
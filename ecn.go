@@ -0,0 +1,58 @@
+package kcp
+
+import (
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	ecnMask    = 0x03 // the ECN bits of TOS or Traffic Class
+	ecnECT0    = 0x02 // ECN capable transport
+	ecnCE      = 0x03 // congestion experienced
+	ecnOOBSize = 64   // the control message buffer for the received TOS
+)
+
+// setTOS sets the DSCP and the ECN codepoint of the outgoing packets on 'conn',
+// ECT(0) is not set if 'conn' sets the DSCP by itself.
+func setTOS(conn net.PacketConn, dscp int, ecn bool) error {
+	// interface enabled
+	if ts, ok := conn.(setDSCP); ok {
+		return ts.SetDSCP(dscp)
+	}
+
+	if nc, ok := conn.(net.Conn); ok {
+		tos, tclass := dscp<<2, dscp
+		if ecn {
+			tos |= ecnECT0
+			tclass |= ecnECT0
+		}
+
+		var succeed bool
+		if err := ipv4.NewConn(nc).SetTOS(tos); err == nil {
+			succeed = true
+		}
+		if err := ipv6.NewConn(nc).SetTrafficClass(tclass); err == nil {
+			succeed = true
+		}
+
+		if succeed {
+			return nil
+		}
+	}
+	return ErrInvalidOperation
+}
+
+// inputCE counts a packet received with the CE mark, and echoes it to the remote
+func (s *UDPSession) inputCE() {
+	atomic.AddUint64(&DefaultSnmp.InCEMarks, 1)
+	atomic.AddUint64(&s.snmp.InCEMarks, 1)
+
+	s.mu.Lock()
+	if s.kcp.ecn != 0 {
+		s.kcp.probe |= IKCP_ASK_ECE
+	}
+	s.mu.Unlock()
+}
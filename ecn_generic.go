@@ -0,0 +1,11 @@
+// +build !linux
+
+package kcp
+
+import "net"
+
+// setRecvTOS is not supported, the CE marks are not detected
+func setRecvTOS(conn net.PacketConn) error { return ErrInvalidOperation }
+
+// ecnMarked is not supported
+func ecnMarked(oob []byte) bool { return false }
@@ -0,0 +1,52 @@
+// +build linux
+
+package kcp
+
+import (
+	"net"
+	"syscall"
+)
+
+// setRecvTOS asks the kernel for the TOS or Traffic Class of the received packets
+func setRecvTOS(conn net.PacketConn) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return ErrInvalidOperation
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var succeed bool
+	rc.Control(func(fd uintptr) {
+		if syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1) == nil {
+			succeed = true
+		}
+		if syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVTCLASS, 1) == nil {
+			succeed = true
+		}
+	})
+	if !succeed {
+		return ErrInvalidOperation
+	}
+	return nil
+}
+
+// ecnMarked returns true if the control messages carry the CE mark
+func ecnMarked(oob []byte) bool {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return false
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_TOS && len(m.Data) >= 1 {
+			return m.Data[0]&ecnMask == ecnCE
+		}
+		if m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_TCLASS && len(m.Data) >= 1 {
+			// a native endian int below 256, the byte at the other end is zero
+			return (m.Data[0]|m.Data[len(m.Data)-1])&ecnMask == ecnCE
+		}
+	}
+	return false
+}
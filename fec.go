@@ -3,8 +3,6 @@ package kcp
 import (
 	"encoding/binary"
 	"sync/atomic"
-
-	"github.com/klauspost/reedsolomon"
 )
 
 const (
@@ -12,6 +10,7 @@ const (
 	fecHeaderSizePlus2 = fecHeaderSize + 2 // plus 2B data size
 	typeData           = 0xf1
 	typeParity         = 0xf2
+	typeParity16       = 0xf3 // the parity shards over GF(2^16), of the groups beyond 255 shards
 	fecExpire          = 60000
 	rxFECMulti         = 3 // FEC keeps rxFECMulti* (dataShard+parityShard) ordered packets in memory
 )
@@ -20,9 +19,28 @@ const (
 type fecPacket []byte
 
 func (bts fecPacket) seqid() uint32 { return binary.LittleEndian.Uint32(bts) }
-func (bts fecPacket) flag() uint16  { return binary.LittleEndian.Uint16(bts[4:]) }
+func (bts fecPacket) flag() uint16  { return uint16(bts[4]) }
+func (bts fecPacket) shards() int   { return int(bts[5]) } // signaled by adaptive FEC, 0 if absent
 func (bts fecPacket) data() []byte  { return bts[6:] }
 
+// parityType returns the type of the parity shards, which marks the GF field of
+// Reed-Solomon by the shard count
+func parityType(shardSize int) uint16 {
+	if shardSize > rs8Shards {
+		return typeParity16
+	}
+	return typeParity
+}
+
+// fecPadding returns the room of the padding of the parity shards, the shards over
+// GF(2^16) are padded to even sizes
+func fecPadding(dataShards, parityShards int) int {
+	if dataShards+parityShards > rs8Shards {
+		return 1
+	}
+	return 0
+}
+
 // fecElement has auxcilliary time field
 type fecElement struct {
 	fecPacket
@@ -32,6 +50,9 @@ type fecElement struct {
 // fecDecoder for decoding incoming packets
 type fecDecoder struct {
 	rxlimit      int // queue size limit
+	rxGroups     int // queue size limit in shard groups
+	rxBytes      int // the bytes of the packets in queue
+	rxMaxBytes   int // the limit of rxBytes, 0 for unlimited
 	dataShards   int
 	parityShards int
 	shardSize    int
@@ -44,11 +65,31 @@ type fecDecoder struct {
 	// zeros
 	zeros []byte
 
-	// RS decoder
-	codec reedsolomon.Encoder
+	// RS decoder by default
+	codec     FECCodec
+	codecFunc FECCodecFunc // nil for Reed-Solomon
 
 	// auto tune fec parameter
-	autoTune autoTune
+	autoTune    autoTune
+	autoTuneOff bool // the shards are never tuned by the period of the packets
+
+	// the data shards lost for good since the latest takeLost
+	lost int
+
+	// loss statistics since the latest lossRate
+	received uint32 // packets received
+	expected uint32 // packets sent by the remote, by the advance of seqid
+	maxSeqid uint32 // the highest seqid received
+	sampled  bool   // maxSeqid is valid
+
+	// the latest shard counts signaled by adaptive FEC
+	sigDataShards   int
+	sigParityShards int
+	sigSeqid        uint32 // the seqid of the latest signal
+	signaled        bool   // sigSeqid is valid
+
+	// per-session statistics
+	snmp *Snmp
 }
 
 func newFECDecoder(dataShards, parityShards int) *fecDecoder {
@@ -60,8 +101,9 @@ func newFECDecoder(dataShards, parityShards int) *fecDecoder {
 	dec.dataShards = dataShards
 	dec.parityShards = parityShards
 	dec.shardSize = dataShards + parityShards
-	dec.rxlimit = rxFECMulti * dec.shardSize
-	codec, err := reedsolomon.New(dataShards, parityShards)
+	dec.rxGroups = rxFECMulti
+	dec.rxlimit = dec.rxGroups * dec.shardSize
+	codec, err := NewRSCodec(dataShards, parityShards)
 	if err != nil {
 		return nil
 	}
@@ -81,6 +123,24 @@ func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) {
 		dec.autoTune.Sample(false, in.seqid())
 	}
 
+	// shard counts signaled by the remote, ignoring the signals of late packets
+	if n := in.shards(); n > 0 && (!dec.signaled || _itimediff(in.seqid(), dec.sigSeqid) > 0) {
+		dec.signaled = true
+		dec.sigSeqid = in.seqid()
+		if in.flag() == typeData {
+			dec.sigDataShards = n
+		} else {
+			dec.sigParityShards = n
+		}
+
+		ds, ps := dec.sigDataShards, dec.sigParityShards
+		if ds > 0 && ps > 0 && (ds != dec.dataShards || ps != dec.parityShards) {
+			if !dec.reshape(ds, ps) {
+				return nil
+			}
+		}
+	}
+
 	// check if FEC parameters is out of sync
 	var shouldTune bool
 	if int(in.seqid())%dec.shardSize < dec.dataShards {
@@ -88,12 +148,12 @@ func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) {
 			shouldTune = true
 		}
 	} else {
-		if in.flag() != typeParity {
+		if in.flag() != parityType(dec.shardSize) {
 			shouldTune = true
 		}
 	}
 
-	if shouldTune {
+	if shouldTune && !dec.autoTuneOff {
 		autoDS := dec.autoTune.FindPeriod(true)
 		autoPS := dec.autoTune.FindPeriod(false)
 
@@ -101,17 +161,9 @@ func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) {
 		if autoDS > 0 && autoPS > 0 && autoDS < 256 && autoPS < 256 {
 			// and make sure it's different
 			if autoDS != dec.dataShards || autoPS != dec.parityShards {
-				dec.dataShards = autoDS
-				dec.parityShards = autoPS
-				dec.shardSize = autoDS + autoPS
-				dec.rxlimit = rxFECMulti * dec.shardSize
-				codec, err := reedsolomon.New(autoDS, autoPS)
-				if err != nil {
+				if !dec.reshape(autoDS, autoPS) {
 					return nil
 				}
-				dec.codec = codec
-				dec.decodeCache = make([][]byte, dec.shardSize)
-				dec.flagCache = make([]bool, dec.shardSize)
 				//log.Println("autotune to :", dec.dataShards, dec.parityShards)
 			}
 		}
@@ -129,10 +181,23 @@ func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) {
 		}
 	}
 
-	// make a copy
-	pkt := fecPacket(xmitBuf.Get().([]byte)[:len(in)])
+	// loss statistics
+	dec.received++
+	if !dec.sampled {
+		dec.sampled = true
+		dec.maxSeqid = in.seqid()
+		dec.expected++
+	} else if diff := _itimediff(in.seqid(), dec.maxSeqid); diff > 0 {
+		dec.maxSeqid = in.seqid()
+		dec.expected += uint32(diff)
+	}
+
+	// make a copy, of mtuLimit as the shards are extended in place to the longest
+	// one of the group for recovery
+	pkt := fecPacket(xmitBuf.Get(mtuLimit)[:len(in)])
 	copy(pkt, in)
 	elem := fecElement{pkt, currentMs()}
+	dec.rxBytes += len(pkt)
 
 	// insert into ordered rx queue
 	if insertIdx == n+1 {
@@ -201,7 +266,7 @@ func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) {
 					shards[k] = shards[k][:maxlen]
 					copy(shards[k][dlen:], dec.zeros)
 				} else if k < dec.dataShards {
-					shards[k] = xmitBuf.Get().([]byte)[:0]
+					shards[k] = xmitBuf.Get(maxlen)[:0]
 				}
 			}
 			if err := dec.codec.ReconstructData(shards); err == nil {
@@ -211,15 +276,29 @@ func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) {
 						recovered = append(recovered, shards[k])
 					}
 				}
+			} else {
+				dec.lost += dec.dataShards - numDataShard
+				atomic.AddUint64(&DefaultSnmp.FECGroupFails, 1)
+				if dec.snmp != nil {
+					atomic.AddUint64(&dec.snmp.FECGroupFails, 1)
+				}
 			}
 			dec.rx = dec.freeRange(first, numshard, dec.rx)
 		}
 	}
 
-	// keep rxlimit
-	if len(dec.rx) > dec.rxlimit {
+	// keep rxlimit and rxMaxBytes, evicting the oldest packets
+	for len(dec.rx) > dec.rxlimit || (dec.rxMaxBytes > 0 && dec.rxBytes > dec.rxMaxBytes) {
 		if dec.rx[0].flag() == typeData { // track the unrecoverable data
+			dec.lost++
 			atomic.AddUint64(&DefaultSnmp.FECShortShards, 1)
+			if dec.snmp != nil {
+				atomic.AddUint64(&dec.snmp.FECShortShards, 1)
+			}
+		}
+		atomic.AddUint64(&DefaultSnmp.FECEvicted, 1)
+		if dec.snmp != nil {
+			atomic.AddUint64(&dec.snmp.FECEvicted, 1)
 		}
 		dec.rx = dec.freeRange(0, 1, dec.rx)
 	}
@@ -240,9 +319,72 @@ func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) {
 	return
 }
 
+// reshape regroups the shards with the new shard counts
+func (dec *fecDecoder) reshape(dataShards, parityShards int) bool {
+	codec, err := newFECCodec(dec.codecFunc, dataShards, parityShards)
+	if err != nil {
+		return false
+	}
+	dec.dataShards = dataShards
+	dec.parityShards = parityShards
+	dec.shardSize = dataShards + parityShards
+	dec.rxlimit = dec.rxGroups * dec.shardSize
+	dec.codec = codec
+	dec.decodeCache = make([][]byte, dec.shardSize)
+	dec.flagCache = make([]bool, dec.shardSize)
+	return true
+}
+
+// setCodec replaces the codec by the one created by 'f'
+func (dec *fecDecoder) setCodec(f FECCodecFunc) error {
+	codec, err := newFECCodec(f, dec.dataShards, dec.parityShards)
+	if err != nil {
+		return err
+	}
+	dec.codec = codec
+	dec.codecFunc = f
+	return nil
+}
+
+// setLimits bounds the queue to 'groups' shard groups, and 'maxBytes' bytes of
+// packets if it's positive, the default is rxFECMulti groups without a byte limit.
+func (dec *fecDecoder) setLimits(groups, maxBytes int) {
+	if groups <= 0 {
+		groups = rxFECMulti
+	}
+	if maxBytes < 0 {
+		maxBytes = 0
+	}
+	dec.rxGroups = groups
+	dec.rxlimit = groups * dec.shardSize
+	dec.rxMaxBytes = maxBytes
+}
+
+// takeLost returns the data shards lost for good since the last call
+func (dec *fecDecoder) takeLost() int {
+	lost := dec.lost
+	dec.lost = 0
+	return lost
+}
+
+// lossRate returns the ratio of the packets lost since the last call,
+// ok is false if nothing has been received.
+func (dec *fecDecoder) lossRate() (loss float64, ok bool) {
+	received, expected := dec.received, dec.expected
+	dec.received, dec.expected = 0, 0
+	if expected == 0 {
+		return 0, false
+	}
+	if received >= expected { // duplicated
+		return 0, true
+	}
+	return float64(expected-received) / float64(expected), true
+}
+
 // free a range of fecPacket
 func (dec *fecDecoder) freeRange(first, n int, q []fecElement) []fecElement {
 	for i := first; i < first+n; i++ { // recycle buffer
+		dec.rxBytes -= len(q[i].fecPacket)
 		xmitBuf.Put([]byte(q[i].fecPacket))
 	}
 
@@ -269,12 +411,19 @@ type (
 		paws         uint32 // Protect Against Wrapped Sequence numbers
 		next         uint32 // next seqid
 
-		shardCount int // count the number of datashards collected
-		maxSize    int // track maximum data length in datashard
+		shardCount int    // count the number of datashards collected
+		maxSize    int    // track maximum data length in datashard
+		openTs     uint32 // the time the current shard group got its first datashard
 
 		headerOffset  int // FEC header offset
 		payloadOffset int // FEC payload offset
 
+		// the shard counts from the next shard group
+		nextDataShards   int
+		nextParityShards int
+		signal           bool // signal the shard counts in the FEC header
+		nextCodec        bool // codecFunc has changed
+
 		// caches
 		shardCache  [][]byte
 		encodeCache [][]byte
@@ -282,8 +431,9 @@ type (
 		// zeros
 		zeros []byte
 
-		// RS encoder
-		codec reedsolomon.Encoder
+		// RS encoder by default
+		codec     FECCodec
+		codecFunc FECCodecFunc // nil for Reed-Solomon
 	}
 )
 
@@ -298,8 +448,10 @@ func newFECEncoder(dataShards, parityShards, offset int) *fecEncoder {
 	enc.paws = 0xffffffff / uint32(enc.shardSize) * uint32(enc.shardSize)
 	enc.headerOffset = offset
 	enc.payloadOffset = enc.headerOffset + fecHeaderSize
+	enc.nextDataShards = dataShards
+	enc.nextParityShards = parityShards
 
-	codec, err := reedsolomon.New(dataShards, parityShards)
+	codec, err := NewRSCodec(dataShards, parityShards)
 	if err != nil {
 		return nil
 	}
@@ -319,8 +471,12 @@ func newFECEncoder(dataShards, parityShards, offset int) *fecEncoder {
 // notice: the contents of 'ps' will be re-written in successive calling
 func (enc *fecEncoder) encode(b []byte) (ps [][]byte) {
 	// The header format:
-	// | FEC SEQID(4B) | FEC TYPE(2B) | SIZE (2B) | PAYLOAD(SIZE-2) |
-	// |<-headerOffset                |<-payloadOffset
+	// | FEC SEQID(4B) | FEC TYPE(1B) | SHARDS(1B) | SIZE (2B) | PAYLOAD(SIZE-2) |
+	// |<-headerOffset                             |<-payloadOffset
+	// SHARDS is the number of the data or parity shards by the type if signaled
+	if enc.shardCount == 0 && (enc.nextCodec || enc.nextDataShards != enc.dataShards || enc.nextParityShards != enc.parityShards) {
+		enc.applyShape()
+	}
 	enc.markData(b[enc.headerOffset:])
 	binary.LittleEndian.PutUint16(b[enc.payloadOffset:], uint16(len(b[enc.payloadOffset:])))
 
@@ -330,6 +486,10 @@ func (enc *fecEncoder) encode(b []byte) (ps [][]byte) {
 	copy(enc.shardCache[enc.shardCount][enc.payloadOffset:], b[enc.payloadOffset:])
 	enc.shardCount++
 
+	if enc.shardCount == 1 {
+		enc.openTs = currentMs()
+	}
+
 	// track max datashard length
 	if sz > enc.maxSize {
 		enc.maxSize = sz
@@ -337,6 +497,11 @@ func (enc *fecEncoder) encode(b []byte) (ps [][]byte) {
 
 	//  Generation of Reed-Solomon Erasure Code
 	if enc.shardCount == enc.dataShards {
+		// the symbols of GF(2^16) are 2 bytes, the session reserves the room of the padding
+		if enc.shardSize > rs8Shards && (enc.maxSize-enc.payloadOffset)%2 != 0 {
+			enc.maxSize++
+		}
+
 		// fill '0' into the tail of each datashard
 		for i := 0; i < enc.dataShards; i++ {
 			shard := enc.shardCache[i]
@@ -367,15 +532,78 @@ func (enc *fecEncoder) encode(b []byte) (ps [][]byte) {
 	return
 }
 
+// expired returns true if the current shard group has been open for 'timeout' ms
+func (enc *fecEncoder) expired(timeout uint32) bool {
+	return enc.shardCount > 0 && _itimediff(currentMs(), enc.openTs) >= int32(timeout)
+}
+
+// setCodec replaces the codec by the one created by 'f' from the next shard group
+func (enc *fecEncoder) setCodec(f FECCodecFunc) error {
+	if _, err := newFECCodec(f, enc.nextDataShards, enc.nextParityShards); err != nil {
+		return err
+	}
+	enc.codecFunc = f
+	enc.nextCodec = true
+	return nil
+}
+
+// reshape changes the shard counts from the next shard group, it never happens
+// in the middle of a group.
+func (enc *fecEncoder) reshape(dataShards, parityShards int) {
+	enc.nextDataShards = dataShards
+	enc.nextParityShards = parityShards
+}
+
+// applyShape switches to the pending shard counts at a group boundary, and aligns
+// the seqid to the new group size, for the remote decoder to regroup the shards
+// after it has tuned to the new period of data and parity shards.
+func (enc *fecEncoder) applyShape() {
+	codec, err := newFECCodec(enc.codecFunc, enc.nextDataShards, enc.nextParityShards)
+	if err != nil {
+		enc.nextDataShards = enc.dataShards
+		enc.nextParityShards = enc.parityShards
+		enc.nextCodec = false
+		return
+	}
+	enc.codec = codec
+	enc.nextCodec = false
+	enc.dataShards = enc.nextDataShards
+	enc.parityShards = enc.nextParityShards
+	enc.shardSize = enc.dataShards + enc.parityShards
+	enc.paws = 0xffffffff / uint32(enc.shardSize) * uint32(enc.shardSize)
+
+	size := uint64(enc.shardSize)
+	enc.next = uint32((uint64(enc.next) + size - 1) / size * size % uint64(enc.paws))
+
+	// caches, the shards beyond the current size are kept for reuse
+	enc.encodeCache = make([][]byte, enc.shardSize)
+	shards := enc.shardCache[:cap(enc.shardCache)]
+	for len(shards) < enc.shardSize {
+		shards = append(shards, nil)
+	}
+	for k := range shards[:enc.shardSize] {
+		if shards[k] == nil {
+			shards[k] = make([]byte, mtuLimit)
+		}
+	}
+	enc.shardCache = shards[:enc.shardSize]
+}
+
 func (enc *fecEncoder) markData(data []byte) {
 	binary.LittleEndian.PutUint32(data, enc.next)
 	binary.LittleEndian.PutUint16(data[4:], typeData)
+	if enc.signal && enc.shardSize <= rs8Shards {
+		data[5] = byte(enc.dataShards)
+	}
 	enc.next++
 }
 
 func (enc *fecEncoder) markParity(data []byte) {
 	binary.LittleEndian.PutUint32(data, enc.next)
-	binary.LittleEndian.PutUint16(data[4:], typeParity)
+	binary.LittleEndian.PutUint16(data[4:], parityType(enc.shardSize))
+	if enc.signal && enc.shardSize <= rs8Shards {
+		data[5] = byte(enc.parityShards)
+	}
 	// sequence wrap will only happen at parity shard
 	enc.next = (enc.next + 1) % enc.paws
 }
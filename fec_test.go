@@ -1,6 +1,7 @@
 package kcp
 
 import (
+	"bytes"
 	"encoding/binary"
 	"math/rand"
 	"testing"
@@ -41,3 +42,292 @@ func BenchmarkFECEncode(b *testing.B) {
 		encoder.encode(data)
 	}
 }
+
+func TestFECEncodeAllocs(t *testing.T) {
+	encoder := newFECEncoder(10, 3, 0)
+	data := make([]byte, 1500)
+	allocs := testing.AllocsPerRun(1000, func() {
+		encoder.encode(data)
+	})
+	if allocs != 0 {
+		t.Fatal("allocations per encode", allocs)
+	}
+}
+
+func TestFECMixedSizes(t *testing.T) {
+	// the short packets are extended in place to the longest one of the group for
+	// recovery, and their buffers are classed by xmitBuf by the size
+	const dataSize = 10
+	encoder := newFECEncoder(dataSize, 3, 0)
+	decoder := newFECDecoder(dataSize, 3)
+	for g := 0; g < 20; g++ {
+		lost := g % dataSize
+		var want []byte
+		for i := 0; i < dataSize; i++ {
+			size := fecHeaderSizePlus2 + 30
+			if i%3 == 0 {
+				size = 1400
+			}
+			pkt := xmitBuf.Get(size)
+			rand.Read(pkt[fecHeaderSizePlus2:])
+			ps := encoder.encode(pkt)
+			if i == lost {
+				want = append([]byte(nil), pkt[fecHeaderSize:]...)
+			} else {
+				decoder.decode(pkt)
+			}
+			for k := range ps {
+				for _, r := range decoder.decode(ps[k]) {
+					if sz := binary.LittleEndian.Uint16(r); !bytes.Equal(r[:sz], want) {
+						t.Fatal("shard not recovered", g, len(want), sz)
+					}
+					want = nil
+					xmitBuf.Put(r)
+				}
+			}
+			xmitBuf.Put(pkt)
+		}
+		if want != nil {
+			t.Fatal("shard not recovered", g)
+		}
+	}
+	checkPool(t, &xmitBuf)
+}
+
+func TestFECReshape(t *testing.T) {
+	const dataSize = 10
+	encoder := newFECEncoder(dataSize, 3, 0)
+	encoder.signal = true
+	decoder := newFECDecoder(dataSize, 3)
+
+	phases := []int{3, 1, 5}
+	const groups = 30
+	for p, paritySize := range phases {
+		encoder.reshape(dataSize, paritySize)
+		recovered := 0
+		for g := 0; g < groups; g++ {
+			lost := -1
+			if g%3 == 0 {
+				lost = rand.Intn(dataSize)
+			}
+			for i := 0; i < dataSize; i++ {
+				pkt := make([]byte, fecHeaderSizePlus2+4)
+				binary.LittleEndian.PutUint32(pkt[fecHeaderSizePlus2:], uint32(p<<16|g<<8|i))
+				ps := encoder.encode(pkt)
+				if i != lost {
+					decoder.decode(pkt)
+				}
+				for k := range ps {
+					for _, r := range decoder.decode(ps[k]) {
+						if binary.LittleEndian.Uint32(r[2:]) == uint32(p<<16|g<<8|lost) {
+							recovered++
+						}
+						xmitBuf.Put(r)
+					}
+				}
+			}
+		}
+
+		if encoder.parityShards != paritySize {
+			t.Fatal("shape not changed", encoder.parityShards)
+		}
+		if decoder.parityShards != paritySize {
+			t.Fatal("decoder not tuned", decoder.parityShards)
+		}
+		if recovered != groups/3 {
+			t.Fatal("shards not recovered", paritySize, recovered)
+		}
+	}
+
+	if loss, ok := decoder.lossRate(); !ok || loss <= 0 || loss > 0.1 {
+		t.Fatal("loss rate", loss, ok)
+	}
+	if _, ok := decoder.lossRate(); ok {
+		t.Fatal("loss rate not reset")
+	}
+}
+
+func TestXORCodec(t *testing.T) {
+	const dataSize = 10
+	if _, err := NewXORCodec(dataSize, 2); err == nil {
+		t.Fatal("XOR codec with 2 parity shards")
+	}
+
+	// an XOR sender against an XOR receiver and a Reed-Solomon one
+	for _, tc := range []struct {
+		codec      FECCodecFunc
+		compatible bool
+	}{{NewXORCodec, true}, {NewRSCodec, false}} {
+		encoder := newFECEncoder(dataSize, 1, 0)
+		if err := encoder.setCodec(NewXORCodec); err != nil {
+			t.Fatal(err)
+		}
+		decoder := newFECDecoder(dataSize, 1)
+		if err := decoder.setCodec(tc.codec); err != nil {
+			t.Fatal(err)
+		}
+
+		var lost []byte
+		var recovered [][]byte
+		for i := 0; i < dataSize; i++ {
+			pkt := make([]byte, fecHeaderSizePlus2+64+i)
+			rand.Read(pkt[fecHeaderSizePlus2:])
+			ps := encoder.encode(pkt)
+			if i == 3 {
+				lost = pkt[fecHeaderSize:]
+			} else {
+				decoder.decode(pkt)
+			}
+			for k := range ps {
+				recovered = append(recovered, decoder.decode(ps[k])...)
+			}
+		}
+
+		// the garbage of a mismatched codec is left to the KCP input to drop
+		if len(recovered) != 1 {
+			t.Fatal("shard not reconstructed", len(recovered))
+		}
+		if bytes.Equal(recovered[0][:len(lost)], lost) != tc.compatible {
+			t.Fatal("XOR codec interop, compatible:", tc.compatible)
+		}
+	}
+}
+
+func BenchmarkFECEncodeXOR(b *testing.B) {
+	const dataSize = 10
+	const payLoad = 1500
+
+	b.ReportAllocs()
+	b.SetBytes(payLoad)
+	encoder := newFECEncoder(dataSize, 1, 0)
+	encoder.setCodec(NewXORCodec)
+	for i := 0; i < b.N; i++ {
+		data := make([]byte, payLoad)
+		encoder.encode(data)
+	}
+}
+
+func TestFECDecoderEviction(t *testing.T) {
+	const dataSize = 10
+	const paritySize = 3
+	decoder := newFECDecoder(dataSize, paritySize)
+	decoder.snmp = newSnmp()
+
+	// half of each group is lost, nothing can be recovered
+	for i := 0; i < 10*(dataSize+paritySize); i++ {
+		if i%(dataSize+paritySize) >= (dataSize+paritySize)/2 {
+			continue
+		}
+		pkt := make([]byte, fecHeaderSizePlus2+64)
+		binary.LittleEndian.PutUint32(pkt, uint32(i))
+		binary.LittleEndian.PutUint16(pkt[4:], typeData)
+		decoder.decode(pkt)
+	}
+
+	if decoder.snmp.FECEvicted == 0 || decoder.snmp.FECShortShards != decoder.snmp.FECEvicted {
+		t.Fatal("evicted shards not counted", decoder.snmp.FECEvicted, decoder.snmp.FECShortShards)
+	}
+	if len(decoder.rx) > decoder.rxlimit {
+		t.Fatal("rxlimit exceeded", len(decoder.rx))
+	}
+	if lost := decoder.takeLost(); uint64(lost) != decoder.snmp.FECShortShards || decoder.takeLost() != 0 {
+		t.Fatal("lost shards not taken", lost)
+	}
+}
+
+func TestFECDecoderLimits(t *testing.T) {
+	const dataSize = 10
+	const paritySize = 3
+	const maxBytes = 8 * 1024
+	decoder := newFECDecoder(dataSize, paritySize)
+	decoder.setLimits(2, maxBytes)
+	if decoder.rxlimit != 2*(dataSize+paritySize) {
+		t.Fatal("rxlimit not set", decoder.rxlimit)
+	}
+
+	// a lossy stream of large packets
+	for i := 0; i < 100*(dataSize+paritySize); i++ {
+		if rand.Intn(10) < 3 {
+			continue
+		}
+		pkt := make([]byte, fecHeaderSizePlus2+rand.Intn(1300))
+		binary.LittleEndian.PutUint32(pkt, uint32(i))
+		if i%(dataSize+paritySize) < dataSize {
+			binary.LittleEndian.PutUint16(pkt[4:], typeData)
+		} else {
+			binary.LittleEndian.PutUint16(pkt[4:], typeParity)
+		}
+		for _, r := range decoder.decode(pkt) {
+			xmitBuf.Put(r)
+		}
+
+		retained := 0
+		for _, e := range decoder.rx {
+			retained += len(e.fecPacket)
+		}
+		if retained != decoder.rxBytes {
+			t.Fatal("retained bytes mismatch", retained, decoder.rxBytes)
+		}
+		if retained > maxBytes {
+			t.Fatal("retained bytes exceed the limit", retained)
+		}
+	}
+
+	decoder.release()
+	if decoder.rxBytes != 0 {
+		t.Fatal("retained bytes after release", decoder.rxBytes)
+	}
+}
+
+func TestRS16Codec(t *testing.T) {
+	const dataSize = 300
+	const paritySize = 20
+	if _, err := NewRSCodec(1000, 25); err == nil {
+		t.Fatal("RS codec beyond 1024 shards")
+	}
+
+	// the shard groups of odd-sized packets beyond 255 shards, losing paritySize data shards
+	encoder := newFECEncoder(dataSize, paritySize, 0)
+	decoder := newFECDecoder(dataSize, paritySize)
+	const groups = 3
+	for g := 0; g < groups; g++ {
+		lost := make(map[int][]byte)
+		for len(lost) < paritySize {
+			lost[rand.Intn(dataSize)] = nil
+		}
+
+		var recovered [][]byte
+		for i := 0; i < dataSize; i++ {
+			pkt := make([]byte, fecHeaderSizePlus2+1+2*rand.Intn(600))
+			rand.Read(pkt[fecHeaderSizePlus2:])
+			ps := encoder.encode(pkt)
+			if _, ok := lost[i]; ok {
+				lost[i] = pkt[fecHeaderSize:]
+			} else {
+				decoder.decode(pkt)
+			}
+			for k := range ps {
+				if fecPacket(ps[k]).flag() != typeParity16 || (len(ps[k])-fecHeaderSize)%2 != 0 {
+					t.Fatal("parity shard over GF(2^16)", fecPacket(ps[k]).flag(), len(ps[k]))
+				}
+				recovered = append(recovered, decoder.decode(ps[k])...)
+			}
+		}
+
+		if len(recovered) != paritySize {
+			t.Fatal("shards not reconstructed", len(recovered))
+		}
+		for _, r := range recovered {
+			found := false
+			for _, shard := range lost {
+				if bytes.Equal(r[:len(shard)], shard) {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatal("shard reconstructed wrongly")
+			}
+			xmitBuf.Put(r)
+		}
+	}
+}
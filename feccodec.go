@@ -0,0 +1,118 @@
+package kcp
+
+import (
+	"github.com/klauspost/reedsolomon"
+	"github.com/pkg/errors"
+	xor "github.com/templexxx/xorsimd"
+)
+
+var (
+	errXORParity       = errors.New("XOR codec supports only one parity shard")
+	errTooFewShards    = errors.New("too few shards to reconstruct")
+	errShardSizeDiffer = errors.New("shard sizes differ")
+)
+
+// FECCodec computes the parity shards and reconstructs the lost data shards of a
+// shard group, the shards of zero length are the lost ones, and they are extended
+// within their capacity if possible, like reedsolomon.Encoder.
+type FECCodec interface {
+	// Encode computes the parity shards from the data shards ahead of them.
+	Encode(shards [][]byte) error
+
+	// ReconstructData recovers the lost data shards.
+	ReconstructData(shards [][]byte) error
+}
+
+// FECCodecFunc creates a FECCodec for the shard counts.
+type FECCodecFunc func(dataShards, parityShards int) (FECCodec, error)
+
+// NewRSCodec creates the Reed-Solomon codec, the default of FEC. It's over GF(2^8)
+// up to 255 shards, and over GF(2^16) beyond, up to 1024 shards of even sizes.
+func NewRSCodec(dataShards, parityShards int) (FECCodec, error) {
+	if dataShards+parityShards > rs8Shards {
+		return newRS16Codec(dataShards, parityShards)
+	}
+	return reedsolomon.New(dataShards, parityShards)
+}
+
+// newFECCodec creates a codec by 'f', or the Reed-Solomon one if 'f' is nil
+func newFECCodec(f FECCodecFunc, dataShards, parityShards int) (FECCodec, error) {
+	if f == nil {
+		return NewRSCodec(dataShards, parityShards)
+	}
+	return f(dataShards, parityShards)
+}
+
+// xorCodec has the parity shard as the XOR of the data shards, which recovers
+// one lost shard at a fraction of the Reed-Solomon cost.
+type xorCodec struct {
+	dataShards int
+	srcs       [][]byte
+}
+
+// NewXORCodec creates the XOR codec for a single parity shard, it's incompatible
+// with the Reed-Solomon codec on the wire.
+func NewXORCodec(dataShards, parityShards int) (FECCodec, error) {
+	if dataShards <= 0 || parityShards != 1 {
+		return nil, errors.WithStack(errXORParity)
+	}
+	return &xorCodec{dataShards: dataShards, srcs: make([][]byte, 0, dataShards)}, nil
+}
+
+func (c *xorCodec) Encode(shards [][]byte) error {
+	if len(shards) != c.dataShards+1 {
+		return errors.WithStack(errTooFewShards)
+	}
+	size := len(shards[0])
+	for _, shard := range shards {
+		if len(shard) != size {
+			return errors.WithStack(errShardSizeDiffer)
+		}
+	}
+	xor.Encode(shards[c.dataShards], shards[:c.dataShards])
+	return nil
+}
+
+func (c *xorCodec) ReconstructData(shards [][]byte) error {
+	if len(shards) != c.dataShards+1 {
+		return errors.WithStack(errTooFewShards)
+	}
+
+	// find the lost data shard, and the size of the others
+	lost, size := -1, 0
+	for k, shard := range shards {
+		if len(shard) == 0 {
+			if k == c.dataShards {
+				continue
+			}
+			if lost >= 0 {
+				return errors.WithStack(errTooFewShards)
+			}
+			lost = k
+		} else if size == 0 {
+			size = len(shard)
+		} else if len(shard) != size {
+			return errors.WithStack(errShardSizeDiffer)
+		}
+	}
+	if lost < 0 {
+		return nil
+	}
+	if len(shards[c.dataShards]) == 0 {
+		return errors.WithStack(errTooFewShards)
+	}
+
+	if cap(shards[lost]) >= size {
+		shards[lost] = shards[lost][:size]
+	} else {
+		shards[lost] = make([]byte, size)
+	}
+	c.srcs = c.srcs[:0]
+	for k, shard := range shards {
+		if k != lost {
+			c.srcs = append(c.srcs, shard)
+		}
+	}
+	xor.Encode(shards[lost], c.srcs)
+	return nil
+}
@@ -0,0 +1,41 @@
+package kcp
+
+import (
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const ipv6FlowLabelMask = 0xfffff // the 20 bits of the IPv6 flow label
+
+var (
+	errFlowLabelRange  = errors.New("IPv6 flow label must be within 1 to 0xfffff")
+	errFlowLabelShared = errors.New("IPv6 flow label can't be set on the socket of a Listener")
+)
+
+// SetIPv6FlowLabel sets the flow label of the outgoing IPv6 packets, so that the
+// routers hash the packets of the session consistently over the ECMP paths. The
+// label fills only the 20 bits of its own, the traffic class by SetDSCP is kept.
+//
+// The kernel applies a label only to the packets sent on a connected socket, so
+// the socket of the session is connected to the remote, after which the packets
+// from any other address are dropped by the kernel. It works on Linux only, with
+// the IPv6 remotes of the sessions owning a *net.UDPConn. The sessions accepted
+// from Listener share its unconnected socket, and fail with an error, as do the
+// IPv4 remotes and the other platforms.
+func (s *UDPSession) SetIPv6FlowLabel(label uint32) error {
+	if label == 0 || label > ipv6FlowLabelMask {
+		return errors.WithStack(errFlowLabelRange)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.l != nil {
+		return errors.WithStack(errFlowLabelShared)
+	}
+	if err := setFlowLabel(s.conn, s.remote, label); err != nil {
+		return errors.WithStack(err)
+	}
+	atomic.StoreUint32(&s.flowLabel, label)
+	return nil
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package kcp
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+var errFlowLabel = errors.New("IPv6 flow label is supported on Linux only")
+
+func setFlowLabel(conn net.PacketConn, raddr net.Addr, label uint32) error {
+	return errFlowLabel
+}
@@ -0,0 +1,92 @@
+// +build linux
+
+package kcp
+
+import (
+	"encoding/binary"
+	"net"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// the flow label options of linux/in6.h
+const (
+	ipv6FlowLabelMgr  = 32  // IPV6_FLOWLABEL_MGR
+	ipv6FlowInfoSend  = 33  // IPV6_FLOWINFO_SEND
+	ipv6FlowLabelGet  = 0   // IPV6_FL_A_GET, leases a label
+	ipv6FlowLabelAny  = 255 // IPV6_FL_S_ANY, shared with any socket
+	ipv6FlowLabelMake = 1   // IPV6_FL_F_CREATE, creates the label if missing
+)
+
+var (
+	errFlowLabelIPv4 = errors.New("IPv6 flow label can't be set for an IPv4 remote")
+	errFlowLabelConn = errors.New("IPv6 flow label needs a *net.UDPConn to connect")
+)
+
+// in6FlowLabelReq is struct in6_flowlabel_req of linux/in6.h
+type in6FlowLabelReq struct {
+	dst     [16]byte
+	label   [4]byte // big endian
+	action  uint8
+	share   uint8
+	flags   uint16
+	expires uint16
+	linger  uint16
+	_       uint32
+}
+
+// setFlowLabel leases 'label' for the socket of 'conn', and connects the socket
+// to 'raddr' with the label, which the kernel applies to the packets sent by
+// Write afterwards.
+func setFlowLabel(conn net.PacketConn, raddr net.Addr, label uint32) error {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return errFlowLabelConn
+	}
+	udpAddr, ok := raddr.(*net.UDPAddr)
+	if !ok || udpAddr.IP.To4() != nil || udpAddr.IP.To16() == nil {
+		return errFlowLabelIPv4
+	}
+	rc, err := udpConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	req := in6FlowLabelReq{action: ipv6FlowLabelGet, share: ipv6FlowLabelAny, flags: ipv6FlowLabelMake}
+	copy(req.dst[:], udpAddr.IP.To16())
+	binary.BigEndian.PutUint32(req.label[:], label)
+
+	var sa unix.RawSockaddrInet6
+	sa.Family = unix.AF_INET6
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:], uint16(udpAddr.Port))
+	binary.BigEndian.PutUint32((*[4]byte)(unsafe.Pointer(&sa.Flowinfo))[:], label)
+	copy(sa.Addr[:], udpAddr.IP.To16())
+	if udpAddr.Zone != "" {
+		if ifi, err := net.InterfaceByName(udpAddr.Zone); err == nil {
+			sa.Scope_id = uint32(ifi.Index)
+		}
+	}
+
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		_, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, fd, unix.IPPROTO_IPV6, ipv6FlowLabelMgr,
+			uintptr(unsafe.Pointer(&req)), unsafe.Sizeof(req), 0)
+		if errno != 0 {
+			sockErr = errors.Wrap(errno, "IPV6_FLOWLABEL_MGR")
+			return
+		}
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, ipv6FlowInfoSend, 1); err != nil {
+			sockErr = errors.Wrap(err, "IPV6_FLOWINFO_SEND")
+			return
+		}
+		_, _, errno = unix.Syscall(unix.SYS_CONNECT, fd, uintptr(unsafe.Pointer(&sa)), unix.SizeofSockaddrInet6)
+		if errno != 0 {
+			sockErr = errors.Wrap(errno, "connect")
+		}
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
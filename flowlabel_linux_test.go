@@ -0,0 +1,57 @@
+// +build linux
+
+package kcp
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const ipv6FlowInfo = 11 // IPV6_FLOWINFO of linux/in6.h, the flow info received
+
+func TestIPv6FlowLabelLinux(t *testing.T) {
+	// the flow label of the packets received, with the traffic class untouched
+	server, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skip("no IPv6 loopback", err)
+	}
+	defer server.Close()
+	rc, _ := server.SyscallConn()
+	rc.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6FlowInfo, 1)
+	})
+	sess, err := DialWithOptions(server.LocalAddr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := sess.SetDSCP(46); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.SetIPv6FlowLabel(0x12345); err != nil {
+		t.Fatal(err)
+	}
+	sess.Write([]byte("hello"))
+
+	buf := make([]byte, mtuLimit)
+	oob := make([]byte, 64)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	_, oobn, _, _, err := server.ReadMsgUDP(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, _ := syscall.ParseSocketControlMessage(oob[:oobn])
+	for _, m := range msgs {
+		if m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == ipv6FlowInfo && len(m.Data) >= 4 {
+			info := binary.BigEndian.Uint32(m.Data)
+			if info&ipv6FlowLabelMask != 0x12345 || info>>20 == 0 {
+				t.Fatalf("flow info %#x", info)
+			}
+			return
+		}
+	}
+	t.Fatal("no flow info received")
+}
@@ -0,0 +1,219 @@
+package kcp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// the handshake packets are typed apart from the FEC types at the same offset,
+	// | TOKEN(4B) | TYPE(1B) | CONV(4B) |
+	typeConvRequest   = 0xf4
+	typeConvReply     = 0xf5
+	handshakeSize     = 9
+	handshakeInterval = 200 * time.Millisecond // the interval of resending a request
+	handshakeTimeout  = 5 * time.Second        // the timeout of a handshake, and of the conv offered
+	handshakeOffers   = 4096                   // the convs offered at once, the requests beyond are dropped
+)
+
+// convOffer is a conv allocated by a Listener for a handshake
+type convOffer struct {
+	token uint32
+	conv  uint32
+}
+
+// handshakeWireSize returns the size of the handshake packets on wire, which is
+// shorter than any KCP packet, so they are told apart by the size first
+func handshakeWireSize(block BlockCrypt) int {
+	size := handshakeSize
+	if block != nil {
+		size += nonceSize + crcSize
+	}
+	if aead, ok := block.(AEADCrypt); ok {
+		size += aead.Overhead()
+	}
+	return size
+}
+
+// sealHandshake seals a handshake packet like a packet of the default settings,
+// without the replay counter and the key epoch
+func sealHandshake(block BlockCrypt, payload []byte) []byte {
+	if block == nil {
+		return append([]byte(nil), payload...)
+	}
+
+	buf := make([]byte, nonceSize+crcSize+len(payload))
+	copy(buf[nonceSize+crcSize:], payload)
+	NewCRC32Authenticator().Sign(buf[nonceSize:])
+	io.ReadFull(rand.Reader, buf[:nonceSize])
+	if aead, ok := block.(AEADCrypt); ok {
+		bts := make([]byte, len(buf)+aead.Overhead())
+		aead.Seal(bts, buf)
+		return bts
+	}
+	block.Encrypt(buf, buf)
+	return buf
+}
+
+// openHandshake opens a handshake packet in place, and returns its payload
+func openHandshake(block BlockCrypt, data []byte) ([]byte, bool) {
+	var auth PacketAuthenticator
+	if block != nil {
+		auth = NewCRC32Authenticator()
+	}
+	payload, ok := openPacket(block, auth, data, nil)
+	if !ok || len(payload) != handshakeSize {
+		return nil, false
+	}
+	return payload, true
+}
+
+// handshake answers the conv request of a new address with a conv unique among
+// the sessions and the other offers, the same request gets the same conv. A new
+// request is limited as a new session by SetSessionRate, and the session started
+// with the conv offered isn't limited again. It returns false if 'data' isn't of
+// the size of a handshake packet.
+func (l *Listener) handshake(data []byte, addr net.Addr, conn net.PacketConn) bool {
+	l.keyLock.Lock()
+	block := l.block
+	l.keyLock.Unlock()
+	if len(data) != handshakeWireSize(block) {
+		return false
+	}
+
+	payload, ok := openHandshake(block, data)
+	if !ok || payload[4] != typeConvRequest {
+		return true
+	}
+	token := binary.LittleEndian.Uint32(payload)
+
+	key := addr.String()
+	l.sessionLock.Lock()
+	offer, ok := l.offers[key]
+	if !ok || offer.token != token {
+		if (!ok && len(l.offers) >= handshakeOffers) || l.rateLimited(addr) {
+			l.sessionLock.Unlock()
+			return true
+		}
+		l.withdrawOffer(key)
+		offer = convOffer{token: token}
+		for offer.conv == 0 || l.offered(offer.conv) {
+			binary.Read(rand.Reader, binary.LittleEndian, &offer.conv)
+		}
+		l.offers[key] = offer
+		l.offerConvs[offer.conv] = struct{}{}
+		l.timedSched().Put(func() {
+			l.sessionLock.Lock()
+			if l.offers[key] == offer {
+				l.withdrawOffer(key)
+			}
+			l.sessionLock.Unlock()
+		}, time.Now().Add(handshakeTimeout))
+	}
+	l.sessionLock.Unlock()
+
+	var reply [handshakeSize]byte
+	binary.LittleEndian.PutUint32(reply[:], token)
+	reply[4] = typeConvReply
+	binary.LittleEndian.PutUint32(reply[5:], offer.conv)
+	conn.WriteTo(sealHandshake(block, reply[:]), addr)
+	return true
+}
+
+// offered returns true if a session or an offer has the conv, sessionLock held
+func (l *Listener) offered(conv uint32) bool {
+	if _, ok := l.convs[conv]; ok {
+		return true
+	}
+	_, ok := l.offerConvs[conv]
+	return ok
+}
+
+// offeredTo returns true if the conv is offered to 'addr' by a handshake
+func (l *Listener) offeredTo(addr net.Addr, conv uint32) bool {
+	l.sessionLock.RLock()
+	defer l.sessionLock.RUnlock()
+	offer, ok := l.offers[addr.String()]
+	return ok && offer.conv == conv
+}
+
+// withdrawOffer removes the offer to the address 'key', sessionLock held
+func (l *Listener) withdrawOffer(key string) {
+	if offer, ok := l.offers[key]; ok {
+		delete(l.offerConvs, offer.conv)
+		delete(l.offers, key)
+	}
+}
+
+// negotiateConv requests a conv from the Listener at 'raddr', the request is resent
+// until the reply arrives, or it fails after handshakeTimeout or once 'ctx' is done.
+func negotiateConv(ctx context.Context, conn net.PacketConn, raddr net.Addr, block BlockCrypt) (uint32, error) {
+	var token uint32
+	binary.Read(rand.Reader, binary.LittleEndian, &token)
+	var request [handshakeSize]byte
+	binary.LittleEndian.PutUint32(request[:], token)
+	request[4] = typeConvRequest
+	packet := sealHandshake(block, request[:])
+
+	done := make(chan struct{})
+	var resend func()
+	resend = func() {
+		select {
+		case <-done:
+		default:
+			conn.WriteTo(packet, raddr)
+			SystemTimedSched.Put(resend, time.Now().Add(handshakeInterval))
+		}
+	}
+	resend()
+
+	// the reads are bounded by the timeout, and interrupted once 'ctx' is done
+	deadline := time.Now().Add(handshakeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	var cancelled int32
+	watcher := make(chan struct{})
+	go func() {
+		defer close(watcher)
+		select {
+		case <-ctx.Done():
+			atomic.StoreInt32(&cancelled, 1)
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	defer func() {
+		close(done)
+		<-watcher
+		conn.SetReadDeadline(time.Time{})
+	}()
+
+	buf := make([]byte, mtuLimit)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if atomic.LoadInt32(&cancelled) != 0 {
+				return 0, errors.WithStack(ctx.Err())
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return 0, errors.WithStack(ErrTimeout)
+			}
+			return 0, errors.WithStack(err)
+		}
+		if addr.String() != raddr.String() || n != handshakeWireSize(block) {
+			continue
+		}
+		if payload, ok := openHandshake(block, buf[:n]); ok && payload[4] == typeConvReply && binary.LittleEndian.Uint32(payload) == token {
+			return binary.LittleEndian.Uint32(payload[5:]), nil
+		}
+	}
+}
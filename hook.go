@@ -0,0 +1,83 @@
+package kcp
+
+import "golang.org/x/net/ipv4"
+
+// inputHookBacklog is the number of the datagrams queued for an input hook, the
+// datagrams arriving beyond it are not passed to the hook
+const inputHookBacklog = 1024
+
+// inputHook passes the incoming datagrams to a function in a goroutine of its own,
+// in the order of arrival, so a slow function never blocks the read loop.
+type inputHook struct {
+	f   func(raw []byte)
+	ch  chan []byte
+	die chan struct{}
+}
+
+func newInputHook(f func(raw []byte)) *inputHook {
+	h := &inputHook{f: f, ch: make(chan []byte, inputHookBacklog), die: make(chan struct{})}
+	go h.run()
+	return h
+}
+
+// input queues a copy of 'raw' for the function, it's a no-op on a nil hook
+func (h *inputHook) input(raw []byte) {
+	if h == nil {
+		return
+	}
+	buf := xmitBuf.Get(len(raw))
+	copy(buf, raw)
+	select {
+	case h.ch <- buf:
+	default:
+		xmitBuf.Put(buf)
+	}
+}
+
+func (h *inputHook) run() {
+	for {
+		select {
+		case buf := <-h.ch:
+			h.f(buf)
+			xmitBuf.Put(buf)
+		case <-h.die:
+			return
+		}
+	}
+}
+
+// close stops the goroutine, it's a no-op on a nil hook
+func (h *inputHook) close() {
+	if h != nil {
+		close(h.die)
+	}
+}
+
+// outputHooked passes the datagrams of 'txqueue' through the hook set by
+// SetOutputHook, it returns the ones to send, rewritten in place so they're
+// recycled along with 'txqueue'.
+func (s *UDPSession) outputHooked(txqueue []ipv4.Message) []ipv4.Message {
+	f := s.outputHook
+	if f == nil {
+		return txqueue
+	}
+
+	s.hookqueue = s.hookqueue[:0]
+	for k := range txqueue {
+		buf := txqueue[k].Buffers[0]
+		out := f(buf)
+		if len(out) == 0 || len(out) > mtuLimit {
+			continue
+		}
+		if len(out) > cap(buf) { // grown beyond the class of the buffer
+			grown := xmitBuf.Get(len(out))
+			copy(grown, out)
+			xmitBuf.Put(buf)
+			txqueue[k].Buffers[0] = grown
+		} else {
+			txqueue[k].Buffers[0] = buf[:copy(buf[:cap(buf)], out)]
+		}
+		s.hookqueue = append(s.hookqueue, txqueue[k])
+	}
+	return s.hookqueue
+}
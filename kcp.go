@@ -2,6 +2,7 @@ package kcp
 
 import (
 	"encoding/binary"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -15,8 +16,12 @@ const (
 	IKCP_CMD_ACK     = 82 // cmd: ack
 	IKCP_CMD_WASK    = 83 // cmd: window probe (ask)
 	IKCP_CMD_WINS    = 84 // cmd: window size (tell)
+	IKCP_CMD_FIN     = 85 // cmd: no more data from sender (only if enabled on both sides)
+	IKCP_CMD_ECE     = 86 // cmd: congestion experienced echo (only if enabled on both sides)
+	IKCP_CMD_DGRAM   = 87 // cmd: unreliable datagram (only if enabled on both sides)
 	IKCP_ASK_SEND    = 1  // need to send IKCP_CMD_WASK
 	IKCP_ASK_TELL    = 2  // need to send IKCP_CMD_WINS
+	IKCP_ASK_ECE     = 4  // need to send IKCP_CMD_ECE
 	IKCP_WND_SND     = 32
 	IKCP_WND_RCV     = 32
 	IKCP_MTU_DEF     = 1400
@@ -31,6 +36,9 @@ const (
 	IKCP_SN_OFFSET   = 12
 )
 
+// convSize is the size of conv in the segment header, omitted in the conv-less mode
+const convSize = 4
+
 // monotonic reference time point
 var refTime time.Time = time.Now()
 
@@ -113,11 +121,14 @@ type segment struct {
 	fastack  uint32
 	acked    uint32 // mark if the seg has acked
 	data     []byte
+	buf      *[]byte // the pooled buffer of data, nil if data isn't pooled
 }
 
 // encode a segment into buffer
-func (seg *segment) encode(ptr []byte) []byte {
-	ptr = ikcp_encode32u(ptr, seg.conv)
+func (seg *segment) encode(ptr []byte, noconv bool) []byte {
+	if !noconv {
+		ptr = ikcp_encode32u(ptr, seg.conv)
+	}
 	ptr = ikcp_encode8u(ptr, seg.cmd)
 	ptr = ikcp_encode8u(ptr, seg.frg)
 	ptr = ikcp_encode16u(ptr, seg.wnd)
@@ -125,7 +136,6 @@ func (seg *segment) encode(ptr []byte) []byte {
 	ptr = ikcp_encode32u(ptr, seg.sn)
 	ptr = ikcp_encode32u(ptr, seg.una)
 	ptr = ikcp_encode32u(ptr, uint32(len(seg.data)))
-	atomic.AddUint64(&DefaultSnmp.OutSegs, 1)
 	return ptr
 }
 
@@ -135,7 +145,7 @@ type KCP struct {
 	snd_una, snd_nxt, rcv_nxt              uint32
 	ssthresh                               uint32
 	rx_rttvar, rx_srtt                     int32
-	rx_rto, rx_minrto                      uint32
+	rx_rto, rx_minrto, rx_maxrto           uint32
 	snd_wnd, rcv_wnd, rmt_wnd, cwnd, probe uint32
 	interval, ts_flush                     uint32
 	nodelay, updated                       uint32
@@ -143,18 +153,51 @@ type KCP struct {
 	dead_link, incr                        uint32
 
 	fastresend     int32
+	fastlimit      int32 // the fast retransmissions of a segment at most, 0 for unlimited
 	nocwnd, stream int32
+	fin, snd_fin   int32  // IKCP_CMD_FIN enabled, FIN queued
+	ecn            int32  // IKCP_CMD_ECE enabled
+	dgram          int32  // IKCP_CMD_DGRAM enabled
+	ts_ece         uint32 // the latest reaction to IKCP_CMD_ECE
+	tlp            int32  // tail loss probe enabled
+	tlp_sn         uint32 // the segment probed last
+	tlp_sent       bool   // tlp_sn is valid
+
+	rack       int32  // RACK time-based loss detection enabled
+	rack_acked bool   // rack_sn & rack_ts are valid
+	rack_sn    uint32 // the highest segment acknowledged
+	rack_ts    uint32 // the transmit time of the latest sent segment acknowledged
+	rack_reo   uint32 // the reordering observed in milliseconds
+
+	pmtu_sn, pmtu_ts uint32 // the MTU probe awaiting its ack
+	pmtu_state       int32  // the MTU probe, 0: none, 1: awaiting its ack, 2: acknowledged
+	path_sn, path_ts uint32 // the path challenge awaiting its ack
+	path_state       int32  // the path challenge, 0: none, 1: awaiting its ack, 2: acknowledged
 
 	snd_queue []segment
 	rcv_queue []segment
 	snd_buf   []segment
 	rcv_buf   []segment
+	snd_bytes int // the bytes of the data in snd_queue & snd_buf unacknowledged
+	rcv_off   int // the bytes of rcv_queue[0] consumed by recvStream
+	rcv_bytes int // the bytes of the data in rcv_buf & rcv_queue
+	rcv_limit int // the bytes held in rcv_buf & rcv_queue at most, 0 for no limit
+
+	dgrams [][]byte // the datagrams received, up to dgramQueue
 
 	acklist []ackItem
 
 	buffer   []byte
 	reserved int
+	overhead int  // the size of the segment header
+	noconv   bool // conv omitted from the segment header, see setNoConv
 	output   output_callback
+
+	snmp *Snmp // per-connection statistics
+
+	cc CongestionController // congestion window control
+
+	clock Clock // the time source, nil for the wall clock
 }
 
 type ackItem struct {
@@ -174,30 +217,76 @@ func NewKCP(conv uint32, output output_callback) *KCP {
 	kcp.rcv_wnd = IKCP_WND_RCV
 	kcp.rmt_wnd = IKCP_WND_RCV
 	kcp.mtu = IKCP_MTU_DEF
+	kcp.overhead = IKCP_OVERHEAD
 	kcp.mss = kcp.mtu - IKCP_OVERHEAD
 	kcp.buffer = make([]byte, kcp.mtu)
 	kcp.rx_rto = IKCP_RTO_DEF
+	kcp.rx_maxrto = IKCP_RTO_MAX
 	kcp.rx_minrto = IKCP_RTO_MIN
 	kcp.interval = IKCP_INTERVAL
 	kcp.ts_flush = IKCP_INTERVAL
 	kcp.ssthresh = IKCP_THRESH_INIT
 	kcp.dead_link = IKCP_DEADLINK
 	kcp.output = output
+	kcp.snmp = newSnmp()
+	kcp.cc = &lossController{kcp}
 	return kcp
 }
 
+// SetClock replaces the wall clock of KCP with 'c', e.g. a ManualClock driving it
+// in tests, set nil to restore the wall clock. It's meant to be called before
+// any input or output, as the timestamps of the two clocks don't compare.
+func (kcp *KCP) SetClock(c Clock) {
+	kcp.clock = c
+}
+
+// now returns the milliseconds of the clock of KCP, see currentMs
+func (kcp *KCP) now() uint32 {
+	if kcp.clock == nil {
+		return currentMs()
+	}
+	return uint32(kcp.clock.Now().Sub(refTime) / time.Millisecond)
+}
+
+// segmentPools pool the segment buffers by bufferClasses, as pointers so that
+// recycling them doesn't allocate. A segment takes the smallest class holding the
+// MSS, so it can grow up to the MSS in stream mode.
+var segmentPools [len(bufferClasses)]sync.Pool
+
+func init() {
+	for k := range segmentPools {
+		size := bufferClasses[k]
+		segmentPools[k].New = func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		}
+	}
+}
+
 // newSegment creates a KCP segment
 func (kcp *KCP) newSegment(size int) (seg segment) {
-	seg.data = xmitBuf.Get().([]byte)[:size]
+	capacity := size
+	if capacity < int(kcp.mss) {
+		capacity = int(kcp.mss)
+	}
+	class := bufferClass(capacity)
+	if class < 0 {
+		seg.data = make([]byte, size, capacity)
+		return
+	}
+	seg.buf = segmentPools[class].Get().(*[]byte)
+	seg.data = (*seg.buf)[:size]
 	return
 }
 
-// delSegment recycles a KCP segment
+// delSegment recycles a KCP segment, once it's acknowledged or discarded, and
+// its data copied out
 func (kcp *KCP) delSegment(seg *segment) {
-	if seg.data != nil {
-		xmitBuf.Put(seg.data)
-		seg.data = nil
+	if seg.buf != nil {
+		segmentPools[bufferClass(cap(*seg.buf))].Put(seg.buf)
+		seg.buf = nil
 	}
+	seg.data = nil
 }
 
 // ReserveBytes keeps n bytes untouched from the beginning of the buffer,
@@ -205,14 +294,22 @@ func (kcp *KCP) delSegment(seg *segment) {
 //
 // Return false if n >= mss
 func (kcp *KCP) ReserveBytes(n int) bool {
-	if n >= int(kcp.mtu-IKCP_OVERHEAD) || n < 0 {
+	if n >= int(kcp.mtu)-kcp.overhead || n < 0 {
 		return false
 	}
 	kcp.reserved = n
-	kcp.mss = kcp.mtu - IKCP_OVERHEAD - uint32(n)
+	kcp.mss = kcp.mtu - uint32(kcp.overhead+n)
 	return true
 }
 
+// setNoConv omits conv from the segment header, both sides must agree on it, and
+// it must be set before any segment is sent or received.
+func (kcp *KCP) setNoConv() {
+	kcp.noconv = true
+	kcp.overhead = IKCP_OVERHEAD - convSize
+	kcp.mss += convSize
+}
+
 // PeekSize checks the size of next message in the recv queue
 func (kcp *KCP) PeekSize() (length int) {
 	if len(kcp.rcv_queue) == 0 {
@@ -221,7 +318,7 @@ func (kcp *KCP) PeekSize() (length int) {
 
 	seg := &kcp.rcv_queue[0]
 	if seg.frg == 0 {
-		return len(seg.data)
+		return len(seg.data) - kcp.rcv_off
 	}
 
 	if len(kcp.rcv_queue) < int(seg.frg+1) {
@@ -255,18 +352,17 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 		return -2
 	}
 
-	var fast_recover bool
-	if len(kcp.rcv_queue) >= int(kcp.rcv_wnd) {
-		fast_recover = true
-	}
+	fast_recover := kcp.wnd_unused() == 0
 
 	// merge fragment
 	count := 0
 	for k := range kcp.rcv_queue {
 		seg := &kcp.rcv_queue[k]
-		copy(buffer, seg.data)
-		buffer = buffer[len(seg.data):]
-		n += len(seg.data)
+		copy(buffer, seg.data[kcp.rcv_off:])
+		buffer = buffer[len(seg.data)-kcp.rcv_off:]
+		n += len(seg.data) - kcp.rcv_off
+		kcp.rcv_off = 0
+		kcp.rcv_bytes -= len(seg.data)
 		count++
 		kcp.delSegment(seg)
 		if seg.frg == 0 {
@@ -276,9 +372,54 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 	if count > 0 {
 		kcp.rcv_queue = kcp.remove_front(kcp.rcv_queue, count)
 	}
+	kcp.refillRcvQueue(fast_recover)
+	return
+}
+
+// recvStream receives the stream data into buffer as much as possible, a segment
+// larger than the rest of buffer is consumed partially, so the data is copied once
+// without the intermediate buffer for Recv. It stops at a FIN.
+//
+// Return number of bytes read.
+//
+// Return -1 when there is no readable data.
+func (kcp *KCP) recvStream(buffer []byte) (n int) {
+	if len(kcp.rcv_queue) == 0 || kcp.peekFin() {
+		return -1
+	}
+
+	fast_recover := kcp.wnd_unused() == 0
+
+	count := 0
+	for k := range kcp.rcv_queue {
+		seg := &kcp.rcv_queue[k]
+		if seg.cmd == IKCP_CMD_FIN || len(buffer) == 0 {
+			break
+		}
+		copied := copy(buffer, seg.data[kcp.rcv_off:])
+		buffer = buffer[copied:]
+		n += copied
+		if kcp.rcv_off+copied < len(seg.data) {
+			kcp.rcv_off += copied
+			break
+		}
+		kcp.rcv_off = 0
+		count++
+		kcp.rcv_bytes -= len(seg.data)
+		kcp.delSegment(seg)
+	}
+	if count > 0 {
+		kcp.rcv_queue = kcp.remove_front(kcp.rcv_queue, count)
+	}
+	kcp.refillRcvQueue(fast_recover)
+	return
+}
 
+// refillRcvQueue moves the data in order from rcv_buf to rcv_queue after receiving,
+// and tells the remote the window if it has reopened.
+func (kcp *KCP) refillRcvQueue(fast_recover bool) {
 	// move available data from rcv_buf -> rcv_queue
-	count = 0
+	count := 0
 	for k := range kcp.rcv_buf {
 		seg := &kcp.rcv_buf[k]
 		if seg.sn == kcp.rcv_nxt && len(kcp.rcv_queue)+count < int(kcp.rcv_wnd) {
@@ -295,12 +436,11 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 	}
 
 	// fast recover
-	if len(kcp.rcv_queue) < int(kcp.rcv_wnd) && fast_recover {
+	if fast_recover && kcp.wnd_unused() > 0 {
 		// ready to send back IKCP_CMD_WINS in ikcp_flush
 		// tell remote my window size
 		kcp.probe |= IKCP_ASK_TELL
 	}
-	return
 }
 
 // Send is user/upper level send, returns below zero for error
@@ -310,6 +450,11 @@ func (kcp *KCP) Send(buffer []byte) int {
 		return -1
 	}
 
+	// nothing can follow a FIN
+	if kcp.snd_fin != 0 {
+		return -3
+	}
+
 	// append to previous segment in streaming mode (if possible)
 	if kcp.stream != 0 {
 		n := len(kcp.snd_queue)
@@ -317,17 +462,21 @@ func (kcp *KCP) Send(buffer []byte) int {
 			seg := &kcp.snd_queue[n-1]
 			if len(seg.data) < int(kcp.mss) {
 				capacity := int(kcp.mss) - len(seg.data)
+				// the buffer is smaller than the MSS if the MSS has grown since
+				if room := cap(seg.data) - len(seg.data); capacity > room {
+					capacity = room
+				}
 				extend := capacity
 				if len(buffer) < capacity {
 					extend = len(buffer)
 				}
 
-				// grow slice, the underlying cap is guaranteed to
-				// be larger than kcp.mss
+				// grow slice within the underlying cap
 				oldlen := len(seg.data)
 				seg.data = seg.data[:oldlen+extend]
 				copy(seg.data[oldlen:], buffer)
 				buffer = buffer[extend:]
+				kcp.snd_bytes += extend
 			}
 		}
 
@@ -365,11 +514,48 @@ func (kcp *KCP) Send(buffer []byte) int {
 			seg.frg = 0
 		}
 		kcp.snd_queue = append(kcp.snd_queue, seg)
+		kcp.snd_bytes += size
 		buffer = buffer[size:]
 	}
 	return 0
 }
 
+// queueFin appends a FIN segment behind all the pending data, the FIN
+// is sent and retransmitted as a data segment with no payload.
+//
+// Return -1 if FIN is not enabled or has been queued already.
+func (kcp *KCP) queueFin() int {
+	if kcp.fin == 0 || kcp.snd_fin != 0 {
+		return -1
+	}
+	var seg segment
+	seg.cmd = IKCP_CMD_FIN
+	kcp.snd_queue = append(kcp.snd_queue, seg)
+	kcp.snd_fin = 1
+	return 0
+}
+
+// finXmit returns how many times the queued FIN has been transmitted,
+// returns -1 if there is no FIN waiting to be acknowledged.
+func (kcp *KCP) finXmit() int {
+	if kcp.snd_fin == 0 {
+		return -1
+	}
+	if n := len(kcp.snd_queue); n > 0 && kcp.snd_queue[n-1].cmd == IKCP_CMD_FIN {
+		return 0
+	}
+	if n := len(kcp.snd_buf); n > 0 && kcp.snd_buf[n-1].cmd == IKCP_CMD_FIN && kcp.snd_buf[n-1].acked == 0 {
+		return int(kcp.snd_buf[n-1].xmit)
+	}
+	return -1
+}
+
+// peekFin checks if the next segment in the recv queue is a FIN,
+// which means the remote will send no more data.
+func (kcp *KCP) peekFin() bool {
+	return len(kcp.rcv_queue) > 0 && kcp.rcv_queue[0].cmd == IKCP_CMD_FIN
+}
+
 func (kcp *KCP) update_ack(rtt int32) {
 	// https://tools.ietf.org/html/rfc6298
 	var rto uint32
@@ -392,7 +578,7 @@ func (kcp *KCP) update_ack(rtt int32) {
 		}
 	}
 	rto = uint32(kcp.rx_srtt) + _imax_(kcp.interval, uint32(kcp.rx_rttvar)<<2)
-	kcp.rx_rto = _ibound_(kcp.rx_minrto, rto, IKCP_RTO_MAX)
+	kcp.rx_rto = _ibound_(kcp.rx_minrto, rto, kcp.rx_maxrto)
 }
 
 func (kcp *KCP) shrink_buf() {
@@ -417,6 +603,7 @@ func (kcp *KCP) parse_ack(sn uint32) {
 			// have to shift the segments behind forward,
 			// which is an expensive operation for large window
 			seg.acked = 1
+			kcp.snd_bytes -= len(seg.data)
 			kcp.delSegment(seg)
 			break
 		}
@@ -441,11 +628,55 @@ func (kcp *KCP) parse_fastack(sn, ts uint32) {
 	}
 }
 
+// fastAllowed returns if 'seg' may be retransmitted by the duplicate acks, within
+// fastlimit transmissions, the RTO retransmits it beyond
+func (kcp *KCP) fastAllowed(seg *segment) bool {
+	return kcp.fastlimit <= 0 || seg.xmit <= uint32(kcp.fastlimit)
+}
+
+// rackAck records the ack of the segment 'sn' sent at 'ts' for RACK, an ack below
+// the highest segment acknowledged for a segment sent earlier is taken as reordering
+func (kcp *KCP) rackAck(sn, ts uint32) {
+	if !kcp.rack_acked {
+		kcp.rack_acked, kcp.rack_sn, kcp.rack_ts = true, sn, ts
+		return
+	}
+	if _itimediff(sn, kcp.rack_sn) < 0 {
+		if reo := _itimediff(kcp.rack_ts, ts); reo > 0 && uint32(reo) > kcp.rack_reo {
+			kcp.rack_reo = uint32(reo)
+		}
+	} else {
+		kcp.rack_sn = sn
+	}
+	if _itimediff(ts, kcp.rack_ts) > 0 {
+		kcp.rack_ts = ts
+	}
+}
+
+// rackSentBefore returns if 'seg' was sent before the latest segment acknowledged
+func (kcp *KCP) rackSentBefore(seg *segment) bool {
+	if diff := _itimediff(seg.ts, kcp.rack_ts); diff != 0 {
+		return diff < 0
+	}
+	return _itimediff(seg.sn, kcp.rack_sn) < 0
+}
+
+// rackWindow returns the reordering window of RACK, the reordering observed plus
+// a quarter of SRTT, up to SRTT
+func (kcp *KCP) rackWindow() int32 {
+	wnd := int32(kcp.rack_reo) + kcp.rx_srtt/4
+	if wnd > kcp.rx_srtt {
+		wnd = kcp.rx_srtt
+	}
+	return wnd
+}
+
 func (kcp *KCP) parse_una(una uint32) int {
 	count := 0
 	for k := range kcp.snd_buf {
 		seg := &kcp.snd_buf[k]
 		if _itimediff(una, seg.sn) > 0 {
+			kcp.snd_bytes -= len(seg.data)
 			kcp.delSegment(seg)
 			count++
 		} else {
@@ -488,9 +719,11 @@ func (kcp *KCP) parse_data(newseg segment) bool {
 
 	if !repeat {
 		// replicate the content if it's new
-		dataCopy := xmitBuf.Get().([]byte)[:len(newseg.data)]
-		copy(dataCopy, newseg.data)
-		newseg.data = dataCopy
+		data := newseg.data
+		copied := kcp.newSegment(len(data))
+		copy(copied.data, data)
+		newseg.data, newseg.buf = copied.data, copied.buf
+		kcp.rcv_bytes += len(data)
 
 		if insert_idx == n+1 {
 			kcp.rcv_buf = append(kcp.rcv_buf, newseg)
@@ -528,13 +761,14 @@ func (kcp *KCP) parse_data(newseg segment) bool {
 // 'ackNoDelay' will trigger immediate ACK, but surely it will not be efficient in bandwidth
 func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 	snd_una := kcp.snd_una
-	if len(data) < IKCP_OVERHEAD {
+	if len(data) < kcp.overhead {
 		return -1
 	}
 
 	var latest uint32 // the latest ack packet
+	var rtt int32     // the latest rtt sample
 	var flag int
-	var inSegs uint64
+	var inSegs, repeatSegs, outOfWindowSegs, rcvLimitSegs uint64
 	var windowSlides bool
 
 	for {
@@ -542,13 +776,17 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 		var wnd uint16
 		var cmd, frg uint8
 
-		if len(data) < int(IKCP_OVERHEAD) {
+		if len(data) < kcp.overhead {
 			break
 		}
 
-		data = ikcp_decode32u(data, &conv)
-		if conv != kcp.conv {
-			return -1
+		if kcp.noconv {
+			conv = kcp.conv
+		} else {
+			data = ikcp_decode32u(data, &conv)
+			if conv != kcp.conv {
+				return -1
+			}
 		}
 
 		data = ikcp_decode8u(data, &cmd)
@@ -563,10 +801,20 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 		}
 
 		if cmd != IKCP_CMD_PUSH && cmd != IKCP_CMD_ACK &&
-			cmd != IKCP_CMD_WASK && cmd != IKCP_CMD_WINS {
+			cmd != IKCP_CMD_WASK && cmd != IKCP_CMD_WINS &&
+			(cmd != IKCP_CMD_FIN || kcp.fin == 0) &&
+			(cmd != IKCP_CMD_ECE || kcp.ecn == 0) &&
+			(cmd != IKCP_CMD_DGRAM || kcp.dgram == 0) {
 			return -3
 		}
 
+		// a datagram bypasses the windows and the sequence numbers
+		if cmd == IKCP_CMD_DGRAM {
+			kcp.inputDatagram(data[:length])
+			data = data[length:]
+			continue
+		}
+
 		// only trust window updates from regular packets. i.e: latest update
 		if regular {
 			kcp.rmt_wnd = uint32(wnd)
@@ -577,13 +825,26 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 		kcp.shrink_buf()
 
 		if cmd == IKCP_CMD_ACK {
+			if kcp.pmtu_state == 1 && sn == kcp.pmtu_sn && ts == kcp.pmtu_ts {
+				kcp.pmtu_state = 2
+			}
+			if kcp.path_state == 1 && sn == kcp.path_sn && ts == kcp.path_ts {
+				kcp.path_state = 2
+			}
 			kcp.parse_ack(sn)
 			kcp.parse_fastack(sn, ts)
+			if kcp.rack != 0 {
+				kcp.rackAck(sn, ts)
+			}
 			flag |= 1
 			latest = ts
-		} else if cmd == IKCP_CMD_PUSH {
+		} else if cmd == IKCP_CMD_PUSH || cmd == IKCP_CMD_FIN { // FIN takes a sequence number as data does
 			repeat := true
-			if _itimediff(sn, kcp.rcv_nxt+kcp.rcv_wnd) < 0 {
+			if _itimediff(sn, kcp.rcv_nxt+kcp.rcv_wnd) >= 0 {
+				outOfWindowSegs++
+			} else if !kcp.rcvAdmit(sn, int(length)) {
+				rcvLimitSegs++ // not acknowledged, the remote retransmits it later
+			} else {
 				kcp.ack_push(sn, ts)
 				if _itimediff(sn, kcp.rcv_nxt) >= 0 {
 					var seg segment
@@ -599,7 +860,7 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 				}
 			}
 			if regular && repeat {
-				atomic.AddUint64(&DefaultSnmp.RepeatSegs, 1)
+				repeatSegs++
 			}
 		} else if cmd == IKCP_CMD_WASK {
 			// ready to send back IKCP_CMD_WINS in Ikcp_flush
@@ -607,6 +868,8 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 			kcp.probe |= IKCP_ASK_TELL
 		} else if cmd == IKCP_CMD_WINS {
 			// do nothing
+		} else if cmd == IKCP_CMD_ECE {
+			kcp.congested()
 		} else {
 			return -3
 		}
@@ -615,42 +878,37 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 		data = data[length:]
 	}
 	atomic.AddUint64(&DefaultSnmp.InSegs, inSegs)
+	atomic.AddUint64(&kcp.snmp.InSegs, inSegs)
+	if repeatSegs > 0 {
+		atomic.AddUint64(&DefaultSnmp.RepeatSegs, repeatSegs)
+		atomic.AddUint64(&kcp.snmp.RepeatSegs, repeatSegs)
+	}
+	if outOfWindowSegs > 0 {
+		atomic.AddUint64(&DefaultSnmp.OutOfWindow, outOfWindowSegs)
+		atomic.AddUint64(&kcp.snmp.OutOfWindow, outOfWindowSegs)
+	}
+	if rcvLimitSegs > 0 {
+		atomic.AddUint64(&DefaultSnmp.RcvLimitDrops, rcvLimitSegs)
+		atomic.AddUint64(&kcp.snmp.RcvLimitDrops, rcvLimitSegs)
+	}
 
 	// update rtt with the latest ts
 	// ignore the FEC packet
 	if flag != 0 && regular {
-		current := currentMs()
+		current := kcp.now()
 		if _itimediff(current, latest) >= 0 {
-			kcp.update_ack(_itimediff(current, latest))
+			rtt = _itimediff(current, latest)
+			kcp.update_ack(rtt)
 		}
 	}
 
 	// cwnd update when packet arrived
 	if kcp.nocwnd == 0 {
 		if _itimediff(kcp.snd_una, snd_una) > 0 {
-			if kcp.cwnd < kcp.rmt_wnd {
-				mss := kcp.mss
-				if kcp.cwnd < kcp.ssthresh {
-					kcp.cwnd++
-					kcp.incr += mss
-				} else {
-					if kcp.incr < mss {
-						kcp.incr = mss
-					}
-					kcp.incr += (mss*mss)/kcp.incr + (mss / 16)
-					if (kcp.cwnd+1)*mss <= kcp.incr {
-						if mss > 0 {
-							kcp.cwnd = (kcp.incr + mss - 1) / mss
-						} else {
-							kcp.cwnd = kcp.incr + mss - 1
-						}
-					}
-				}
-				if kcp.cwnd > kcp.rmt_wnd {
-					kcp.cwnd = kcp.rmt_wnd
-					kcp.incr = kcp.rmt_wnd * mss
-				}
+			if rtt == 0 {
+				rtt = kcp.rx_srtt
 			}
+			kcp.cc.OnAck(time.Duration(rtt)*time.Millisecond, kcp.snd_una-snd_una)
 		}
 	}
 
@@ -662,13 +920,132 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 	return 0
 }
 
+// congested takes the congestion experienced by the remote as a loss without
+// retransmission, at most once per RTT like TCP does.
+func (kcp *KCP) congested() {
+	current := kcp.now()
+	if kcp.ts_ece != 0 && _itimediff(current, kcp.ts_ece) < kcp.rx_srtt {
+		return
+	}
+	kcp.ts_ece = current
+	if kcp.nocwnd == 0 {
+		kcp.cc.OnLoss(0, 1)
+	}
+}
+
+// mtuProbe encodes a data segment filling 'buf' as an MTU probe, its sequence
+// number has long been acknowledged, so the remote discards the data and acks it.
+func (kcp *KCP) mtuProbe(buf []byte) {
+	var seg segment
+	seg.conv = kcp.conv
+	seg.cmd = IKCP_CMD_PUSH
+	seg.wnd = kcp.wnd_unused()
+	seg.ts = kcp.now()
+	seg.sn = kcp.snd_una - 0x40000000
+	seg.una = kcp.rcv_nxt
+	seg.data = buf[kcp.overhead:]
+
+	padding := seg.encode(buf, kcp.noconv)
+	for k := range padding {
+		padding[k] = 0
+	}
+	kcp.pmtu_sn, kcp.pmtu_ts = seg.sn, seg.ts
+	kcp.pmtu_state = 1
+}
+
+// pathChallenge encodes a data segment without data into 'buf' as a path challenge,
+// which the remote acks like an MTU probe.
+func (kcp *KCP) pathChallenge(buf []byte) {
+	var seg segment
+	seg.conv = kcp.conv
+	seg.cmd = IKCP_CMD_PUSH
+	seg.wnd = kcp.wnd_unused()
+	seg.ts = kcp.now()
+	seg.sn = kcp.snd_una - 0x60000000
+	seg.una = kcp.rcv_nxt
+	seg.encode(buf, kcp.noconv)
+	kcp.path_sn, kcp.path_ts = seg.sn, seg.ts
+	kcp.path_state = 1
+}
+
+// datagram encodes a segment carrying 'p' as an unreliable datagram into 'buf',
+// it takes no sequence number, and returns the size of the segment.
+func (kcp *KCP) datagram(buf, p []byte) int {
+	var seg segment
+	seg.conv = kcp.conv
+	seg.cmd = IKCP_CMD_DGRAM
+	seg.wnd = kcp.wnd_unused()
+	seg.ts = kcp.now()
+	seg.una = kcp.rcv_nxt
+	seg.data = p
+	seg.encode(buf, kcp.noconv)
+	return kcp.overhead + copy(buf[kcp.overhead:], p)
+}
+
+// inputDatagram queues a datagram received, dropped if the queue is full
+func (kcp *KCP) inputDatagram(p []byte) {
+	if len(kcp.dgrams) >= dgramQueue {
+		atomic.AddUint64(&DefaultSnmp.DgramDrops, 1)
+		atomic.AddUint64(&kcp.snmp.DgramDrops, 1)
+		return
+	}
+	kcp.dgrams = append(kcp.dgrams, append([]byte(nil), p...))
+	atomic.AddUint64(&DefaultSnmp.InDgrams, 1)
+	atomic.AddUint64(&kcp.snmp.InDgrams, 1)
+}
+
 func (kcp *KCP) wnd_unused() uint16 {
 	if len(kcp.rcv_queue) < int(kcp.rcv_wnd) {
-		return uint16(int(kcp.rcv_wnd) - len(kcp.rcv_queue))
+		wnd := int(kcp.rcv_wnd) - len(kcp.rcv_queue)
+		if kcp.rcv_limit > 0 { // shrinks with the bytes held
+			if free := (kcp.rcv_limit - kcp.rcv_bytes) / int(kcp.mss); free < wnd {
+				wnd = free
+			}
+			if wnd < 0 {
+				wnd = 0
+			}
+		}
+		return uint16(wnd)
 	}
 	return 0
 }
 
+// rcvAdmit returns false if the data of segment 'sn' exceeds rcv_limit. The room
+// of a segment is kept for rcv_nxt, so the data out of order never blocks the
+// data in order.
+func (kcp *KCP) rcvAdmit(sn uint32, length int) bool {
+	if kcp.rcv_limit <= 0 || _itimediff(sn, kcp.rcv_nxt) < 0 {
+		return true
+	}
+	limit := kcp.rcv_limit
+	if sn != kcp.rcv_nxt {
+		limit -= int(kcp.mss)
+	}
+	if kcp.rcv_bytes+length <= limit {
+		return true
+	}
+	for k := range kcp.rcv_buf { // the repeated data takes no room
+		if kcp.rcv_buf[k].sn == sn {
+			return true
+		}
+	}
+	return false
+}
+
+// tellWindow outputs a standalone segment telling the window size
+func (kcp *KCP) tellWindow() {
+	var seg segment
+	seg.conv = kcp.conv
+	seg.cmd = IKCP_CMD_WINS
+	seg.wnd = kcp.wnd_unused()
+	seg.una = kcp.rcv_nxt
+
+	ptr := seg.encode(kcp.buffer[kcp.reserved:], kcp.noconv)
+	kcp.output(kcp.buffer, len(kcp.buffer)-len(ptr))
+	atomic.AddUint64(&DefaultSnmp.OutSegs, 1)
+	atomic.AddUint64(&kcp.snmp.OutSegs, 1)
+}
+
 // flush pending data
 func (kcp *KCP) flush(ackOnly bool) uint32 {
 	var seg segment
@@ -698,24 +1075,30 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	}
 
 	// flush acknowledges
+	var outSegs uint64
 	for i, ack := range kcp.acklist {
-		makeSpace(IKCP_OVERHEAD)
-		// filter jitters caused by bufferbloat
-		if _itimediff(ack.sn, kcp.rcv_nxt) >= 0 || len(kcp.acklist)-1 == i {
+		makeSpace(kcp.overhead)
+		// filter jitters caused by bufferbloat, but not the probes far behind the window
+		if _itimediff(ack.sn, kcp.rcv_nxt) >= 0 || _itimediff(ack.sn, kcp.rcv_nxt-kcp.rcv_wnd) < 0 || len(kcp.acklist)-1 == i {
 			seg.sn, seg.ts = ack.sn, ack.ts
-			ptr = seg.encode(ptr)
+			ptr = seg.encode(ptr, kcp.noconv)
+			outSegs++
 		}
 	}
 	kcp.acklist = kcp.acklist[0:0]
 
 	if ackOnly { // flash remain ack segments
 		flushBuffer()
+		if outSegs > 0 {
+			atomic.AddUint64(&DefaultSnmp.OutSegs, outSegs)
+			atomic.AddUint64(&kcp.snmp.OutSegs, outSegs)
+		}
 		return kcp.interval
 	}
 
 	// probe window size (if remote window size equals zero)
 	if kcp.rmt_wnd == 0 {
-		current := currentMs()
+		current := kcp.now()
 		if kcp.probe_wait == 0 {
 			kcp.probe_wait = IKCP_PROBE_INIT
 			kcp.ts_probe = current + kcp.probe_wait
@@ -740,15 +1123,25 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	// flush window probing commands
 	if (kcp.probe & IKCP_ASK_SEND) != 0 {
 		seg.cmd = IKCP_CMD_WASK
-		makeSpace(IKCP_OVERHEAD)
-		ptr = seg.encode(ptr)
+		makeSpace(kcp.overhead)
+		ptr = seg.encode(ptr, kcp.noconv)
+		outSegs++
 	}
 
 	// flush window probing commands
 	if (kcp.probe & IKCP_ASK_TELL) != 0 {
 		seg.cmd = IKCP_CMD_WINS
-		makeSpace(IKCP_OVERHEAD)
-		ptr = seg.encode(ptr)
+		makeSpace(kcp.overhead)
+		ptr = seg.encode(ptr, kcp.noconv)
+		outSegs++
+	}
+
+	// flush congestion experienced echo
+	if (kcp.probe & IKCP_ASK_ECE) != 0 {
+		seg.cmd = IKCP_CMD_ECE
+		makeSpace(kcp.overhead)
+		ptr = seg.encode(ptr, kcp.noconv)
+		outSegs++
 	}
 
 	kcp.probe = 0
@@ -756,7 +1149,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	// calculate window size
 	cwnd := _imin_(kcp.snd_wnd, kcp.rmt_wnd)
 	if kcp.nocwnd == 0 {
-		cwnd = _imin_(kcp.cwnd, cwnd)
+		cwnd = _imin_(kcp.cc.Window(), cwnd)
 	}
 
 	// sliding window, controlled by snd_nxt && sna_una+cwnd
@@ -767,7 +1160,9 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		}
 		newseg := kcp.snd_queue[k]
 		newseg.conv = kcp.conv
-		newseg.cmd = IKCP_CMD_PUSH
+		if newseg.cmd != IKCP_CMD_FIN {
+			newseg.cmd = IKCP_CMD_PUSH
+		}
 		newseg.sn = kcp.snd_nxt
 		kcp.snd_buf = append(kcp.snd_buf, newseg)
 		kcp.snd_nxt++
@@ -784,11 +1179,37 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	}
 
 	// check for retransmissions
-	current := currentMs()
-	var change, lostSegs, fastRetransSegs, earlyRetransSegs uint64
+	current := kcp.now()
+	var change, lostSegs, fastRetransSegs, earlyRetransSegs, tlpSegs uint64
 	minrto := int32(kcp.interval)
 
 	ref := kcp.snd_buf[:len(kcp.snd_buf)] // for bounds check elimination
+
+	// tail loss probe, nothing new is sent to have the tail acknowledged and
+	// retransmitted early if lost
+	tail, pto := -1, int32(0)
+	if kcp.tlp != 0 && newSegsCount == 0 && kcp.rx_srtt > 0 {
+		for k := len(ref) - 1; k >= 0; k-- {
+			if ref[k].acked == 0 {
+				if ref[k].xmit > 0 && (!kcp.tlp_sent || ref[k].sn != kcp.tlp_sn) {
+					tail = k
+				}
+				break
+			}
+		}
+		pto = kcp.rx_srtt * 3 / 2
+		if pto < int32(kcp.interval) {
+			pto = int32(kcp.interval)
+		}
+	}
+
+	// RACK, the segments sent before the latest one acknowledged are lost once
+	// they're unacknowledged for SRTT plus the reordering window
+	rack, reo := kcp.rack != 0 && kcp.rack_acked, int32(0)
+	if rack {
+		reo = kcp.rx_srtt + kcp.rackWindow()
+	}
+
 	for k := range ref {
 		segment := &ref[k]
 		needsend := false
@@ -799,14 +1220,21 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 			needsend = true
 			segment.rto = kcp.rx_rto
 			segment.resendts = current + segment.rto
-		} else if segment.fastack >= resent { // fast retransmit
+		} else if rack && kcp.rackSentBefore(segment) && _itimediff(current, segment.ts+uint32(reo)) >= 0 { // time-based fast retransmit
+			needsend = true
+			segment.fastack = 0
+			segment.rto = kcp.rx_rto
+			segment.resendts = current + segment.rto
+			change++
+			fastRetransSegs++
+		} else if kcp.rack == 0 && segment.fastack >= resent && kcp.fastAllowed(segment) { // fast retransmit
 			needsend = true
 			segment.fastack = 0
 			segment.rto = kcp.rx_rto
 			segment.resendts = current + segment.rto
 			change++
 			fastRetransSegs++
-		} else if segment.fastack > 0 && newSegsCount == 0 { // early retransmit
+		} else if kcp.rack == 0 && segment.fastack > 0 && newSegsCount == 0 && kcp.fastAllowed(segment) { // early retransmit
 			needsend = true
 			segment.fastack = 0
 			segment.rto = kcp.rx_rto
@@ -823,20 +1251,25 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 			segment.fastack = 0
 			segment.resendts = current + segment.rto
 			lostSegs++
+		} else if k == tail && _itimediff(current, segment.ts+uint32(pto)) >= 0 { // tail loss probe
+			needsend = true
+			kcp.tlp_sn, kcp.tlp_sent = segment.sn, true
+			tlpSegs++
 		}
 
 		if needsend {
-			current = currentMs()
+			current = kcp.now()
 			segment.xmit++
 			segment.ts = current
 			segment.wnd = seg.wnd
 			segment.una = seg.una
 
-			need := IKCP_OVERHEAD + len(segment.data)
+			need := kcp.overhead + len(segment.data)
 			makeSpace(need)
-			ptr = segment.encode(ptr)
+			ptr = segment.encode(ptr, kcp.noconv)
 			copy(ptr, segment.data)
 			ptr = ptr[len(segment.data):]
+			outSegs++
 
 			if segment.xmit >= kcp.dead_link {
 				kcp.state = 0xFFFFFFFF
@@ -847,50 +1280,55 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		if rto := _itimediff(segment.resendts, current); rto > 0 && rto < minrto {
 			minrto = rto
 		}
+		if rack && !needsend && segment.acked == 0 && kcp.rackSentBefore(segment) {
+			if lost := _itimediff(segment.ts+uint32(reo), current); lost > 0 && lost < minrto {
+				minrto = lost
+			}
+		}
+		if k == tail && !needsend {
+			if probe := _itimediff(segment.ts+uint32(pto), current); probe > 0 && probe < minrto {
+				minrto = probe
+			}
+		}
 	}
 
 	// flash remain segments
 	flushBuffer()
 
 	// counter updates
+	if outSegs > 0 {
+		atomic.AddUint64(&DefaultSnmp.OutSegs, outSegs)
+		atomic.AddUint64(&kcp.snmp.OutSegs, outSegs)
+	}
 	sum := lostSegs
 	if lostSegs > 0 {
 		atomic.AddUint64(&DefaultSnmp.LostSegs, lostSegs)
+		atomic.AddUint64(&kcp.snmp.LostSegs, lostSegs)
 	}
 	if fastRetransSegs > 0 {
 		atomic.AddUint64(&DefaultSnmp.FastRetransSegs, fastRetransSegs)
+		atomic.AddUint64(&kcp.snmp.FastRetransSegs, fastRetransSegs)
 		sum += fastRetransSegs
 	}
 	if earlyRetransSegs > 0 {
 		atomic.AddUint64(&DefaultSnmp.EarlyRetransSegs, earlyRetransSegs)
+		atomic.AddUint64(&kcp.snmp.EarlyRetransSegs, earlyRetransSegs)
 		sum += earlyRetransSegs
 	}
+	if tlpSegs > 0 {
+		atomic.AddUint64(&DefaultSnmp.TLPSegs, tlpSegs)
+		atomic.AddUint64(&kcp.snmp.TLPSegs, tlpSegs)
+		sum += tlpSegs
+	}
 	if sum > 0 {
 		atomic.AddUint64(&DefaultSnmp.RetransSegs, sum)
+		atomic.AddUint64(&kcp.snmp.RetransSegs, sum)
 	}
 
 	// cwnd update
 	if kcp.nocwnd == 0 {
-		// update ssthresh
-		// rate halving, https://tools.ietf.org/html/rfc6937
-		if change > 0 {
-			inflight := kcp.snd_nxt - kcp.snd_una
-			kcp.ssthresh = inflight / 2
-			if kcp.ssthresh < IKCP_THRESH_MIN {
-				kcp.ssthresh = IKCP_THRESH_MIN
-			}
-			kcp.cwnd = kcp.ssthresh + resent
-			kcp.incr = kcp.cwnd * kcp.mss
-		}
-
-		// congestion control, https://tools.ietf.org/html/rfc5681
-		if lostSegs > 0 {
-			kcp.ssthresh = cwnd / 2
-			if kcp.ssthresh < IKCP_THRESH_MIN {
-				kcp.ssthresh = IKCP_THRESH_MIN
-			}
-			kcp.cwnd = 1
-			kcp.incr = kcp.mss
+		if change > 0 || lostSegs > 0 {
+			kcp.cc.OnLoss(uint32(lostSegs), uint32(change))
 		}
 
 		if kcp.cwnd < 1 {
@@ -910,7 +1348,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 func (kcp *KCP) Update() {
 	var slap int32
 
-	current := currentMs()
+	current := kcp.now()
 	if kcp.updated == 0 {
 		kcp.updated = 1
 		kcp.ts_flush = current
@@ -942,7 +1380,7 @@ func (kcp *KCP) Update() {
 // schedule ikcp_update (eg. implementing an epoll-like mechanism,
 // or optimize ikcp_update when handling massive kcp connections)
 func (kcp *KCP) Check() uint32 {
-	current := currentMs()
+	current := kcp.now()
 	ts_flush := kcp.ts_flush
 	tm_flush := int32(0x7fffffff)
 	tm_packet := int32(0x7fffffff)
@@ -986,23 +1424,59 @@ func (kcp *KCP) Check() uint32 {
 
 // SetMtu changes MTU size, default is 1400
 func (kcp *KCP) SetMtu(mtu int) int {
-	if mtu < 50 || mtu < IKCP_OVERHEAD {
+	if mtu < 50 || mtu < kcp.overhead {
 		return -1
 	}
-	if kcp.reserved >= int(kcp.mtu-IKCP_OVERHEAD) || kcp.reserved < 0 {
+	if kcp.reserved >= int(kcp.mtu)-kcp.overhead || kcp.reserved < 0 {
 		return -1
 	}
 
-	buffer := make([]byte, mtu)
-	if buffer == nil {
-		return -2
+	// the segments sent at a larger MTU are retransmitted as they are
+	if mtu > len(kcp.buffer) {
+		kcp.buffer = make([]byte, mtu)
 	}
 	kcp.mtu = uint32(mtu)
-	kcp.mss = kcp.mtu - IKCP_OVERHEAD - uint32(kcp.reserved)
-	kcp.buffer = buffer
+	kcp.mss = kcp.mtu - uint32(kcp.overhead+kcp.reserved)
+	if kcp.stream != 0 {
+		kcp.resegment()
+	}
 	return 0
 }
 
+// resegment splits the segments in the send queue larger than mss in stream mode
+func (kcp *KCP) resegment() {
+	mss := int(kcp.mss)
+	n := 0
+	for k := range kcp.snd_queue {
+		if len(kcp.snd_queue[k].data) > mss {
+			n += (len(kcp.snd_queue[k].data) + mss - 1) / mss
+		} else {
+			n++
+		}
+	}
+	if n == len(kcp.snd_queue) {
+		return
+	}
+
+	queue := make([]segment, 0, n)
+	for k := range kcp.snd_queue {
+		seg := &kcp.snd_queue[k]
+		if len(seg.data) <= mss {
+			queue = append(queue, *seg)
+			continue
+		}
+		for data := seg.data; len(data) > 0; {
+			size := _imin_(uint32(len(data)), uint32(mss))
+			part := kcp.newSegment(int(size))
+			copy(part.data, data[:size])
+			queue = append(queue, part)
+			data = data[size:]
+		}
+		kcp.delSegment(seg)
+	}
+	kcp.snd_queue = queue
+}
+
 // NoDelay options
 // fastest: ikcp_nodelay(kcp, 1, 20, 2, 1)
 // nodelay: 0:disable(default), 1:enable
@@ -1051,11 +1525,25 @@ func (kcp *KCP) WaitSnd() int {
 	return len(kcp.snd_buf) + len(kcp.snd_queue)
 }
 
+// WaitRcv gets how many segments are received but not read yet, including the
+// ones out of order
+func (kcp *KCP) WaitRcv() int {
+	return len(kcp.rcv_queue) + len(kcp.rcv_buf)
+}
+
+// WaitSndBytes gets how many bytes of data is waiting to be sent or acknowledged
+func (kcp *KCP) WaitSndBytes() int {
+	return kcp.snd_bytes
+}
+
 // remove front n elements from queue
 // if the number of elements to remove is more than half of the size.
 // just shift the rear elements to front, otherwise just reslice q to q[n:]
 // then the cost of runtime.growslice can always be less than n/2
 func (kcp *KCP) remove_front(q []segment, n int) []segment {
+	if n == len(q) { // keep the capacity from the front for the appends
+		return q[:0]
+	}
 	if n > cap(q)/2 {
 		newn := copy(q, q[n:])
 		return q[:newn]
@@ -1066,15 +1554,12 @@ func (kcp *KCP) remove_front(q []segment, n int) []segment {
 // Release all cached outgoing segments
 func (kcp *KCP) ReleaseTX() {
 	for k := range kcp.snd_queue {
-		if kcp.snd_queue[k].data != nil {
-			xmitBuf.Put(kcp.snd_queue[k].data)
-		}
+		kcp.delSegment(&kcp.snd_queue[k])
 	}
 	for k := range kcp.snd_buf {
-		if kcp.snd_buf[k].data != nil {
-			xmitBuf.Put(kcp.snd_buf[k].data)
-		}
+		kcp.delSegment(&kcp.snd_buf[k])
 	}
 	kcp.snd_queue = nil
 	kcp.snd_buf = nil
+	kcp.snd_bytes = 0
 }
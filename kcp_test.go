@@ -1,7 +1,10 @@
 package kcp
 
 import (
+	"bytes"
+	"encoding/binary"
 	"io"
+	"math/rand"
 	"net"
 	"sync"
 	"testing"
@@ -133,3 +136,514 @@ func BenchmarkFlush(b *testing.B) {
 		mu.Unlock()
 	}
 }
+
+// packetQueue holds the packets output by a KCP until delivered, reusing their memory
+type packetQueue struct {
+	pkts [][]byte
+	n    int
+}
+
+func (q *packetQueue) output(buf []byte, size int) {
+	if q.n == len(q.pkts) {
+		q.pkts = append(q.pkts, nil)
+	}
+	q.pkts[q.n] = append(q.pkts[q.n][:0], buf[:size]...)
+	q.n++
+}
+
+func (q *packetQueue) deliver(to *KCP) {
+	for k := 0; k < q.n; k++ {
+		to.Input(q.pkts[k], true, false)
+	}
+	q.n = 0
+}
+
+// BenchmarkSegmentRoundTrip moves a segment from a sender to a receiver and its
+// ack back per op, the segments and their buffers are recycled
+func BenchmarkSegmentRoundTrip(b *testing.B) {
+	var toReceiver, toSender packetQueue
+	sender, receiver := NewKCP(1, toReceiver.output), NewKCP(1, toSender.output)
+	for _, kcp := range []*KCP{sender, receiver} {
+		kcp.NoDelay(1, 10, 2, 1)
+		kcp.WndSize(1024, 1024)
+	}
+
+	data := make([]byte, sender.mss)
+	buf := make([]byte, sender.mss)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sender.Send(data)
+		sender.flush(false)
+		toReceiver.deliver(receiver)
+		receiver.Recv(buf)
+		receiver.flush(false)
+		toSender.deliver(sender)
+	}
+}
+
+func TestLossControllerWindow(t *testing.T) {
+	// reading the window leaves it alone, it opens by the flush
+	kcp := NewKCP(1, func(buf []byte, size int) {})
+	for i := 0; i < 2; i++ {
+		if w := kcp.cc.Window(); w != 0 || kcp.cwnd != 0 {
+			t.Fatal("window changed by reading", w, kcp.cwnd)
+		}
+	}
+	kcp.flush(false)
+	if w := kcp.cc.Window(); w != 1 {
+		t.Fatal("window not opened by the flush", w)
+	}
+}
+
+func TestBBRController(t *testing.T) {
+	// a link of 1000 segments per second, and 50ms RTT
+	const rate, rtt = 1000, 50 * time.Millisecond
+	now := time.Unix(0, 0)
+	cc := NewBBRController()
+	cc.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		// a round delivers the window up to the link capacity
+		acked := cc.Window()
+		if acked > rate*uint32(rtt/time.Millisecond)/1000 {
+			acked = rate * uint32(rtt/time.Millisecond) / 1000
+		}
+		now = now.Add(rtt)
+		cc.OnAck(rtt, acked)
+		cc.OnLoss(1, 1) // random loss is ignored
+	}
+
+	if bw := cc.Bandwidth(); bw < rate*0.9 || bw > rate*1.1 {
+		t.Fatal("bandwidth estimate", bw)
+	}
+	if cc.MinRTT() != rtt {
+		t.Fatal("min RTT", cc.MinRTT())
+	}
+	if cc.startup {
+		t.Fatal("startup not finished")
+	}
+	if w := cc.Window(); w != 2*rate*uint32(rtt/time.Millisecond)/1000 {
+		t.Fatal("window not 2 BDP", w)
+	}
+}
+
+func TestReadBufferLimit(t *testing.T) {
+	var packets [][]byte
+	sender := NewKCP(1, func(buf []byte, size int) {
+		packets = append(packets, append([]byte(nil), buf[:size]...))
+	})
+	sender.NoDelay(1, 10, 0, 1)
+	sender.WndSize(1024, 1024)
+	sender.rmt_wnd = 1024
+
+	const limit = 16
+	receiver := NewKCP(1, func(buf []byte, size int) {})
+	receiver.WndSize(1024, 1024)
+	receiver.rcv_limit = limit * int(receiver.mss)
+
+	// each packet takes a segment of mss bytes
+	data := make([]byte, sender.mss)
+	for i := 0; i < 512; i++ {
+		sender.Send(data)
+	}
+	sender.flush(false)
+	if len(packets) != 512 {
+		t.Fatal("packets", len(packets))
+	}
+
+	// all the data but the first segment, out of order
+	for _, p := range packets[1:] {
+		receiver.Input(p, true, false)
+		if receiver.rcv_bytes > receiver.rcv_limit-int(receiver.mss) {
+			t.Fatal("bytes held beyond the limit", receiver.rcv_bytes)
+		}
+	}
+	if n := len(receiver.rcv_buf); n != limit-1 {
+		t.Fatal("segments held", n)
+	}
+	if n := receiver.snmp.RcvLimitDrops; n != 512-limit {
+		t.Fatal("drops", n)
+	}
+	if n := len(receiver.acklist); n != limit-1 {
+		t.Fatal("the dropped segments acknowledged", n)
+	}
+	if wnd := receiver.wnd_unused(); wnd != 1 {
+		t.Fatal("window", wnd)
+	}
+
+	// the segment in order still gets in
+	receiver.Input(packets[0], true, false)
+	if n := len(receiver.rcv_queue); n != limit {
+		t.Fatal("segments in order", n)
+	}
+	if wnd := receiver.wnd_unused(); wnd != 0 {
+		t.Fatal("window", wnd)
+	}
+
+	buf := make([]byte, receiver.mss)
+	for i := 0; i < limit; i++ {
+		if n := receiver.Recv(buf); n != int(receiver.mss) {
+			t.Fatal("recv", n)
+		}
+	}
+	if receiver.rcv_bytes != 0 || receiver.wnd_unused() != limit {
+		t.Fatal("bytes not released", receiver.rcv_bytes, receiver.wnd_unused())
+	}
+	if receiver.probe&IKCP_ASK_TELL == 0 {
+		t.Fatal("reopened window not told")
+	}
+}
+
+func TestInitialWindow(t *testing.T) {
+	// the bytes delivered in the first second over a link of 100ms RTT
+	ramp := func(segments uint32) int {
+		client, err := lossyconn.NewLossyConn(0, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := lossyconn.NewLossyConn(0, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := ServeConn(nil, 0, 0, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		sess, err := NewConn2(server.LocalAddr(), nil, 0, 0, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Close()
+		sess.SetWindowSize(256, 256)
+		if segments > 0 {
+			sess.SetInitialWindow(segments)
+		}
+
+		start := time.Now()
+		sess.Write(make([]byte, 1<<20))
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		s.SetWindowSize(256, 256)
+		s.SetReadDeadline(start.Add(time.Second))
+		n := 0
+		buf := make([]byte, 65536)
+		for {
+			size, err := s.Read(buf)
+			if err != nil {
+				return n
+			}
+			n += size
+		}
+	}
+
+	slow, fast := ramp(0), ramp(64)
+	t.Log("first second:", slow, "bytes from 1 segment,", fast, "bytes from 64 segments")
+	if fast < 2*slow {
+		t.Fatal("no faster ramp-up", slow, fast)
+	}
+}
+
+// virtualLink connects two KCP state machines over an in-memory link dropping
+// packets at 'loss' or by 'drop', and delaying them by 'delay', driven by a ManualClock
+type virtualLink struct {
+	clock *ManualClock
+	rnd   *rand.Rand
+	loss  float64
+	delay time.Duration
+	drop  func(from *KCP) bool
+	extra func(from *KCP) time.Duration // more delay per packet, for reordering
+}
+
+// connect delivers the output of 'from' to 'to'
+func (l *virtualLink) connect(from, to *KCP, onInput func()) {
+	from.SetClock(l.clock)
+	from.output = func(buf []byte, size int) {
+		if l.rnd.Float64() < l.loss || (l.drop != nil && l.drop(from)) {
+			return
+		}
+		pkt := append([]byte(nil), buf[:size]...)
+		delay := l.delay
+		if l.extra != nil {
+			delay += l.extra(from)
+		}
+		l.clock.Put(func() {
+			to.Input(pkt, true, false)
+			onInput()
+		}, l.clock.Now().Add(delay))
+	}
+}
+
+// update updates 'kcp' every 10ms
+func (l *virtualLink) update(kcp *KCP) {
+	var update func()
+	update = func() {
+		kcp.Update()
+		l.clock.Put(update, l.clock.Now().Add(10*time.Millisecond))
+	}
+	l.clock.Put(update, l.clock.Now())
+}
+
+// run transfers 'data' from a sender to a receiver updated every 10ms, it
+// returns the data received, the virtual time taken and the retransmissions
+func (l *virtualLink) run(data []byte) ([]byte, time.Duration, uint64) {
+	sender, receiver := NewKCP(1, nil), NewKCP(1, nil)
+	for _, kcp := range []*KCP{sender, receiver} {
+		kcp.NoDelay(0, 10, 0, 0)
+		kcp.WndSize(128, 128)
+	}
+
+	var received []byte
+	buf := make([]byte, 1<<16)
+	l.connect(sender, receiver, func() {
+		for {
+			n := receiver.Recv(buf)
+			if n <= 0 {
+				return
+			}
+			received = append(received, buf[:n]...)
+		}
+	})
+	l.connect(receiver, sender, func() {})
+
+	l.update(sender)
+	l.update(receiver)
+
+	start, total := l.clock.Now(), len(data)
+	for len(received) < total && l.clock.Now().Sub(start) < time.Hour {
+		for len(data) > 0 && sender.WaitSnd() < 256 {
+			n := int(sender.mss)
+			if n > len(data) {
+				n = len(data)
+			}
+			sender.Send(data[:n])
+			data = data[n:]
+		}
+		l.clock.Advance(10 * time.Millisecond)
+	}
+	return received, l.clock.Now().Sub(start), sender.snmp.RetransSegs
+}
+
+func TestVirtualClock(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	transfer := func() (time.Duration, uint64) {
+		link := &virtualLink{
+			clock: NewManualClock(time.Now()),
+			rnd:   rand.New(rand.NewSource(1)),
+			loss:  0.2,
+			delay: 50 * time.Millisecond,
+		}
+		received, elapsed, retrans := link.run(data)
+		if !bytes.Equal(received, data) {
+			t.Fatal("data corrupted", len(received))
+		}
+		return elapsed, retrans
+	}
+
+	start := time.Now()
+	elapsed, retrans := transfer()
+	wall := time.Since(start)
+	t.Log("virtual:", elapsed, "wall:", wall, "retransmissions:", retrans)
+	if retrans == 0 || elapsed < 10*time.Second || wall > elapsed/2 {
+		t.Fatal("not a long lossy transfer in short time", elapsed, wall, retrans)
+	}
+
+	// deterministic
+	if elapsed2, retrans2 := transfer(); elapsed2 != elapsed || retrans2 != retrans {
+		t.Fatal("not deterministic", elapsed, elapsed2, retrans, retrans2)
+	}
+}
+
+func TestTailLossProbe(t *testing.T) {
+	// the time to deliver a request whose last segment is lost
+	request := func(tlp bool) (time.Duration, uint64) {
+		link := &virtualLink{
+			clock: NewManualClock(time.Now()),
+			rnd:   rand.New(rand.NewSource(1)),
+			delay: 20 * time.Millisecond,
+		}
+		sender, receiver := NewKCP(1, nil), NewKCP(1, nil)
+		sender.NoDelay(0, 10, 0, 1)
+		receiver.NoDelay(0, 10, 0, 1)
+		if tlp {
+			sender.tlp = 1
+		}
+		var received int
+		buf := make([]byte, 1<<16)
+		link.connect(sender, receiver, func() {
+			for n := receiver.Recv(buf); n > 0; n = receiver.Recv(buf) {
+				received += n
+			}
+		})
+		link.connect(receiver, sender, func() {})
+		link.update(sender)
+		link.update(receiver)
+
+		// a round trip for the RTT
+		sender.Send([]byte{1})
+		link.clock.Advance(time.Second)
+
+		// the 3rd packet of the request is lost
+		var sent int
+		link.drop = func(from *KCP) bool {
+			if from == sender {
+				sent++
+				return sent == 3
+			}
+			return false
+		}
+		mss := int(sender.mss)
+		sender.Send(make([]byte, 3*mss))
+		start := link.clock.Now()
+		for received < 1+3*mss {
+			link.clock.Advance(time.Millisecond)
+		}
+		return link.clock.Now().Sub(start), sender.snmp.TLPSegs
+	}
+
+	rto, probes := request(false)
+	if probes != 0 {
+		t.Fatal("probes sent while disabled", probes)
+	}
+	tlp, probes := request(true)
+	t.Log("tail lost:", rto, "by RTO,", tlp, "by TLP")
+	if probes != 1 || tlp >= rto {
+		t.Fatal("tail not probed ahead of the RTO", probes, tlp, rto)
+	}
+}
+
+func TestRACK(t *testing.T) {
+	// a transfer over a link reordering every 4th packet of the sender by
+	// 'reorder', and dropping every 50th of the first 200, not the tail
+	transfer := func(rack bool, reorder time.Duration) *Snmp {
+		link := &virtualLink{
+			clock: NewManualClock(time.Now()),
+			rnd:   rand.New(rand.NewSource(1)),
+			delay: 20 * time.Millisecond,
+		}
+		sender, receiver := NewKCP(1, nil), NewKCP(1, nil)
+		for _, kcp := range []*KCP{sender, receiver} {
+			kcp.NoDelay(1, 10, 2, 1)
+			kcp.WndSize(128, 128)
+		}
+		if rack {
+			sender.rack = 1
+		}
+		var sent int
+		link.drop = func(from *KCP) bool {
+			if from == sender {
+				sent++
+				return sent <= 200 && sent%50 == 0
+			}
+			return false
+		}
+		link.extra = func(from *KCP) time.Duration {
+			if from == sender && sent%4 == 0 {
+				return reorder
+			}
+			return 0
+		}
+
+		var received int
+		buf := make([]byte, 1<<16)
+		link.connect(sender, receiver, func() {
+			for n := receiver.Recv(buf); n > 0; n = receiver.Recv(buf) {
+				received += n
+			}
+		})
+		link.connect(receiver, sender, func() {})
+		link.update(sender)
+		link.update(receiver)
+
+		total := 256 * int(sender.mss)
+		for k := 0; k < 256; k++ {
+			sender.Send(make([]byte, sender.mss))
+		}
+		for received < total {
+			link.clock.Advance(time.Millisecond)
+		}
+		return sender.snmp
+	}
+
+	// the dupack counting retransmits the reordered segments spuriously, RACK
+	// waits for them within the reordering window
+	dupack, racked := transfer(false, 15*time.Millisecond), transfer(true, 15*time.Millisecond)
+	t.Log("reordered, dupacks:", dupack.FastRetransSegs+dupack.EarlyRetransSegs, "RACK:", racked.FastRetransSegs)
+	if racked.FastRetransSegs >= dupack.FastRetransSegs+dupack.EarlyRetransSegs {
+		t.Fatal("no fewer spurious retransmissions")
+	}
+
+	// the losses are still recovered ahead of the RTO
+	racked = transfer(true, 0)
+	t.Log("in order, RACK:", racked.FastRetransSegs, "RTO:", racked.LostSegs)
+	if racked.FastRetransSegs == 0 || racked.LostSegs != 0 {
+		t.Fatal("losses not detected by RACK", racked.FastRetransSegs, racked.LostSegs)
+	}
+}
+
+func TestFastRetransmitLimit(t *testing.T) {
+	// a transfer over a link losing the first 2 transmissions of segment 10, the
+	// fast retransmissions of a segment limited to 'limit' transmissions
+	transfer := func(limit int32) *Snmp {
+		link := &virtualLink{
+			clock: NewManualClock(time.Now()),
+			rnd:   rand.New(rand.NewSource(1)),
+			delay: 20 * time.Millisecond,
+		}
+		sender, receiver := NewKCP(1, nil), NewKCP(1, nil)
+		for _, kcp := range []*KCP{sender, receiver} {
+			kcp.NoDelay(1, 10, 2, 1)
+			kcp.WndSize(128, 128)
+		}
+		sender.fastlimit = limit
+
+		var received int
+		buf := make([]byte, 1<<16)
+		link.connect(sender, receiver, func() {
+			for n := receiver.Recv(buf); n > 0; n = receiver.Recv(buf) {
+				received += n
+			}
+		})
+		link.connect(receiver, sender, func() {})
+		var lost int
+		output := sender.output
+		sender.output = func(buf []byte, size int) {
+			for seg := buf[:size]; len(seg) >= IKCP_OVERHEAD; seg = seg[IKCP_OVERHEAD+binary.LittleEndian.Uint32(seg[20:]):] {
+				if seg[4] == IKCP_CMD_PUSH && binary.LittleEndian.Uint32(seg[12:]) == 10 && lost < 2 {
+					lost++
+					return
+				}
+			}
+			output(buf, size)
+		}
+		link.update(sender)
+		link.update(receiver)
+
+		total := 256 * int(sender.mss)
+		for k := 0; k < 256; k++ {
+			sender.Send(make([]byte, sender.mss))
+		}
+		for received < total {
+			link.clock.Advance(time.Millisecond)
+		}
+		return sender.snmp
+	}
+
+	// the fast retransmissions recover the segment on their own, or only once
+	// and the RTO takes over beyond the limit
+	unlimited, limited := transfer(0), transfer(1)
+	t.Log("unlimited, fast:", unlimited.FastRetransSegs+unlimited.EarlyRetransSegs, "RTO:", unlimited.LostSegs)
+	t.Log("limited, fast:", limited.FastRetransSegs+limited.EarlyRetransSegs, "RTO:", limited.LostSegs)
+	if unlimited.LostSegs != 0 {
+		t.Fatal("retransmitted by the RTO without a limit")
+	}
+	if limited.FastRetransSegs+limited.EarlyRetransSegs != 1 || limited.LostSegs == 0 {
+		t.Fatal("the fast retransmissions are not limited")
+	}
+}
@@ -0,0 +1,101 @@
+package kcp
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// the segments of a message at most, they are numbered by the 8-bit frg
+const maxFragments = 255
+
+// WriteMessage writes 'p' as one message, its segments are marked with fragment
+// numbers, so the remote ReadMessage returns it whole. Unlike Write, which sends
+// the buffers beyond a segment as separate messages, the message may take up to
+// 255 segments, or ErrMessageTooLarge is returned, and the receive window of the
+// remote must hold all of them to reassemble it. Empty messages are not sent.
+//
+// It's not applicable in stream mode, see SetStreamMode.
+func (s *UDPSession) WriteMessage(p []byte) error {
+	s.mu.Lock()
+	stream := s.kcp.stream != 0
+	s.mu.Unlock()
+	if stream {
+		return errors.WithStack(ErrInvalidOperation)
+	}
+
+	_, err := s.write([][]byte{p}, true)
+	return err
+}
+
+// ReadMessage reads the next message into 'p' and returns its size. If the message
+// doesn't fit, it returns the size of the message with io.ErrShortBuffer and the
+// message is kept for the next read. The rest of a message partially read by Read
+// counts as a message.
+//
+// It's not applicable in stream mode, see SetStreamMode.
+func (s *UDPSession) ReadMessage(p []byte) (n int, err error) {
+	var timeout deadlineTimer
+	var c <-chan time.Time
+	var changed <-chan struct{}
+	defer timeout.stop()
+
+	for {
+		s.mu.Lock()
+		if s.kcp.stream != 0 {
+			s.mu.Unlock()
+			return 0, errors.WithStack(ErrInvalidOperation)
+		}
+		c, changed = timeout.reset(s.rd), s.rdChanged.wait()
+		if timeout.expired() {
+			s.mu.Unlock()
+			return 0, ErrTimeout
+		}
+
+		if len(s.bufptr) > 0 {
+			if len(p) < len(s.bufptr) {
+				n = len(s.bufptr)
+				s.mu.Unlock()
+				return n, io.ErrShortBuffer
+			}
+			n = copy(p, s.bufptr)
+			s.bufptr = s.bufptr[n:]
+			s.mu.Unlock()
+			atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(n))
+			atomic.AddUint64(&s.snmp.BytesReceived, uint64(n))
+			return n, nil
+		}
+
+		if size := s.kcp.PeekSize(); size > 0 {
+			if len(p) < size {
+				s.mu.Unlock()
+				return size, io.ErrShortBuffer
+			}
+			s.kcp.Recv(p)
+			s.mu.Unlock()
+			atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(size))
+			atomic.AddUint64(&s.snmp.BytesReceived, uint64(size))
+			return size, nil
+		}
+
+		if s.kcp.peekFin() { // remote has closed and all messages have been read
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+
+		s.mu.Unlock()
+
+		select {
+		case <-s.chReadEvent:
+		case <-changed:
+		case <-c:
+			return 0, ErrTimeout
+		case <-s.chSocketReadError:
+			return 0, s.socketReadError.Load().(error)
+		case <-s.die:
+			return 0, s.closedError()
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package kcp
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	migrationChallenge    = 2                      // Listener.migration with path challenges
+	pathChallengeInterval = 500 * time.Millisecond // the interval of resending a path challenge
+)
+
+// migrate feeds a packet of a known conv from a new address to its session, and
+// moves the session to the address, after the path challenge if required. It
+// returns false if no session has the conv.
+func (l *Listener) migrate(conv uint32, addr net.Addr, packet []byte, overhead int, ce bool) bool {
+	l.sessionLock.RLock()
+	s, ok := l.convs[conv]
+	l.sessionLock.RUnlock()
+	if !ok {
+		return false
+	}
+
+	// a replayed packet never migrates
+	data := s.replayFilter(packet)
+	if len(data) < overhead {
+		return true
+	}
+
+	// a packet resent from elsewhere is caught only by the replay protection, the
+	// sessions without it are challenged
+	if atomic.LoadInt32(&l.migration) == migrationChallenge || atomic.LoadInt32(&s.replay) == 0 {
+		s.mu.Lock()
+		if s.migrateAddr == nil || s.migrateAddr.String() != addr.String() {
+			s.migrateAddr = addr
+			s.sendPathChallenge()
+		} else if s.kcp.path_state == 1 && time.Since(s.migrateSent) >= pathChallengeInterval {
+			s.sendPathChallenge()
+		}
+		s.mu.Unlock()
+
+		if ce {
+			s.inputCE()
+		}
+		s.kcpInput(data) // the ack of the challenge may come with the packet
+
+		s.mu.Lock()
+		validated := s.migrateAddr != nil && s.migrateAddr.String() == addr.String() && s.kcp.path_state == 2
+		s.mu.Unlock()
+		if validated {
+			l.rebind(s, addr)
+		}
+		return true
+	}
+
+	l.rebind(s, addr)
+	if ce {
+		s.inputCE()
+	}
+	s.kcpInput(data)
+	return true
+}
+
+// authenticated returns if the packets opened by 'block' and 'auth' are proven to
+// come from a holder of the key, a precondition of the migration
+func authenticated(block BlockCrypt, auth PacketAuthenticator) bool {
+	if _, ok := block.(AEADCrypt); ok {
+		return true
+	}
+	return auth != nil
+}
+
+// rebind moves a session to the new remote address unless the hook vetoes it
+func (l *Listener) rebind(s *UDPSession, addr net.Addr) {
+	l.keyLock.Lock()
+	f := l.migrateHook
+	l.keyLock.Unlock()
+	if f != nil && !f(s, addr) {
+		s.mu.Lock()
+		s.migrateAddr = nil
+		s.kcp.path_state = 0
+		s.mu.Unlock()
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.migrateAddr = nil
+	s.kcp.path_state = 0
+	select {
+	case <-s.die:
+		return
+	default:
+	}
+
+	l.sessionLock.Lock()
+	defer l.sessionLock.Unlock()
+	if _, ok := l.sessions[addr.String()]; ok {
+		return
+	}
+	if l.sessions[s.remote.String()] == s {
+		delete(l.sessions, s.remote.String())
+	}
+	l.sessions[addr.String()] = s
+	s.remote = addr
+}
+
+// sendPathChallenge sends a path challenge to migrateAddr, the challenge is lost on errors
+func (s *UDPSession) sendPathChallenge() {
+	prefix := s.probeOffset()
+	buf := xmitBuf.Get(prefix + s.kcp.overhead)
+	s.kcp.pathChallenge(buf[prefix:])
+	s.rawFrame(buf, prefix)
+	s.seal(buf)
+	bts := s.wire(buf)
+	if _, err := s.conn.WriteTo(bts, s.migrateAddr); err == nil {
+		atomic.AddUint64(&DefaultSnmp.OutPkts, 1)
+		atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(len(bts)))
+		atomic.AddUint64(&s.snmp.OutPkts, 1)
+		atomic.AddUint64(&s.snmp.OutBytes, uint64(len(bts)))
+	}
+	xmitBuf.Put(buf)
+	xmitBuf.Put(bts)
+	s.migrateSent = time.Now()
+}
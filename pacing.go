@@ -0,0 +1,117 @@
+package kcp
+
+import (
+	"time"
+)
+
+const (
+	paceBurst = 10 * time.Millisecond // the duration of the bytes allowed to be sent at once by pacing
+	paceGain  = 1.25                  // the pacing rate derived from the window, in windows per RTT
+)
+
+// pacing returns true if the outgoing packets are paced
+func (s *UDPSession) pacing() bool {
+	return s.maxSendRate > 0 || s.autoPacing
+}
+
+// paceRate returns the pacing rate in bytes per second, 0 to send without pacing.
+// The automatic rate spreads the window over the smoothed RTT, bounded by maxSendRate.
+func (s *UDPSession) paceRate() int {
+	if !s.autoPacing || s.kcp.rx_srtt <= 0 {
+		return s.maxSendRate
+	}
+
+	cwnd := _imin_(s.kcp.snd_wnd, s.kcp.rmt_wnd)
+	if s.kcp.nocwnd == 0 {
+		cwnd = _imin_(s.kcp.cc.Window(), cwnd)
+	}
+	rate := int(paceGain * float64(cwnd*s.kcp.mtu) * 1000 / float64(s.kcp.rx_srtt))
+	if s.maxSendRate > 0 && rate > s.maxSendRate {
+		rate = s.maxSendRate
+	}
+	return rate
+}
+
+// isControl returns true if a KCP frame has no data segment nor datagram, such as the acks,
+// 'noconv' for the frames of the conv-less wire format
+func isControl(frame []byte, noconv bool) bool {
+	overhead, cmdOffset := IKCP_OVERHEAD, convSize
+	if noconv {
+		overhead, cmdOffset = IKCP_OVERHEAD-convSize, 0
+	}
+	for len(frame) >= overhead {
+		if cmd := frame[cmdOffset]; cmd == IKCP_CMD_PUSH || cmd == IKCP_CMD_FIN || cmd == IKCP_CMD_DGRAM {
+			return false
+		}
+		var length uint32
+		ikcp_decode32u(frame[overhead-4:], &length)
+		if uint64(length) > uint64(len(frame)-overhead) {
+			return false
+		}
+		frame = frame[overhead+int(length):]
+	}
+	return true
+}
+
+// pace sends the packets held back as long as the send rate allows, and schedules
+// a tick for the rest when the bytes of the next packet are allowed.
+func (s *UDPSession) pace() {
+	rate := s.paceRate()
+	if rate <= 0 {
+		s.releasePaced(true)
+		return
+	}
+
+	now := time.Now()
+	s.paceTokens += now.Sub(s.paceTime).Seconds() * float64(rate)
+	burst := float64(rate) * paceBurst.Seconds()
+	if burst < mtuLimit {
+		burst = mtuLimit
+	}
+	if s.paceTokens > burst {
+		s.paceTokens = burst
+	}
+	s.paceTime = now
+
+	n := 0
+	for n < len(s.paced) && float64(len(s.paced[n].Buffers[0])) <= s.paceTokens {
+		s.paceTokens -= float64(len(s.paced[n].Buffers[0]))
+		n++
+	}
+	if n > 0 {
+		s.tx(s.paced[:n])
+		for k := range s.paced[:n] {
+			xmitBuf.Put(s.paced[k].Buffers[0])
+			s.paced[k].Buffers = nil
+		}
+		rest := copy(s.paced, s.paced[n:])
+		s.paced = s.paced[:rest]
+	}
+
+	if len(s.paced) > 0 && !s.paceScheduled {
+		need := float64(len(s.paced[0].Buffers[0])) - s.paceTokens
+		wait := time.Duration(need / float64(rate) * float64(time.Second))
+		s.paceScheduled = true
+		s.sched.Put(s.paceTick, now.Add(wait))
+	}
+}
+
+// paceTick sends the packets held back by pacing on schedule
+func (s *UDPSession) paceTick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paceScheduled = false
+	s.pace()
+}
+
+// releasePaced sends or drops the packets held back by pacing
+func (s *UDPSession) releasePaced(send bool) {
+	if len(s.paced) > 0 && send {
+		s.tx(s.paced)
+	}
+	for k := range s.paced {
+		xmitBuf.Put(s.paced[k].Buffers[0])
+		s.paced[k].Buffers = nil
+	}
+	s.paced = s.paced[:0]
+}
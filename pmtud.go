@@ -0,0 +1,101 @@
+package kcp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pmtuMin      = 576              // the MTU falling back to if the current one has been lost
+	pmtuStep     = 16               // the precision of the search
+	pmtuRetries  = 3                // the transmissions of a probe before it's taken as too big
+	pmtuInterval = 10 * time.Minute // the interval of searching again for a larger MTU
+)
+
+// pmtuState is the binary search for the path MTU, between the confirmed MTU
+// and an upper bound, by the probes of the sizes in between
+type pmtuState struct {
+	lo, hi   int       // the confirmed MTU, and the upper bound of the search
+	verified bool      // the confirmed MTU has been probed in this search
+	size     int       // the size of the probe awaiting its ack, 0 for none
+	tries    int       // the transmissions of the probe
+	sent     time.Time // the latest transmission of the probe
+	next     time.Time // the next search
+}
+
+// pmtuUpdate advances the search, it's called by update.
+//
+// A probe is a data segment padded to the size, with the DF bit set on the socket.
+// It's sent aside the transmit queue and the window, so the data is never held by
+// it, and there is a single probe in flight at most, retransmitted after an RTO.
+func (s *UDPSession) pmtuUpdate() {
+	p := s.pmtu
+	now := time.Now()
+	switch s.kcp.pmtu_state {
+	case 2: // acknowledged
+		s.kcp.pmtu_state = 0
+		p.lo, p.verified, p.size = p.size, true, 0
+		s.kcp.SetMtu(p.lo)
+	case 1: // awaiting the ack
+		if now.Sub(p.sent) < time.Duration(s.kcp.rx_rto)*time.Millisecond {
+			return
+		}
+		if p.tries < pmtuRetries {
+			s.sendMtuProbe(p.size)
+			return
+		}
+
+		// too big, or the current MTU has been lost
+		s.kcp.pmtu_state = 0
+		if !p.verified {
+			p.lo, p.verified = pmtuMin, true
+			s.kcp.SetMtu(p.lo)
+		}
+		p.hi, p.size = p.size-1, 0
+	}
+
+	if now.Before(p.next) {
+		return
+	}
+	if !p.verified {
+		p.size, p.tries = p.lo, 0
+		s.sendMtuProbe(p.size)
+	} else if p.hi-p.lo >= pmtuStep {
+		p.size, p.tries = (p.lo+p.hi+1)/2, 0
+		s.sendMtuProbe(p.size)
+	} else { // found, and search again later
+		p.hi, p.verified = mtuLimit, false
+		p.next = now.Add(pmtuInterval)
+	}
+}
+
+// probeOffset returns the offset of the KCP frame in the probes, they go without FEC
+func (s *UDPSession) probeOffset() int {
+	prefix := s.headerSize - s.trailerSize - s.fecPad
+	if s.fecEncoder != nil {
+		prefix -= fecHeaderSizePlus2
+	}
+	return prefix
+}
+
+// sendMtuProbe sends an MTU probe of 'size' bytes on wire, the probe is lost on errors
+func (s *UDPSession) sendMtuProbe(size int) {
+	buf := xmitBuf.Get(size - s.trailerSize)
+	prefix := s.probeOffset()
+	s.kcp.mtuProbe(buf[prefix:])
+	s.rawFrame(buf, prefix)
+	s.seal(buf)
+	bts := s.wire(buf)
+	if _, err := s.writeTo(bts, s.remote); err == nil {
+		atomic.AddUint64(&DefaultSnmp.OutPkts, 1)
+		atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(len(bts)))
+		atomic.AddUint64(&s.snmp.OutPkts, 1)
+		atomic.AddUint64(&s.snmp.OutBytes, uint64(len(bts)))
+	}
+	xmitBuf.Put(buf)
+	xmitBuf.Put(bts)
+
+	p := s.pmtu
+	p.tries++
+	p.sent = time.Now()
+}
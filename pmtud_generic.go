@@ -0,0 +1,13 @@
+// +build !linux
+
+package kcp
+
+import "net"
+
+// setDontFragment supports the connections implementing SetDontFragment only
+func setDontFragment(conn net.PacketConn) error {
+	if df, ok := conn.(setDF); ok {
+		return df.SetDontFragment(true)
+	}
+	return ErrInvalidOperation
+}
@@ -0,0 +1,39 @@
+// +build linux
+
+package kcp
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDontFragment sets the DF bit on the packets of 'conn', regardless of the
+// path MTU known by the kernel
+func setDontFragment(conn net.PacketConn) error {
+	if df, ok := conn.(setDF); ok {
+		return df.SetDontFragment(true)
+	}
+
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return ErrInvalidOperation
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var succeed bool
+	rc.Control(func(fd uintptr) {
+		if syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE) == nil {
+			succeed = true
+		}
+		if syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE) == nil {
+			succeed = true
+		}
+	})
+	if !succeed {
+		return ErrInvalidOperation
+	}
+	return nil
+}
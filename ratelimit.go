@@ -0,0 +1,124 @@
+package kcp
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the source IPs tracked by the per-IP session rate at most, the new sessions from
+// the others are dropped until the idle ones expire
+const rateLimitIPs = 65536
+
+// tokenBucket admits 'rate' events per second, with bursts of up to a second of them
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket since the last call and takes a token if there is one
+func (b *tokenBucket) take(rate int, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+		if b.tokens > float64(rate) {
+			b.tokens = float64(rate)
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sessionLimiter limits the rate of the new sessions of a Listener, in total and
+// per source IP
+type sessionLimiter struct {
+	mu     sync.Mutex
+	rate   int // new sessions per second in total, 0 for unlimited
+	ipRate int // new sessions per second per source IP, 0 for unlimited
+	total  tokenBucket
+	ips    map[string]*tokenBucket
+}
+
+// admit takes the tokens for a new session from 'addr', the per-IP one first, so
+// a source beyond its own rate never drains the total one for the others
+func (sl *sessionLimiter) admit(addr net.Addr) bool {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if sl.rate <= 0 && sl.ipRate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	if sl.ipRate > 0 && !sl.admitIP(addr, now) {
+		return false
+	}
+	return sl.rate <= 0 || sl.total.take(sl.rate, now)
+}
+
+// admitIP takes the token of the source IP of 'addr', the unknown sources pass
+func (sl *sessionLimiter) admitIP(addr net.Addr, now time.Time) bool {
+	var ip net.IP
+	if udpaddr, ok := addr.(*net.UDPAddr); ok {
+		ip = udpaddr.IP.To16()
+	} else if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		ip = net.ParseIP(host).To16()
+	}
+	if ip == nil {
+		return true
+	}
+
+	b, ok := sl.ips[string(ip)]
+	if !ok {
+		if len(sl.ips) >= rateLimitIPs {
+			sl.expire(now)
+			if len(sl.ips) >= rateLimitIPs {
+				return false
+			}
+		}
+		if sl.ips == nil {
+			sl.ips = make(map[string]*tokenBucket)
+		}
+		b = new(tokenBucket)
+		sl.ips[string(ip)] = b
+	}
+	return b.take(sl.ipRate, now)
+}
+
+// expire forgets the source IPs whose buckets have been refilled, they start full
+// anyway when seen again
+func (sl *sessionLimiter) expire(now time.Time) {
+	for ip, b := range sl.ips {
+		if now.Sub(b.last) >= time.Second {
+			delete(sl.ips, ip)
+		}
+	}
+}
+
+// rateLimited checks the new session from 'addr' against SetSessionRate, and counts
+// it in RateLimited if it's dropped
+func (l *Listener) rateLimited(addr net.Addr) bool {
+	if l.limiter.admit(addr) {
+		return false
+	}
+	atomic.AddUint64(&DefaultSnmp.RateLimited, 1)
+	return true
+}
+
+// SetSessionRate limits the new sessions per second, in 'total' and per source IP
+// by 'perIP', with bursts of up to a second of them. The packets of the new
+// sessions beyond are dropped before a session is created for them and counted
+// in RateLimited, the remotes retry by retransmission. Set 0 for unlimited(default).
+// SetMaxSessions limits the live sessions, and GetSessionCount reports them.
+func (l *Listener) SetSessionRate(total, perIP int) {
+	l.limiter.mu.Lock()
+	defer l.limiter.mu.Unlock()
+	l.limiter.rate, l.limiter.ipRate = total, perIP
+	l.limiter.total = tokenBucket{}
+	l.limiter.ips = nil
+}
@@ -1,6 +1,7 @@
 package kcp
 
 import (
+	"net"
 	"sync/atomic"
 
 	"github.com/pkg/errors"
@@ -8,17 +9,31 @@ import (
 
 func (s *UDPSession) defaultReadLoop() {
 	buf := make([]byte, mtuLimit)
+	oob := make([]byte, ecnOOBSize)
+	udpconn, _ := s.conn.(*net.UDPConn)
 	var src string
 	for {
-		if n, addr, err := s.conn.ReadFrom(buf); err == nil {
+		var n, oobn int
+		var addr net.Addr
+		var err error
+		if udpconn != nil && atomic.LoadInt32(&s.recvTOS) != 0 { // with the TOS of the packet
+			var from *net.UDPAddr
+			n, oobn, _, from, err = udpconn.ReadMsgUDP(buf, oob)
+			addr = from
+		} else {
+			n, addr, err = s.conn.ReadFrom(buf)
+		}
+
+		if err == nil {
 			// make sure the packet is from the same source
 			if src == "" { // set source address
 				src = addr.String()
 			} else if addr.String() != src {
 				atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+				atomic.AddUint64(&s.snmp.InErrs, 1)
 				continue
 			}
-			s.packetInput(buf[:n])
+			s.packetInput(buf[:n], oobn > 0 && ecnMarked(oob[:oobn]))
 		} else {
 			s.notifyReadError(errors.WithStack(err))
 			return
@@ -26,14 +41,41 @@ func (s *UDPSession) defaultReadLoop() {
 	}
 }
 
-func (l *Listener) defaultMonitor() {
+func (l *Listener) defaultMonitor(conn net.PacketConn) {
 	buf := make([]byte, mtuLimit)
+	oob := make([]byte, ecnOOBSize)
+	udpconn, _ := conn.(*net.UDPConn)
 	for {
-		if n, from, err := l.conn.ReadFrom(buf); err == nil {
-			l.packetInput(buf[:n], from)
+		var n, oobn int
+		var from net.Addr
+		var err error
+		if udpconn != nil && atomic.LoadInt32(&l.recvTOS) != 0 { // with the TOS of the packet
+			var addr *net.UDPAddr
+			n, oobn, _, addr, err = udpconn.ReadMsgUDP(buf, oob)
+			from = addr
+		} else {
+			n, from, err = conn.ReadFrom(buf)
+		}
+
+		if err == nil {
+			l.packetInput(buf[:n], from, conn, oobn > 0 && ecnMarked(oob[:oobn]))
 		} else {
 			l.notifyReadError(errors.WithStack(err))
 			return
 		}
 	}
 }
+
+// splitGRO passes the packets of a coalesced read of 'size'-byte segments to 'input',
+// the last of which may be shorter, 'size' is 0 for a single packet
+func splitGRO(buf []byte, size int, input func(packet []byte)) {
+	if size <= 0 {
+		input(buf)
+		return
+	}
+	for len(buf) > size {
+		input(buf[:size])
+		buf = buf[size:]
+	}
+	input(buf)
+}
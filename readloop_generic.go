@@ -2,10 +2,12 @@
 
 package kcp
 
+import "net"
+
 func (s *UDPSession) readLoop() {
 	s.defaultReadLoop()
 }
 
-func (l *Listener) monitor() {
-	l.defaultMonitor()
+func (l *Listener) monitor(conn net.PacketConn) {
+	l.defaultMonitor(conn)
 }
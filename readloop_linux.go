@@ -6,16 +6,32 @@ import (
 	"net"
 	"os"
 	"sync/atomic"
+	"syscall"
+	"unsafe"
 
 	"github.com/pkg/errors"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 )
 
+const (
+	udpGRO     = 104   // UDP_GRO of linux/udp.h, since Linux 5.0
+	groBufSize = 65536 // the largest coalesced read
+	groOOBSize = 128   // the control messages of the segment size and the TOS
+)
+
 // the read loop for a client session
 func (s *UDPSession) readLoop() {
-	// default version
-	if s.xconn == nil {
+	// GRO version, for the sockets created by kcp-go, as the coalesced reads
+	// must be split by whoever reads the socket afterwards
+	if conn, ok := s.conn.(*net.UDPConn); ok && s.ownConn && setGRO(conn) {
+		s.groReadLoop(conn)
+		return
+	}
+
+	// default version, also for reading the TOS of the packets, the control
+	// messages of ReadBatch are not used as x/net may carry them over to WriteBatch
+	if s.xconn == nil || atomic.LoadInt32(&s.recvTOS) != 0 {
 		s.defaultReadLoop()
 		return
 	}
@@ -36,11 +52,16 @@ func (s *UDPSession) readLoop() {
 					src = msg.Addr.String()
 				} else if msg.Addr.String() != src {
 					atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+					atomic.AddUint64(&s.snmp.InErrs, 1)
 					continue
 				}
 
 				// source and size has validated
-				s.packetInput(msg.Buffers[0][:msg.N])
+				s.packetInput(msg.Buffers[0][:msg.N], false)
+			}
+			if atomic.LoadInt32(&s.recvTOS) != 0 {
+				s.defaultReadLoop()
+				return
 			}
 		} else {
 			// compatibility issue:
@@ -61,22 +82,28 @@ func (s *UDPSession) readLoop() {
 }
 
 // monitor incoming data for all connections of server
-func (l *Listener) monitor() {
+func (l *Listener) monitor(conn net.PacketConn) {
+	// GRO version, see UDPSession.readLoop
+	if udpconn, ok := conn.(*net.UDPConn); ok && l.ownConn && setGRO(udpconn) {
+		l.groMonitor(udpconn)
+		return
+	}
+
 	var xconn batchConn
-	if _, ok := l.conn.(*net.UDPConn); ok {
-		addr, err := net.ResolveUDPAddr("udp", l.conn.LocalAddr().String())
+	if _, ok := conn.(*net.UDPConn); ok {
+		addr, err := net.ResolveUDPAddr("udp", conn.LocalAddr().String())
 		if err == nil {
 			if addr.IP.To4() != nil {
-				xconn = ipv4.NewPacketConn(l.conn)
+				xconn = ipv4.NewPacketConn(conn)
 			} else {
-				xconn = ipv6.NewPacketConn(l.conn)
+				xconn = ipv6.NewPacketConn(conn)
 			}
 		}
 	}
 
-	// default version
-	if xconn == nil {
-		l.defaultMonitor()
+	// default version, also for reading the TOS of the packets
+	if xconn == nil || atomic.LoadInt32(&l.recvTOS) != 0 {
+		l.defaultMonitor(conn)
 		return
 	}
 
@@ -90,7 +117,11 @@ func (l *Listener) monitor() {
 		if count, err := xconn.ReadBatch(msgs, 0); err == nil {
 			for i := 0; i < count; i++ {
 				msg := &msgs[i]
-				l.packetInput(msg.Buffers[0][:msg.N], msg.Addr)
+				l.packetInput(msg.Buffers[0][:msg.N], msg.Addr, conn, false)
+			}
+			if atomic.LoadInt32(&l.recvTOS) != 0 {
+				l.defaultMonitor(conn)
+				return
 			}
 		} else {
 			// compatibility issue:
@@ -99,7 +130,7 @@ func (l *Listener) monitor() {
 			if operr, ok := err.(*net.OpError); ok {
 				if se, ok := operr.Err.(*os.SyscallError); ok {
 					if se.Syscall == "recvmmsg" {
-						l.defaultMonitor()
+						l.defaultMonitor(conn)
 						return
 					}
 				}
@@ -109,3 +140,78 @@ func (l *Listener) monitor() {
 		}
 	}
 }
+
+// setGRO enables UDP GRO on the socket, returns false if it's unsupported
+func setGRO(conn *net.UDPConn) bool {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var succeed bool
+	rc.Control(func(fd uintptr) {
+		succeed = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_UDP, udpGRO, 1) == nil
+	})
+	return succeed
+}
+
+// groSegment returns the segment size of a coalesced read in the control
+// messages, 0 if the read is a single packet
+func groSegment(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.IPPROTO_UDP && m.Header.Type == udpGRO && len(m.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&m.Data[0])))
+		}
+	}
+	return 0
+}
+
+// the read loop for a client session on a socket with GRO, the coalesced reads
+// are split into the packets
+func (s *UDPSession) groReadLoop(conn *net.UDPConn) {
+	buf := make([]byte, groBufSize)
+	oob := make([]byte, groOOBSize)
+	var src string
+	var ce bool
+	input := func(packet []byte) { s.packetInput(packet, ce) }
+	for {
+		n, oobn, _, addr, err := conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			s.notifyReadError(errors.WithStack(err))
+			return
+		}
+
+		// make sure the packets are from the same source
+		if src == "" { // set source address
+			src = addr.String()
+		} else if addr.String() != src {
+			atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+			atomic.AddUint64(&s.snmp.InErrs, 1)
+			continue
+		}
+		ce = oobn > 0 && ecnMarked(oob[:oobn])
+		splitGRO(buf[:n], groSegment(oob[:oobn]), input)
+	}
+}
+
+// the monitor of a Listener on a socket with GRO, see UDPSession.groReadLoop
+func (l *Listener) groMonitor(conn *net.UDPConn) {
+	buf := make([]byte, groBufSize)
+	oob := make([]byte, groOOBSize)
+	var from *net.UDPAddr
+	var ce bool
+	input := func(packet []byte) { l.packetInput(packet, from, conn, ce) }
+	for {
+		n, oobn, _, addr, err := conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			l.notifyReadError(errors.WithStack(err))
+			return
+		}
+		from, ce = addr, oobn > 0 && ecnMarked(oob[:oobn])
+		splitGRO(buf[:n], groSegment(oob[:oobn]), input)
+	}
+}
@@ -0,0 +1,43 @@
+package kcp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitGRO(t *testing.T) {
+	buf := make([]byte, 10)
+	for k := range buf {
+		buf[k] = byte(k)
+	}
+
+	cases := []struct {
+		size  int
+		sizes []int
+	}{
+		{0, []int{10}},      // a single packet
+		{4, []int{4, 4, 2}}, // the last segment is shorter
+		{5, []int{5, 5}},
+		{10, []int{10}},
+		{16, []int{10}},
+	}
+	for _, c := range cases {
+		var sizes []int
+		var joined []byte
+		splitGRO(buf, c.size, func(packet []byte) {
+			sizes = append(sizes, len(packet))
+			joined = append(joined, packet...)
+		})
+		if len(sizes) != len(c.sizes) {
+			t.Fatalf("segment size %v: got %v, want %v", c.size, sizes, c.sizes)
+		}
+		for k := range sizes {
+			if sizes[k] != c.sizes[k] {
+				t.Fatalf("segment size %v: got %v, want %v", c.size, sizes, c.sizes)
+			}
+		}
+		if !bytes.Equal(joined, buf) {
+			t.Fatalf("segment size %v: packets mismatch", c.size)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package kcp
+
+import (
+	"sync"
+	"time"
+)
+
+// registry holds the sessions open in the process, from creation to Close, a
+// session is reachable by its updater until then anyway, so it leaks nothing.
+var registry struct {
+	sync.Mutex
+	sessions map[*UDPSession]struct{}
+}
+
+func register(s *UDPSession) {
+	registry.Lock()
+	if registry.sessions == nil {
+		registry.sessions = make(map[*UDPSession]struct{})
+	}
+	registry.sessions[s] = struct{}{}
+	registry.Unlock()
+}
+
+func unregister(s *UDPSession) {
+	registry.Lock()
+	delete(registry.sessions, s)
+	registry.Unlock()
+}
+
+// Sessions returns the sessions open in the process, both dialed and accepted,
+// for diagnostics such as an admin page listing RemoteAddr, GetConv, Uptime and
+// Stats of each, or an emergency teardown by Close.
+func Sessions() []*UDPSession {
+	registry.Lock()
+	defer registry.Unlock()
+	sessions := make([]*UDPSession, 0, len(registry.sessions))
+	for s := range registry.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// Uptime returns the duration since the session was created
+func (s *UDPSession) Uptime() time.Duration {
+	return time.Since(s.created)
+}
@@ -0,0 +1,45 @@
+package kcp
+
+const (
+	// 8-bytes packet counter for replay protection
+	replayHeaderSize = 8
+
+	// the number of packets tracked behind the highest counter
+	replayWindowSize = 1024
+)
+
+// replayWindow is a sliding bitmap of the packet counters received,
+// https://tools.ietf.org/html/rfc6479
+type replayWindow struct {
+	max    uint64 // the highest counter received
+	bitmap [replayWindowSize / 64]uint64
+}
+
+// accept checks if the packet with 'counter' is neither too old nor received
+// already, and marks it as received.
+func (w *replayWindow) accept(counter uint64) bool {
+	if counter == 0 { // counter starts from 1
+		return false
+	}
+
+	if counter > w.max {
+		// slide the window, clearing the bits of the new range
+		if counter-w.max >= replayWindowSize {
+			w.bitmap = [replayWindowSize / 64]uint64{}
+		} else {
+			for c := w.max + 1; c <= counter; c++ {
+				w.bitmap[(c/64)%(replayWindowSize/64)] &^= 1 << (c % 64)
+			}
+		}
+		w.max = counter
+	} else if w.max-counter >= replayWindowSize {
+		return false
+	}
+
+	idx, bit := (counter/64)%(replayWindowSize/64), uint64(1)<<(counter%64)
+	if w.bitmap[idx]&bit != 0 {
+		return false
+	}
+	w.bitmap[idx] |= bit
+	return true
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package kcp
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+var errReuseport = errors.New("SO_REUSEPORT load balancing is supported on Linux only")
+
+func listenReuseport(addr *net.UDPAddr) (net.PacketConn, error) {
+	return nil, errReuseport
+}
@@ -0,0 +1,27 @@
+// +build linux
+
+package kcp
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenReuseport binds a UDP socket to 'addr' with SO_REUSEPORT
+func listenReuseport(addr *net.UDPAddr) (net.PacketConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	return lc.ListenPacket(context.Background(), "udp", addr.String())
+}
@@ -0,0 +1,239 @@
+package kcp
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	gf16Poly   = 0x1002d // x^16 + x^5 + x^3 + x^2 + 1
+	gf16Order  = 65535   // the order of the multiplicative group
+	rs8Shards  = 255     // the shard limit of Reed-Solomon over GF(2^8)
+	rs16Shards = 1024    // the shard limit over GF(2^16), bounding the memory of the shard caches
+)
+
+var (
+	errRS16Shards   = errors.New("GF(2^16) Reed-Solomon supports up to 1024 shards")
+	errOddShardSize = errors.New("GF(2^16) shards must have even sizes")
+)
+
+// log & exp tables of GF(2^16), built on the first use
+var (
+	gf16Once sync.Once
+	gf16Log  [gf16Order + 1]uint16
+	gf16Exp  [2 * gf16Order]uint16
+)
+
+func gf16Init() {
+	x := 1
+	for i := 0; i < gf16Order; i++ {
+		gf16Exp[i] = uint16(x)
+		gf16Exp[i+gf16Order] = uint16(x)
+		gf16Log[x] = uint16(i)
+		x <<= 1
+		if x > gf16Order {
+			x ^= gf16Poly
+		}
+	}
+}
+
+func gf16Mul(a, b uint16) uint16 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gf16Exp[int(gf16Log[a])+int(gf16Log[b])]
+}
+
+func gf16Inv(a uint16) uint16 {
+	return gf16Exp[gf16Order-int(gf16Log[a])]
+}
+
+// gf16MulAdd adds c*src to dst, the symbols are little endian uint16s
+func gf16MulAdd(dst, src []byte, c uint16) {
+	if c == 0 {
+		return
+	}
+	lc := int(gf16Log[c])
+	for i := 0; i+1 < len(src); i += 2 {
+		s := uint16(src[i]) | uint16(src[i+1])<<8
+		if s == 0 {
+			continue
+		}
+		v := gf16Exp[int(gf16Log[s])+lc]
+		dst[i] ^= byte(v)
+		dst[i+1] ^= byte(v >> 8)
+	}
+}
+
+// rs16Codec is the systematic Reed-Solomon codec over GF(2^16) for the shard
+// groups beyond 255 shards, with a Cauchy matrix for the parity shards, so any
+// square submatrix of it is invertible. The shards must have even sizes.
+type rs16Codec struct {
+	dataShards   int
+	parityShards int
+	matrix       [][]uint16 // the coefficients of the data shards per parity shard
+
+	// caches
+	syndromes [][]byte
+}
+
+func newRS16Codec(dataShards, parityShards int) (FECCodec, error) {
+	if dataShards <= 0 || parityShards <= 0 || dataShards+parityShards > rs16Shards {
+		return nil, errors.WithStack(errRS16Shards)
+	}
+	gf16Once.Do(gf16Init)
+
+	c := &rs16Codec{dataShards: dataShards, parityShards: parityShards}
+	c.matrix = make([][]uint16, parityShards)
+	for i := range c.matrix {
+		c.matrix[i] = make([]uint16, dataShards)
+		for j := range c.matrix[i] {
+			c.matrix[i][j] = gf16Inv(uint16(dataShards+i) ^ uint16(j))
+		}
+	}
+	return c, nil
+}
+
+// shardSize returns the size of the non-empty shards
+func (c *rs16Codec) shardSize(shards [][]byte) (int, error) {
+	if len(shards) != c.dataShards+c.parityShards {
+		return 0, errors.WithStack(errTooFewShards)
+	}
+	size := 0
+	for _, shard := range shards {
+		if len(shard) == 0 {
+			continue
+		} else if size == 0 {
+			size = len(shard)
+		} else if len(shard) != size {
+			return 0, errors.WithStack(errShardSizeDiffer)
+		}
+	}
+	if size%2 != 0 {
+		return 0, errors.WithStack(errOddShardSize)
+	}
+	return size, nil
+}
+
+func (c *rs16Codec) Encode(shards [][]byte) error {
+	if _, err := c.shardSize(shards); err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		if len(shard) == 0 {
+			return errors.WithStack(errTooFewShards)
+		}
+	}
+
+	for i, coeffs := range c.matrix {
+		parity := shards[c.dataShards+i]
+		for k := range parity {
+			parity[k] = 0
+		}
+		for j, coeff := range coeffs {
+			gf16MulAdd(parity, shards[j], coeff)
+		}
+	}
+	return nil
+}
+
+func (c *rs16Codec) ReconstructData(shards [][]byte) error {
+	size, err := c.shardSize(shards)
+	if err != nil {
+		return err
+	}
+
+	var lost, rows []int
+	for k := range shards[:c.dataShards] {
+		if len(shards[k]) == 0 {
+			lost = append(lost, k)
+		}
+	}
+	if len(lost) == 0 {
+		return nil
+	}
+	for k := range c.matrix {
+		if len(rows) < len(lost) && len(shards[c.dataShards+k]) > 0 {
+			rows = append(rows, k)
+		}
+	}
+	if len(rows) < len(lost) {
+		return errors.WithStack(errTooFewShards)
+	}
+
+	// the syndromes are the parity shards without the received data shards,
+	// they are the lost data shards multiplied by the square Cauchy submatrix
+	for len(c.syndromes) < len(rows) {
+		c.syndromes = append(c.syndromes, nil)
+	}
+	sub := make([][]uint16, len(rows))
+	for r, row := range rows {
+		if cap(c.syndromes[r]) < size {
+			c.syndromes[r] = make([]byte, size)
+		}
+		syndrome := c.syndromes[r][:size]
+		copy(syndrome, shards[c.dataShards+row])
+		for j, coeff := range c.matrix[row] {
+			if len(shards[j]) > 0 {
+				gf16MulAdd(syndrome, shards[j], coeff)
+			}
+		}
+		sub[r] = make([]uint16, len(lost))
+		for m, k := range lost {
+			sub[r][m] = c.matrix[row][k]
+		}
+	}
+
+	inv := gf16Invert(sub)
+	for m, k := range lost {
+		if cap(shards[k]) >= size {
+			shards[k] = shards[k][:size]
+		} else {
+			shards[k] = make([]byte, size)
+		}
+		shard := shards[k]
+		for i := range shard {
+			shard[i] = 0
+		}
+		for r := range rows {
+			gf16MulAdd(shard, c.syndromes[r][:size], inv[m][r])
+		}
+	}
+	return nil
+}
+
+// gf16Invert inverts a square Cauchy matrix by Gauss-Jordan elimination, the
+// matrix is always invertible, and it's overwritten.
+func gf16Invert(m [][]uint16) [][]uint16 {
+	n := len(m)
+	inv := make([][]uint16, n)
+	for i := range inv {
+		inv[i] = make([]uint16, n)
+		inv[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for m[pivot][col] == 0 {
+			pivot++
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		scale := gf16Inv(m[col][col])
+		for j := 0; j < n; j++ {
+			m[col][j] = gf16Mul(m[col][j], scale)
+			inv[col][j] = gf16Mul(inv[col][j], scale)
+		}
+		for i := 0; i < n; i++ {
+			if f := m[i][col]; i != col && f != 0 {
+				for j := 0; j < n; j++ {
+					m[i][j] ^= gf16Mul(f, m[col][j])
+					inv[i][j] ^= gf16Mul(f, inv[col][j])
+				}
+			}
+		}
+	}
+	return inv
+}
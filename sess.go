@@ -8,10 +8,12 @@
 package kcp
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
-	"hash/crc32"
 	"io"
+	"math"
+	mrand "math/rand"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -29,34 +31,74 @@ const (
 	// 4-bytes packet checksum
 	crcSize = 4
 
-	// overall crypto header size
-	cryptHeaderSize = nonceSize + crcSize
-
 	// maximum packet size
 	mtuLimit = 1500
 
-	// accept backlog
+	// the default accept backlog, see ListenWithBacklog
 	acceptBacklog = 128
+
+	// maximum transmissions of FIN before a closed session is released
+	finRetries = 5
+
+	// maximum duration a closed session waits for its FIN to be acknowledged
+	finTimeout = 10 * time.Second
+
+	// the interval Close checks the data acknowledged while lingering
+	lingerInterval = 10 * time.Millisecond
+
+	// 1-byte key epoch trailer for key rotation
+	epochSize = 1
+
+	// duration the key of the previous epoch is accepted after a rotation
+	keyGracePeriod = 10 * time.Second
+
+	// interval of adjusting the parity shards by the loss rate for adaptive FEC
+	fecAdaptInterval = 5 * time.Second
+
+	// the segments of the buffers of ReadFrom and WriteTo
+	copySegments = 64
+
+	// the update jitter is at most 1/updateJitterDiv of the interval either way
+	updateJitterDiv = 4
 )
 
 var (
-	errInvalidOperation = errors.New("invalid operation")
-	errTimeout          = errors.New("timeout")
+	// ErrInvalidOperation is returned by the operations not applicable to the session or listener
+	ErrInvalidOperation = errors.New("invalid operation")
+
+	// ErrTimeout is returned by Read, Write and Accept after the deadline, it's a
+	// net.Error with Timeout() true, and it's returned without wrapping for the
+	// callers asserting net.Error directly
+	ErrTimeout error = timeoutError{}
+
+	// ErrBrokenPipe is returned by Read and Write after the link has been detected dead, see SetMaxRetries
+	ErrBrokenPipe = errors.New("broken pipe")
+
+	// ErrIdleTimeout is returned by Read and Write after the session has been closed by the idle timeout, see SetIdleTimeout
+	ErrIdleTimeout = errors.New("idle timeout")
+
+	// ErrMessageTooLarge is returned by WriteMessage for a message beyond 255 segments
+	ErrMessageTooLarge = errors.New("message too large")
+
+	// ErrKeyExhausted is returned by Write after the AEAD key has sealed the packets
+	// it's allowed to, see SetBlockCrypt to replace it before
+	ErrKeyExhausted = errors.New("key exhausted")
 )
 
+// timeoutError implements net.Error for the deadlines
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
 var (
 	// a system-wide packet buffer shared among sending, receiving and FEC
 	// to mitigate high-frequency memory allocation for packets, bytes from xmitBuf
-	// is aligned to 64bit
-	xmitBuf sync.Pool
+	// is aligned to 64bit, see bufferPool for the size classes
+	xmitBuf bufferPool
 )
 
-func init() {
-	xmitBuf.New = func() interface{} {
-		return make([]byte, mtuLimit)
-	}
-}
-
 type (
 	// UDPSession defines a KCP session implemented by UDP
 	UDPSession struct {
@@ -65,6 +107,15 @@ type (
 		kcp     *KCP           // KCP ARQ protocol
 		l       *Listener      // pointing to the Listener object if it's been accepted by a Listener
 		block   BlockCrypt     // block encryption object
+		aead    AEADCrypt      // non-nil if block is authenticated
+		tagSize int            // the size of authentication tag appended to packets
+
+		trailerSize int // the size of tag & key epoch appended to packets
+		fecPad      int // the room of the padding of GF(2^16) parity shards, reserved like trailerSize
+
+		auth        PacketAuthenticator // packet integrity check, nil to disable
+		compressor  Compressor          // compression of the KCP frames, nil to disable
+		cryptHeader int                 // the size of nonce & authentication code in front of packets
 
 		// kcp receiving is based on packets
 		// recvbuf turns packets into stream
@@ -74,21 +125,99 @@ type (
 		// FEC codec
 		fecDecoder *fecDecoder
 		fecEncoder *fecEncoder
+		fecCodec   FECCodecFunc // nil for Reed-Solomon
+		fecRxOff   bool         // the incoming parity shards are dropped by SetRxFEC(0, 0)
+
+		// FEC decoder options
+		fecAutoTuneOff bool                      // the decoder never tunes the shards by the period of packets
+		fecRecovery    func(recovered, lost int) // notified of the data shards recovered & lost
+
+		// FEC decoder limits
+		fecRxGroups   int // the shard groups kept by the decoder, 0 for default
+		fecRxMaxBytes int // the bytes kept by the decoder, 0 for unlimited
+
+		// adaptive FEC
+		fecMinParity, fecMaxParity int       // the bounds of parity shards, 0 to disable
+		fecAdapted                 time.Time // the time of the latest adjustment
+
+		// complete the shard groups open for fecFlushTimeout, 0 to disable
+		fecFlushTimeout time.Duration
+
+		// FEC interleaving
+		fecInterleave int              // the shard groups interleaved on wire, 0 or 1 to disable
+		ilvGroups     [][]ipv4.Message // the packets of the shard groups being interleaved
+		ilvOpened     time.Time        // the time the first packet joined ilvGroups
 
 		// settings
-		remote     net.Addr  // remote peer address
-		rd         time.Time // read deadline
-		wd         time.Time // write deadline
-		headerSize int       // the header size additional to a KCP frame
-		ackNoDelay bool      // send ack immediately for each incoming packet(testing purpose)
-		writeDelay bool      // delay kcp.flush() for Write() for bulk transfer
-		dup        int       // duplicate udp packets(testing purpose)
+		remote      net.Addr      // remote peer address
+		rd          time.Time     // read deadline
+		wd          time.Time     // write deadline
+		rdChanged   deadlineEvent // wakes the blocked reads when rd changes
+		wdChanged   deadlineEvent // wakes the blocked writes when wd changes
+		headerSize  int           // the header size additional to a KCP frame
+		ackNoDelay  bool          // send ack immediately for each incoming packet(testing purpose)
+		ackDelay    time.Duration // the acks are sent within, 0 for the update interval
+		ackSched    bool          // a flush of the delayed acks is scheduled
+		writeDelay  bool          // delay kcp.flush() for Write() for bulk transfer
+		streamFlush bool          // flush each Write in stream mode regardless of writeDelay
+		dup         int           // duplicate udp packets(testing purpose)
+		dscp        int           // the DSCP set by SetDSCP
+		recvTOS     int32         // read the TOS of the packets for the CE marks
+		pmtu        *pmtuState    // path MTU discovery, nil to disable
+		maxRetries  int           // dead link detection, 0 to disable
+		writeLimit  int           // the bytes waiting to be sent or acknowledged beyond which Write blocks, 0 to disable
+		linger      int           // the seconds Close waits for the data to be acknowledged, 0 to disable, negative for ever
+		jitter      bool          // jitter the update interval, see SetUpdateJitter
+
+		idleTimeout time.Duration // close the session if nothing received within, 0 to disable
+		lastInput   time.Time     // the time of the latest valid incoming packet
+		idleClosed  int32         // closed by the idle timeout
+
+		keepAlive  time.Duration // probe the remote if nothing sent within, 0 to disable
+		lastOutput time.Time     // the time of the latest outgoing packet
+
+		created time.Time    // the time the session was created, see Uptime
+		sched   *TimedSched  // the scheduler of the timed functions, see SetTimedSched
+		updater *TimedHandle // the next update on sched, canceled by Close
+
+		// replay protection
+		replay    int32        // packet counter enabled
+		txCounter uint64       // the counter of the latest outgoing packet
+		replayWin replayWindow // the counters received
+
+		// key rotation
+		rotation   int32      // key epoch appended to packets
+		epoch      byte       // the epoch of block
+		prevBlock  BlockCrypt // the block of the previous epoch
+		prevExpiry time.Time  // prevBlock is accepted until
+
+		// pacing
+		maxSendRate   int            // bytes per second, 0 to disable
+		autoPacing    bool           // pace by the window over RTT
+		ctrlqueue     []ipv4.Message // packets without data, bypassing pacing
+		paceTokens    float64        // the bytes allowed to be sent
+		paceTime      time.Time      // the time paceTokens was refilled
+		paced         []ipv4.Message // packets held back by pacing
+		paceScheduled bool           // a pacing tick is scheduled
+
+		// congestion window reports, see SetCongestionCallback
+		windowCallback  func(cwnd, ssthresh, inflight uint32)
+		windowReported  [2]uint32 // the cwnd & ssthresh reported last
+		windowReporting bool      // a goroutine is reporting
+
+		// dialing context, bounds the writes until the first one succeeds
+		dialCtx context.Context
+
+		// connection migration, see Listener.SetMigration
+		migrateAddr net.Addr  // the new address awaiting the ack of the path challenge
+		migrateSent time.Time // the time the latest path challenge was sent
 
 		// notifications
 		die          chan struct{} // notify current session has Closed
 		dieOnce      sync.Once
 		chReadEvent  chan struct{} // notify Read() can be called without blocking
 		chWriteEvent chan struct{} // notify Write() can be called without blocking
+		chDgramEvent chan struct{} // notify ReadUnreliable() can be called without blocking
 
 		// socket error handling
 		socketReadError      atomic.Value
@@ -98,13 +227,26 @@ type (
 		socketReadErrorOnce  sync.Once
 		socketWriteErrorOnce sync.Once
 
+		inputHook atomic.Value // *inputHook set by SetInputHook
+
 		// nonce generator
 		nonce Entropy
 
+		// per-session statistics
+		snmp *Snmp
+
 		// packets waiting to be sent on wire
 		txqueue         []ipv4.Message
 		xconn           batchConn // for x/net
 		xconnWriteError error
+		gso             int    // UDP GSO of the socket, 1 supported, -1 unsupported, 0 unknown
+		flowLabel       uint32 // the IPv6 flow label, the socket is connected if set
+
+		outputHook func(raw []byte) []byte // set by SetOutputHook
+		hookqueue  []ipv4.Message          // the packets passed by outputHook
+
+		noconv    bool // the conv-less wire format, see NewConnNoConv
+		noconvFEC bool // all the packets carry the FEC header in the conv-less wire format
 
 		mu sync.Mutex
 	}
@@ -120,15 +262,20 @@ type (
 	setDSCP interface {
 		SetDSCP(int) error
 	}
+
+	setDF interface {
+		SetDontFragment(bool) error
+	}
 )
 
 // newUDPSession create a new udp session for client or server
-func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn net.PacketConn, ownConn bool, remote net.Addr, block BlockCrypt) *UDPSession {
+func newUDPSession(conv uint32, noconv bool, dataShards, parityShards int, l *Listener, conn net.PacketConn, ownConn bool, remote net.Addr, block BlockCrypt) *UDPSession {
 	sess := new(UDPSession)
 	sess.die = make(chan struct{})
 	sess.nonce = new(nonceAES128)
 	sess.nonce.Init()
 	sess.chReadEvent = make(chan struct{}, 1)
+	sess.chDgramEvent = make(chan struct{}, 1)
 	sess.chWriteEvent = make(chan struct{}, 1)
 	sess.chSocketReadError = make(chan struct{})
 	sess.chSocketWriteError = make(chan struct{})
@@ -138,6 +285,10 @@ func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn
 	sess.l = l
 	sess.block = block
 	sess.recvbuf = make([]byte, mtuLimit)
+	sess.snmp = newSnmp()
+	sess.lastInput = time.Now()
+	sess.lastOutput = sess.lastInput
+	sess.created = sess.lastInput
 
 	// cast to writebatch conn
 	if _, ok := conn.(*net.UDPConn); ok {
@@ -152,27 +303,41 @@ func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn
 	}
 
 	// FEC codec initialization
-	sess.fecDecoder = newFECDecoder(dataShards, parityShards)
+	sess.fecDecoder = sess.newFECDecoder(dataShards, parityShards)
 	if sess.block != nil {
-		sess.fecEncoder = newFECEncoder(dataShards, parityShards, cryptHeaderSize)
-	} else {
-		sess.fecEncoder = newFECEncoder(dataShards, parityShards, 0)
+		sess.auth = NewCRC32Authenticator()
+		sess.cryptHeader = nonceSize + crcSize
 	}
+	sess.fecEncoder = newFECEncoder(dataShards, parityShards, sess.cryptHeader)
 
 	// calculate additional header size introduced by FEC and encryption
-	if sess.block != nil {
-		sess.headerSize += cryptHeaderSize
-	}
+	sess.headerSize += sess.cryptHeader
 	if sess.fecEncoder != nil {
-		sess.headerSize += fecHeaderSizePlus2
+		sess.fecPad = fecPadding(dataShards, parityShards)
+		sess.headerSize += fecHeaderSizePlus2 + sess.fecPad
+	}
+
+	// the authentication tag is appended to the packets, its room is
+	// reserved in front of the headers to keep the packets within MTU
+	if aead, ok := block.(AEADCrypt); ok {
+		sess.aead = aead
+		sess.tagSize = aead.Overhead()
+		sess.headerSize += sess.tagSize
+		sess.trailerSize = sess.tagSize
 	}
 
 	sess.kcp = NewKCP(conv, func(buf []byte, size int) {
-		if size >= IKCP_OVERHEAD+sess.headerSize {
-			sess.output(buf[:size])
+		if size >= sess.kcp.overhead+sess.headerSize {
+			sess.output(buf[sess.trailerSize+sess.fecPad : size])
 		}
 	})
+	if noconv {
+		sess.kcp.setNoConv()
+		sess.noconv = true
+		sess.noconvFEC = sess.fecEncoder != nil
+	}
 	sess.kcp.ReserveBytes(sess.headerSize)
+	sess.kcp.snmp = sess.snmp
 
 	if sess.l == nil { // it's a client connection
 		go sess.readLoop()
@@ -181,9 +346,17 @@ func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn
 		atomic.AddUint64(&DefaultSnmp.PassiveOpens, 1)
 	}
 
-	// start per-session updater
-	SystemTimedSched.Put(sess.update, time.Now())
+	// start per-session updater, it takes over the handle under the lock
+	sched := SystemTimedSched
+	if l != nil {
+		sched = l.timedSched()
+	}
+	sess.mu.Lock()
+	sess.sched = sched
+	sess.updater = sess.sched.PutWithCancel(sess.update, time.Now())
+	sess.mu.Unlock()
 
+	register(sess)
 	currestab := atomic.AddUint64(&DefaultSnmp.CurrEstab, 1)
 	maxconn := atomic.LoadUint64(&DefaultSnmp.MaxConn)
 	if currestab > maxconn {
@@ -195,31 +368,42 @@ func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn
 
 // Read implements net.Conn
 func (s *UDPSession) Read(b []byte) (n int, err error) {
-	var timeout *time.Timer
 	// deadline for current reading operation
+	var timeout deadlineTimer
 	var c <-chan time.Time
-	if !s.rd.IsZero() {
-		delay := time.Until(s.rd)
-		timeout = time.NewTimer(delay)
-		c = timeout.C
-		defer timeout.Stop()
-	}
+	var changed <-chan struct{}
+	defer timeout.stop()
 
 	for {
 		s.mu.Lock()
+		c, changed = timeout.reset(s.rd), s.rdChanged.wait()
+		if timeout.expired() {
+			s.mu.Unlock()
+			return 0, ErrTimeout
+		}
 		if len(s.bufptr) > 0 { // copy from buffer into b
 			n = copy(b, s.bufptr)
 			s.bufptr = s.bufptr[n:]
 			s.mu.Unlock()
 			atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(n))
+			atomic.AddUint64(&s.snmp.BytesReceived, uint64(n))
 			return n, nil
 		}
 
-		if size := s.kcp.PeekSize(); size > 0 { // peek data size from kcp
+		if s.kcp.stream != 0 { // receive the stream data into 'b' directly, across the segments
+			if n = s.kcp.recvStream(b); n >= 0 {
+				s.mu.Unlock()
+				atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(n))
+				atomic.AddUint64(&s.snmp.BytesReceived, uint64(n))
+				return n, nil
+			}
+			n = 0
+		} else if size := s.kcp.PeekSize(); size > 0 { // peek data size from kcp
 			if len(b) >= size { // receive data into 'b' directly
 				s.kcp.Recv(b)
 				s.mu.Unlock()
 				atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(size))
+				atomic.AddUint64(&s.snmp.BytesReceived, uint64(size))
 				return size, nil
 			}
 
@@ -235,36 +419,138 @@ func (s *UDPSession) Read(b []byte) (n int, err error) {
 			s.bufptr = s.recvbuf[n:] // pointer update
 			s.mu.Unlock()
 			atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(n))
+			atomic.AddUint64(&s.snmp.BytesReceived, uint64(n))
 			return n, nil
 		}
 
+		if s.kcp.peekFin() { // remote has closed and all data has been read
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+
 		s.mu.Unlock()
 
 		// wait for read event or timeout or error
 		select {
 		case <-s.chReadEvent:
+		case <-changed:
 		case <-c:
-			return 0, errors.WithStack(errTimeout)
+			return 0, ErrTimeout
 		case <-s.chSocketReadError:
 			return 0, s.socketReadError.Load().(error)
 		case <-s.die:
-			return 0, errors.WithStack(io.ErrClosedPipe)
+			return 0, s.closedError()
+		}
+	}
+}
+
+// ReadMulti reads as many messages as available into bufs in one call, blocking
+// like Read until there is at least one, and returns the number of messages with
+// each bufs[i] resliced to the size of its message.
+//
+// It behaves like Read on bufs[0] in stream mode, or when the next message doesn't
+// fit in bufs[0], otherwise it stops before a message larger than its buffer.
+func (s *UDPSession) ReadMulti(bufs [][]byte) (n int, err error) {
+	if len(bufs) == 0 {
+		return 0, nil
+	}
+
+	// deadline for current reading operation
+	var timeout deadlineTimer
+	var c <-chan time.Time
+	var changed <-chan struct{}
+	defer timeout.stop()
+
+	for {
+		s.mu.Lock()
+		c, changed = timeout.reset(s.rd), s.rdChanged.wait()
+		if timeout.expired() {
+			s.mu.Unlock()
+			return 0, ErrTimeout
+		}
+		if s.kcp.stream != 0 || len(s.bufptr) > 0 || s.kcp.PeekSize() > len(bufs[0]) {
+			s.mu.Unlock()
+			nbytes, err := s.Read(bufs[0])
+			if err != nil {
+				return 0, err
+			}
+			bufs[0] = bufs[0][:nbytes]
+			return 1, nil
+		}
+
+		var nbytes int
+		for n < len(bufs) {
+			size := s.kcp.PeekSize()
+			if size <= 0 || size > len(bufs[n]) {
+				break
+			}
+			s.kcp.Recv(bufs[n])
+			bufs[n] = bufs[n][:size]
+			nbytes += size
+			n++
+		}
+
+		if n > 0 {
+			s.mu.Unlock()
+			atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(nbytes))
+			atomic.AddUint64(&s.snmp.BytesReceived, uint64(nbytes))
+			return n, nil
+		}
+
+		if s.kcp.peekFin() { // remote has closed and all data has been read
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+
+		s.mu.Unlock()
+
+		// wait for read event or timeout or error
+		select {
+		case <-s.chReadEvent:
+		case <-changed:
+		case <-c:
+			return 0, ErrTimeout
+		case <-s.chSocketReadError:
+			return 0, s.socketReadError.Load().(error)
+		case <-s.die:
+			return 0, s.closedError()
 		}
 	}
 }
 
-// Write implements net.Conn
+// Write implements net.Conn, 'b' of any size is cut into segments sent separately,
+// unlike WriteMessage bounded by 255 segments.
 func (s *UDPSession) Write(b []byte) (n int, err error) { return s.WriteBuffers([][]byte{b}) }
 
 // WriteBuffers write a vector of byte slices to the underlying connection
-func (s *UDPSession) WriteBuffers(v [][]byte) (n int, err error) {
-	var timeout *time.Timer
+//
+// The buffers are queued into KCP in order without being concatenated first, in the
+// same way as Write regarding the write deadline and the sliding window, and the
+// total number of bytes is returned. In stream mode the small buffers are coalesced
+// into full segments.
+func (s *UDPSession) WriteBuffers(v [][]byte) (n int, err error) { return s.write(v, false) }
+
+// write queues the buffers into KCP, each buffer as a message of segments marked
+// with fragment numbers if 'message', or cut into the segments sent separately.
+func (s *UDPSession) write(v [][]byte, message bool) (n int, err error) {
+	// deadline for current writing operation
+	var timeout deadlineTimer
 	var c <-chan time.Time
-	if !s.wd.IsZero() {
-		delay := time.Until(s.wd)
-		timeout = time.NewTimer(delay)
-		c = timeout.C
-		defer timeout.Stop()
+	var changed <-chan struct{}
+	defer timeout.stop()
+
+	// the dialing context is still in effect before the first write succeeds
+	s.mu.Lock()
+	dialCtx := s.dialCtx
+	s.mu.Unlock()
+	var ctxDone <-chan struct{}
+	if dialCtx != nil {
+		ctxDone = dialCtx.Done()
+	}
+
+	var size int
+	for _, b := range v {
+		size += len(b)
 	}
 
 	for {
@@ -272,17 +558,41 @@ func (s *UDPSession) WriteBuffers(v [][]byte) (n int, err error) {
 		case <-s.chSocketWriteError:
 			return 0, s.socketWriteError.Load().(error)
 		case <-s.die:
-			return 0, errors.WithStack(io.ErrClosedPipe)
+			return 0, s.closedError()
+		case <-ctxDone:
+			return 0, errors.WithStack(dialCtx.Err())
 		default:
 		}
 
 		s.mu.Lock()
+		c, changed = timeout.reset(s.wd), s.wdChanged.wait()
+		if timeout.expired() {
+			s.mu.Unlock()
+			return 0, ErrTimeout
+		}
+
+		// write side has been shut down by CloseWrite
+		if s.kcp.snd_fin != 0 {
+			s.mu.Unlock()
+			return 0, errors.WithStack(io.ErrClosedPipe)
+		}
+		if message && size > maxFragments*int(s.kcp.mss) {
+			s.mu.Unlock()
+			return 0, errors.WithStack(ErrMessageTooLarge)
+		}
 
-		// make sure write do not overflow the max sliding window on both side
+		// make sure write do not overflow the max sliding window on both side,
+		// nor the write buffer limit unless nothing is waiting
 		waitsnd := s.kcp.WaitSnd()
-		if waitsnd < int(s.kcp.snd_wnd) && waitsnd < int(s.kcp.rmt_wnd) {
+		pending := s.kcp.WaitSndBytes()
+		if waitsnd < int(s.kcp.snd_wnd) && waitsnd < int(s.kcp.rmt_wnd) &&
+			(s.writeLimit <= 0 || pending == 0 || pending+size <= s.writeLimit) {
 			for _, b := range v {
 				n += len(b)
+				if message {
+					s.kcp.Send(b)
+					continue
+				}
 				for {
 					if len(b) <= int(s.kcp.mss) {
 						s.kcp.Send(b)
@@ -295,12 +605,15 @@ func (s *UDPSession) WriteBuffers(v [][]byte) (n int, err error) {
 			}
 
 			waitsnd = s.kcp.WaitSnd()
-			if waitsnd >= int(s.kcp.snd_wnd) || waitsnd >= int(s.kcp.rmt_wnd) || !s.writeDelay {
+			if waitsnd >= int(s.kcp.snd_wnd) || waitsnd >= int(s.kcp.rmt_wnd) || !s.writeDelay ||
+				(s.streamFlush && s.kcp.stream != 0) {
 				s.kcp.flush(false)
 				s.uncork()
 			}
+			s.dialCtx = nil
 			s.mu.Unlock()
 			atomic.AddUint64(&DefaultSnmp.BytesSent, uint64(n))
+			atomic.AddUint64(&s.snmp.BytesSent, uint64(n))
 			return n, nil
 		}
 
@@ -308,18 +621,107 @@ func (s *UDPSession) WriteBuffers(v [][]byte) (n int, err error) {
 
 		select {
 		case <-s.chWriteEvent:
+		case <-changed:
 		case <-c:
-			return 0, errors.WithStack(errTimeout)
+			return 0, ErrTimeout
 		case <-s.chSocketWriteError:
 			return 0, s.socketWriteError.Load().(error)
 		case <-s.die:
-			return 0, errors.WithStack(io.ErrClosedPipe)
+			return 0, s.closedError()
+		case <-ctxDone:
+			return 0, errors.WithStack(dialCtx.Err())
+		}
+	}
+}
+
+// ReadFrom implements io.ReaderFrom, so io.Copy to the session reads from 'r' in
+// buffers of whole segments, sized by the current MTU, instead of 32KB chunks. It
+// returns at io.EOF of 'r', or on the first error.
+func (s *UDPSession) ReadFrom(r io.Reader) (n int64, err error) {
+	var buf []byte
+	for {
+		s.mu.Lock()
+		size := int(s.kcp.mss) * copySegments
+		s.mu.Unlock()
+		if cap(buf) < size {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+
+		nr, er := r.Read(buf)
+		if nr > 0 {
+			nw, ew := s.WriteBuffers([][]byte{buf[:nr]})
+			n += int64(nw)
+			if ew != nil {
+				return n, ew
+			}
+		}
+		if er == io.EOF {
+			return n, nil
+		} else if er != nil {
+			return n, er
+		}
+	}
+}
+
+// WriteTo implements io.WriterTo, so io.Copy from the session writes to 'w' all
+// the data received at once, up to the buffer of whole segments sized by the
+// current MTU. It returns at io.EOF of the session, see SetCloseNotify, or on the
+// first error, including the read deadline.
+func (s *UDPSession) WriteTo(w io.Writer) (n int64, err error) {
+	var buf []byte
+	for {
+		s.mu.Lock()
+		size := int(s.kcp.mss) * copySegments
+		s.mu.Unlock()
+		if cap(buf) < size {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+
+		nr, er := s.Read(buf)
+		if nr > 0 {
+			nw, ew := w.Write(buf[:nr])
+			n += int64(nw)
+			if ew != nil {
+				return n, ew
+			}
+			if nw != nr {
+				return n, io.ErrShortWrite
+			}
+		}
+		if er == io.EOF {
+			return n, nil
+		} else if er != nil {
+			return n, er
 		}
 	}
 }
 
 // uncork sends data in txqueue if there is any
 func (s *UDPSession) uncork() {
+	s.notifyWindow()
+	if s.pacing() {
+		// the packets without data are sent at once
+		if len(s.ctrlqueue) > 0 {
+			s.tx(s.ctrlqueue)
+			for k := range s.ctrlqueue {
+				xmitBuf.Put(s.ctrlqueue[k].Buffers[0])
+				s.ctrlqueue[k].Buffers = nil
+			}
+			s.ctrlqueue = s.ctrlqueue[:0]
+		}
+
+		// hand the packets over to pacing, which recycles them
+		s.paced = append(s.paced, s.txqueue...)
+		for k := range s.txqueue {
+			s.txqueue[k].Buffers = nil
+		}
+		s.txqueue = s.txqueue[:0]
+		s.pace()
+		return
+	}
+
 	if len(s.txqueue) > 0 {
 		s.tx(s.txqueue)
 		// recycle
@@ -331,8 +733,82 @@ func (s *UDPSession) uncork() {
 	}
 }
 
-// Close closes the connection.
+// deadlineTimer is a timer following the changes of a deadline, such that a
+// blocking operation wakes up on time even if the deadline is set during the wait
+type deadlineTimer struct {
+	deadline time.Time
+	timer    *time.Timer
+}
+
+// reset returns the channel which fires at 'deadline', nil if it's zero,
+// the timer is recreated only if the deadline has changed.
+func (t *deadlineTimer) reset(deadline time.Time) <-chan time.Time {
+	if !deadline.Equal(t.deadline) {
+		t.stop()
+		t.deadline = deadline
+		if !deadline.IsZero() {
+			t.timer = time.NewTimer(time.Until(deadline))
+		}
+	}
+	if t.timer == nil {
+		return nil
+	}
+	return t.timer.C
+}
+
+// expired returns if the deadline has passed, the operations fail then even if
+// they could proceed, like net.Conn
+func (t *deadlineTimer) expired() bool {
+	return !t.deadline.IsZero() && !time.Now().Before(t.deadline)
+}
+
+func (t *deadlineTimer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
+
+// deadlineEvent wakes all the operations blocked on a deadline when it changes, so
+// each of them rechecks it. The channel is created only when an operation waits.
+type deadlineEvent struct {
+	ch chan struct{}
+}
+
+// wait returns the channel closed at the next change
+func (e *deadlineEvent) wait() <-chan struct{} {
+	if e.ch == nil {
+		e.ch = make(chan struct{})
+	}
+	return e.ch
+}
+
+func (e *deadlineEvent) notify() {
+	if e.ch != nil {
+		close(e.ch)
+		e.ch = nil
+	}
+}
+
+// Close closes the connection, after the data written has been acknowledged if
+// lingering, see SetLinger.
 func (s *UDPSession) Close() error {
+	select {
+	case <-s.die:
+	default:
+		s.mu.Lock()
+		linger := s.linger
+		s.mu.Unlock()
+		if linger != 0 {
+			s.lingerSend(linger)
+		}
+	}
+	return s.closeNow()
+}
+
+// closeNow closes the connection without lingering, for the closes made by the
+// library itself on the timed scheduler or the read loop, which must not block.
+func (s *UDPSession) closeNow() error {
 	var once bool
 	s.dieOnce.Do(func() {
 		close(s.die)
@@ -341,36 +817,135 @@ func (s *UDPSession) Close() error {
 
 	if once {
 		atomic.AddUint64(&DefaultSnmp.CurrEstab, ^uint64(0))
+		unregister(s)
 
 		// try best to send all queued messages
 		s.mu.Lock()
+		s.sched.Cancel(s.updater) // the closure and the session are released at once
+		s.updater = nil
+		s.loadInputHook().close()
+		s.inputHook.Store((*inputHook)(nil))
+		s.kcp.queueFin()
 		s.kcp.flush(false)
 		s.uncork()
-		// release pending segments
-		s.kcp.ReleaseTX()
-		if s.fecDecoder != nil {
-			s.fecDecoder.release()
-		}
+		fin := s.kcp.finXmit() >= 0 // including the FIN queued by CloseWrite
+		sched := s.sched
 		s.mu.Unlock()
 
-		if s.l != nil { // belongs to listener
-			s.l.closeSession(s.remote)
-			return nil
-		} else if s.ownConn { // client socket close
-			return s.conn.Close()
-		} else {
+		if fin { // keep retransmitting until the FIN has been acknowledged
+			sched.Put(s.lingerFin(time.Now().Add(finTimeout)), time.Now())
 			return nil
 		}
+		return s.release()
 	} else {
 		return errors.WithStack(io.ErrClosedPipe)
 	}
 }
 
+// closedError returns the error of Read and Write on a closed session
+func (s *UDPSession) closedError() error {
+	if atomic.LoadInt32(&s.idleClosed) != 0 {
+		return errors.WithStack(ErrIdleTimeout)
+	}
+	return errors.WithStack(io.ErrClosedPipe)
+}
+
+// CloseWrite shuts down the writing side of the session like TCP's half-close, the
+// pending data is flushed followed by a FIN, after which Write returns an error,
+// the remote Read returns io.EOF once it has consumed all the data before the FIN.
+//
+// Reading keeps working until the remote shuts down its writing side as well.
+// SetCloseNotify must be enabled on both sides.
+func (s *UDPSession) CloseWrite() error {
+	select {
+	case <-s.die:
+		return errors.WithStack(io.ErrClosedPipe)
+	default:
+	}
+
+	s.mu.Lock()
+	if s.kcp.fin == 0 {
+		s.mu.Unlock()
+		return errors.WithStack(ErrInvalidOperation)
+	}
+	s.kcp.queueFin()
+	s.kcp.flush(false)
+	s.uncork()
+	s.mu.Unlock()
+
+	// wake up the blocking writers
+	s.notifyWriteEvent()
+	return nil
+}
+
+// lingerFin returns the updater of a closed session with a FIN queued, the session
+// is released after the FIN is acknowledged, retransmitted finRetries times, or the deadline
+func (s *UDPSession) lingerFin(deadline time.Time) func() {
+	var linger func()
+	linger = func() {
+		s.mu.Lock()
+		interval := s.kcp.flush(false)
+		s.uncork()
+		xmit := s.kcp.finXmit()
+		sched := s.sched
+		s.mu.Unlock()
+
+		if xmit < 0 || xmit >= finRetries || time.Now().After(deadline) {
+			s.release()
+			return
+		}
+		sched.Put(linger, time.Now().Add(time.Duration(interval)*time.Millisecond))
+	}
+	return linger
+}
+
+// release frees the resources held by a closed session
+func (s *UDPSession) release() error {
+	s.mu.Lock()
+	// release pending segments
+	s.kcp.ReleaseTX()
+	if s.fecDecoder != nil {
+		s.fecDecoder.release()
+	}
+	s.releasePaced(false)
+	for k := range s.ctrlqueue {
+		xmitBuf.Put(s.ctrlqueue[k].Buffers[0])
+	}
+	s.ctrlqueue = nil
+	for _, group := range s.ilvGroups {
+		for k := range group {
+			xmitBuf.Put(group[k].Buffers[0])
+		}
+	}
+	s.ilvGroups = nil
+	remote := s.remote
+	s.mu.Unlock()
+
+	if s.l != nil { // belongs to listener
+		s.l.closeSession(remote)
+		return nil
+	} else if s.ownConn { // client socket close
+		return s.conn.Close()
+	} else {
+		return nil
+	}
+}
+
 // LocalAddr returns the local network address. The Addr returned is shared by all invocations of LocalAddr, so do not modify it.
 func (s *UDPSession) LocalAddr() net.Addr { return s.conn.LocalAddr() }
 
 // RemoteAddr returns the remote network address. The Addr returned is shared by all invocations of RemoteAddr, so do not modify it.
-func (s *UDPSession) RemoteAddr() net.Addr { return s.remote }
+// It changes as the session follows the remote across address changes, see Listener.SetMigration.
+func (s *UDPSession) RemoteAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remote
+}
+
+// LocalConn returns the underlying connection, shared with the listener for the
+// accepted sessions, e.g. to set the socket options by syscall.RawConn.Control.
+// It's for option-setting only, reading or writing it directly corrupts the KCP stream.
+func (s *UDPSession) LocalConn() net.PacketConn { return s.conn }
 
 // SetDeadline sets the deadline associated with the listener. A zero time value disables the deadline.
 func (s *UDPSession) SetDeadline(t time.Time) error {
@@ -378,26 +953,28 @@ func (s *UDPSession) SetDeadline(t time.Time) error {
 	defer s.mu.Unlock()
 	s.rd = t
 	s.wd = t
-	s.notifyReadEvent()
-	s.notifyWriteEvent()
+	s.rdChanged.notify()
+	s.wdChanged.notify()
 	return nil
 }
 
-// SetReadDeadline implements the Conn SetReadDeadline method.
+// SetReadDeadline implements the Conn SetReadDeadline method, all the reads
+// in progress observe the new deadline.
 func (s *UDPSession) SetReadDeadline(t time.Time) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.rd = t
-	s.notifyReadEvent()
+	s.rdChanged.notify()
 	return nil
 }
 
-// SetWriteDeadline implements the Conn SetWriteDeadline method.
+// SetWriteDeadline implements the Conn SetWriteDeadline method, all the writes
+// in progress observe the new deadline.
 func (s *UDPSession) SetWriteDeadline(t time.Time) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.wd = t
-	s.notifyWriteEvent()
+	s.wdChanged.notify()
 	return nil
 }
 
@@ -408,6 +985,31 @@ func (s *UDPSession) SetWriteDelay(delay bool) {
 	s.writeDelay = delay
 }
 
+// Flush sends the data delayed by SetWriteDelay immediately, as much as the
+// window allows, instead of waiting for the next update interval. It returns
+// the error of the underlying conn if the packets failed to be sent.
+func (s *UDPSession) Flush() error {
+	select {
+	case <-s.chSocketWriteError:
+		return s.socketWriteError.Load().(error)
+	case <-s.die:
+		return s.closedError()
+	default:
+	}
+
+	s.mu.Lock()
+	s.kcp.flush(false)
+	s.uncork()
+	s.mu.Unlock()
+
+	select {
+	case <-s.chSocketWriteError:
+		return s.socketWriteError.Load().(error)
+	default:
+		return nil
+	}
+}
+
 // SetWindowSize set maximum window size
 func (s *UDPSession) SetWindowSize(sndwnd, rcvwnd int) {
 	s.mu.Lock()
@@ -427,7 +1029,48 @@ func (s *UDPSession) SetMtu(mtu int) bool {
 	return true
 }
 
-// SetStreamMode toggles the stream mode on/off
+// SetMtuDiscovery toggles the path MTU discovery, which probes the path with the
+// DF bit set for the largest MTU up to mtuLimit, and sets the MTU accordingly, see
+// GetMtu. The search starts from the current MTU, and falls back to 576 bytes if
+// it's too big, it's repeated every 10 minutes.
+//
+// An error is returned if the DF bit cannot be set, which is supported on Linux,
+// or by a net.PacketConn implementing `SetDontFragment(bool) error`, or in the
+// conv-less wire format with FEC. The socket is left untouched if it's accepted
+// from Listener, see Listener.SetMtuDiscovery.
+func (s *UDPSession) SetMtuDiscovery(enable bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !enable {
+		s.pmtu = nil
+		s.kcp.pmtu_state = 0
+		return nil
+	}
+	if s.pmtu != nil {
+		return nil
+	}
+	if s.noconvFEC { // the probes go without FEC
+		return errors.WithStack(ErrInvalidOperation)
+	}
+
+	if s.l == nil {
+		if err := setDontFragment(s.conn); err != nil {
+			return err
+		}
+	}
+	s.pmtu = &pmtuState{lo: int(s.kcp.mtu), hi: mtuLimit}
+	return nil
+}
+
+// GetMtu returns the MTU of the session, as discovered if SetMtuDiscovery is enabled
+func (s *UDPSession) GetMtu() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int(s.kcp.mtu)
+}
+
+// SetStreamMode toggles the stream mode on/off, the message boundaries are kept
+// with it off, see WriteMessage and ReadMessage
 func (s *UDPSession) SetStreamMode(enable bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -438,6 +1081,17 @@ func (s *UDPSession) SetStreamMode(enable bool) {
 	}
 }
 
+// SetStreamFlush toggles sending each Write in stream mode at once, even if it
+// doesn't fill a segment and SetWriteDelay is on, trading the coalescing of small
+// writes for latency, e.g. for interactive traffic. The data still waits for the
+// congestion window, which the remote opens sooner with SetACKNoDelay, and for
+// the pacing of SetMaxSendRate and SetAutoPacing.
+func (s *UDPSession) SetStreamFlush(immediate bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streamFlush = immediate
+}
+
 // SetACKNoDelay changes ack flush option, set true to flush ack immediately,
 func (s *UDPSession) SetACKNoDelay(nodelay bool) {
 	s.mu.Lock()
@@ -445,23 +1099,811 @@ func (s *UDPSession) SetACKNoDelay(nodelay bool) {
 	s.ackNoDelay = nodelay
 }
 
-// (deprecated)
-//
-// SetDUP duplicates udp packets for kcp output.
-func (s *UDPSession) SetDUP(dup int) {
+// SetACKDelay sends the acks within 'd' after the first one is due, coalesced into
+// an ack-only packet unless data is sent meanwhile, instead of waiting for the next
+// update interval. It's between SetACKNoDelay, which sends them for each incoming
+// packet and takes precedence, and the default of 0 waiting for the interval.
+func (s *UDPSession) SetACKDelay(d time.Duration) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.dup = dup
+	if d < 0 {
+		d = 0
+	}
+	s.ackDelay = d
 }
 
-// SetNoDelay calls nodelay() of kcp
-// https://github.com/skywind3000/kcp/blob/master/README.en.md#protocol-configuration
-func (s *UDPSession) SetNoDelay(nodelay, interval, resend, nc int) {
+// delayAck schedules the flush of the acks pending by SetACKDelay
+func (s *UDPSession) delayAck() {
+	if s.ackDelay > 0 && !s.ackSched && len(s.kcp.acklist) > 0 {
+		s.ackSched = true
+		s.sched.Put(s.flushAck, time.Now().Add(s.ackDelay))
+	}
+}
+
+// flushAck sends the acks delayed by SetACKDelay
+func (s *UDPSession) flushAck() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ackSched = false
+	select {
+	case <-s.die:
+		return
+	default:
+	}
+	if len(s.kcp.acklist) > 0 {
+		s.kcp.flush(true)
+		s.uncork()
+	}
+}
+
+// SetFastRetransmitLimit limits the fast and early retransmissions of a segment to
+// its first 'n' transmissions, the RTO retransmits it beyond, e.g. 5 as the
+// fastlimit of the original KCP. Set 0 for unlimited(default).
+func (s *UDPSession) SetFastRetransmitLimit(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n < 0 {
+		n = 0
+	}
+	s.kcp.fastlimit = int32(n)
+}
+
+// SetMaxRetries sets the maximum retransmissions of a segment, the session breaks
+// once exceeded, with Read and Write returning ErrBrokenPipe, and it's removed from
+// the Listener. Set 0 to disable dead link detection(default).
+func (s *UDPSession) SetMaxRetries(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n > 0 {
+		s.maxRetries = n
+		s.kcp.dead_link = uint32(n) + 1 // the first transmission is not a retry
+	} else {
+		s.maxRetries = 0
+		s.kcp.dead_link = IKCP_DEADLINK
+	}
+}
+
+// SetKeepAlive sends a probe to the remote whenever nothing has been sent within
+// 'interval', to keep the NAT mappings alive, set 0 to disable(default).
+//
+// The probes are answered by the remote, so a quiet session is not closed by
+// the idle timeout on either side.
+func (s *UDPSession) SetKeepAlive(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keepAlive = interval
+}
+
+// SetIdleTimeout closes the session if no valid packet has been received within 'd',
+// after which Read and Write return ErrIdleTimeout, set 0 to disable(default),
+// see also Listener.SetIdleTimeout.
+func (s *UDPSession) SetIdleTimeout(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idleTimeout = d
+}
+
+// SetInitialWindow starts the congestion window of the default congestion control
+// from 'segments' instead of 1, bounded by the send window, for the links of a known
+// capacity. It's meant to be called before writing, the window grows from there,
+// and an RTO still collapses it to 1.
+func (s *UDPSession) SetInitialWindow(segments uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if segments > s.kcp.snd_wnd {
+		segments = s.kcp.snd_wnd
+	}
+	if segments > 0 {
+		s.kcp.cwnd = segments
+		s.kcp.incr = segments * s.kcp.mss
+	}
+}
+
+// SetCongestionController replaces the congestion control of the session,
+// set nil to restore the default loss-based one.
+func (s *UDPSession) SetCongestionController(cc CongestionController) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cc == nil {
+		cc = &lossController{s.kcp}
+	}
+	s.kcp.cc = cc
+}
+
+// SetCongestionCallback sets a callback notified of the congestion window and the
+// slow start threshold in segments when they change on ACKs or flushes, along with
+// the segments in flight. It runs in a goroutine of its own, and the changes during
+// a slow callback are coalesced into the latest one. Set nil to remove it.
+func (s *UDPSession) SetCongestionCallback(f func(cwnd, ssthresh, inflight uint32)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.windowCallback = f
+	s.windowReported = [2]uint32{}
+}
+
+// window returns the congestion window and the slow start threshold
+func (s *UDPSession) window() [2]uint32 {
+	return [2]uint32{s.kcp.cc.Window(), s.kcp.ssthresh}
+}
+
+// notifyWindow starts reporting to the congestion callback if the window has
+// changed and no report is ongoing
+func (s *UDPSession) notifyWindow() {
+	if s.windowCallback == nil || s.windowReporting || s.kcp.nocwnd != 0 {
+		return
+	}
+	if s.window() != s.windowReported {
+		s.windowReporting = true
+		go s.reportWindow()
+	}
+}
+
+// reportWindow calls the congestion callback until it has seen the latest window
+func (s *UDPSession) reportWindow() {
+	for {
+		s.mu.Lock()
+		f, window := s.windowCallback, s.window()
+		inflight := s.kcp.snd_nxt - s.kcp.snd_una
+		select {
+		case <-s.die:
+			f = nil
+		default:
+		}
+		if f == nil || window == s.windowReported {
+			s.windowReporting = false
+			s.mu.Unlock()
+			return
+		}
+		s.windowReported = window
+		s.mu.Unlock()
+		f(window[0], window[1], inflight)
+	}
+}
+
+// (deprecated)
+//
+// SetDUP duplicates udp packets for kcp output.
+func (s *UDPSession) SetDUP(dup int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dup = dup
+}
+
+// SetReplayProtection toggles the replay protection, with it enabled every packet
+// carries a counter and the packets received already or too old are dropped, it's
+// meaningful only with encryption, where the counter cannot be forged.
+//
+// It changes the packet format, so it must be enabled on both sides before any data
+// is exchanged, see also Listener.SetReplayProtection. Duplicated packets by SetDUP
+// are dropped as replays.
+func (s *UDPSession) SetReplayProtection(enable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if enable == (s.replay != 0) {
+		return
+	}
+
+	delta := replayHeaderSize
+	if enable {
+		atomic.StoreInt32(&s.replay, 1)
+	} else {
+		atomic.StoreInt32(&s.replay, 0)
+		delta = -delta
+	}
+	s.headerSize += delta
+	s.kcp.ReserveBytes(s.headerSize)
+	if s.fecEncoder != nil {
+		s.fecEncoder.headerOffset += delta
+		s.fecEncoder.payloadOffset += delta
+	}
+}
+
+// SetPacketAuthenticator replaces the packet integrity check, which is CRC32 for
+// the encrypted sessions and nothing otherwise by default, the code of Overhead()
+// bytes follows the nonce, or leads the packet if not encrypted. A nil 'auth'
+// disables the check.
+//
+// It must be set on both sides before any data is exchanged, the accepted sessions
+// follow Listener.SetPacketAuthenticator.
+func (s *UDPSession) SetPacketAuthenticator(auth PacketAuthenticator) error {
+	if s.l != nil {
+		return errors.WithStack(ErrInvalidOperation)
+	}
+	s.setPacketAuthenticator(auth)
+	return nil
+}
+
+func (s *UDPSession) setPacketAuthenticator(auth PacketAuthenticator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delta := 0
+	if s.auth != nil {
+		delta -= s.auth.Overhead()
+	}
+	if auth != nil {
+		delta += auth.Overhead()
+	}
+
+	s.auth = auth
+	s.cryptHeader += delta
+	s.headerSize += delta
+	s.kcp.ReserveBytes(s.headerSize)
+	if s.fecEncoder != nil {
+		s.fecEncoder.headerOffset += delta
+		s.fecEncoder.payloadOffset += delta
+	}
+}
+
+// SetAdaptiveFEC lets the parity shards follow the loss rate observed by the FEC
+// decoder every few seconds, between minParity and maxParity per the data shards,
+// it assumes the loss rates of both directions are similar. (0, 0) disables it,
+// and the current parity shards are kept.
+//
+// The changes take effect at the shard group boundaries, and the shard counts are
+// signaled in the FEC headers for the remote decoder to regroup, which requires
+// the remote of this version. It requires FEC enabled.
+func (s *UDPSession) SetAdaptiveFEC(minParity, maxParity int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if minParity == 0 && maxParity == 0 {
+		s.fecMinParity, s.fecMaxParity = 0, 0
+		return nil
+	}
+	if s.fecEncoder == nil || minParity <= 0 || maxParity < minParity || s.fecEncoder.nextDataShards+maxParity > rs8Shards {
+		return errors.WithStack(ErrInvalidOperation)
+	}
+
+	s.fecMinParity, s.fecMaxParity = minParity, maxParity
+	s.fecAdapted = time.Now()
+	s.fecEncoder.signal = true
+	if s.fecDecoder != nil {
+		s.fecDecoder.lossRate() // restart the statistics
+	}
+	return nil
+}
+
+// SetFEC changes the FEC shards of a live session in both directions, (0, 0)
+// disables FEC, and it's rejected if parityShards > dataShards or the total is
+// beyond 1024. The outgoing shards switch at the next shard group boundary, so the
+// packets in flight are neither dropped nor re-encoded, and it disables adaptive
+// FEC. The shards must be supported by the codec of SetFECCodec.
+//
+// Both sides must agree on the shards, a mismatch breaks the recovery until the
+// decoder re-tunes. FEC can be enabled on a session without it only when nothing
+// is waiting to be sent, since the FEC header takes room from the segments, and
+// likewise for going beyond 255 shards, where Reed-Solomon is over GF(2^16) and
+// the parity shards take one more byte of room.
+func (s *UDPSession) SetFEC(dataShards, parityShards int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkFECShards(dataShards, parityShards); err != nil {
+		return err
+	}
+	if err := s.setTxFEC(dataShards, parityShards); err != nil {
+		return err
+	}
+	s.setRxFEC(dataShards, parityShards)
+	return nil
+}
+
+// SetTxFEC changes the FEC shards of the outgoing packets only, e.g. to protect
+// a lossy uplink, (0, 0) disables the parity shards, see SetFEC for details. The
+// remote must decode with the same shards by SetRxFEC or SetFEC.
+func (s *UDPSession) SetTxFEC(dataShards, parityShards int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkFECShards(dataShards, parityShards); err != nil {
+		return err
+	}
+	return s.setTxFEC(dataShards, parityShards)
+}
+
+// SetRxFEC changes the FEC shards expected from the remote only, (0, 0) stops
+// the recovery, such that the data shards are taken as they are and the parity
+// shards are dropped, see SetFEC for details.
+func (s *UDPSession) SetRxFEC(dataShards, parityShards int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkFECShards(dataShards, parityShards); err != nil {
+		return err
+	}
+	s.setRxFEC(dataShards, parityShards)
+	return nil
+}
+
+// checkFECShards validates the shards for the codec, (0, 0) is valid for disabling
+func (s *UDPSession) checkFECShards(dataShards, parityShards int) error {
+	if s.noconv && (dataShards > 0) != s.noconvFEC {
+		return errors.WithStack(ErrInvalidOperation)
+	}
+	if dataShards == 0 && parityShards == 0 {
+		return nil
+	}
+	if dataShards <= 0 || parityShards <= 0 || parityShards > dataShards || dataShards+parityShards > rs16Shards {
+		return errors.WithStack(ErrInvalidOperation)
+	}
+	if _, err := newFECCodec(s.fecCodec, dataShards, parityShards); err != nil {
+		return err
+	}
+	return nil
+}
+
+// setTxFEC changes the shards of fecEncoder, and disables adaptive FEC
+func (s *UDPSession) setTxFEC(dataShards, parityShards int) error {
+	switch {
+	case dataShards == 0 && parityShards == 0:
+		if s.fecEncoder != nil {
+			s.interleave()
+			s.fecEncoder = nil
+			s.headerSize -= fecHeaderSizePlus2 + s.fecPad
+			s.fecPad = 0
+			s.kcp.ReserveBytes(s.headerSize)
+		}
+	case s.fecEncoder != nil:
+		// the padding is kept until FEC is off, as the open shard group may be wide
+		if pad := fecPadding(dataShards, parityShards); pad > s.fecPad {
+			if s.kcp.WaitSnd() > 0 {
+				return errors.WithStack(ErrInvalidOperation)
+			}
+			s.fecPad = pad
+			s.headerSize += pad
+			s.kcp.ReserveBytes(s.headerSize)
+		}
+		s.fecEncoder.reshape(dataShards, parityShards)
+	default:
+		if s.kcp.WaitSnd() > 0 {
+			return errors.WithStack(ErrInvalidOperation)
+		}
+		offset := s.cryptHeader
+		if s.replay != 0 {
+			offset += replayHeaderSize
+		}
+		s.fecEncoder = newFECEncoder(dataShards, parityShards, offset)
+		s.fecEncoder.setCodec(s.fecCodec)
+		s.fecPad = fecPadding(dataShards, parityShards)
+		s.headerSize += fecHeaderSizePlus2 + s.fecPad
+		s.kcp.ReserveBytes(s.headerSize)
+	}
+	s.fecMinParity, s.fecMaxParity = 0, 0
+	return nil
+}
+
+// setRxFEC changes the shards of fecDecoder, (0, 0) turns off the decoding
+func (s *UDPSession) setRxFEC(dataShards, parityShards int) {
+	if dataShards == 0 && parityShards == 0 {
+		if s.fecDecoder != nil {
+			s.fecDecoder.release()
+			s.fecDecoder = nil
+		}
+		s.fecRxOff = true
+		return
+	}
+
+	s.fecRxOff = false
+	if s.fecDecoder != nil {
+		s.fecDecoder.reshape(dataShards, parityShards)
+	} else {
+		s.fecDecoder = s.newFECDecoder(dataShards, parityShards)
+	}
+}
+
+// SetFECCodec replaces the Reed-Solomon codec of FEC by the one created by 'f',
+// e.g. NewXORCodec for a single parity shard, nil restores Reed-Solomon. It fails
+// if 'f' doesn't support the current shards, and the outgoing shards switch at the
+// next shard group boundary.
+//
+// Both sides must use the same codec, a mismatch recovers garbage which is dropped
+// by the KCP input, see also Listener.SetFECCodec.
+func (s *UDPSession) SetFECCodec(f FECCodecFunc) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fecEncoder != nil {
+		if err := s.fecEncoder.setCodec(f); err != nil {
+			return err
+		}
+	}
+	if s.fecDecoder != nil {
+		s.fecDecoder.setCodec(f)
+	}
+	s.fecCodec = f
+	return nil
+}
+
+// SetMaxSendRate limits the bytes per second sent on wire, the packets of a flush
+// beyond the rate are held back and sent over time, 0 to disable.
+func (s *UDPSession) SetMaxSendRate(bytesPerSec int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bytesPerSec < 0 {
+		bytesPerSec = 0
+	}
+	s.maxSendRate = bytesPerSec
+	if !s.pacing() {
+		s.releasePaced(true)
+	}
+}
+
+// SetAutoPacing toggles the pacing at the rate of the window over the smoothed RTT,
+// which smooths the bursts of a flush without limiting the throughput, and it's
+// bounded by SetMaxSendRate if set. The packets without data such as the acks are
+// never delayed by pacing.
+func (s *UDPSession) SetAutoPacing(enable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.autoPacing = enable
+	if !s.pacing() {
+		s.releasePaced(true)
+	}
+}
+
+// newFECDecoder creates a FEC decoder with the codec and limits of the session
+func (s *UDPSession) newFECDecoder(dataShards, parityShards int) *fecDecoder {
+	dec := newFECDecoder(dataShards, parityShards)
+	if dec == nil {
+		return nil
+	}
+	dec.snmp = s.snmp
+	dec.setCodec(s.fecCodec)
+	dec.setLimits(s.fecRxGroups, s.fecRxMaxBytes)
+	dec.autoTuneOff = s.fecAutoTuneOff
+	return dec
+}
+
+// SetFECWindow bounds the memory of the FEC decoder, which keeps the packets of
+// the latest 'groups' shard groups for recovery, 3 by default, and at most 'maxBytes'
+// bytes of them if it's positive. The oldest packets are evicted beyond the limits,
+// which may leave their shard groups unrecoverable.
+func (s *UDPSession) SetFECWindow(groups, maxBytes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fecRxGroups, s.fecRxMaxBytes = groups, maxBytes
+	if s.fecDecoder != nil {
+		s.fecDecoder.setLimits(groups, maxBytes)
+	}
+}
+
+// SetInputHook sets a function called with each datagram read from the socket for
+// the session, before the decryption and FEC, e.g. to inspect the packets of other
+// KCP implementations. The datagram must not be modified or retained after the
+// function returns.
+//
+// The function runs in a goroutine of its own in the order of arrival, so it never
+// blocks the read loop, and the datagrams are skipped while 1024 of them are queued.
+// Set nil to remove it.
+func (s *UDPSession) SetInputHook(f func(raw []byte)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loadInputHook().close()
+	var h *inputHook
+	select {
+	case <-s.die:
+	default:
+		if f != nil {
+			h = newInputHook(f)
+		}
+	}
+	s.inputHook.Store(h)
+}
+
+// SetOutputHook sets a function called with each datagram just before it's written
+// to the socket, after the FEC and the encryption, returning the bytes to send
+// instead, e.g. for testing the loss resilience or obfuscation. Returning nil or
+// an empty slice drops the datagram, and the bytes returned are copied, longer
+// ones than 1500 bytes are dropped as well. 'raw' may be rewritten and returned.
+//
+// The function runs on the sending path with the session locked, so it delays the
+// session by blocking, and it must not call the methods of the session. The remote
+// gets exactly the bytes returned, a rewrite it doesn't undo before the decryption
+// breaks the session, while the drops are recovered like the losses on wire.
+// Set nil to remove it.
+func (s *UDPSession) SetOutputHook(f func(raw []byte) []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outputHook = f
+}
+
+// loadInputHook returns the hook set by SetInputHook, nil for none
+func (s *UDPSession) loadInputHook() *inputHook {
+	h, _ := s.inputHook.Load().(*inputHook)
+	return h
+}
+
+// SetFECRecoveryCallback sets a callback notified of the data shards recovered by
+// the parity shards and the ones lost for good, after each FEC packet changing them,
+// e.g. to drive SetFEC. It runs on the TimedSched of the session rather than in the packet input,
+// and it should return quickly not to delay the scheduled tasks. Set nil to remove it.
+func (s *UDPSession) SetFECRecoveryCallback(f func(recovered, lost int)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fecRecovery = f
+}
+
+// SetFECAutoTune toggles the tuning of the decoder to the shards detected from the
+// period of the incoming packets, it's on by default. The shards signaled by
+// adaptive FEC and set by SetFEC/SetRxFEC are applied regardless.
+func (s *UDPSession) SetFECAutoTune(enable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fecAutoTuneOff = !enable
+	if s.fecDecoder != nil {
+		s.fecDecoder.autoTuneOff = !enable
+	}
+}
+
+// SetWriteBufferLimit makes Write block, until the write deadline, while the bytes
+// waiting to be sent or acknowledged plus the bytes to write exceed 'maxBytes', a
+// Write is never blocked by the limit if nothing is waiting. Set 0 to disable(default),
+// which only bounds the queue by the window.
+func (s *UDPSession) SetWriteBufferLimit(maxBytes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeLimit = maxBytes
+}
+
+// SetReadBufferLimit bounds the bytes received but not read, in order or not, by
+// 'maxBytes', the segments beyond are dropped unacknowledged and counted in
+// RcvLimitDrops, and the window told to the remote shrinks with the bytes held.
+// A segment of room is kept for the data in order, so 'maxBytes' should be a few
+// segments at least. Set 0 to disable(default), which only bounds them by the window.
+func (s *UDPSession) SetReadBufferLimit(maxBytes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcp.rcv_limit = maxBytes
+}
+
+// SetFECInterleave interleaves the packets of 'depth' consecutive shard groups on
+// wire, e.g. the first packets of the groups, then the second ones, so a burst of
+// loss costs each group a few packets within its parity. It delays the packets by
+// up to depth groups, a low-rate flow needs SetFECFlushTimeout to bound the delay,
+// and the remote needs a FEC window of more than depth groups, see SetFECWindow.
+// Set 0 or 1 to disable(default).
+func (s *UDPSession) SetFECInterleave(depth int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.interleave()
+	s.uncork()
+	s.fecInterleave = depth
+}
+
+// SetFECFlushTimeout completes a shard group open for 'd' with the segments telling
+// the window size, which are harmless to the remote, so a low-rate flow gets its
+// parity shards in time instead of after dataShards packets, at the cost of the
+// extra packets. Set 0 to disable(default).
+func (s *UDPSession) SetFECFlushTimeout(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fecFlushTimeout = d
+}
+
+// GetFECShards returns the data and parity shards of the outgoing packets,
+// (0, 0) if FEC is disabled.
+func (s *UDPSession) GetFECShards() (dataShards, parityShards int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fecEncoder == nil {
+		return 0, 0
+	}
+	return s.fecEncoder.dataShards, s.fecEncoder.parityShards
+}
+
+// SetKeyRotation toggles the 1-byte key epoch appended to the packets, which lets
+// the keys be replaced by SetBlockCrypt without interrupting the session.
+//
+// It has no effect without encryption, and it must be enabled on both sides before
+// any data is exchanged, see also Listener.SetKeyRotation.
+func (s *UDPSession) SetKeyRotation(enable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.block == nil || enable == (s.rotation != 0) {
+		return
+	}
+
+	delta := epochSize
+	if enable {
+		atomic.StoreInt32(&s.rotation, 1)
+	} else {
+		atomic.StoreInt32(&s.rotation, 0)
+		delta = -delta
+	}
+	s.trailerSize += delta
+	s.headerSize += delta
+	s.kcp.ReserveBytes(s.headerSize)
+}
+
+// SetBlockCrypt replaces the key of the session and advances the key epoch, the
+// packets of the previous epoch are still accepted for a grace period, so the
+// remote can switch to the same key at any time within it.
+//
+// Key rotation must be enabled, and 'next' must be of the same kind as the current
+// key, i.e. both AEAD with the same tag size or neither. An AEAD key seals up to
+// 2^32 packets, and must be replaced before, or Write fails with ErrKeyExhausted.
+func (s *UDPSession) SetBlockCrypt(next BlockCrypt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rotation == 0 || next == nil {
+		return errors.WithStack(ErrInvalidOperation)
+	}
+
+	aead, _ := next.(AEADCrypt)
+	if (aead == nil) != (s.aead == nil) || (aead != nil && aead.Overhead() != s.tagSize) {
+		return errors.WithStack(ErrInvalidOperation)
+	}
+
+	s.prevBlock = s.block
+	s.prevExpiry = time.Now().Add(keyGracePeriod)
+	s.block = next
+	s.aead = aead
+	s.epoch++
+	return nil
+}
+
+// SetLinger sets how Close waits for the data written to be acknowledged, like
+// SO_LINGER of TCP. A positive 'sec' bounds the wait in seconds, 0 closes at once
+// as by default, which drops the data not yet sent, and a negative one waits until
+// all has been acknowledged or the link is dead, once a segment has been sent
+// as many times as SetMaxRetries allows, 20 by default.
+//
+// Only the Close called by the user lingers, the sessions closed by the idle
+// timeout or replaced by a new conv close at once.
+func (s *UDPSession) SetLinger(sec int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.linger = sec
+}
+
+// lingerSend blocks until the data written has been acknowledged or the link is
+// dead, within 'sec' seconds if it's positive.
+func (s *UDPSession) lingerSend(sec int) {
+	var timeout <-chan time.Time
+	if sec > 0 {
+		timer := time.NewTimer(time.Duration(sec) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	ticker := time.NewTicker(lingerInterval)
+	defer ticker.Stop()
+
+	for {
+		s.mu.Lock()
+		done := s.kcp.WaitSnd() == 0 || s.kcp.state == 0xFFFFFFFF
+		s.mu.Unlock()
+		if done {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			return
+		case <-s.chSocketWriteError:
+			return
+		case <-s.die:
+			return
+		}
+	}
+}
+
+// SetCloseNotify toggles the FIN handshake, with it enabled Close sends a FIN segment
+// behind the pending data, and Read returns io.EOF after the remote FIN has been
+// received and all the data before it have been read.
+//
+// FIN is rejected by the peers without this option, so it must be enabled on both sides
+// before any data is exchanged, see also Listener.SetCloseNotify.
+func (s *UDPSession) SetCloseNotify(enable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if enable {
+		s.kcp.fin = 1
+	} else {
+		s.kcp.fin = 0
+	}
+}
+
+// SetRTOBounds sets the range of the retransmission timeout computed from the RTT,
+// 'min' must be no less than the update interval, and less than 'max'.
+//
+// SetNoDelay resets the lower bound, so it should be called before SetRTOBounds.
+func (s *UDPSession) SetRTOBounds(min, max time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	minrto, maxrto := min/time.Millisecond, max/time.Millisecond
+	if minrto < time.Duration(s.kcp.interval) || minrto >= maxrto || maxrto > math.MaxInt32 {
+		return errors.WithStack(ErrInvalidOperation)
+	}
+	s.kcp.rx_minrto = uint32(minrto)
+	s.kcp.rx_maxrto = uint32(maxrto)
+	s.kcp.rx_rto = _ibound_(s.kcp.rx_minrto, s.kcp.rx_rto, s.kcp.rx_maxrto)
+	return nil
+}
+
+// SetNoDelay calls nodelay() of kcp
+// https://github.com/skywind3000/kcp/blob/master/README.en.md#protocol-configuration
+func (s *UDPSession) SetNoDelay(nodelay, interval, resend, nc int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.kcp.NoDelay(nodelay, interval, resend, nc)
 }
 
+// GetNoDelay returns the current parameters of SetNoDelay
+func (s *UDPSession) GetNoDelay() (nodelay, interval, resend, nc int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int(s.kcp.nodelay), int(s.kcp.interval), int(s.kcp.fastresend), int(s.kcp.nocwnd)
+}
+
+// SetInterval sets the internal update interval in milliseconds, clamped to [10, 5000]
+// like SetNoDelay, the other parameters are kept.
+func (s *UDPSession) SetInterval(ms int) {
+	if ms < 0 {
+		ms = 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcp.NoDelay(-1, ms, -1, -1)
+}
+
+// SetUpdateJitter toggles shifting each update of the session randomly by up to a
+// quarter of the interval, so the sessions created in a burst drift apart instead
+// of flushing in lockstep. It's off by default for the exact timing.
+func (s *UDPSession) SetUpdateJitter(enable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jitter = enable
+}
+
+// SetResend sets the duplicated acks triggering a fast retransmission, 0 to disable,
+// the other parameters are kept.
+func (s *UDPSession) SetResend(n int) {
+	if n < 0 {
+		n = 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcp.NoDelay(-1, -1, n, -1)
+}
+
+// SetRACK toggles the time-based loss detection like RACK in place of counting
+// the duplicate acks by the resend parameter of SetNoDelay, for the links with
+// heavy reordering. A segment is retransmitted once a segment sent after it is
+// acknowledged and it has been unacknowledged for SRTT plus the reordering window,
+// which is the reordering observed plus a quarter of SRTT, up to SRTT. The
+// retransmissions are counted in FastRetransSegs.
+func (s *UDPSession) SetRACK(enable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if enable {
+		s.kcp.rack = 1
+	} else {
+		s.kcp.rack = 0
+	}
+}
+
+// SetTailLossProbe toggles the tail loss probe. When nothing new is sent after the
+// last segment in flight, it's retransmitted once after 1.5 SRTT, at least an
+// interval, so a lost tail gets acknowledged or fast retransmitted before the RTO,
+// e.g. for the requests of RPC. The probes are counted in TLPSegs, and they're
+// redundant if the tail was just late.
+func (s *UDPSession) SetTailLossProbe(enable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if enable {
+		s.kcp.tlp = 1
+	} else {
+		s.kcp.tlp = 0
+	}
+}
+
+// SetNC toggles the congestion control off, the other parameters are kept.
+func (s *UDPSession) SetNC(nc bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if nc {
+		s.kcp.NoDelay(-1, -1, -1, 1)
+	} else {
+		s.kcp.NoDelay(-1, -1, -1, 0)
+	}
+}
+
 // SetDSCP sets the 6bit DSCP field in IPv4 header, or 8bit Traffic Class in IPv6 header.
 //
 // if the underlying connection has implemented `func SetDSCP(int) error`, SetDSCP() will invoke
@@ -472,28 +1914,39 @@ func (s *UDPSession) SetDSCP(dscp int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.l != nil {
-		return errInvalidOperation
+		return ErrInvalidOperation
 	}
 
-	// interface enabled
-	if ts, ok := s.conn.(setDSCP); ok {
-		return ts.SetDSCP(dscp)
-	}
+	s.dscp = dscp
+	return setTOS(s.conn, dscp, s.kcp.ecn != 0)
+}
 
-	if nc, ok := s.conn.(net.Conn); ok {
-		var succeed bool
-		if err := ipv4.NewConn(nc).SetTOS(dscp << 2); err == nil {
-			succeed = true
-		}
-		if err := ipv6.NewConn(nc).SetTrafficClass(dscp); err == nil {
-			succeed = true
-		}
+// SetECN toggles ECN, with it enabled the outgoing packets are marked ECT(0), and
+// the packets received with the CE mark are echoed to the remote, which takes the
+// echo as a loss without retransmission.
+//
+// The echo is rejected by the peers without this option, so it must be enabled on
+// both sides, see also Listener.SetECN. The CE marks are detected on Linux only.
+//
+// The socket is left untouched if it's accepted from Listener.
+func (s *UDPSession) SetECN(enable bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if enable {
+		s.kcp.ecn = 1
+	} else {
+		s.kcp.ecn = 0
+	}
+	if s.l != nil {
+		return nil
+	}
 
-		if succeed {
-			return nil
-		}
+	if !enable {
+		atomic.StoreInt32(&s.recvTOS, 0)
+	} else if setRecvTOS(s.conn) == nil {
+		atomic.StoreInt32(&s.recvTOS, 1)
 	}
-	return errInvalidOperation
+	return setTOS(s.conn, s.dscp, enable)
 }
 
 // SetReadBuffer sets the socket read buffer, no effect if it's accepted from Listener
@@ -505,7 +1958,7 @@ func (s *UDPSession) SetReadBuffer(bytes int) error {
 			return nc.SetReadBuffer(bytes)
 		}
 	}
-	return errInvalidOperation
+	return ErrInvalidOperation
 }
 
 // SetWriteBuffer sets the socket write buffer, no effect if it's accepted from Listener
@@ -517,99 +1970,398 @@ func (s *UDPSession) SetWriteBuffer(bytes int) error {
 			return nc.SetWriteBuffer(bytes)
 		}
 	}
-	return errInvalidOperation
+	return ErrInvalidOperation
+}
+
+// SetTimedSched moves the timed functions of the session, such as its updates, to
+// 'ts', nil for SystemTimedSched(default). The session stops updating if 'ts' is
+// closed before the session. The accepted sessions follow Listener.SetTimedSched.
+func (s *UDPSession) SetTimedSched(ts *TimedSched) {
+	if ts == nil {
+		ts = SystemTimedSched
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ts == s.sched || s.updater == nil {
+		return
+	}
+	s.sched.Cancel(s.updater)
+	s.sched = ts
+	s.updater = ts.PutWithCancel(s.update, time.Now())
+}
+
+// GetReadBuffer returns the socket read buffer as granted by the kernel, which may
+// be clamped, or doubled on Linux, from the value set. It's supported on Linux.
+func (s *UDPSession) GetReadBuffer() (int, error) {
+	return getReadBuffer(s.conn)
+}
+
+// GetWriteBuffer returns the socket write buffer as granted by the kernel, see
+// GetReadBuffer.
+func (s *UDPSession) GetWriteBuffer() (int, error) {
+	return getWriteBuffer(s.conn)
 }
 
 // post-processing for sending a packet from kcp core
 // steps:
-// 1. FEC packet generation
-// 2. CRC32 integrity
-// 3. Encryption
-// 4. TxQueue
+// 1. Compression
+// 2. FEC packet generation
+// 3. Authentication code
+// 4. Encryption
+// 5. TxQueue
 func (s *UDPSession) output(buf []byte) {
 	var ecc [][]byte
 
-	// 1. FEC encoding
+	offset := s.headerSize - s.trailerSize - s.fecPad
+	control := s.pacing() && isControl(buf[offset:], s.kcp.noconv)
+
+	// 1. compression
+	if s.compressor != nil {
+		buf = s.compress(buf, offset)
+	}
+
+	// 2. FEC encoding
 	if s.fecEncoder != nil {
 		ecc = s.fecEncoder.encode(buf)
+		if n := uint64(len(ecc)); n > 0 {
+			atomic.AddUint64(&DefaultSnmp.FECParitySent, n)
+			atomic.AddUint64(&s.snmp.FECParitySent, n)
+		}
 	}
 
-	// 2&3. crc32 & encryption
-	if s.block != nil {
-		s.nonce.Fill(buf[:nonceSize])
-		checksum := crc32.ChecksumIEEE(buf[cryptHeaderSize:])
-		binary.LittleEndian.PutUint32(buf[nonceSize:], checksum)
-		s.block.Encrypt(buf, buf)
+	// 4. packet counter, authentication code & encryption
+	s.seal(buf)
+	for k := range ecc {
+		s.seal(ecc[k])
+	}
 
-		for k := range ecc {
-			s.nonce.Fill(ecc[k][:nonceSize])
-			checksum := crc32.ChecksumIEEE(ecc[k][cryptHeaderSize:])
-			binary.LittleEndian.PutUint32(ecc[k][nonceSize:], checksum)
-			s.block.Encrypt(ecc[k], ecc[k])
+	// 5. TxQueue, or the shard group being interleaved
+	s.lastOutput = time.Now()
+	queue := &s.txqueue
+	if s.fecInterleave > 1 && s.fecEncoder != nil {
+		if len(s.ilvGroups) == 0 {
+			s.ilvNextGroup()
+			s.ilvOpened = s.lastOutput
 		}
+		queue = &s.ilvGroups[len(s.ilvGroups)-1]
+	} else if control {
+		queue = &s.ctrlqueue
 	}
 
-	// 4. TxQueue
 	var msg ipv4.Message
 	for i := 0; i < s.dup+1; i++ {
-		bts := xmitBuf.Get().([]byte)[:len(buf)]
-		copy(bts, buf)
-		msg.Buffers = [][]byte{bts}
+		msg.Buffers = [][]byte{s.wire(buf)}
 		msg.Addr = s.remote
-		s.txqueue = append(s.txqueue, msg)
+		*queue = append(*queue, msg)
 	}
 
 	for k := range ecc {
-		bts := xmitBuf.Get().([]byte)[:len(ecc[k])]
-		copy(bts, ecc[k])
-		msg.Buffers = [][]byte{bts}
+		msg.Buffers = [][]byte{s.wire(ecc[k])}
 		msg.Addr = s.remote
-		s.txqueue = append(s.txqueue, msg)
+		*queue = append(*queue, msg)
+	}
+
+	// a shard group is complete
+	if s.fecInterleave > 1 && s.fecEncoder != nil && len(ecc) > 0 {
+		if len(s.ilvGroups) >= s.fecInterleave {
+			s.interleave()
+		} else {
+			s.ilvNextGroup()
+		}
 	}
 }
 
+// seal sets the packet counter for replay protection, covered by the authentication
+// code following the nonce, and encrypts a packet in place unless it's AEAD
+func (s *UDPSession) seal(buf []byte) {
+	if atomic.LoadInt32(&s.replay) != 0 {
+		s.txCounter++
+		binary.LittleEndian.PutUint64(buf[s.replayOffset():], s.txCounter)
+	}
+
+	if s.auth != nil {
+		s.auth.Sign(buf[s.cryptHeader-s.auth.Overhead():])
+	}
+
+	if s.block != nil {
+		s.nonce.Fill(buf[:nonceSize])
+		if s.aead == nil {
+			s.block.Encrypt(buf, buf)
+		}
+	}
+}
+
+// wire copies a sealed packet to a buffer from xmitBuf with the trailer, AEAD seals
+// while copying
+func (s *UDPSession) wire(buf []byte) []byte {
+	bts := xmitBuf.Get(len(buf) + s.trailerSize)
+	if s.aead != nil {
+		s.aead.Seal(bts, buf)
+		if c, ok := s.aead.(*aeadCrypt); ok && c.exhausted() {
+			s.notifyWriteError(errors.WithStack(ErrKeyExhausted))
+		}
+	} else {
+		copy(bts, buf)
+	}
+	if s.rotation != 0 {
+		bts[len(bts)-1] = s.epoch
+	}
+	return bts
+}
+
+// ilvNextGroup opens a shard group to interleave, reusing the memory of the previous ones
+func (s *UDPSession) ilvNextGroup() {
+	if len(s.ilvGroups) < cap(s.ilvGroups) {
+		s.ilvGroups = s.ilvGroups[:len(s.ilvGroups)+1]
+	} else {
+		s.ilvGroups = append(s.ilvGroups, nil)
+	}
+}
+
+// interleave moves the packets of the shard groups being interleaved to txqueue,
+// taking a packet from each group in turn, so a burst of loss on wire is spread
+// over the groups.
+func (s *UDPSession) interleave() {
+	for col, more := 0, true; more; col++ {
+		more = false
+		for _, group := range s.ilvGroups {
+			if col < len(group) {
+				s.txqueue = append(s.txqueue, group[col])
+				more = true
+			}
+		}
+	}
+	for k := range s.ilvGroups {
+		s.ilvGroups[k] = s.ilvGroups[k][:0]
+	}
+	s.ilvGroups = s.ilvGroups[:0]
+}
+
 // sess update to trigger protocol
 func (s *UDPSession) update() {
 	select {
 	case <-s.die:
 	default:
 		s.mu.Lock()
-		interval := s.kcp.flush(false)
+		// a window probe keeps the path alive without advancing the stream,
+		// and the remote answers with its window size
+		if s.keepAlive > 0 && time.Since(s.lastOutput) >= s.keepAlive {
+			s.kcp.probe |= IKCP_ASK_SEND
+			atomic.AddUint64(&DefaultSnmp.KeepAlives, 1)
+			atomic.AddUint64(&s.snmp.KeepAlives, 1)
+		}
+		if s.fecMaxParity > 0 && time.Since(s.fecAdapted) >= fecAdaptInterval {
+			s.adaptFEC()
+		}
+		if s.pmtu != nil {
+			s.pmtuUpdate()
+		}
+		delay := time.Duration(s.kcp.flush(false)) * time.Millisecond
+		if s.jitter {
+			delay = jitterDelay(delay)
+		}
+		if s.fecFlushTimeout > 0 && s.fecEncoder != nil {
+			if s.fecEncoder.expired(uint32(s.fecFlushTimeout/time.Millisecond)) ||
+				(len(s.ilvGroups) > 0 && time.Since(s.ilvOpened) >= s.fecFlushTimeout) {
+				s.flushFEC()
+			}
+		}
 		waitsnd := s.kcp.WaitSnd()
 		if waitsnd < int(s.kcp.snd_wnd) && waitsnd < int(s.kcp.rmt_wnd) {
 			s.notifyWriteEvent()
 		}
 		s.uncork()
+		dead := s.maxRetries > 0 && s.kcp.state == 0xFFFFFFFF
+		idle := s.idleTimeout > 0 && time.Since(s.lastInput) > s.idleTimeout
+		if !dead && !idle {
+			select {
+			case <-s.die: // closed meanwhile, and the updater canceled
+			default:
+				// self-synchronized timed scheduling
+				s.updater = s.sched.PutWithCancel(s.update, time.Now().Add(delay))
+			}
+		}
 		s.mu.Unlock()
-		// self-synchronized timed scheduling
-		SystemTimedSched.Put(s.update, time.Now().Add(time.Duration(interval)*time.Millisecond))
+
+		if dead {
+			s.notifyDeadLink()
+			return
+		}
+		if idle {
+			atomic.AddUint64(&DefaultSnmp.IdleClosed, 1)
+			atomic.AddUint64(&s.snmp.IdleClosed, 1)
+			atomic.StoreInt32(&s.idleClosed, 1)
+			s.closeNow()
+		}
+	}
+}
+
+// jitterDelay shifts 'd' randomly by up to 1/updateJitterDiv of it either way,
+// the mean is kept
+func jitterDelay(d time.Duration) time.Duration {
+	if span := int64(d) / updateJitterDiv; span > 0 {
+		d += time.Duration(mrand.Int63n(2*span+1) - span)
+	}
+	return d
+}
+
+// flushFEC completes the current shard group with window size segments, so the
+// parity shards are sent without waiting for more data
+func (s *UDPSession) flushFEC() {
+	for s.fecEncoder.shardCount > 0 {
+		s.kcp.tellWindow()
+	}
+	s.interleave()
+}
+
+// adaptFEC adjusts the parity shards by the loss rate observed by the FEC decoder,
+// with the parity shards twice as many as the data shards expected to be lost.
+func (s *UDPSession) adaptFEC() {
+	s.fecAdapted = time.Now()
+	if s.fecDecoder == nil {
+		return
 	}
+	loss, ok := s.fecDecoder.lossRate()
+	if !ok {
+		return
+	}
+
+	dataShards := s.fecEncoder.nextDataShards
+	parityShards := int(math.Ceil(2 * float64(dataShards) * loss / (1 - loss)))
+	if parityShards < s.fecMinParity {
+		parityShards = s.fecMinParity
+	} else if parityShards > s.fecMaxParity {
+		parityShards = s.fecMaxParity
+	}
+	s.fecEncoder.reshape(dataShards, parityShards)
 }
 
 // GetConv gets conversation id of a session
 func (s *UDPSession) GetConv() uint32 { return s.kcp.conv }
 
-// GetRTO gets current rto of the session
+// GetSnmp returns a snapshot of the statistics scoped to this session,
+// the connection-level counters such as CurrEstab and MaxConn are left zero.
+//
+// Every counter is accumulated into DefaultSnmp as well.
+func (s *UDPSession) GetSnmp() *Snmp { return s.snmp.Copy() }
+
+// FECStats returns a snapshot of the FEC statistics of the session, to tell the
+// losses repaired by FEC from the ones left to retransmission.
+func (s *UDPSession) FECStats() FECStats {
+	return FECStats{
+		ParitySent:     atomic.LoadUint64(&s.snmp.FECParitySent),
+		ParityReceived: atomic.LoadUint64(&s.snmp.FECParityShards),
+		Recovered:      atomic.LoadUint64(&s.snmp.FECRecovered),
+		RecoverErrors:  atomic.LoadUint64(&s.snmp.FECErrs),
+		GroupFails:     atomic.LoadUint64(&s.snmp.FECGroupFails),
+		ShortShards:    atomic.LoadUint64(&s.snmp.FECShortShards),
+		Evicted:        atomic.LoadUint64(&s.snmp.FECEvicted),
+	}
+}
+
+// Stats returns a snapshot of the counters and the protocol state of the session,
+// it's cheap enough to be polled periodically.
+func (s *UDPSession) Stats() SessionStats {
+	stats := SessionStats{
+		BytesSent:        atomic.LoadUint64(&s.snmp.BytesSent),
+		BytesReceived:    atomic.LoadUint64(&s.snmp.BytesReceived),
+		InSegs:           atomic.LoadUint64(&s.snmp.InSegs),
+		OutSegs:          atomic.LoadUint64(&s.snmp.OutSegs),
+		RetransSegs:      atomic.LoadUint64(&s.snmp.RetransSegs),
+		FastRetransSegs:  atomic.LoadUint64(&s.snmp.FastRetransSegs),
+		EarlyRetransSegs: atomic.LoadUint64(&s.snmp.EarlyRetransSegs),
+		TLPSegs:          atomic.LoadUint64(&s.snmp.TLPSegs),
+		LostSegs:         atomic.LoadUint64(&s.snmp.LostSegs),
+		RepeatSegs:       atomic.LoadUint64(&s.snmp.RepeatSegs),
+		OutOfWindow:      atomic.LoadUint64(&s.snmp.OutOfWindow),
+		FECRecovered:     atomic.LoadUint64(&s.snmp.FECRecovered),
+		InCsumErrors:     atomic.LoadUint64(&s.snmp.InCsumErrors),
+		InAuthErrors:     atomic.LoadUint64(&s.snmp.InAuthErrors),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats.Cwnd = s.kcp.cc.Window()
+	stats.SndWnd = s.kcp.snd_wnd
+	stats.RmtWnd = s.kcp.rmt_wnd
+	stats.SRTT = s.kcp.rx_srtt
+	stats.RTTVar = s.kcp.rx_rttvar
+	stats.RTO = s.kcp.rx_rto
+	for k := range s.kcp.snd_buf {
+		if s.kcp.snd_buf[k].acked == 0 {
+			stats.InFlight += len(s.kcp.snd_buf[k].data)
+		}
+	}
+	stats.SndQueue = len(s.kcp.snd_queue)
+	stats.RcvQueue = len(s.kcp.rcv_queue)
+	return stats
+}
+
+// WaitSnd gets how many segments are waiting to be sent or acknowledged, like
+// ikcp_waitsnd, e.g. to throttle the writes before the queue grows too long.
+func (s *UDPSession) WaitSnd() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kcp.WaitSnd()
+}
+
+// WaitRcv gets how many segments are received but not read yet, including the
+// ones waiting for the missing segments ahead of them.
+func (s *UDPSession) WaitRcv() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kcp.WaitRcv()
+}
+
+// GetRTO gets current rto of the session in milliseconds, within the bounds of SetRTOBounds
 func (s *UDPSession) GetRTO() uint32 {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	return s.kcp.rx_rto
 }
 
-// GetSRTT gets current srtt of the session
+// GetSRTT gets current srtt of the session in milliseconds, as updated by the latest ACK
 func (s *UDPSession) GetSRTT() int32 {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	return s.kcp.rx_srtt
 }
 
-// GetRTTVar gets current rtt variance of the session
+// GetSRTTVar gets current rtt variance of the session in milliseconds
 func (s *UDPSession) GetSRTTVar() int32 {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	return s.kcp.rx_rttvar
 }
 
+// SRTT gets current srtt of the session, as updated by the latest ACK, e.g. to
+// send application heartbeats at a few round trips apart:
+//
+//	interval := 4 * sess.SRTT()
+//	if interval < time.Second {
+//		interval = time.Second
+//	}
+//	ticker := time.NewTicker(interval)
+func (s *UDPSession) SRTT() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Duration(s.kcp.rx_srtt) * time.Millisecond
+}
+
+// RTTVar gets current rtt variance of the session
+func (s *UDPSession) RTTVar() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Duration(s.kcp.rx_rttvar) * time.Millisecond
+}
+
+// RTO gets current rto of the session, within the bounds of SetRTOBounds
+func (s *UDPSession) RTO() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Duration(s.kcp.rx_rto) * time.Millisecond
+}
+
 func (s *UDPSession) notifyReadEvent() {
 	select {
 	case s.chReadEvent <- struct{}{}:
@@ -631,6 +2383,15 @@ func (s *UDPSession) notifyReadError(err error) {
 	})
 }
 
+// notifyDeadLink breaks the session as the remote has stopped acknowledging
+func (s *UDPSession) notifyDeadLink() {
+	s.notifyReadError(errors.WithStack(ErrBrokenPipe))
+	s.notifyWriteError(errors.WithStack(ErrBrokenPipe))
+	if s.l != nil {
+		s.l.closeSession(s.RemoteAddr())
+	}
+}
+
 func (s *UDPSession) notifyWriteError(err error) {
 	s.socketWriteErrorOnce.Do(func() {
 		s.socketWriteError.Store(err)
@@ -638,48 +2399,148 @@ func (s *UDPSession) notifyWriteError(err error) {
 	})
 }
 
-// packet input stage
-func (s *UDPSession) packetInput(data []byte) {
-	decrypted := false
-	if s.block != nil && len(data) >= cryptHeaderSize {
-		s.block.Decrypt(data, data)
+// packet input stage, 'ce' for the ECN congestion experienced mark
+func (s *UDPSession) packetInput(data []byte, ce bool) {
+	s.loadInputHook().input(data)
+	block := s.block
+	if atomic.LoadInt32(&s.rotation) != 0 {
+		if block, data = s.epochKey(data); block == nil {
+			return
+		}
+	}
+
+	s.mu.Lock()
+	auth := s.auth
+	s.mu.Unlock()
+
+	data, decrypted := openPacket(block, auth, data, s.snmp)
+	if decrypted {
+		data = s.replayFilter(data)
+	}
+
+	if decrypted && len(data) >= s.kcp.overhead {
+		if ce {
+			s.inputCE()
+		}
+		s.kcpInput(data)
+	}
+}
+
+// openPacket decrypts and verifies a packet in place, returns the data behind the
+// nonce & authentication code, the failures are counted into DefaultSnmp and 'snmp'.
+func openPacket(block BlockCrypt, auth PacketAuthenticator, data []byte, snmp *Snmp) ([]byte, bool) {
+	if aead, ok := block.(AEADCrypt); ok {
+		tagSize := aead.Overhead()
+		if len(data) < nonceSize+tagSize {
+			return nil, false
+		}
+		if !aead.Open(data[:len(data)-tagSize], data) {
+			atomic.AddUint64(&DefaultSnmp.InAuthErrors, 1)
+			if snmp != nil {
+				atomic.AddUint64(&snmp.InAuthErrors, 1)
+			}
+			return nil, false
+		}
+		data = data[nonceSize : len(data)-tagSize]
+	} else if block != nil {
+		if len(data) < nonceSize {
+			return nil, false
+		}
+		block.Decrypt(data, data)
 		data = data[nonceSize:]
-		checksum := crc32.ChecksumIEEE(data[crcSize:])
-		if checksum == binary.LittleEndian.Uint32(data) {
-			data = data[crcSize:]
-			decrypted = true
-		} else {
+	}
+
+	if auth != nil {
+		if len(data) < auth.Overhead() {
+			return nil, false
+		}
+		if !auth.Verify(data) {
 			atomic.AddUint64(&DefaultSnmp.InCsumErrors, 1)
+			if snmp != nil {
+				atomic.AddUint64(&snmp.InCsumErrors, 1)
+			}
+			return nil, false
 		}
-	} else if s.block == nil {
-		decrypted = true
+		data = data[auth.Overhead():]
 	}
+	return data, true
+}
 
-	if decrypted && len(data) >= IKCP_OVERHEAD {
-		s.kcpInput(data)
+// epochKey strips the key epoch from the packet and returns the key of the epoch,
+// the key is nil if the epoch is unknown or its grace period has expired.
+func (s *UDPSession) epochKey(data []byte) (BlockCrypt, []byte) {
+	if len(data) < epochSize {
+		return nil, data
+	}
+	epoch := data[len(data)-1]
+	data = data[:len(data)-epochSize]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case epoch == s.epoch:
+		return s.block, data
+	case epoch == s.epoch-1 && s.prevBlock != nil && time.Now().Before(s.prevExpiry):
+		return s.prevBlock, data
+	}
+	atomic.AddUint64(&DefaultSnmp.UnknownEpochs, 1)
+	atomic.AddUint64(&s.snmp.UnknownEpochs, 1)
+	return nil, data
+}
+
+// replayOffset returns the offset of the packet counter for replay protection
+func (s *UDPSession) replayOffset() int {
+	return s.cryptHeader
+}
+
+// replayFilter strips the packet counter if replay protection is enabled,
+// returns nil if the packet has been received already or it's too old.
+func (s *UDPSession) replayFilter(data []byte) []byte {
+	if atomic.LoadInt32(&s.replay) == 0 {
+		return data
+	}
+
+	s.mu.Lock()
+	ok := len(data) >= replayHeaderSize && s.replayWin.accept(binary.LittleEndian.Uint64(data))
+	s.mu.Unlock()
+	if !ok {
+		atomic.AddUint64(&DefaultSnmp.ReplayDrops, 1)
+		atomic.AddUint64(&s.snmp.ReplayDrops, 1)
+		return nil
 	}
+	return data[replayHeaderSize:]
 }
 
 func (s *UDPSession) kcpInput(data []byte) {
 	var kcpInErrors, fecErrs, fecRecovered, fecParityShards uint64
+	var fecLost int
+	var onRecovery func(recovered, lost int)
+	var sched *TimedSched
 
-	fecFlag := binary.LittleEndian.Uint16(data[4:])
-	if fecFlag == typeData || fecFlag == typeParity { // 16bit kcp cmd [81-84] and frg [0-255] will not overlap with FEC type 0x00f1 0x00f2
+	fecFlag := fecPacket(data).flag()
+	if s.noconv && !s.noconvFEC {
+		fecFlag = 0 // the flag overlaps ts of the conv-less frames
+	}
+	if fecFlag == typeData || fecFlag == typeParity || fecFlag == typeParity16 { // kcp cmd [81-86] will not overlap with FEC type 0xf1-0xf3
 		if len(data) >= fecHeaderSizePlus2 {
 			f := fecPacket(data)
-			if f.flag() == typeParity {
+			if f.flag() != typeData {
 				fecParityShards++
 			}
 
 			// lock
 			s.mu.Lock()
+			s.lastInput = time.Now()
 			// if fecDecoder is not initialized, create one with default parameter
-			if s.fecDecoder == nil {
-				s.fecDecoder = newFECDecoder(1, 1)
+			if s.fecDecoder == nil && !s.fecRxOff {
+				s.fecDecoder = s.newFECDecoder(1, 1)
+			}
+			var recovers [][]byte
+			if s.fecDecoder != nil {
+				recovers = s.fecDecoder.decode(f)
 			}
-			recovers := s.fecDecoder.decode(f)
 			if f.flag() == typeData {
-				if ret := s.kcp.Input(data[fecHeaderSizePlus2:], true, s.ackNoDelay); ret != 0 {
+				if ret := s.frameInput(data[fecHeaderSizePlus2:], true); ret != 0 {
 					kcpInErrors++
 				}
 			}
@@ -688,7 +2549,7 @@ func (s *UDPSession) kcpInput(data []byte) {
 				if len(r) >= 2 { // must be larger than 2bytes
 					sz := binary.LittleEndian.Uint16(r)
 					if int(sz) <= len(r) && sz >= 2 {
-						if ret := s.kcp.Input(r[2:sz], false, s.ackNoDelay); ret == 0 {
+						if ret := s.frameInput(r[2:sz], false); ret == 0 {
 							fecRecovered++
 						} else {
 							kcpInErrors++
@@ -702,51 +2563,75 @@ func (s *UDPSession) kcpInput(data []byte) {
 				// recycle the recovers
 				xmitBuf.Put(r)
 			}
+			if s.fecDecoder != nil {
+				fecLost = s.fecDecoder.takeLost()
+			}
+			onRecovery, sched = s.fecRecovery, s.sched
 
 			// to notify the readers to receive the data
-			if n := s.kcp.PeekSize(); n > 0 {
+			if n := s.kcp.PeekSize(); n > 0 || s.kcp.peekFin() {
 				s.notifyReadEvent()
 			}
+			if len(s.kcp.dgrams) > 0 {
+				s.notifyDgramEvent()
+			}
 			// to notify the writers
 			waitsnd := s.kcp.WaitSnd()
 			if waitsnd < int(s.kcp.snd_wnd) && waitsnd < int(s.kcp.rmt_wnd) {
 				s.notifyWriteEvent()
 			}
 
+			s.delayAck()
 			s.uncork()
 			s.mu.Unlock()
 		} else {
 			atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+			atomic.AddUint64(&s.snmp.InErrs, 1)
 		}
 	} else {
 		s.mu.Lock()
-		if ret := s.kcp.Input(data, true, s.ackNoDelay); ret != 0 {
+		s.lastInput = time.Now()
+		if ret := s.frameInput(data, true); ret != 0 {
 			kcpInErrors++
 		}
-		if n := s.kcp.PeekSize(); n > 0 {
+		if n := s.kcp.PeekSize(); n > 0 || s.kcp.peekFin() {
 			s.notifyReadEvent()
 		}
+		if len(s.kcp.dgrams) > 0 {
+			s.notifyDgramEvent()
+		}
 		waitsnd := s.kcp.WaitSnd()
 		if waitsnd < int(s.kcp.snd_wnd) && waitsnd < int(s.kcp.rmt_wnd) {
 			s.notifyWriteEvent()
 		}
+		s.delayAck()
 		s.uncork()
 		s.mu.Unlock()
 	}
 
 	atomic.AddUint64(&DefaultSnmp.InPkts, 1)
 	atomic.AddUint64(&DefaultSnmp.InBytes, uint64(len(data)))
+	atomic.AddUint64(&s.snmp.InPkts, 1)
+	atomic.AddUint64(&s.snmp.InBytes, uint64(len(data)))
 	if fecParityShards > 0 {
 		atomic.AddUint64(&DefaultSnmp.FECParityShards, fecParityShards)
+		atomic.AddUint64(&s.snmp.FECParityShards, fecParityShards)
 	}
 	if kcpInErrors > 0 {
 		atomic.AddUint64(&DefaultSnmp.KCPInErrors, kcpInErrors)
+		atomic.AddUint64(&s.snmp.KCPInErrors, kcpInErrors)
 	}
 	if fecErrs > 0 {
 		atomic.AddUint64(&DefaultSnmp.FECErrs, fecErrs)
+		atomic.AddUint64(&s.snmp.FECErrs, fecErrs)
 	}
 	if fecRecovered > 0 {
 		atomic.AddUint64(&DefaultSnmp.FECRecovered, fecRecovered)
+		atomic.AddUint64(&s.snmp.FECRecovered, fecRecovered)
+	}
+	if onRecovery != nil && (fecRecovered > 0 || fecLost > 0) {
+		recovered := int(fecRecovered)
+		sched.Put(func() { onRecovery(recovered, fecLost) }, time.Now())
 	}
 
 }
@@ -754,13 +2639,24 @@ func (s *UDPSession) kcpInput(data []byte) {
 type (
 	// Listener defines a server which will be waiting to accept incoming connections
 	Listener struct {
-		block        BlockCrypt     // block encryption
-		dataShards   int            // FEC data shard
-		parityShards int            // FEC parity shard
-		conn         net.PacketConn // the underlying packet connection
-		ownConn      bool           // true if we created conn internally, false if provided by caller
+		idleTimeout int64 // idle timeout for the accepted sessions, first for 64bit alignment
+		fecFlush    int64 // FEC flush timeout for the accepted sessions
+		fecRxBytes  int64 // FEC decoder bytes for the accepted sessions
+		readLimit   int64 // receive buffer bytes for the accepted sessions
+
+		block        BlockCrypt       // block encryption
+		aead         AEADCrypt        // non-nil if block is authenticated
+		dataShards   int              // FEC data shard
+		parityShards int              // FEC parity shard
+		conn         net.PacketConn   // the underlying packet connection
+		conns        []net.PacketConn // all the sockets by SO_REUSEPORT, conns[0] is conn
+		ownConn      bool             // true if we created conn internally, false if provided by caller
+		noconv       bool             // the conv-less wire format, see ServeConnNoConv
 
 		sessions        map[string]*UDPSession // all sessions accepted by this Listener
+		convs           map[uint32]*UDPSession // the sessions by conv for the migration
+		offers          map[string]convOffer   // the convs offered by the handshakes, by address
+		offerConvs      map[uint32]struct{}    // the convs of the offers
 		sessionLock     sync.RWMutex
 		chAccepts       chan *UDPSession // Listen() backlog
 		chSessionClosed chan net.Addr    // session close queue
@@ -773,66 +2669,241 @@ type (
 		chSocketReadError   chan struct{}
 		socketReadErrorOnce sync.Once
 
-		rd atomic.Value // read deadline for Accept()
+		rd        atomic.Value  // read deadline for Accept()
+		rdMu      sync.Mutex    // guards rdChanged
+		rdChanged deadlineEvent // wakes the blocked accepts when rd changes
+		inputHook atomic.Value  // *inputHook set by SetInputHook
+
+		closeNotify int32      // FIN handshake for the accepted sessions
+		unreliable  int32      // unreliable datagrams for the accepted sessions
+		ecn         int32      // ECN for the socket and the accepted sessions
+		pmtud       int32      // path MTU discovery for the accepted sessions
+		dscp        int32      // the DSCP set by SetDSCP
+		recvTOS     int32      // read the TOS of the packets for the CE marks
+		replay      int32      // replay protection for the accepted sessions
+		reject      int32      // close the new sessions beyond the accept backlog
+		jitter      int32      // update jitter for the accepted sessions
+		tlp         int32      // tail loss probe for the accepted sessions
+		rotation    int32      // key rotation for the accepted sessions
+		maxSessions int32      // the limit of live sessions, 0 for unlimited
+		fecRxGroups int32      // FEC decoder shard groups for the accepted sessions
+		migration   int32      // connection migration, 0: off, 1: on, 2: with path challenges
+		negotiate   int32      // answer the conv requests of DialNegotiated
+		keyLock     sync.Mutex // guards auth, fecCodec, inputHook, migrateHook, connFilter & sched, and block & aead once key rotation is enabled
+
+		auth        PacketAuthenticator                     // packet integrity check for the accepted sessions
+		fecCodec    FECCodecFunc                            // FEC codec for the accepted sessions
+		compressor  Compressor                              // compression for the accepted sessions
+		migrateHook func(s *UDPSession, addr net.Addr) bool // vetoes the migrations if it returns false
+		connFilter  func(addr net.Addr, packet []byte) bool // drops the packets of unknown addresses if it returns false
+		limiter     sessionLimiter                          // the rate of the new sessions, see SetSessionRate
+		sched       *TimedSched                             // the scheduler for the accepted sessions, nil for SystemTimedSched
+		ownSched    bool                                    // close sched with the listener
 	}
 )
 
 // packet input stage
-func (l *Listener) packetInput(data []byte, addr net.Addr) {
-	decrypted := false
-	if l.block != nil && len(data) >= cryptHeaderSize {
-		l.block.Decrypt(data, data)
-		data = data[nonceSize:]
-		checksum := crc32.ChecksumIEEE(data[crcSize:])
-		if checksum == binary.LittleEndian.Uint32(data) {
-			data = data[crcSize:]
-			decrypted = true
+// frameHeader returns conv, cmd and sn of a KCP frame, conv is 0 in the conv-less wire format
+func (l *Listener) frameHeader(frame []byte) (conv uint32, cmd byte, sn uint32) {
+	if l.noconv {
+		return 0, frame[0], binary.LittleEndian.Uint32(frame[IKCP_SN_OFFSET-convSize:])
+	}
+	return binary.LittleEndian.Uint32(frame), frame[4], binary.LittleEndian.Uint32(frame[IKCP_SN_OFFSET:])
+}
+
+func (l *Listener) packetInput(data []byte, addr net.Addr, conn net.PacketConn, ce bool) {
+	l.sessionLock.RLock()
+	s, ok := l.sessions[addr.String()]
+	l.sessionLock.RUnlock()
+
+	l.loadInputHook().input(data)
+	if ok {
+		s.loadInputHook().input(data)
+	} else {
+		l.keyLock.Lock()
+		filter := l.connFilter
+		l.keyLock.Unlock()
+		if filter != nil && !filter(addr, data) {
+			atomic.AddUint64(&DefaultSnmp.ConnFiltered, 1)
+			return
+		}
+	}
+
+	// a conv request, shorter than any KCP packet
+	if !ok && atomic.LoadInt32(&l.negotiate) != 0 && !l.noconv && l.handshake(data, addr, conn) {
+		return
+	}
+
+	var block BlockCrypt
+	var epoch byte
+	if atomic.LoadInt32(&l.rotation) == 0 {
+		block = l.block
+	} else {
+		// an existing session checks the epoch, a new session follows the remote
+		if ok {
+			if block, data = s.epochKey(data); block == nil {
+				return
+			}
+		} else if len(data) >= epochSize {
+			epoch = data[len(data)-1]
+			data = data[:len(data)-epochSize]
+			l.keyLock.Lock()
+			block = l.block
+			l.keyLock.Unlock()
 		} else {
-			atomic.AddUint64(&DefaultSnmp.InCsumErrors, 1)
+			return
 		}
-	} else if l.block == nil {
-		decrypted = true
 	}
 
-	if decrypted && len(data) >= IKCP_OVERHEAD {
-		l.sessionLock.RLock()
-		s, ok := l.sessions[addr.String()]
-		l.sessionLock.RUnlock()
+	l.keyLock.Lock()
+	auth := l.auth
+	compressor := l.compressor
+	l.keyLock.Unlock()
+
+	data, decrypted := openPacket(block, auth, data, nil)
 
+	// the packet counter of replay protection is checked by the session
+	packet := data
+	if decrypted && atomic.LoadInt32(&l.replay) != 0 {
+		if len(data) >= replayHeaderSize {
+			data = data[replayHeaderSize:]
+		} else {
+			decrypted = false
+		}
+	}
+
+	overhead := IKCP_OVERHEAD
+	if l.noconv {
+		overhead -= convSize
+	}
+	// the frames of the sessions with compression lead with the magic byte
+	skip := 0
+	if compressor != nil {
+		skip = compressHeaderSize
+		overhead += skip
+	}
+	if decrypted && len(data) >= overhead {
 		var conv, sn uint32
-		convRecovered := false
-		fecFlag := binary.LittleEndian.Uint16(data[4:])
-		if fecFlag == typeData || fecFlag == typeParity { // 16bit kcp cmd [81-84] and frg [0-255] will not overlap with FEC type 0x00f1 0x00f2
+		var cmd byte
+		convRecovered, mismatch := false, false
+		fecFlag := fecPacket(data).flag()
+		if l.noconv && (l.dataShards <= 0 || l.parityShards <= 0) {
+			fecFlag = 0 // the flag overlaps ts of the conv-less frames
+		}
+		if fecFlag == typeData || fecFlag == typeParity || fecFlag == typeParity16 { // kcp cmd [81-86] will not overlap with FEC type 0xf1-0xf3
 			// packet with FEC
-			if fecFlag == typeData && len(data) >= fecHeaderSizePlus2+IKCP_OVERHEAD {
-				conv = binary.LittleEndian.Uint32(data[fecHeaderSizePlus2:])
-				sn = binary.LittleEndian.Uint32(data[fecHeaderSizePlus2+IKCP_SN_OFFSET:])
-				convRecovered = true
+			if fecFlag == typeData && len(data) >= fecHeaderSizePlus2+overhead {
+				conv, cmd, sn = l.frameHeader(data[fecHeaderSizePlus2+skip:])
+				convRecovered = skip == 0 || isCompressMagic(data[fecHeaderSizePlus2])
+				mismatch = !convRecovered
 			}
 		} else {
 			// packet without FEC
-			conv = binary.LittleEndian.Uint32(data)
-			sn = binary.LittleEndian.Uint32(data[IKCP_SN_OFFSET:])
-			convRecovered = true
+			conv, cmd, sn = l.frameHeader(data[skip:])
+			convRecovered = skip == 0 || isCompressMagic(data[0])
+			mismatch = !convRecovered
+		}
+		if mismatch && !ok { // the sessions count their own
+			atomic.AddUint64(&DefaultSnmp.CompressErrors, 1)
 		}
 
 		if ok { // existing connection
 			if !convRecovered || conv == s.kcp.conv { // parity data or valid conversation
-				s.kcpInput(data)
+				if data := s.replayFilter(packet); len(data) >= overhead {
+					if ce {
+						s.inputCE()
+					}
+					s.kcpInput(data)
+				}
 			} else if sn == 0 { // should replace current connection
-				s.Close()
+				s.closeNow()
 				s = nil
 			}
+		} else if convRecovered && !l.noconv && authenticated(block, auth) && atomic.LoadInt32(&l.migration) != 0 {
+			if l.migrate(conv, addr, packet, overhead, ce) { // a known conv from a new address
+				return
+			}
 		}
 
-		if s == nil && convRecovered { // new session
-			if len(l.chAccepts) < cap(l.chAccepts) { // do not let the new sessions overwhelm accept queue
-				s := newUDPSession(conv, l.dataShards, l.parityShards, l, l.conn, false, addr, l.block)
-				s.kcpInput(data)
+		if s == nil && convRecovered && cmd != IKCP_CMD_FIN { // new session, a late FIN will not start one
+			// do not let the new sessions overwhelm accept queue or memory, see SetRejectOverflow
+			overflow := len(l.chAccepts) >= cap(l.chAccepts)
+			if overflow {
+				atomic.AddUint64(&DefaultSnmp.AcceptOverflow, 1)
+			}
+			if (!overflow || atomic.LoadInt32(&l.reject) != 0) && !l.sessionsFull() && (l.offeredTo(addr, conv) || !l.rateLimited(addr)) {
+				s := newUDPSession(conv, l.noconv, l.dataShards, l.parityShards, l, conn, false, addr, block)
+				s.setPacketAuthenticator(auth)
+				if compressor != nil {
+					s.setCompression(compressor)
+				}
+				l.keyLock.Lock()
+				codec := l.fecCodec
+				l.keyLock.Unlock()
+				if codec != nil {
+					s.SetFECCodec(codec)
+				}
+				if groups, maxBytes := atomic.LoadInt32(&l.fecRxGroups), atomic.LoadInt64(&l.fecRxBytes); groups != 0 || maxBytes != 0 {
+					s.SetFECWindow(int(groups), int(maxBytes))
+				}
+				if atomic.LoadInt32(&l.closeNotify) != 0 {
+					s.SetCloseNotify(true)
+				}
+				if atomic.LoadInt32(&l.unreliable) != 0 {
+					s.SetUnreliable(true)
+				}
+				if maxBytes := atomic.LoadInt64(&l.readLimit); maxBytes > 0 {
+					s.SetReadBufferLimit(int(maxBytes))
+				}
+				if atomic.LoadInt32(&l.jitter) != 0 {
+					s.SetUpdateJitter(true)
+				}
+				if atomic.LoadInt32(&l.tlp) != 0 {
+					s.SetTailLossProbe(true)
+				}
+				if atomic.LoadInt32(&l.ecn) != 0 {
+					s.SetECN(true)
+				}
+				if atomic.LoadInt32(&l.pmtud) != 0 {
+					s.SetMtuDiscovery(true)
+				}
+				if d := atomic.LoadInt64(&l.idleTimeout); d > 0 {
+					s.SetIdleTimeout(time.Duration(d))
+				}
+				if d := atomic.LoadInt64(&l.fecFlush); d > 0 {
+					s.SetFECFlushTimeout(time.Duration(d))
+				}
+				if atomic.LoadInt32(&l.replay) != 0 {
+					s.SetReplayProtection(true)
+				}
+				if atomic.LoadInt32(&l.rotation) != 0 {
+					s.SetKeyRotation(true)
+					s.mu.Lock()
+					s.epoch = epoch
+					s.mu.Unlock()
+				}
+				if data := s.replayFilter(packet); len(data) >= overhead {
+					if ce {
+						s.inputCE()
+					}
+					s.kcpInput(data)
+				}
 				l.sessionLock.Lock()
 				l.sessions[addr.String()] = s
+				if !l.noconv {
+					l.convs[conv] = s
+				}
+				l.withdrawOffer(addr.String())
 				l.sessionLock.Unlock()
-				l.chAccepts <- s
+
+				select {
+				case l.chAccepts <- s:
+				default: // overflowed, or filled by the other sockets meanwhile
+					if !overflow {
+						atomic.AddUint64(&DefaultSnmp.AcceptOverflow, 1)
+					}
+					s.closeNow()
+				}
 			}
 		}
 	}
@@ -854,18 +2925,62 @@ func (l *Listener) notifyReadError(err error) {
 
 // SetReadBuffer sets the socket read buffer for the Listener
 func (l *Listener) SetReadBuffer(bytes int) error {
-	if nc, ok := l.conn.(setReadBuffer); ok {
-		return nc.SetReadBuffer(bytes)
+	for _, conn := range l.conns {
+		nc, ok := conn.(setReadBuffer)
+		if !ok {
+			return ErrInvalidOperation
+		}
+		if err := nc.SetReadBuffer(bytes); err != nil {
+			return err
+		}
 	}
-	return errInvalidOperation
+	return nil
 }
 
 // SetWriteBuffer sets the socket write buffer for the Listener
 func (l *Listener) SetWriteBuffer(bytes int) error {
-	if nc, ok := l.conn.(setWriteBuffer); ok {
-		return nc.SetWriteBuffer(bytes)
+	for _, conn := range l.conns {
+		nc, ok := conn.(setWriteBuffer)
+		if !ok {
+			return ErrInvalidOperation
+		}
+		if err := nc.SetWriteBuffer(bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetTimedSched sets the scheduler of the timed functions for the sessions accepted
+// afterwards and the listener itself, nil for SystemTimedSched(default), see
+// UDPSession.SetTimedSched. With 'own', 'ts' is closed by Close, after which the
+// sessions left on it stop updating.
+func (l *Listener) SetTimedSched(ts *TimedSched, own bool) {
+	l.keyLock.Lock()
+	l.sched, l.ownSched = ts, own && ts != nil
+	l.keyLock.Unlock()
+}
+
+// timedSched returns the scheduler set by SetTimedSched
+func (l *Listener) timedSched() *TimedSched {
+	l.keyLock.Lock()
+	defer l.keyLock.Unlock()
+	if l.sched != nil {
+		return l.sched
 	}
-	return errInvalidOperation
+	return SystemTimedSched
+}
+
+// GetReadBuffer returns the socket read buffer of the Listener as granted by the
+// kernel, see UDPSession.GetReadBuffer.
+func (l *Listener) GetReadBuffer() (int, error) {
+	return getReadBuffer(l.conn)
+}
+
+// GetWriteBuffer returns the socket write buffer of the Listener as granted by the
+// kernel, see UDPSession.GetReadBuffer.
+func (l *Listener) GetWriteBuffer() (int, error) {
+	return getWriteBuffer(l.conn)
 }
 
 // SetDSCP sets the 6bit DSCP field in IPv4 header, or 8bit Traffic Class in IPv6 header.
@@ -873,25 +2988,299 @@ func (l *Listener) SetWriteBuffer(bytes int) error {
 // if the underlying connection has implemented `func SetDSCP(int) error`, SetDSCP() will invoke
 // this function instead.
 func (l *Listener) SetDSCP(dscp int) error {
-	// interface enabled
-	if ts, ok := l.conn.(setDSCP); ok {
-		return ts.SetDSCP(dscp)
+	atomic.StoreInt32(&l.dscp, int32(dscp))
+	for _, conn := range l.conns {
+		if err := setTOS(conn, dscp, atomic.LoadInt32(&l.ecn) != 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetECN toggles ECN on the socket and for the sessions accepted afterwards,
+// see UDPSession.SetECN for details.
+func (l *Listener) SetECN(enable bool) error {
+	if enable {
+		atomic.StoreInt32(&l.ecn, 1)
+	} else {
+		atomic.StoreInt32(&l.ecn, 0)
+	}
+
+	recvTOS := enable
+	for _, conn := range l.conns {
+		if recvTOS && setRecvTOS(conn) != nil {
+			recvTOS = false
+		}
+	}
+	if recvTOS {
+		atomic.StoreInt32(&l.recvTOS, 1)
+	} else {
+		atomic.StoreInt32(&l.recvTOS, 0)
 	}
 
-	if nc, ok := l.conn.(net.Conn); ok {
-		var succeed bool
-		if err := ipv4.NewConn(nc).SetTOS(dscp << 2); err == nil {
-			succeed = true
+	for _, conn := range l.conns {
+		if err := setTOS(conn, int(atomic.LoadInt32(&l.dscp)), enable); err != nil {
+			return err
 		}
-		if err := ipv6.NewConn(nc).SetTrafficClass(dscp); err == nil {
-			succeed = true
+	}
+	return nil
+}
+
+// SetInputHook sets a function called with each datagram read from the socket,
+// including the ones of the accepted sessions, like UDPSession.SetInputHook.
+func (l *Listener) SetInputHook(f func(raw []byte)) {
+	l.keyLock.Lock()
+	defer l.keyLock.Unlock()
+	l.loadInputHook().close()
+	var h *inputHook
+	select {
+	case <-l.die:
+	default:
+		if f != nil {
+			h = newInputHook(f)
 		}
+	}
+	l.inputHook.Store(h)
+}
 
-		if succeed {
-			return nil
+// loadInputHook returns the hook set by SetInputHook, nil for none
+func (l *Listener) loadInputHook() *inputHook {
+	h, _ := l.inputHook.Load().(*inputHook)
+	return h
+}
+
+// SetMtuDiscovery sets the DF bit on the socket, and toggles the path MTU discovery
+// for the sessions accepted afterwards, see UDPSession.SetMtuDiscovery.
+func (l *Listener) SetMtuDiscovery(enable bool) error {
+	if !enable {
+		atomic.StoreInt32(&l.pmtud, 0)
+		return nil
+	}
+	for _, conn := range l.conns {
+		if err := setDontFragment(conn); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&l.pmtud, 1)
+	return nil
+}
+
+// SetConvNegotiation toggles answering the conv requests of DialNegotiated, each
+// gets a conversation id unique among the sessions of the Listener. The requests
+// count as new sessions against SetSessionRate, and up to 4096 are pending at once.
+// The clients choosing their own ids are served as before, either way.
+func (l *Listener) SetConvNegotiation(enable bool) {
+	if enable {
+		atomic.StoreInt32(&l.negotiate, 1)
+	} else {
+		atomic.StoreInt32(&l.negotiate, 0)
+	}
+}
+
+// SetConnFilter sets a function called with each packet from a remote address
+// without a session, as read from the socket, before decryption, false drops the
+// packet before anything is allocated for it and counts ConnFiltered, nil accepts
+// all(default). It's for allowlists or cheap checks of the first packets, it runs in
+// the read loop and must not block, and 'packet' must not be retained.
+func (l *Listener) SetConnFilter(f func(addr net.Addr, packet []byte) bool) {
+	l.keyLock.Lock()
+	l.connFilter = f
+	l.keyLock.Unlock()
+}
+
+// SetMigration lets the accepted sessions follow their remotes across address
+// changes, e.g. a mobile client switching between networks or a NAT rebinding. A
+// packet of a known conv from a new address moves the session to the address if
+// it passes the decryption and the authentication, by the integrity check or an
+// AEAD cipher, one of which must be on, and it's not a replay.
+//
+// With 'challenge', the session moves only after the remote has acknowledged a
+// probe sent to the new address, it takes a round trip and the remote of this
+// version. Without it, a captured packet resent from elsewhere would move the
+// session, so SetReplayProtection must be enabled first, or ErrInvalidOperation
+// is returned, and the sessions without the replay protection are challenged.
+// 'f' is called before a session moves, and false vetoes it, it runs in the read
+// loop and must not block, nil allows all. The conv-less wire format can't migrate.
+func (l *Listener) SetMigration(enable, challenge bool, f func(s *UDPSession, addr net.Addr) bool) error {
+	if enable && !challenge && atomic.LoadInt32(&l.replay) == 0 {
+		return errors.WithStack(ErrInvalidOperation)
+	}
+	l.keyLock.Lock()
+	l.migrateHook = f
+	l.keyLock.Unlock()
+	switch {
+	case !enable:
+		atomic.StoreInt32(&l.migration, 0)
+	case challenge:
+		atomic.StoreInt32(&l.migration, migrationChallenge)
+	default:
+		atomic.StoreInt32(&l.migration, 1)
+	}
+	return nil
+}
+
+// SetCloseNotify toggles the FIN handshake for the sessions accepted afterwards,
+// see UDPSession.SetCloseNotify for details.
+func (l *Listener) SetCloseNotify(enable bool) {
+	if enable {
+		atomic.StoreInt32(&l.closeNotify, 1)
+	} else {
+		atomic.StoreInt32(&l.closeNotify, 0)
+	}
+}
+
+// SetReplayProtection toggles the replay protection for the sessions accepted
+// afterwards, see UDPSession.SetReplayProtection for details.
+func (l *Listener) SetReplayProtection(enable bool) {
+	if enable {
+		atomic.StoreInt32(&l.replay, 1)
+	} else {
+		atomic.StoreInt32(&l.replay, 0)
+	}
+}
+
+// SetPacketAuthenticator sets the packet integrity check for all the sessions, it
+// must be called before any session is accepted, see UDPSession.SetPacketAuthenticator.
+func (l *Listener) SetPacketAuthenticator(auth PacketAuthenticator) {
+	l.keyLock.Lock()
+	l.auth = auth
+	l.keyLock.Unlock()
+}
+
+// SetFECCodec sets the FEC codec for the sessions accepted afterwards,
+// see UDPSession.SetFECCodec.
+func (l *Listener) SetFECCodec(f FECCodecFunc) {
+	l.keyLock.Lock()
+	l.fecCodec = f
+	l.keyLock.Unlock()
+}
+
+// SetFECWindow bounds the memory of the FEC decoder for the sessions accepted
+// afterwards, see UDPSession.SetFECWindow.
+func (l *Listener) SetFECWindow(groups, maxBytes int) {
+	atomic.StoreInt32(&l.fecRxGroups, int32(groups))
+	atomic.StoreInt64(&l.fecRxBytes, int64(maxBytes))
+}
+
+// SetReadBufferLimit bounds the bytes received but not read for the sessions
+// accepted afterwards, see UDPSession.SetReadBufferLimit.
+func (l *Listener) SetReadBufferLimit(maxBytes int) {
+	atomic.StoreInt64(&l.readLimit, int64(maxBytes))
+}
+
+// SetUpdateJitter toggles the update jitter for the sessions accepted afterwards,
+// e.g. for a server accepting thousands of sessions at once after a restart,
+// see UDPSession.SetUpdateJitter.
+func (l *Listener) SetUpdateJitter(enable bool) {
+	if enable {
+		atomic.StoreInt32(&l.jitter, 1)
+	} else {
+		atomic.StoreInt32(&l.jitter, 0)
+	}
+}
+
+// SetTailLossProbe toggles the tail loss probe for the sessions accepted afterwards,
+// see UDPSession.SetTailLossProbe.
+func (l *Listener) SetTailLossProbe(enable bool) {
+	if enable {
+		atomic.StoreInt32(&l.tlp, 1)
+	} else {
+		atomic.StoreInt32(&l.tlp, 0)
+	}
+}
+
+// SetKeyRotation toggles the key epoch for the sessions accepted afterwards,
+// see UDPSession.SetKeyRotation for details.
+func (l *Listener) SetKeyRotation(enable bool) {
+	if enable {
+		atomic.StoreInt32(&l.rotation, 1)
+	} else {
+		atomic.StoreInt32(&l.rotation, 0)
+	}
+}
+
+// SetBlockCrypt replaces the key for the sessions accepted afterwards, and rotates
+// the key of all the current sessions by UDPSession.SetBlockCrypt. The new sessions
+// follow the key epoch of the remote, the sessions accepted before key rotation was
+// enabled keep their key.
+func (l *Listener) SetBlockCrypt(next BlockCrypt) error {
+	if atomic.LoadInt32(&l.rotation) == 0 || next == nil {
+		return errors.WithStack(ErrInvalidOperation)
+	}
+
+	aead, _ := next.(AEADCrypt)
+	l.keyLock.Lock()
+	if l.block == nil || (aead == nil) != (l.aead == nil) || (aead != nil && aead.Overhead() != l.aead.Overhead()) {
+		l.keyLock.Unlock()
+		return errors.WithStack(ErrInvalidOperation)
+	}
+	l.block = next
+	l.aead = aead
+	l.keyLock.Unlock()
+
+	l.sessionLock.RLock()
+	for _, s := range l.sessions {
+		s.SetBlockCrypt(next)
+	}
+	l.sessionLock.RUnlock()
+	return nil
+}
+
+// SetMaxSessions limits the number of live sessions, once reached the packets from
+// new remote addresses are ignored until a session is closed, 0 for unlimited.
+func (l *Listener) SetMaxSessions(n int) {
+	atomic.StoreInt32(&l.maxSessions, int32(n))
+}
+
+// SetRejectOverflow defines how the new sessions are refused once the accept backlog
+// is full, both counted in AcceptOverflow. By default(false) their packets are
+// dropped, so the remotes retry until the backlog drains, with 'enable' the sessions
+// are created and closed at once, which tells the remotes by a FIN if SetCloseNotify
+// is enabled on both sides.
+func (l *Listener) SetRejectOverflow(enable bool) {
+	if enable {
+		atomic.StoreInt32(&l.reject, 1)
+	} else {
+		atomic.StoreInt32(&l.reject, 0)
+	}
+}
+
+// Sessions returns the open sessions of the listener, accepted or waiting in the
+// backlog, e.g. to list RemoteAddr and GetConv of each, or kick one by Close, which
+// removes it from the listener after its FIN handshake if any.
+func (l *Listener) Sessions() []*UDPSession {
+	l.sessionLock.RLock()
+	defer l.sessionLock.RUnlock()
+	sessions := make([]*UDPSession, 0, len(l.sessions))
+	for _, s := range l.sessions {
+		select {
+		case <-s.die: // lingering for its FIN
+		default:
+			sessions = append(sessions, s)
 		}
 	}
-	return errInvalidOperation
+	return sessions
+}
+
+// GetSessionCount returns the number of live sessions, including the accepted ones
+// waiting in the backlog and the closed ones lingering for their FIN.
+func (l *Listener) GetSessionCount() int {
+	l.sessionLock.RLock()
+	defer l.sessionLock.RUnlock()
+	return len(l.sessions)
+}
+
+// SetIdleTimeout sets the idle timeout for the sessions accepted afterwards, a session
+// is closed and removed from the listener if nothing is received from it within 'd',
+// the timeout can be changed per-session by UDPSession.SetIdleTimeout.
+func (l *Listener) SetIdleTimeout(d time.Duration) {
+	atomic.StoreInt64(&l.idleTimeout, int64(d))
+}
+
+// SetFECFlushTimeout sets the FEC flush timeout for the sessions accepted afterwards,
+// see UDPSession.SetFECFlushTimeout.
+func (l *Listener) SetFECFlushTimeout(d time.Duration) {
+	atomic.StoreInt64(&l.fecFlush, int64(d))
 }
 
 // Accept implements the Accept method in the Listener interface; it waits for the next call and returns a generic Conn.
@@ -899,22 +3288,47 @@ func (l *Listener) Accept() (net.Conn, error) {
 	return l.AcceptKCP()
 }
 
+// AcceptContext is like Accept, and returns ctx.Err() once 'ctx' is done, the
+// listener keeps working after that.
+func (l *Listener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	s, err := l.acceptKCP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
 // AcceptKCP accepts a KCP connection
 func (l *Listener) AcceptKCP() (*UDPSession, error) {
-	var timeout <-chan time.Time
-	if tdeadline, ok := l.rd.Load().(time.Time); ok && !tdeadline.IsZero() {
-		timeout = time.After(time.Until(tdeadline))
-	}
+	return l.acceptKCP(context.Background())
+}
 
-	select {
-	case <-timeout:
-		return nil, errors.WithStack(errTimeout)
-	case c := <-l.chAccepts:
-		return c, nil
-	case <-l.chSocketReadError:
-		return nil, l.socketReadError.Load().(error)
-	case <-l.die:
-		return nil, errors.WithStack(io.ErrClosedPipe)
+func (l *Listener) acceptKCP(ctx context.Context) (*UDPSession, error) {
+	var timeout deadlineTimer
+	defer timeout.stop()
+
+	for {
+		l.rdMu.Lock()
+		deadline, _ := l.rd.Load().(time.Time)
+		expiry, changed := timeout.reset(deadline), l.rdChanged.wait()
+		l.rdMu.Unlock()
+		if timeout.expired() {
+			return nil, ErrTimeout
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		case <-expiry:
+			return nil, ErrTimeout
+		case c := <-l.chAccepts:
+			return c, nil
+		case <-l.chSocketReadError:
+			return nil, l.socketReadError.Load().(error)
+		case <-l.die:
+			return nil, errors.WithStack(io.ErrClosedPipe)
+		}
 	}
 }
 
@@ -925,14 +3339,18 @@ func (l *Listener) SetDeadline(t time.Time) error {
 	return nil
 }
 
-// SetReadDeadline implements the Conn SetReadDeadline method.
+// SetReadDeadline implements the Conn SetReadDeadline method, the accepts in
+// progress observe the new deadline.
 func (l *Listener) SetReadDeadline(t time.Time) error {
+	l.rdMu.Lock()
+	defer l.rdMu.Unlock()
 	l.rd.Store(t)
+	l.rdChanged.notify()
 	return nil
 }
 
 // SetWriteDeadline implements the Conn SetWriteDeadline method.
-func (l *Listener) SetWriteDeadline(t time.Time) error { return errInvalidOperation }
+func (l *Listener) SetWriteDeadline(t time.Time) error { return ErrInvalidOperation }
 
 // Close stops listening on the UDP address, and closes the socket
 func (l *Listener) Close() error {
@@ -944,8 +3362,18 @@ func (l *Listener) Close() error {
 
 	var err error
 	if once {
+		l.keyLock.Lock()
+		l.loadInputHook().close()
+		l.inputHook.Store((*inputHook)(nil))
+		if l.ownSched {
+			l.sched.Close()
+		}
+		l.keyLock.Unlock()
 		if l.ownConn {
 			err = l.conn.Close()
+			for _, conn := range l.conns[1:] {
+				conn.Close()
+			}
 		}
 	} else {
 		err = errors.WithStack(io.ErrClosedPipe)
@@ -953,12 +3381,21 @@ func (l *Listener) Close() error {
 	return err
 }
 
+// sessionsFull checks if the live sessions have reached the limit of SetMaxSessions
+func (l *Listener) sessionsFull() bool {
+	n := atomic.LoadInt32(&l.maxSessions)
+	return n > 0 && l.GetSessionCount() >= int(n)
+}
+
 // closeSession notify the listener that a session has closed
 func (l *Listener) closeSession(remote net.Addr) (ret bool) {
 	l.sessionLock.Lock()
 	defer l.sessionLock.Unlock()
-	if _, ok := l.sessions[remote.String()]; ok {
+	if s, ok := l.sessions[remote.String()]; ok {
 		delete(l.sessions, remote.String())
+		if l.convs[s.kcp.conv] == s {
+			delete(l.convs, s.kcp.conv)
+		}
 		return true
 	}
 	return false
@@ -967,6 +3404,11 @@ func (l *Listener) closeSession(remote net.Addr) (ret bool) {
 // Addr returns the listener's network address, The Addr returned is shared by all invocations of Addr, so do not modify it.
 func (l *Listener) Addr() net.Addr { return l.conn.LocalAddr() }
 
+// LocalConn returns the underlying connection, e.g. to set the socket options by
+// syscall.RawConn.Control. It's for option-setting only, reading or writing it
+// directly corrupts the KCP streams.
+func (l *Listener) LocalConn() net.PacketConn { return l.conn }
+
 // Listen listens for incoming KCP packets addressed to the local address laddr on the network "udp",
 func Listen(laddr string) (net.Listener, error) { return ListenWithOptions(laddr, nil, 0, 0) }
 
@@ -987,27 +3429,92 @@ func ListenWithOptions(laddr string, block BlockCrypt, dataShards, parityShards
 		return nil, errors.WithStack(err)
 	}
 
-	return serveConn(block, dataShards, parityShards, conn, true)
+	return serveConn(block, dataShards, parityShards, []net.PacketConn{conn}, true, false, acceptBacklog)
+}
+
+// ListenWithBacklog acts like ListenWithOptions with room for 'backlog' sessions
+// waiting for AcceptKCP, instead of 128, see SetRejectOverflow for the sessions beyond.
+func ListenWithBacklog(laddr string, block BlockCrypt, dataShards, parityShards, backlog int) (*Listener, error) {
+	if backlog <= 0 {
+		return nil, errors.WithStack(ErrInvalidOperation)
+	}
+	udpaddr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	conn, err := net.ListenUDP("udp", udpaddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return serveConn(block, dataShards, parityShards, []net.PacketConn{conn}, true, false, backlog)
+}
+
+// ListenWithOptionsReuseport acts like ListenWithOptions with 'sockets' UDP sockets
+// bound to laddr with SO_REUSEPORT, each read by a goroutine of its own, so the
+// packets are spread over the cores by the kernel hashing the remote addresses.
+// A session is served by the socket its first packet arrives on, and its packets
+// are looked up by the remote address on any socket. It's supported on Linux only.
+func ListenWithOptionsReuseport(laddr string, block BlockCrypt, dataShards, parityShards, sockets int) (*Listener, error) {
+	if sockets <= 0 {
+		return nil, errors.WithStack(ErrInvalidOperation)
+	}
+	udpaddr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	conns := make([]net.PacketConn, 0, sockets)
+	for i := 0; i < sockets; i++ {
+		conn, err := listenReuseport(udpaddr)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, errors.WithStack(err)
+		}
+		conns = append(conns, conn)
+		udpaddr = conn.LocalAddr().(*net.UDPAddr) // the port picked for laddr of port 0
+	}
+
+	return serveConn(block, dataShards, parityShards, conns, true, false, acceptBacklog)
 }
 
 // ServeConn serves KCP protocol for a single packet connection.
 func ServeConn(block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) (*Listener, error) {
-	return serveConn(block, dataShards, parityShards, conn, false)
+	return serveConn(block, dataShards, parityShards, []net.PacketConn{conn}, false, false, acceptBacklog)
 }
 
-func serveConn(block BlockCrypt, dataShards, parityShards int, conn net.PacketConn, ownConn bool) (*Listener, error) {
+// ServeConnNoConv is like ServeConn with the conv-less wire format, the sessions are
+// told apart by the remote addresses only, see NewConnNoConv.
+func ServeConnNoConv(block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) (*Listener, error) {
+	return serveConn(block, dataShards, parityShards, []net.PacketConn{conn}, false, true, acceptBacklog)
+}
+
+func serveConn(block BlockCrypt, dataShards, parityShards int, conns []net.PacketConn, ownConn, noconv bool, backlog int) (*Listener, error) {
 	l := new(Listener)
-	l.conn = conn
+	l.conn = conns[0]
+	l.conns = conns
 	l.ownConn = ownConn
+	l.noconv = noconv
 	l.sessions = make(map[string]*UDPSession)
-	l.chAccepts = make(chan *UDPSession, acceptBacklog)
+	l.convs = make(map[uint32]*UDPSession)
+	l.offers = make(map[string]convOffer)
+	l.offerConvs = make(map[uint32]struct{})
+	l.chAccepts = make(chan *UDPSession, backlog)
 	l.chSessionClosed = make(chan net.Addr)
 	l.die = make(chan struct{})
 	l.dataShards = dataShards
 	l.parityShards = parityShards
 	l.block = block
+	l.aead, _ = block.(AEADCrypt)
+	if block != nil {
+		l.auth = NewCRC32Authenticator()
+	}
 	l.chSocketReadError = make(chan struct{})
-	go l.monitor()
+	for _, conn := range conns {
+		go l.monitor(conn)
+	}
 	return l, nil
 }
 
@@ -1022,8 +3529,32 @@ func Dial(raddr string) (net.Conn, error) { return DialWithOptions(raddr, nil, 0
 //
 // Check https://github.com/klauspost/reedsolomon for details
 func DialWithOptions(raddr string, block BlockCrypt, dataShards, parityShards int) (*UDPSession, error) {
+	return DialContext(context.Background(), raddr, block, dataShards, parityShards)
+}
+
+// DialContext acts like DialWithOptions but aborts the address resolution and socket creation
+// once 'ctx' is done, the returned error wraps ctx.Err() in that case.
+//
+// 'ctx' also bounds the writes on the returned session until the first one succeeds,
+// so an overall connect budget can be applied to the dial and the first request.
+func DialContext(ctx context.Context, raddr string, block BlockCrypt, dataShards, parityShards int) (*UDPSession, error) {
+	return dial(ctx, raddr, block, dataShards, parityShards, false)
+}
+
+// DialNegotiated acts like DialContext but requests the conversation id from the
+// Listener before any KCP packet is sent, so it's unique on the Listener instead
+// of random, which requires Listener.SetConvNegotiation on the remote. The request
+// is resent until the reply arrives, and it fails with ErrTimeout after 5 seconds.
+//
+// The handshake packets are sealed by 'block' with the default integrity check,
+// without the replay counter or the key epoch.
+func DialNegotiated(ctx context.Context, raddr string, block BlockCrypt, dataShards, parityShards int) (*UDPSession, error) {
+	return dial(ctx, raddr, block, dataShards, parityShards, true)
+}
+
+func dial(ctx context.Context, raddr string, block BlockCrypt, dataShards, parityShards int, negotiate bool) (*UDPSession, error) {
 	// network type detection
-	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
+	udpaddr, err := resolveUDPAddr(ctx, raddr)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -1032,29 +3563,99 @@ func DialWithOptions(raddr string, block BlockCrypt, dataShards, parityShards in
 		network = "udp"
 	}
 
-	conn, err := net.ListenUDP(network, nil)
+	var lc net.ListenConfig
+	conn, err := lc.ListenPacket(ctx, network, "")
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
 	var convid uint32
-	binary.Read(rand.Reader, binary.LittleEndian, &convid)
-	return newUDPSession(convid, dataShards, parityShards, nil, conn, true, udpaddr, block), nil
+	if negotiate {
+		if convid, err = negotiateConv(ctx, conn, udpaddr, block); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	} else {
+		binary.Read(rand.Reader, binary.LittleEndian, &convid)
+	}
+	sess := newUDPSession(convid, false, dataShards, parityShards, nil, conn, true, udpaddr, block)
+	if ctx.Done() != nil {
+		sess.dialCtx = ctx
+	}
+
+	// the context may have been cancelled while the session was being set up
+	if err := ctx.Err(); err != nil {
+		sess.closeNow()
+		return nil, errors.WithStack(err)
+	}
+	return sess, nil
+}
+
+// resolveUDPAddr is a context-aware version of net.ResolveUDPAddr("udp", addr)
+func resolveUDPAddr(ctx context.Context, addr string) (*net.UDPAddr, error) {
+	host, service, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := net.DefaultResolver.LookupPort(ctx, "udp", service)
+	if err != nil {
+		return nil, err
+	}
+
+	if host == "" {
+		return &net.UDPAddr{Port: port}, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	// prefer IPv4 as net.ResolveUDPAddr does
+	ip := ips[0]
+	for k := range ips {
+		if ips[k].IP.To4() != nil {
+			ip = ips[k]
+			break
+		}
+	}
+	return &net.UDPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}, nil
 }
 
 // NewConn3 establishes a session and talks KCP protocol over a packet connection.
+//
+// The connection is owned by the caller, it's not closed by the session, so it
+// can be bound and configured beforehand, and it must be closed by the caller after
+// the session. The session reads all the packets from the connection, those from
+// the other sources than the first one are dropped, so a connection carries only
+// one client session, the Listener serves multiple sessions on one connection.
 func NewConn3(convid uint32, raddr net.Addr, block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) (*UDPSession, error) {
-	return newUDPSession(convid, dataShards, parityShards, nil, conn, false, raddr, block), nil
+	return newUDPSession(convid, false, dataShards, parityShards, nil, conn, false, raddr, block), nil
 }
 
-// NewConn2 establishes a session and talks KCP protocol over a packet connection.
+// NewConn2 establishes a session and talks KCP protocol over a packet connection,
+// with a random conversation id, see NewConn3 for the ownership of the connection.
 func NewConn2(raddr net.Addr, block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) (*UDPSession, error) {
 	var convid uint32
 	binary.Read(rand.Reader, binary.LittleEndian, &convid)
 	return NewConn3(convid, raddr, block, dataShards, parityShards, conn)
 }
 
-// NewConn establishes a session and talks KCP protocol over a packet connection.
+// NewConnNoConv establishes a session like NewConn3 with the conv-less wire format,
+// which omits the conversation id from the KCP segments to save 4 bytes per segment,
+// for one session per connection, or a Listener by ServeConnNoConv. It's
+// incompatible with the default wire format, both sides must use it.
+//
+// The FEC headers are told apart from the segments by the shards, so FEC must be
+// enabled on both sides or neither when they're created, and it cannot be switched
+// on or off afterwards.
+func NewConnNoConv(raddr net.Addr, block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) (*UDPSession, error) {
+	return newUDPSession(0, true, dataShards, parityShards, nil, conn, false, raddr, block), nil
+}
+
+// NewConn establishes a session and talks KCP protocol over a packet connection,
+// see NewConn3 for the ownership of the connection.
 func NewConn(raddr string, block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) (*UDPSession, error) {
 	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
 	if err != nil {
@@ -1,19 +1,28 @@
 package kcp
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	mrand "math/rand"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/net/ipv4"
 )
 
 var baseport = uint32(10000)
@@ -252,6 +261,251 @@ func TestTimeout(t *testing.T) {
 	cli.Close()
 }
 
+func TestTimeoutNetError(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	isTimeout := func(err error) bool {
+		ne, ok := err.(net.Error)
+		return ok && ne.Timeout() && errors.Is(err, ErrTimeout)
+	}
+
+	l.SetDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := l.Accept(); !isTimeout(err) {
+		t.Fatal("expect a net.Error timeout, got:", err)
+	}
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := cli.Read(make([]byte, 10)); !isTimeout(err) {
+		t.Fatal("expect a net.Error timeout, got:", err)
+	}
+
+	if err := cli.SetRTOBounds(time.Second, time.Millisecond); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatal("expect ErrInvalidOperation, got:", err)
+	}
+}
+
+func TestShortDeadline(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+
+	cli, err := dialEcho(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(0, 40, 0, 0)
+	buf := make([]byte, 10)
+
+	start := time.Now()
+	cli.SetReadDeadline(time.Now().Add(5 * time.Millisecond))
+	if _, err := cli.Read(buf); !errors.Is(err, ErrTimeout) {
+		t.Fatal("expect timeout, got:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Fatal("deadline fired late:", elapsed)
+	}
+
+	// deadline set while blocking
+	cli.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cli.SetReadDeadline(time.Now().Add(5 * time.Millisecond))
+	}()
+	start = time.Now()
+	if _, err := cli.Read(buf); !errors.Is(err, ErrTimeout) {
+		t.Fatal("expect timeout, got:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 35*time.Millisecond {
+		t.Fatal("deadline fired late:", elapsed)
+	}
+}
+
+// waitAll fails the test unless 'n' results arrive on 'errs' within a second, each a timeout
+func waitAll(t *testing.T, errs chan error, n int) {
+	for k := 0; k < n; k++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, ErrTimeout) {
+				t.Fatal("expect timeout, got:", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("blocked operations not unblocked by the new deadline", k, "of", n)
+		}
+	}
+}
+
+func TestConcurrentDeadline(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// all the accepts in progress
+	const N = 8
+	errs := make(chan error, N)
+	for k := 0; k < N; k++ {
+		go func() {
+			_, err := l.Accept()
+			errs <- err
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	l.SetDeadline(time.Now())
+	waitAll(t, errs, N)
+	l.SetDeadline(time.Time{})
+
+	// the sessions are never read by the listener, so the writes block once the
+	// remote window is full
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	for {
+		cli.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := cli.Write(make([]byte, 1024)); err != nil {
+			if !errors.Is(err, ErrTimeout) {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	cli.SetDeadline(time.Time{})
+
+	for k := 0; k < N; k++ {
+		go func() {
+			_, err := cli.Read(make([]byte, 10))
+			errs <- err
+		}()
+		go func() {
+			_, err := cli.Write(make([]byte, 10))
+			errs <- err
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	cli.SetReadDeadline(time.Now())
+	waitAll(t, errs, N)
+	cli.SetWriteDeadline(time.Now())
+	waitAll(t, errs, N)
+
+	// a deadline passed fails the operations even if they could proceed
+	echoPort := int(atomic.AddUint32(&baseport, 1))
+	el := echoServer(echoPort)
+	defer el.Close()
+	echo, err := dialEcho(echoPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	if _, err := echo.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	echo.SetDeadline(time.Now().Add(-time.Second))
+	buf := make([]byte, 10)
+	if _, err := echo.Read(buf); !errors.Is(err, ErrTimeout) {
+		t.Fatal("expect timeout, got:", err)
+	}
+	if _, err := echo.Write(buf); !errors.Is(err, ErrTimeout) {
+		t.Fatal("expect timeout, got:", err)
+	}
+	echo.SetDeadline(time.Time{})
+	if n, err := echo.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatal("echo not read after the deadline cleared:", n, err)
+	}
+}
+
+func TestDeadlineStress(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+
+	cli, err := dialEcho(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// readers and writers looping while the deadlines are moved back and forth,
+	// until a deadline passed stops them all
+	const N = 4
+	var wg sync.WaitGroup
+	stopped := make(chan struct{})
+	for k := 0; k < N; k++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 64)
+			for {
+				if _, err := cli.Read(buf); err != nil {
+					select {
+					case <-stopped:
+						return
+					default:
+					}
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 64)
+			for {
+				if _, err := cli.Write(buf); err != nil {
+					select {
+					case <-stopped:
+						return
+					default:
+					}
+				}
+			}
+		}()
+	}
+
+	rnd := mrand.New(mrand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		d := time.Duration(rnd.Intn(2000)-1000) * time.Microsecond
+		switch rnd.Intn(4) {
+		case 0:
+			cli.SetReadDeadline(time.Now().Add(d))
+		case 1:
+			cli.SetWriteDeadline(time.Now().Add(d))
+		case 2:
+			cli.SetDeadline(time.Now().Add(d))
+		default:
+			cli.SetDeadline(time.Time{})
+		}
+		if i%50 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	close(stopped)
+	cli.SetDeadline(time.Now())
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("readers or writers not stopped by the deadline")
+	}
+}
+
 func TestSendRecv(t *testing.T) {
 	port := int(atomic.AddUint32(&baseport, 1))
 	l := echoServer(port)
@@ -445,6 +699,36 @@ func BenchmarkEchoSpeed1M(b *testing.B) {
 	speedclient(b, 1048576)
 }
 
+func BenchmarkStreamFlushCoalesced(b *testing.B) {
+	streamFlushClient(b, false)
+}
+
+func BenchmarkStreamFlushImmediate(b *testing.B) {
+	streamFlushClient(b, true)
+}
+
+// streamFlushClient measures the round trip of 1-byte writes in stream mode with
+// the writes delayed
+func streamFlushClient(b *testing.B, immediate bool) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+
+	cli, err := dialEcho(port)
+	if err != nil {
+		panic(err)
+	}
+	defer cli.Close()
+	cli.SetWriteDelay(true)
+	cli.SetStreamFlush(immediate)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	if err := echo_tester(cli, 1, b.N); err != nil {
+		b.Fatal(err)
+	}
+}
+
 func speedclient(b *testing.B, nbytes int) {
 	port := int(atomic.AddUint32(&baseport, 1))
 	l := echoServer(port)
@@ -495,6 +779,46 @@ func sinkclient(b *testing.B, nbytes int) {
 	cli.Close()
 }
 
+// the benchmarks of io.Copy to a sink, with and without the session's ReadFrom
+func BenchmarkCopyReadFrom(b *testing.B) {
+	copyclient(b, false)
+}
+
+func BenchmarkCopyGeneric(b *testing.B) {
+	copyclient(b, true)
+}
+
+// onlyWriter hides ReadFrom of the session from io.Copy
+type onlyWriter struct{ io.Writer }
+
+func copyclient(b *testing.B, generic bool) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := sinkServer(port)
+	defer l.Close()
+
+	b.ReportAllocs()
+	cli, err := dialSink(port)
+	if err != nil {
+		panic(err)
+	}
+	defer cli.Close()
+
+	const nbytes = 1024 * 1024
+	src := io.LimitReader(zeroReader{}, int64(nbytes)*int64(b.N))
+	var dst io.Writer = cli
+	if generic {
+		dst = onlyWriter{cli}
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(nbytes)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) { return len(p), nil }
+
 func echo_tester(cli net.Conn, msglen, msgcount int) error {
 	buf := make([]byte, msglen)
 	for i := 0; i < msgcount; i++ {
@@ -539,129 +863,640 @@ func TestSNMP(t *testing.T) {
 	t.Log(DefaultSnmp.ToSlice())
 }
 
-func TestListenerClose(t *testing.T) {
+func TestSessionSNMP(t *testing.T) {
 	port := int(atomic.AddUint32(&baseport, 1))
-	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	l := echoServer(port)
+	defer l.Close()
+
+	cli, err := dialEcho(port)
 	if err != nil {
-		t.Fail()
+		panic(err)
 	}
-	l.SetReadDeadline(time.Now().Add(time.Second))
-	l.SetWriteDeadline(time.Now().Add(time.Second))
-	l.SetDeadline(time.Now().Add(time.Second))
-	time.Sleep(2 * time.Second)
-	if _, err := l.Accept(); err == nil {
-		t.Fail()
+	defer cli.Close()
+
+	const msglen, msgcount = 1024, 16
+	if err := echo_tester(cli, msglen, msgcount); err != nil {
+		t.Fatal(err)
 	}
 
-	l.Close()
-	fakeaddr, _ := net.ResolveUDPAddr("udp6", "127.0.0.1:1111")
-	if l.closeSession(fakeaddr) {
-		t.Fail()
+	snmp := cli.GetSnmp()
+	t.Log(snmp.ToSlice())
+	if snmp.BytesSent != msglen*msgcount || snmp.BytesReceived != msglen*msgcount {
+		t.Fatal("per-session bytes mismatch", snmp.BytesSent, snmp.BytesReceived)
+	}
+	if snmp.OutPkts == 0 || snmp.InPkts == 0 || snmp.OutSegs == 0 || snmp.InSegs == 0 {
+		t.Fatal("per-session packet counters not updated")
+	}
+	if snmp.CurrEstab != 0 || DefaultSnmp.Copy().BytesSent < snmp.BytesSent {
+		t.Fatal("per-session counters should not replace the global ones")
 	}
 }
 
-// A wrapper for net.PacketConn that remembers when Close has been called.
-type closedFlagPacketConn struct {
-	net.PacketConn
-	Closed bool
-}
+func TestCloseNotify(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetCloseNotify(true)
 
-func (c *closedFlagPacketConn) Close() error {
-	c.Closed = true
-	return c.PacketConn.Close()
-}
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SetCloseNotify(true)
 
-func newClosedFlagPacketConn(c net.PacketConn) *closedFlagPacketConn {
-	return &closedFlagPacketConn{c, false}
+	const msglen, msgcount = 1024, 16
+	buf := make([]byte, msglen)
+	for i := 0; i < msgcount; i++ {
+		if _, err := cli.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cli.Close()
+
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	nrecv := 0
+	for {
+		n, err := s.Read(buf)
+		nrecv += n
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if nrecv != msglen*msgcount {
+		t.Fatal("data lost before EOF", nrecv)
+	}
+	if _, err := s.Read(buf); err != io.EOF {
+		t.Fatal("EOF should be sticky", err)
+	}
 }
 
-// Listener should close a net.PacketConn that it created.
-// https://github.com/xtaci/kcp-go/issues/165
-func TestListenerOwnedPacketConn(t *testing.T) {
-	// ListenWithOptions creates its own net.PacketConn.
-	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+func TestLinger(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
 	defer l.Close()
-	// Replace the internal net.PacketConn with one that remembers when it
-	// has been closed.
-	pconn := newClosedFlagPacketConn(l.conn)
-	l.conn = pconn
 
-	if pconn.Closed {
-		t.Fatal("owned PacketConn closed before Listener.Close()")
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
 	}
+	cli.SetWindowSize(128, 128)
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetLinger(10)
 
-	err = l.Close()
-	if err != nil {
-		panic(err)
+	const size = 1024 * 1024
+	recv := make([]byte, size)
+	errc := make(chan error, 1)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer s.Close()
+		s.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, err = io.ReadFull(s, recv)
+		errc <- err
+	}()
+
+	// the data queued is far beyond a window, Close returns after all acknowledged
+	sent := make([]byte, size)
+	io.ReadFull(rand.Reader, sent)
+	if _, err := cli.Write(sent); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Close(); err != nil {
+		t.Fatal(err)
 	}
 
-	if !pconn.Closed {
-		t.Fatal("owned PacketConn not closed after Listener.Close()")
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent, recv) {
+		t.Fatal("data mismatch")
 	}
 }
 
-// Listener should not close a net.PacketConn that it did not create.
-// https://github.com/xtaci/kcp-go/issues/165
-func TestListenerNonOwnedPacketConn(t *testing.T) {
-	// Create a net.PacketConn not owned by the Listener.
-	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+// silentPeer returns a socket which never reads, like a vanished peer
+func silentPeer(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
-	defer c.Close()
-	// Make it remember when it has been closed.
-	pconn := newClosedFlagPacketConn(c)
+	return conn
+}
 
-	l, err := ServeConn(nil, 0, 0, pconn)
+func TestLingerDeadLink(t *testing.T) {
+	peer := silentPeer(t)
+	defer peer.Close()
+	cli, err := DialWithOptions(peer.LocalAddr().String(), nil, 0, 0)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetLinger(-1)
+	cli.mu.Lock()
+	cli.kcp.dead_link = 3 // dead sooner, without SetMaxRetries
+	cli.mu.Unlock()
+	if _, err := cli.Write(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
 	}
-	defer l.Close()
 
-	if pconn.Closed {
-		t.Fatal("non-owned PacketConn closed before Listener.Close()")
+	// Close returns once the link is dead
+	closed := make(chan struct{})
+	go func() {
+		cli.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close lingering on a dead link")
 	}
+}
 
-	err = l.Close()
+func TestLingerIdleTimeout(t *testing.T) {
+	peer := silentPeer(t)
+	defer peer.Close()
+	sched := NewTimedSched(1)
+	defer sched.Close()
+	cli, err := DialWithOptions(peer.LocalAddr().String(), nil, 0, 0)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetTimedSched(sched)
+	cli.SetLinger(-1)
+	cli.SetIdleTimeout(200 * time.Millisecond)
+	if _, err := cli.Write(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
 	}
 
-	if pconn.Closed {
-		t.Fatal("non-owned PacketConn closed after Listener.Close()")
+	// the close by the idle timeout doesn't linger on the scheduler
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cli.Read(make([]byte, 1)); !errors.Is(err, ErrIdleTimeout) {
+		t.Fatal("not closed by the idle timeout", err)
+	}
+	ran := make(chan struct{})
+	sched.Put(func() { close(ran) }, time.Now())
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("the scheduler blocked by lingering")
 	}
 }
 
-// UDPSession should close a net.PacketConn that it created.
-// https://github.com/xtaci/kcp-go/issues/165
-func TestUDPSessionOwnedPacketConn(t *testing.T) {
-	l := sinkServer(0)
+func TestWriteBeyondFragments(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer l.Close()
 
-	// DialWithOptions creates its own net.PacketConn.
-	client, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
-	defer client.Close()
-	// Replace the internal net.PacketConn with one that remembers when it
-	// has been closed.
-	pconn := newClosedFlagPacketConn(client.conn)
-	client.conn = pconn
+	defer cli.Close()
+	cli.SetWindowSize(1024, 1024)
+	cli.SetNoDelay(1, 10, 2, 1)
 
-	if pconn.Closed {
-		t.Fatal("owned PacketConn closed before UDPSession.Close()")
+	// just over the fragments of a message, in the message mode
+	sent := make([]byte, maxFragments*int(cli.kcp.mss)+1)
+	io.ReadFull(rand.Reader, sent)
+	if n, err := cli.Write(sent); err != nil || n != len(sent) {
+		t.Fatal(n, err)
 	}
-
-	err = client.Close()
+	s, err := l.AcceptKCP()
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
-
-	if !pconn.Closed {
+	defer s.Close()
+	s.SetWindowSize(1024, 1024)
+	s.SetReadDeadline(time.Now().Add(10 * time.Second))
+	recv := make([]byte, len(sent))
+	if _, err := io.ReadFull(s, recv); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent, recv) {
+		t.Fatal("data mismatch")
+	}
+	if err := cli.WriteMessage(sent); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatal("message beyond 255 segments accepted", err)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetWindowSize(256, 256)
+
+	if err := cli.WriteMessage(make([]byte, 256*int(cli.kcp.mss))); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatal("message beyond 255 segments accepted", err)
+	}
+
+	// the large messages need a receive window beyond their segments
+	mss := int(cli.kcp.mss)
+	if err := cli.WriteMessage([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetWindowSize(256, 256)
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// the messages within a segment and across segments
+	cli.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	sizes := []int{1, mss, mss + 1, 3*mss + 7, 100 * mss}
+	for _, size := range sizes[1:] {
+		msg := make([]byte, size)
+		io.ReadFull(rand.Reader, msg)
+		if err := cli.WriteMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Write cuts the buffers beyond a segment into separate messages
+	if _, err := cli.Write(make([]byte, 2*mss)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range append(sizes, mss, mss) {
+		// the message is kept if the buffer is short
+		n, err := s.ReadMessage(make([]byte, size-1))
+		if err != io.ErrShortBuffer || n != size {
+			t.Fatal("short buffer", size, n, err)
+		}
+		buf := make([]byte, 256*mss)
+		if n, err = s.ReadMessage(buf); err != nil || n != size {
+			t.Fatal("message boundary lost", size, n, err)
+		}
+	}
+
+	s.SetStreamMode(true)
+	if _, err := s.ReadMessage(make([]byte, mss)); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatal("ReadMessage in stream mode", err)
+	}
+	if err := s.WriteMessage(make([]byte, mss)); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatal("WriteMessage in stream mode", err)
+	}
+}
+
+func TestUnreliable(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	block, _ := NewSalsa20BlockCrypt(pass)
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetUnreliable(true)
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.WriteUnreliable([]byte("hello")); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatal("datagram sent without the option", err)
+	}
+	cli.SetUnreliable(true)
+	if err := cli.WriteUnreliable(make([]byte, cli.kcp.mss+1)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatal("datagram beyond a segment sent", err)
+	}
+
+	// the datagrams start the session, and go along with the reliable data
+	const count = 50
+	for i := 0; i < count; i++ {
+		if err := cli.WriteUnreliable([]byte(fmt.Sprintf("datagram%v", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cli.Write([]byte("stream"))
+
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	if n, err := s.ReadUnreliable(buf[:4]); err != io.ErrShortBuffer || n != len("datagram0") {
+		t.Fatal("short buffer", n, err)
+	}
+	recv := 0
+	for {
+		n, err := s.ReadUnreliable(buf)
+		if err != nil {
+			break
+		}
+		if !bytes.HasPrefix(buf[:n], []byte("datagram")) {
+			t.Fatal("corrupt datagram", string(buf[:n]))
+		}
+		recv++
+	}
+	if recv < count/2 {
+		t.Fatal("datagrams lost", recv)
+	}
+	s.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := s.Read(buf); err != nil || string(buf[:n]) != "stream" {
+		t.Fatal("reliable data", string(buf[:n]), err)
+	}
+	if snmp := s.GetSnmp(); snmp.InDgrams != uint64(recv) {
+		t.Fatal("datagrams not counted", snmp.InDgrams, recv)
+	}
+
+	// a peer without the option drops the datagrams
+	s.SetUnreliable(false)
+	kcpInErrors := s.GetSnmp().KCPInErrors
+	cli.WriteUnreliable([]byte("dropped"))
+	cli.Write([]byte("stream"))
+	if n, err := s.Read(buf); err != nil || string(buf[:n]) != "stream" {
+		t.Fatal("reliable data", string(buf[:n]), err)
+	}
+	if s.GetSnmp().KCPInErrors == kcpInErrors {
+		t.Fatal("datagram not dropped")
+	}
+}
+
+func TestReadFromWriteTo(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetCloseNotify(true)
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetCloseNotify(true)
+	cli.SetStreamMode(true)
+	cli.SetWindowSize(256, 256)
+	cli.SetNoDelay(1, 10, 2, 1)
+
+	// the data is sent by ReadFrom and received by WriteTo until the FIN
+	sent := make([]byte, 1024*1024)
+	io.ReadFull(rand.Reader, sent)
+	done := make(chan error, 1)
+	var recv bytes.Buffer
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer s.Close()
+		s.SetWindowSize(256, 256)
+		s.SetNoDelay(1, 10, 2, 1)
+		s.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, err = io.Copy(&recv, s)
+		done <- err
+	}()
+
+	n, err := io.Copy(cli, io.LimitReader(bytes.NewReader(sent), int64(len(sent))))
+	if err != nil || n != int64(len(sent)) {
+		t.Fatal(n, err)
+	}
+	if err := cli.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent, recv.Bytes()) {
+		t.Fatal("data mismatch", recv.Len())
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetCloseNotify(true)
+
+	// relay the request back after the client has finished sending
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		req, err := ioutil.ReadAll(s)
+		if err != nil {
+			return
+		}
+		s.Write(req)
+		s.CloseWrite()
+	}()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetCloseNotify(true)
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	req := make([]byte, 4096)
+	io.ReadFull(rand.Reader, req)
+	if _, err := cli.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Write(req); err == nil {
+		t.Fatal("write after CloseWrite should fail")
+	}
+
+	resp, err := ioutil.ReadAll(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(req, resp) {
+		t.Fatal("response mismatch")
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	if err != nil {
+		t.Fail()
+	}
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	l.SetWriteDeadline(time.Now().Add(time.Second))
+	l.SetDeadline(time.Now().Add(time.Second))
+	time.Sleep(2 * time.Second)
+	if _, err := l.Accept(); err == nil {
+		t.Fail()
+	}
+
+	l.Close()
+	fakeaddr, _ := net.ResolveUDPAddr("udp6", "127.0.0.1:1111")
+	if l.closeSession(fakeaddr) {
+		t.Fail()
+	}
+}
+
+// A wrapper for net.PacketConn that remembers when Close has been called.
+type closedFlagPacketConn struct {
+	net.PacketConn
+	Closed bool
+}
+
+func (c *closedFlagPacketConn) Close() error {
+	c.Closed = true
+	return c.PacketConn.Close()
+}
+
+func newClosedFlagPacketConn(c net.PacketConn) *closedFlagPacketConn {
+	return &closedFlagPacketConn{c, false}
+}
+
+// Listener should close a net.PacketConn that it created.
+// https://github.com/xtaci/kcp-go/issues/165
+func TestListenerOwnedPacketConn(t *testing.T) {
+	// ListenWithOptions creates its own net.PacketConn.
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	// Replace the internal net.PacketConn with one that remembers when it
+	// has been closed.
+	pconn := newClosedFlagPacketConn(l.conn)
+	l.conn = pconn
+
+	if pconn.Closed {
+		t.Fatal("owned PacketConn closed before Listener.Close()")
+	}
+
+	err = l.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	if !pconn.Closed {
+		t.Fatal("owned PacketConn not closed after Listener.Close()")
+	}
+}
+
+// UDPSession should not close a net.PacketConn that it did not create.
+func TestSessionNonOwnedPacketConn(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+	pconn := newClosedFlagPacketConn(c)
+
+	raddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:1111")
+	sess, err := NewConn3(1, raddr, nil, 0, 0, pconn)
+	if err != nil {
+		panic(err)
+	}
+	if err := sess.Close(); err != nil {
+		panic(err)
+	}
+
+	if pconn.Closed {
+		t.Fatal("non-owned PacketConn closed after UDPSession.Close()")
+	}
+}
+
+// Listener should not close a net.PacketConn that it did not create.
+// https://github.com/xtaci/kcp-go/issues/165
+func TestListenerNonOwnedPacketConn(t *testing.T) {
+	// Create a net.PacketConn not owned by the Listener.
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+	// Make it remember when it has been closed.
+	pconn := newClosedFlagPacketConn(c)
+
+	l, err := ServeConn(nil, 0, 0, pconn)
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+
+	if pconn.Closed {
+		t.Fatal("non-owned PacketConn closed before Listener.Close()")
+	}
+
+	err = l.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	if pconn.Closed {
+		t.Fatal("non-owned PacketConn closed after Listener.Close()")
+	}
+}
+
+// UDPSession should close a net.PacketConn that it created.
+// https://github.com/xtaci/kcp-go/issues/165
+func TestUDPSessionOwnedPacketConn(t *testing.T) {
+	l := sinkServer(0)
+	defer l.Close()
+
+	// DialWithOptions creates its own net.PacketConn.
+	client, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		panic(err)
+	}
+	defer client.Close()
+	// Replace the internal net.PacketConn with one that remembers when it
+	// has been closed.
+	pconn := newClosedFlagPacketConn(client.conn)
+	client.conn = pconn
+
+	if pconn.Closed {
+		t.Fatal("owned PacketConn closed before UDPSession.Close()")
+	}
+
+	err = client.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	if !pconn.Closed {
 		t.Fatal("owned PacketConn not closed after UDPSession.Close()")
 	}
 }
@@ -700,3 +1535,3254 @@ func TestUDPSessionNonOwnedPacketConn(t *testing.T) {
 		t.Fatal("non-owned PacketConn closed after UDPSession.Close()")
 	}
 }
+
+func TestDialContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DialContext(ctx, "127.0.0.1:1111", nil, 0, 0); !errors.Is(err, context.Canceled) {
+		t.Fatal("expect context.Canceled, got:", err)
+	}
+
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+
+	block, _ := NewSalsa20BlockCrypt(pass)
+	cli, err := DialContext(context.Background(), fmt.Sprintf("127.0.0.1:%v", port), block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := echo_tester(cli, 64, 16); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDialContextFirstWrite(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	cli, err := DialContext(ctx, "127.0.0.1:1111", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	<-ctx.Done()
+	if _, err := cli.Write([]byte("hello")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expect context.DeadlineExceeded, got:", err)
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	// nobody is listening on the remote
+	cli, err := DialWithOptions("127.0.0.1:1112", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetMaxRetries(3)
+	cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err := cli.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 128)
+	if _, err := cli.Read(buf); !errors.Is(err, ErrBrokenPipe) {
+		t.Fatal("expect ErrBrokenPipe, got:", err)
+	}
+	if _, err := cli.Write([]byte("hello")); !errors.Is(err, ErrBrokenPipe) {
+		t.Fatal("expect ErrBrokenPipe, got:", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetIdleTimeout(300 * time.Millisecond)
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idleClosed := atomic.LoadUint64(&DefaultSnmp.IdleClosed)
+	cli.Close() // the client disappears silently
+
+	buf := make([]byte, 128)
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Read(buf); !errors.Is(err, ErrIdleTimeout) {
+		t.Fatal("expect ErrIdleTimeout, got:", err)
+	}
+	if _, err := s.Write(buf); !errors.Is(err, ErrIdleTimeout) {
+		t.Fatal("expect ErrIdleTimeout, got:", err)
+	}
+	if s.GetSnmp().IdleClosed != 1 || atomic.LoadUint64(&DefaultSnmp.IdleClosed) <= idleClosed {
+		t.Fatal("IdleClosed not counted")
+	}
+
+	l.sessionLock.RLock()
+	n := len(l.sessions)
+	l.sessionLock.RUnlock()
+	if n != 0 {
+		t.Fatal("idle session not removed", n)
+	}
+}
+
+type fixedWindowController struct {
+	acked, losses uint32
+}
+
+func (c *fixedWindowController) OnAck(rtt time.Duration, acked uint32) { c.acked += acked }
+func (c *fixedWindowController) OnLoss(timeouts, fast uint32)          { c.losses += timeouts + fast }
+func (c *fixedWindowController) Window() uint32                        { return 8 }
+
+func TestCongestionController(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+
+	cli, err := dialEcho(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 0) // congestion control enabled
+	cc := new(fixedWindowController)
+	cli.SetCongestionController(cc)
+
+	if err := echo_tester(cli, 4096, 16); err != nil {
+		t.Fatal(err)
+	}
+	cli.mu.Lock()
+	acked := cc.acked
+	cli.mu.Unlock()
+	if acked == 0 {
+		t.Fatal("controller not notified of acks")
+	}
+}
+
+func TestBBRSession(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+
+	cli, err := dialEcho(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 0) // congestion control enabled
+	cc := NewBBRController()
+	cli.SetCongestionController(cc)
+
+	if err := echo_tester(cli, 65536, 16); err != nil {
+		t.Fatal(err)
+	}
+	if cc.Bandwidth() == 0 || cc.MinRTT() == 0 {
+		t.Fatal("no estimate", cc.Bandwidth(), cc.MinRTT())
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetIdleTimeout(400 * time.Millisecond)
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetKeepAlive(100 * time.Millisecond)
+	cli.SetIdleTimeout(400 * time.Millisecond)
+	if _, err := cli.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 128)
+	if _, err := s.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// no traffic from the application
+	time.Sleep(time.Second)
+	s.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := s.Read(buf); !errors.Is(err, ErrTimeout) {
+		t.Fatal("session should be kept alive, got:", err)
+	}
+	cli.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := cli.Read(buf); !errors.Is(err, ErrTimeout) {
+		t.Fatal("session should be kept alive, got:", err)
+	}
+	if cli.GetSnmp().KeepAlives == 0 {
+		t.Fatal("KeepAlives not counted")
+	}
+}
+
+func TestAEADSession(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	block, _ := NewAESGCMBlockCrypt(pass[:32])
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go handleEcho(s)
+		}
+	}()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := echo_tester(cli, 4096, 32); err != nil {
+		t.Fatal(err)
+	}
+
+	// packets sealed with another key are rejected
+	authErrs := atomic.LoadUint64(&DefaultSnmp.InAuthErrors)
+	forged, _ := NewAESGCMBlockCrypt(pass[:16])
+	cli2, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), forged, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli2.Close()
+	cli2.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	cli2.Write([]byte("hello"))
+	if _, err := cli2.Read(make([]byte, 128)); err == nil {
+		t.Fatal("forged packets should not be echoed")
+	}
+	if atomic.LoadUint64(&DefaultSnmp.InAuthErrors) == authErrs {
+		t.Fatal("InAuthErrors not counted")
+	}
+}
+
+func TestAEADKeyExhausted(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	block, _ := NewAESGCMBlockCrypt(pass[:32])
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go handleEcho(s)
+		}
+	}()
+
+	// a key of the client close to its limit
+	key, _ := NewAESGCMBlockCrypt(pass[:32])
+	key.(*aeadCrypt).sealed = aeadPacketLimit - 8
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), key, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	for i := 0; i < 100; i++ {
+		if _, err = cli.Write(make([]byte, 1024)); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !errors.Is(err, ErrKeyExhausted) {
+		t.Fatal("writes beyond the limit of the key", err)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, c := range []uint64{1, 3, 2, 1500, 1000, 600} {
+		if !w.accept(c) {
+			t.Fatal("counter rejected", c)
+		}
+	}
+	for _, c := range []uint64{0, 1, 2, 3, 1500, 1000, 476} {
+		if w.accept(c) {
+			t.Fatal("counter accepted", c)
+		}
+	}
+	if !w.accept(477) || !w.accept(5000) || w.accept(3976) || !w.accept(3977) {
+		t.Fatal("window not slided")
+	}
+}
+
+func TestReplayProtection(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	block, _ := NewAESBlockCrypt(pass[:32])
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetReplayProtection(true)
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go handleEcho(s)
+		}
+	}()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetReplayProtection(true)
+	cli.SetDUP(1) // every packet is replayed once
+
+	replayDrops := atomic.LoadUint64(&DefaultSnmp.ReplayDrops)
+	if err := echo_tester(cli, 4096, 32); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadUint64(&DefaultSnmp.ReplayDrops) == replayDrops {
+		t.Fatal("ReplayDrops not counted")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	block, _ := NewAESGCMBlockCrypt(pass[:32])
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetKeyRotation(true)
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go handleEcho(s)
+		}
+	}()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetKeyRotation(true)
+	if err := echo_tester(cli, 1024, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	// the remote switches to the new key within the grace period
+	next, _ := NewAESGCMBlockCrypt(pass[:16])
+	if err := l.SetBlockCrypt(next); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.SetBlockCrypt(next); err != nil {
+		t.Fatal(err)
+	}
+	if err := echo_tester(cli, 1024, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys of a different kind are rejected
+	aes, _ := NewAESBlockCrypt(pass[:32])
+	if cli.SetBlockCrypt(aes) == nil || l.SetBlockCrypt(aes) == nil {
+		t.Fatal("key of a different kind accepted")
+	}
+
+	// an epoch ahead of the remote is dropped
+	unknown := atomic.LoadUint64(&DefaultSnmp.UnknownEpochs)
+	cli.SetBlockCrypt(next)
+	cli.SetBlockCrypt(next)
+	cli.Write([]byte("ping"))
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadUint64(&DefaultSnmp.UnknownEpochs) == unknown {
+		t.Fatal("UnknownEpochs not counted")
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetMaxSessions(1)
+	accepted := make(chan *UDPSession, 2)
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			accepted <- s
+			go handleEcho(s)
+		}
+	}()
+
+	cli1, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli1.Close()
+	if err := echo_tester(cli1, 64, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second session is ignored while the first one is alive
+	cli2, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli2.Close()
+	cli2.Write([]byte("ping"))
+	time.Sleep(200 * time.Millisecond)
+	if n := l.GetSessionCount(); n != 1 {
+		t.Fatal("session limit exceeded", n)
+	}
+
+	// a slot frees up after the first one closed
+	(<-accepted).Close()
+	buf := make([]byte, 4)
+	cli2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli2, buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := l.GetSessionCount(); n != 1 {
+		t.Fatal("session not counted", n)
+	}
+}
+
+func TestAcceptBacklog(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithBacklog(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// AcceptKCP times out on an empty backlog
+	l.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := l.AcceptKCP(); err == nil {
+		t.Fatal("accepted nothing")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal(err)
+	}
+	l.SetDeadline(time.Time{})
+
+	overflow := atomic.LoadUint64(&DefaultSnmp.AcceptOverflow)
+	for i := 0; i < 2; i++ {
+		cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		cli.Write([]byte("ping"))
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// the second session is dropped while the backlog is full
+	if n := l.GetSessionCount(); n != 1 {
+		t.Fatal("backlog exceeded", n)
+	}
+	if atomic.LoadUint64(&DefaultSnmp.AcceptOverflow) == overflow {
+		t.Fatal("overflow not counted")
+	}
+
+	// and gets in by the retransmission once the backlog drains
+	l.SetDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 2; i++ {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+	}
+}
+
+func TestRejectOverflow(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithBacklog(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetCloseNotify(true)
+	l.SetRejectOverflow(true)
+
+	var clis []*UDPSession
+	for i := 0; i < 2; i++ {
+		cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		cli.SetCloseNotify(true)
+		cli.Write([]byte("ping"))
+		clis = append(clis, cli)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// the second session is closed at once, its remote reads io.EOF
+	clis[1].SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := clis[1].Read(make([]byte, 4)); err != io.EOF {
+		t.Fatal(err)
+	}
+}
+
+func TestConnFilter(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var calls int32
+	l.SetConnFilter(func(addr net.Addr, packet []byte) bool {
+		atomic.AddInt32(&calls, 1)
+		return false
+	})
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go handleEcho(s)
+		}
+	}()
+
+	filtered := atomic.LoadUint64(&DefaultSnmp.ConnFiltered)
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Write([]byte("ping"))
+	time.Sleep(200 * time.Millisecond)
+	if n := l.GetSessionCount(); n != 0 {
+		t.Fatal("filtered session created", n)
+	}
+	if atomic.LoadInt32(&calls) == 0 || atomic.LoadUint64(&DefaultSnmp.ConnFiltered) == filtered {
+		t.Fatal("filter not applied")
+	}
+
+	// the retransmission gets in once the filter is removed
+	l.SetConnFilter(nil)
+	buf := make([]byte, 4)
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionRate(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetSessionRate(10, 1)
+
+	limited := atomic.LoadUint64(&DefaultSnmp.RateLimited)
+	for i := 0; i < 2; i++ {
+		cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		cli.Write([]byte("ping"))
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// a new session per second from 127.0.0.1
+	if n := l.GetSessionCount(); n != 1 {
+		t.Fatal("session rate exceeded", n)
+	}
+	if atomic.LoadUint64(&DefaultSnmp.RateLimited) == limited {
+		t.Fatal("drops not counted")
+	}
+
+	// the second one gets in by the retransmission a second later
+	l.SetDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 2; i++ {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+	}
+}
+
+func TestSessionRatePerIPFirst(t *testing.T) {
+	// a source flooding beyond its own rate leaves the total rate to the others
+	sl := sessionLimiter{rate: 5, ipRate: 1}
+	flooder := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	for i := 0; i < 100; i++ {
+		sl.admit(flooder)
+	}
+	for i := 2; i < 6; i++ {
+		if !sl.admit(&net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 1}) {
+			t.Fatal("the total rate drained by a single source")
+		}
+	}
+}
+
+func TestListenerSessions(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	clis := make(map[int]*UDPSession) // by port
+	for i := 0; i < 2; i++ {
+		cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		cli.Write([]byte("ping"))
+		clis[cli.LocalAddr().(*net.UDPAddr).Port] = cli
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	sessions := l.Sessions()
+	if len(sessions) != 2 {
+		t.Fatal("sessions", len(sessions))
+	}
+	for _, s := range sessions {
+		cli, ok := clis[s.RemoteAddr().(*net.UDPAddr).Port]
+		if !ok || cli.GetConv() != s.GetConv() {
+			t.Fatal("unknown session", s.RemoteAddr(), s.GetConv())
+		}
+	}
+
+	// kicked out by Close
+	sessions[0].Close()
+	if n := len(l.Sessions()); n != 1 {
+		t.Fatal("closed session listed", n)
+	}
+	if n := l.GetSessionCount(); n != 1 {
+		t.Fatal("closed session not removed", n)
+	}
+}
+
+func TestGetSocketBuffer(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// the kernel doubles the values set for its bookkeeping
+	const size = 64 * 1024
+	for _, c := range []struct {
+		set func(int) error
+		get func() (int, error)
+	}{
+		{cli.SetReadBuffer, cli.GetReadBuffer},
+		{cli.SetWriteBuffer, cli.GetWriteBuffer},
+		{l.SetReadBuffer, l.GetReadBuffer},
+		{l.SetWriteBuffer, l.GetWriteBuffer},
+	} {
+		if err := c.set(size); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := c.get(); err != nil || n != 2*size {
+			t.Fatal("granted", n, err)
+		}
+	}
+}
+
+func TestCloseCancelsUpdater(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SetNoDelay(0, 5000, 0, 0)
+	time.Sleep(50 * time.Millisecond) // the first update reschedules itself
+
+	cli.mu.Lock()
+	h := cli.updater
+	cli.mu.Unlock()
+	cli.Close()
+	if !h.isCanceled() {
+		t.Fatal("pending update not canceled")
+	}
+}
+
+func TestAcceptContext(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := l.AcceptContext(ctx); err != context.Canceled {
+		t.Fatal(err)
+	}
+
+	// still accepting
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Write([]byte("ping"))
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := l.AcceptContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+func TestSessionTimedSched(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsched := NewTimedSched(1)
+	l.SetTimedSched(lsched, true)
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			if s.sched != lsched {
+				t.Error("scheduler not inherited")
+			}
+			go handleEcho(s)
+		}
+	}()
+
+	sched := NewTimedSched(1)
+	defer sched.Close()
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetTimedSched(sched)
+	if err := echo_tester(cli, 64, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// the owned scheduler is closed with the listener
+	l.Close()
+	select {
+	case <-lsched.die:
+	default:
+		t.Fatal("owned scheduler not closed")
+	}
+}
+
+func TestCongestionCallback(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+
+	cli, err := dialEcho(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 0)
+
+	var calls, running, maxCwnd uint32
+	cli.SetCongestionCallback(func(cwnd, ssthresh, inflight uint32) {
+		if atomic.AddUint32(&running, 1) != 1 {
+			t.Error("callback called concurrently")
+		}
+		atomic.AddUint32(&calls, 1)
+		if cwnd > atomic.LoadUint32(&maxCwnd) {
+			atomic.StoreUint32(&maxCwnd, cwnd)
+		}
+		time.Sleep(20 * time.Millisecond) // a slow consumer
+		atomic.AddUint32(&running, ^uint32(0))
+	})
+
+	start := time.Now()
+	if err := echo_tester(cli, 1024, 1000); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	time.Sleep(50 * time.Millisecond)
+	n := atomic.LoadUint32(&calls)
+	if n == 0 || atomic.LoadUint32(&maxCwnd) <= 1 {
+		t.Fatal("window growth not reported", n, atomic.LoadUint32(&maxCwnd))
+	}
+	// the changes are coalesced while the callback sleeps
+	if limit := uint32(elapsed/(20*time.Millisecond)) + 2; n > limit {
+		t.Fatal("changes not coalesced", n, limit)
+	}
+}
+
+func TestUpdateJitter(t *testing.T) {
+	const interval = 10 * time.Millisecond
+	for i := 0; i < 1000; i++ {
+		if d := jitterDelay(interval); d < interval-interval/updateJitterDiv || d > interval+interval/updateJitterDiv {
+			t.Fatal("jitter out of bounds", d)
+		}
+	}
+
+	// the updates of the sessions created at once, over a second of lockstep
+	// intervals, spread across the interval
+	const sessions, buckets = 100, 10
+	var hist [buckets]int
+	for i := 0; i < sessions; i++ {
+		var ts time.Duration
+		for ts < time.Second {
+			ts += jitterDelay(interval)
+		}
+		hist[ts%interval*buckets/interval]++
+	}
+	for k, n := range hist {
+		if n == 0 || n > sessions/3 {
+			t.Fatal("updates clustered", k, hist)
+		}
+	}
+
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port).(*Listener)
+	defer l.Close()
+	l.SetUpdateJitter(true)
+	cli, err := dialEcho(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetUpdateJitter(true)
+	if err := echo_tester(cli, 1024, 100); err != nil {
+		t.Fatal(err)
+	}
+	accepted := l.Sessions()
+	if len(accepted) == 0 {
+		t.Fatal("no session accepted")
+	}
+	for _, s := range accepted {
+		s.mu.Lock()
+		jitter := s.jitter
+		s.mu.Unlock()
+		if !jitter {
+			t.Fatal("jitter not inherited")
+		}
+	}
+}
+
+func TestStreamFlush(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+
+	cli, err := dialEcho(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetInterval(500)
+	cli.SetWriteDelay(true)
+	cli.SetStreamFlush(true)
+
+	start := time.Now()
+	if err := echo_tester(cli, 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatal("writes delayed to the interval", elapsed)
+	}
+}
+
+func TestOutputHook(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+
+	cli, err := dialEcho(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// drop every 5th datagram, and pass the rest rewritten to themselves
+	var calls int
+	cli.SetOutputHook(func(raw []byte) []byte {
+		calls++
+		if calls%5 == 0 {
+			return nil
+		}
+		return append([]byte(nil), raw...)
+	})
+	if err := echo_tester(cli, 1024, 100); err != nil {
+		t.Fatal(err)
+	}
+	cli.mu.Lock()
+	n := calls
+	cli.mu.Unlock()
+	if n == 0 {
+		t.Fatal("hook not called")
+	}
+	if stats := cli.Stats(); stats.RetransSegs == 0 {
+		t.Fatal("drops not retransmitted")
+	}
+}
+
+// An output hook dropping 5% of the datagrams at random for chaos testing.
+func ExampleUDPSession_SetOutputHook() {
+	sess, err := Dial("127.0.0.1:12345")
+	if err != nil {
+		return
+	}
+	defer sess.Close()
+	sess.(*UDPSession).SetOutputHook(func(raw []byte) []byte {
+		if mrand.Intn(100) < 5 {
+			return nil
+		}
+		return raw
+	})
+}
+
+// ackOnly returns if a plain datagram carries nothing but ACK segments
+func ackOnly(raw []byte) bool {
+	if len(raw) == 0 {
+		return false
+	}
+	for len(raw) >= IKCP_OVERHEAD {
+		if raw[4] != IKCP_CMD_ACK || binary.LittleEndian.Uint32(raw[20:]) != 0 {
+			return false
+		}
+		raw = raw[IKCP_OVERHEAD:]
+	}
+	return len(raw) == 0
+}
+
+// countACKs streams to a sink configured by 'setup', and returns the ACK-only
+// datagrams it sent
+func countACKs(t *testing.T, setup func(s *UDPSession)) int {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var acks int32
+	accepted := make(chan *UDPSession, 1)
+	go func() {
+		conn, err := l.AcceptKCP()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+		conn.SetNoDelay(0, 100, 0, 0)
+		conn.SetOutputHook(func(raw []byte) []byte {
+			if ackOnly(raw) {
+				atomic.AddInt32(&acks, 1)
+			}
+			return raw
+		})
+		setup(conn)
+		buf := make([]byte, 65536)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SetNoDelay(1, 10, 2, 1)
+	msg := make([]byte, 512)
+	for i := 0; i < 200; i++ {
+		if _, err := cli.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond)
+	cli.Close()
+	if conn, ok := <-accepted; ok {
+		conn.Close()
+	}
+	return int(atomic.LoadInt32(&acks))
+}
+
+func TestACKDelay(t *testing.T) {
+	nodelay := countACKs(t, func(s *UDPSession) { s.SetACKNoDelay(true) })
+	delayed := countACKs(t, func(s *UDPSession) { s.SetACKDelay(20 * time.Millisecond) })
+	interval := countACKs(t, func(s *UDPSession) {})
+	t.Log("ACK-only datagrams, nodelay:", nodelay, "delayed:", delayed, "interval:", interval)
+	if !(nodelay > delayed && delayed > interval) {
+		t.Fatal("the acks are not coalesced by the delay")
+	}
+}
+
+func TestDialer(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+	raddr := fmt.Sprintf("127.0.0.1:%v", port)
+
+	block, _ := NewSalsa20BlockCrypt(pass)
+	d := &Dialer{
+		Block: block, DataShards: 10, ParityShards: 3,
+		NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1,
+		SndWnd: 1024, RcvWnd: 1024,
+		MTU:         1200,
+		StreamMode:  true,
+		ACKNoDelay:  true,
+		ReadBuffer:  4 * 1024 * 1024,
+		WriteBuffer: 4 * 1024 * 1024,
+	}
+	cli, err := d.Dial(raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	if nodelay, interval, resend, nc := cli.GetNoDelay(); nodelay != 1 || interval != 10 || resend != 2 || nc != 1 {
+		t.Fatal("SetNoDelay not applied", nodelay, interval, resend, nc)
+	}
+	cli.mu.Lock()
+	applied := cli.kcp.snd_wnd == 1024 && cli.kcp.rcv_wnd == 1024 && cli.kcp.mtu == 1200 &&
+		cli.kcp.stream == 1 && cli.ackNoDelay
+	cli.mu.Unlock()
+	if !applied {
+		t.Fatal("options not applied")
+	}
+	if err := echo_tester(cli, 4096, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	// the invalid options and the context fail the dial
+	if _, err := (&Dialer{MTU: mtuLimit + 1}).Dial(raddr); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatal("expect ErrInvalidOperation, got:", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.DialContext(ctx, raddr); !errors.Is(err, context.Canceled) {
+		t.Fatal("expect context.Canceled, got:", err)
+	}
+}
+
+func TestPacketAuthenticator(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetPacketAuthenticator(NewHMACAuthenticator(pass))
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go handleEcho(s)
+		}
+	}()
+
+	// a forged packet never starts a session
+	conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%v", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	csumErrors := atomic.LoadUint64(&DefaultSnmp.InCsumErrors)
+	conn.Write(make([]byte, hmacSize+IKCP_OVERHEAD))
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadUint64(&DefaultSnmp.InCsumErrors) == csumErrors {
+		t.Fatal("forged packet not counted")
+	}
+	if n := l.GetSessionCount(); n != 0 {
+		t.Fatal("session started by a forged packet", n)
+	}
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.SetPacketAuthenticator(NewHMACAuthenticator(pass)); err != nil {
+		t.Fatal(err)
+	}
+	if err := echo_tester(cli, 4096, 16); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	block, _ := NewNoneBlockCrypt(pass)
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetCompression(NewSnappyCompressor())
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go handleEcho(s)
+		}
+	}()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.SetCompression(NewSnappyCompressor()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the text shrinks on wire, the random data is sent as is
+	text := bytes.Repeat([]byte("kcp-go compresses the frames before encryption. "), 2000)
+	random := make([]byte, 64*1024)
+	io.ReadFull(rand.Reader, random)
+	for _, sent := range [][]byte{text, random} {
+		outBytes := cli.GetSnmp().OutBytes
+		if _, err := cli.Write(sent); err != nil {
+			t.Fatal(err)
+		}
+		cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+		recv := make([]byte, len(sent))
+		if _, err := io.ReadFull(cli, recv); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sent, recv) {
+			t.Fatal("data mismatch")
+		}
+		if n := cli.GetSnmp().OutBytes - outBytes; bytes.Equal(sent, text) && n > uint64(len(sent)/2) {
+			t.Fatal("text not compressed", n)
+		}
+	}
+
+	// a peer without compression fails instead of delivering garbage
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	raddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%v", port))
+	peer, err := NewConn3(1, raddr, block, 10, 3, conn) // a conv not looking like the magic byte
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	compressErrors := atomic.LoadUint64(&DefaultSnmp.CompressErrors)
+	peer.Write(text[:1024])
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadUint64(&DefaultSnmp.CompressErrors) == compressErrors {
+		t.Fatal("mismatched peer not counted")
+	}
+	peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := peer.Read(make([]byte, 1024)); err == nil {
+		t.Fatal("data delivered to a mismatched peer")
+	}
+}
+
+func TestAdaptiveFEC(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := listenTinyBufferEcho(port) // the loss rate is observed on the FEC from the remote
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleEcho(s.(*UDPSession))
+		}
+	}()
+
+	cli, err := dialEcho(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	if cli.SetAdaptiveFEC(0, 1) == nil || cli.SetAdaptiveFEC(3, 2) == nil || cli.SetAdaptiveFEC(1, 250) == nil {
+		t.Fatal("invalid bounds accepted")
+	}
+	if err := cli.SetAdaptiveFEC(1, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := echo_tester(cli, 4096, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := cli.FECStats(); stats.ParitySent == 0 || stats.ParityReceived == 0 {
+		t.Fatal("FEC statistics not counted", stats)
+	}
+
+	// nothing lost on loopback, the parity shards go down to the lower bound
+	cli.mu.Lock()
+	cli.adaptFEC()
+	cli.mu.Unlock()
+	if err := echo_tester(cli, 4096, 16); err != nil {
+		t.Fatal(err)
+	}
+	if ds, ps := cli.GetFECShards(); ds != 10 || ps != 1 {
+		t.Fatal("parity shards not adapted", ds, ps)
+	}
+}
+
+func TestSetFEC(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := listenTinyBufferEcho(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan *UDPSession, 1)
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- s.(*UDPSession)
+			go handleEcho(s.(*UDPSession))
+		}
+	}()
+
+	cli, err := dialEcho(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if cli.SetFEC(3, 4) == nil || cli.SetFEC(800, 300) == nil || cli.SetFEC(10, 0) == nil {
+		t.Fatal("invalid shards accepted")
+	}
+	if err := echo_tester(cli, 4096, 16); err != nil {
+		t.Fatal(err)
+	}
+	srv := <-accepted
+
+	// the shards change at the group boundaries, and the remote re-tunes
+	for _, shards := range [][2]int{{4, 2}, {0, 0}} {
+		if err := cli.SetFEC(shards[0], shards[1]); err != nil {
+			t.Fatal(err)
+		}
+		if err := echo_tester(cli, 4096, 16); err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.SetFEC(shards[0], shards[1]); err != nil {
+			t.Fatal(err)
+		}
+		if err := echo_tester(cli, 4096, 16); err != nil {
+			t.Fatal(err)
+		}
+		if ds, ps := cli.GetFECShards(); ds != shards[0] || ps != shards[1] {
+			t.Fatal("shards not changed", ds, ps)
+		}
+	}
+
+	// enabled again when idle
+	if err := cli.SetFEC(10, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := echo_tester(cli, 4096, 16); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFECCodec(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	block, _ := NewSalsa20BlockCrypt(pass)
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), block, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetFECCodec(NewXORCodec)
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go handleEcho(s)
+		}
+	}()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), block, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.SetFECCodec(NewXORCodec); err != nil {
+		t.Fatal(err)
+	}
+	if err := echo_tester(cli, 4096, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	// XOR has only one parity shard
+	if cli.SetFEC(10, 3) == nil {
+		t.Fatal("XOR codec with 3 parity shards")
+	}
+	if cli.SetFECCodec(nil) != nil || cli.SetFEC(10, 3) != nil {
+		t.Fatal("Reed-Solomon codec not restored")
+	}
+	if cli.SetFECCodec(NewXORCodec) == nil {
+		t.Fatal("XOR codec with 3 parity shards")
+	}
+}
+
+func TestMaxSendRate(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := sinkServer(port)
+	defer l.Close()
+
+	cli, err := dialSink(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	const rate = 200 * 1024
+	cli.SetMaxSendRate(rate)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			if _, err := cli.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	time.Sleep(time.Second)
+	sent := cli.GetSnmp().OutBytes
+	elapsed := time.Since(start).Seconds()
+
+	burst := float64(rate) * paceBurst.Seconds()
+	if burst < mtuLimit {
+		burst = mtuLimit
+	}
+	if float64(sent) > rate*elapsed+burst {
+		t.Fatalf("sent %v bytes in %.2fs, more than the rate %v", sent, elapsed, rate)
+	}
+	if float64(sent) < rate/2 {
+		t.Fatalf("sent %v bytes in %.2fs, far below the rate %v", sent, elapsed, rate)
+	}
+	t.Log("sent", sent, "bytes in", elapsed, "s")
+}
+
+func TestLocalConn(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.LocalConn().LocalAddr().String() != l.Addr().String() {
+		t.Fatal("listener conn mismatch")
+	}
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	conn, ok := cli.LocalConn().(*net.UDPConn)
+	if !ok {
+		t.Fatal("not a UDP conn")
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := raw.Control(func(fd uintptr) {}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadMulti(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	const count = 1000
+	go func() {
+		for i := 0; i < count; i++ {
+			msg := make([]byte, 1+i%100)
+			msg[0] = byte(i)
+			cli.Write(msg)
+		}
+	}()
+
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	bufs := make([][]byte, 16)
+	for i := 0; i < count; {
+		for k := range bufs {
+			bufs[k] = make([]byte, 128)
+		}
+		n, err := s.ReadMulti(bufs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range bufs[:n] {
+			if len(msg) != 1+i%100 || msg[0] != byte(i) {
+				t.Fatal("message mismatch", i, len(msg))
+			}
+			i++
+		}
+	}
+
+	// a message larger than the buffer is read like Read
+	cli.Write(make([]byte, 100))
+	bufs[0] = make([]byte, 60)
+	if n, err := s.ReadMulti(bufs[:1]); err != nil || n != 1 || len(bufs[0]) != 60 {
+		t.Fatal("partial read", n, err, len(bufs[0]))
+	}
+	if n, err := s.Read(make([]byte, 60)); err != nil || n != 40 {
+		t.Fatal("remaining read", n, err)
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	readBench(b, false)
+}
+
+func BenchmarkReadMulti(b *testing.B) {
+	readBench(b, true)
+}
+
+func readBench(b *testing.B, multi bool) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetWindowSize(1024, 1024)
+	cli.SetNoDelay(1, 10, 2, 1)
+
+	const msglen = 64
+	count := b.N
+	go func() {
+		msg := make([]byte, msglen)
+		for i := 0; i < count; i++ {
+			if _, err := cli.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	s, err := l.AcceptKCP()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	s.SetWindowSize(1024, 1024)
+	s.SetNoDelay(1, 10, 2, 1)
+
+	b.ReportAllocs()
+	b.SetBytes(msglen)
+	b.ResetTimer()
+	buf := make([]byte, msglen)
+	bufs := make([][]byte, 64)
+	for i := 0; i < count; {
+		if !multi {
+			if _, err := s.Read(buf); err != nil {
+				b.Fatal(err)
+			}
+			i++
+			continue
+		}
+		for k := range bufs {
+			bufs[k] = bufs[k][:cap(bufs[k])]
+			if cap(bufs[k]) < msglen {
+				bufs[k] = make([]byte, msglen)
+			}
+		}
+		n, err := s.ReadMulti(bufs)
+		if err != nil {
+			b.Fatal(err)
+		}
+		i += n
+	}
+}
+
+// A wrapper for net.PacketConn that drops the next packet written once armed.
+type dropPacketConn struct {
+	net.PacketConn
+	drop int32
+}
+
+func (c *dropPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if atomic.CompareAndSwapInt32(&c.drop, 1, 0) {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+type firstPacketConn struct {
+	net.PacketConn
+	first chan []byte
+}
+
+func (c *firstPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case c.first <- append([]byte(nil), p...):
+	default:
+	}
+	return len(p), nil
+}
+
+func TestSessionKeystream(t *testing.T) {
+	var packets [2][]byte
+	for k := range packets {
+		conn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fconn := &firstPacketConn{PacketConn: conn, first: make(chan []byte, 1)}
+
+		// identical keys and plaintext, and the same conv
+		block, _ := NewSalsa20BlockCrypt(pass)
+		sess, err := NewConn2(conn.LocalAddr(), block, 0, 0, fconn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Close()
+		sess.mu.Lock()
+		sess.kcp.conv = 1
+		sess.mu.Unlock()
+		if _, err := sess.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case packets[k] = <-fconn.first:
+		case <-time.After(time.Second):
+			t.Fatal("no packet sent")
+		}
+	}
+
+	// the random nonce ahead of each packet keeps the sessions from sharing keystream
+	if bytes.Equal(packets[0][:8], packets[1][:8]) {
+		t.Fatal("sessions share the salsa20 nonce")
+	}
+	if bytes.Equal(packets[0][nonceSize:], packets[1][nonceSize:]) {
+		t.Fatal("identical ciphertext for identical plaintext")
+	}
+}
+
+func TestSessionStats(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+
+	cli, err := dialEcho(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// polled concurrently with the traffic
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			cli.Stats()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	if err := echo_tester(cli, 4096, 64); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	stats := cli.Stats()
+	if stats.BytesSent != 4096*64 || stats.BytesReceived != 4096*64 {
+		t.Fatal("bytes not counted", stats.BytesSent, stats.BytesReceived)
+	}
+	if stats.InSegs == 0 || stats.OutSegs == 0 {
+		t.Fatal("segments not counted", stats.InSegs, stats.OutSegs)
+	}
+	if stats.SndWnd != 1024 || stats.RmtWnd == 0 || stats.Cwnd != 0 || stats.RTO == 0 {
+		t.Fatal("protocol state not reported", stats)
+	}
+}
+
+func TestRTTDurations(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+
+	cli, err := dialEcho(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := echo_tester(cli, 1024, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	// the durations follow the millisecond getters once the ACKs are in
+	if srtt := cli.SRTT(); srtt != time.Duration(cli.GetSRTT())*time.Millisecond {
+		t.Fatal("srtt mismatch", srtt, cli.GetSRTT())
+	}
+	if rttvar := cli.RTTVar(); rttvar != time.Duration(cli.GetSRTTVar())*time.Millisecond {
+		t.Fatal("rttvar mismatch", rttvar, cli.GetSRTTVar())
+	}
+	if rto := cli.RTO(); rto <= 0 || rto != time.Duration(cli.GetRTO())*time.Millisecond {
+		t.Fatal("rto mismatch", rto, cli.GetRTO())
+	}
+}
+
+func TestIPv6FlowLabel(t *testing.T) {
+	// the IPv4 remotes and the sockets of Listener
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+	cli, err := dialEcho(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.SetIPv6FlowLabel(0x12345); err == nil {
+		t.Fatal("flow label set for an IPv4 remote")
+	}
+	if err := echo_tester(cli, 1024, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.SetIPv6FlowLabel(0x100000); err == nil {
+		t.Fatal("flow label out of range accepted")
+	}
+}
+
+func TestECN(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the CE marks are detected on Linux only")
+	}
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.SetECN(true); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		handleEcho(s)
+	}()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.SetECN(true); err != nil {
+		t.Fatal(err)
+	}
+	// the path marks every packet from the client
+	if err := ipv4.NewConn(cli.conn.(net.Conn)).SetTOS(ecnCE); err != nil {
+		t.Fatal(err)
+	}
+
+	ceMarks := atomic.LoadUint64(&DefaultSnmp.InCEMarks)
+	if err := echo_tester(cli, 1024, 16); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadUint64(&DefaultSnmp.InCEMarks) == ceMarks {
+		t.Fatal("CE marks not counted")
+	}
+	if cli.GetSnmp().InCEMarks != 0 {
+		t.Fatal("unmarked packets counted")
+	}
+
+	// the echo reaches the client as congestion
+	cli.mu.Lock()
+	reacted := cli.kcp.ts_ece != 0
+	cli.mu.Unlock()
+	if !reacted {
+		t.Fatal("CE marks not echoed")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		s.SetACKNoDelay(true)
+		handleEcho(s)
+	}()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(0, 200, 0, 0)
+	cli.SetWriteDelay(true)
+
+	buf := make([]byte, 4)
+	echo := func(flush bool) time.Duration {
+		start := time.Now()
+		if _, err := cli.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if flush {
+			if err := cli.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := io.ReadFull(cli, buf); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+
+	echo(true) // the first packet creates the session
+	var waited, flushed time.Duration
+	for i := 0; i < 5; i++ {
+		waited += echo(false)
+		flushed += echo(true)
+	}
+	t.Log("write and wait:", waited/5, "write and flush:", flushed/5)
+	if flushed >= waited {
+		t.Fatal("Flush didn't send ahead of the update interval")
+	}
+
+	cli.Close()
+	if err := cli.Flush(); !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatal("expect io.ErrClosedPipe, got:", err)
+	}
+}
+
+type dupPacketConn struct {
+	net.PacketConn
+	dup int32
+}
+
+func (c *dupPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if atomic.LoadInt32(&c.dup) != 0 {
+		c.PacketConn.WriteTo(p, addr)
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func TestSessionRepeatSegs(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	dconn := &dupPacketConn{PacketConn: conn}
+	raddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%v", port))
+	cli, err := NewConn2(raddr, nil, 0, 0, dconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+
+	buf := make([]byte, 16)
+	cli.Write([]byte("a"))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetNoDelay(1, 10, 2, 1)
+	s.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := s.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// a middlebox duplicating a packet
+	atomic.StoreInt32(&dconn.dup, 1)
+	cli.Write([]byte("b"))
+	atomic.StoreInt32(&dconn.dup, 0)
+	if _, err := s.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := s.GetSnmp().RepeatSegs; n != 1 {
+		t.Fatal("RepeatSegs", n)
+	}
+	if stats := s.Stats(); stats.RepeatSegs != 1 || stats.OutOfWindow != 0 {
+		t.Fatal("stats", stats.RepeatSegs, stats.OutOfWindow)
+	}
+	if n := cli.GetSnmp().RepeatSegs; n != 0 {
+		t.Fatal("RepeatSegs of the client", n)
+	}
+}
+
+type failPacketConn struct {
+	net.PacketConn
+	fail int32
+}
+
+func (c *failPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if atomic.LoadInt32(&c.fail) != 0 {
+		return 0, errors.New("write failed")
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func TestFlushWriteError(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fconn := &failPacketConn{PacketConn: conn}
+	raddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%v", port))
+	cli, err := NewConn2(raddr, nil, 0, 0, fconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	defer conn.Close()
+	cli.SetWriteDelay(true)
+
+	if _, err := cli.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&fconn.fail, 1)
+	if _, err := cli.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Flush(); err == nil || err.Error() != "write failed" {
+		t.Fatal("expect the error of the conn, got:", err)
+	}
+}
+
+// A wrapper for net.PacketConn that drops the packets larger than the path MTU.
+type mtuPacketConn struct {
+	net.PacketConn
+	mtu int
+	df  int32
+}
+
+func (c *mtuPacketConn) SetDontFragment(df bool) error {
+	if df {
+		atomic.StoreInt32(&c.df, 1)
+	} else {
+		atomic.StoreInt32(&c.df, 0)
+	}
+	return nil
+}
+
+func (c *mtuPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if len(p) > c.mtu {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func TestMtuDiscovery(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	mconn := &mtuPacketConn{PacketConn: conn, mtu: 1200}
+	block, _ := NewSalsa20BlockCrypt(pass)
+	cli, err := NewConn(fmt.Sprintf("127.0.0.1:%v", port), block, 10, 3, mconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	if err := cli.SetMtuDiscovery(true); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&mconn.df) != 1 {
+		t.Fatal("DF bit not set")
+	}
+
+	// the default MTU is lost on path, it falls back and rises to the path MTU
+	for i := 0; i < 100 && (cli.GetMtu() > 1200 || cli.GetMtu() <= 1200-pmtuStep); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if mtu := cli.GetMtu(); mtu > 1200 || mtu <= 1200-pmtuStep {
+		t.Fatal("unexpected MTU", mtu)
+	}
+	echo_tester(cli, 4096, 16)
+}
+
+func TestInputHook(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lraw := make(chan []byte, 1024)
+	l.SetInputHook(func(raw []byte) {
+		lraw <- append([]byte(nil), raw...)
+	})
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		handleEcho(s)
+	}()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+
+	// a blocked hook doesn't stall the session
+	block := make(chan struct{})
+	defer close(block)
+	cli.SetInputHook(func(raw []byte) { <-block })
+	echo_tester(cli, 1024, 16)
+
+	craw := make(chan []byte, 1024)
+	cli.SetInputHook(func(raw []byte) {
+		craw <- append([]byte(nil), raw...)
+	})
+	if _, err := cli.Write([]byte("hook")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(cli, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the datagrams are seen in the raw on both sides
+	for _, ch := range []chan []byte{lraw, craw} {
+		found := false
+		for !found {
+			select {
+			case raw := <-ch:
+				found = len(raw) >= IKCP_OVERHEAD && binary.LittleEndian.Uint32(raw) == cli.GetConv() &&
+					bytes.HasSuffix(raw, []byte("hook"))
+			case <-time.After(time.Second):
+				t.Fatal("datagram not passed to the hook")
+			}
+		}
+	}
+	cli.SetInputHook(nil)
+}
+
+func TestGSO(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("UDP GSO is supported on Linux only")
+	}
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+
+	cli, err := dialEcho(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	echo_tester(cli, 65536, 64)
+
+	cli.mu.Lock()
+	gso := cli.gso
+	cli.mu.Unlock()
+	if gso == -1 && gsoSupported(cli.conn) {
+		t.Fatal("GSO disabled on a socket supporting it")
+	}
+	t.Log("GSO:", gso)
+}
+
+func TestNoConv(t *testing.T) {
+	for _, shards := range [][2]int{{0, 0}, {10, 3}} {
+		lconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lconn.Close()
+		block, _ := NewSalsa20BlockCrypt(pass)
+		l, err := ServeConnNoConv(block, shards[0], shards[1], lconn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		first := make(chan int, 1)
+		l.SetInputHook(func(raw []byte) {
+			select {
+			case first <- len(raw):
+			default:
+			}
+		})
+		go func() {
+			for {
+				s, err := l.AcceptKCP()
+				if err != nil {
+					return
+				}
+				go handleEcho(s)
+			}
+		}()
+
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		cli, err := NewConnNoConv(lconn.LocalAddr(), block, shards[0], shards[1], conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		cli.SetNoDelay(1, 10, 2, 1)
+		cli.SetWindowSize(1024, 1024)
+
+		if _, err := cli.Write([]byte("noconv")); err != nil {
+			t.Fatal(err)
+		}
+		if n := <-first; n != cli.headerSize+IKCP_OVERHEAD-convSize+len("noconv") {
+			t.Fatal("unexpected packet size", n, "shards", shards)
+		}
+		buf := make([]byte, 6)
+		if _, err := io.ReadFull(cli, buf); err != nil {
+			t.Fatal(err)
+		}
+		echo_tester(cli, 65536, 16)
+
+		// the FEC header cannot be switched on or off
+		if shards[0] == 0 {
+			if cli.SetFEC(10, 3) == nil {
+				t.Fatal("enabled FEC in the conv-less wire format")
+			}
+		} else if cli.SetFEC(0, 0) == nil {
+			t.Fatal("disabled FEC in the conv-less wire format")
+		}
+	}
+}
+
+func TestReuseport(t *testing.T) {
+	l, err := ListenWithOptionsReuseport("127.0.0.1:0", nil, 0, 0, 4)
+	if runtime.GOOS != "linux" {
+		if err == nil {
+			t.Fatal("SO_REUSEPORT sharding enabled beyond Linux")
+		}
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conns := make(chan net.PacketConn, 32)
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			conns <- s.conn
+			go handleEcho(s)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < cap(conns); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+			if err != nil {
+				panic(err)
+			}
+			defer cli.Close()
+			cli.SetNoDelay(1, 10, 2, 1)
+			echo_tester(cli, 1024, 16)
+		}()
+	}
+	wg.Wait()
+
+	// the sessions are spread over the sockets, and served by them
+	sockets := make(map[net.PacketConn]bool)
+	for i := 0; i < cap(conns); i++ {
+		sockets[<-conns] = true
+	}
+	if len(sockets) < 2 {
+		t.Fatal("all the sessions on a single socket")
+	}
+}
+
+func TestWaitSndRcv(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	if _, err := cli.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the messages are acknowledged, and left unread
+	const count = 10
+	for i := 1; i < count; i++ {
+		if _, err := cli.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100 && (cli.WaitSnd() > 0 || s.WaitRcv() < count); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := cli.WaitSnd(); n != 0 {
+		t.Fatal("segments waiting to be sent", n)
+	}
+	if n := s.WaitRcv(); n != count {
+		t.Fatalf("segments received %v, want %v", n, count)
+	}
+
+	buf := make([]byte, 64)
+	for i := 0; i < count; i++ {
+		if _, err := s.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.WaitRcv(); n != 0 {
+		t.Fatal("segments left unread", n)
+	}
+
+	// unacknowledged after the listener has gone
+	l.Close()
+	s.Close()
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < count; i++ {
+		if _, err := cli.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := cli.WaitSnd(); n != count {
+		t.Fatalf("segments waiting %v, want %v", n, count)
+	}
+}
+
+func TestFECWide(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	block, _ := NewSalsa20BlockCrypt(pass)
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), block, 300, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			s.SetMtu(mtuLimit)
+			go handleEcho(s)
+		}
+	}()
+
+	// the full-sized packets with the padding of GF(2^16)
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), block, 300, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetMtu(mtuLimit)
+	if err := echo_tester(cli, 4096, 256); err != nil {
+		t.Fatal(err)
+	}
+	if snmp := cli.GetSnmp(); snmp.FECParitySent == 0 || snmp.FECParityShards == 0 {
+		t.Fatal("no parity shards over GF(2^16)", snmp.FECParitySent, snmp.FECParityShards)
+	}
+
+	if cli.SetFEC(1000, 30) == nil {
+		t.Fatal("FEC beyond 1024 shards")
+	}
+	if err := cli.SetFEC(10, 3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// movingPacketConn reads both sockets, and writes by the second one once moved
+type movingPacketConn struct {
+	net.PacketConn
+	next  net.PacketConn
+	moved int32
+	in    chan movingPacket
+	die   chan struct{}
+}
+
+type movingPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+func newMovingPacketConn(conn, next net.PacketConn) *movingPacketConn {
+	c := &movingPacketConn{PacketConn: conn, next: next, in: make(chan movingPacket), die: make(chan struct{})}
+	for _, conn := range []net.PacketConn{conn, next} {
+		go func(conn net.PacketConn) {
+			buf := make([]byte, mtuLimit)
+			for {
+				n, addr, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				select {
+				case c.in <- movingPacket{append([]byte(nil), buf[:n]...), addr}:
+				case <-c.die:
+					return
+				}
+			}
+		}(conn)
+	}
+	return c
+}
+
+func (c *movingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.in:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-c.die:
+		return 0, nil, io.ErrClosedPipe
+	}
+}
+
+func (c *movingPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if atomic.LoadInt32(&c.moved) != 0 {
+		return c.next.WriteTo(p, addr)
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *movingPacketConn) Close() error {
+	close(c.die)
+	c.next.Close()
+	return c.PacketConn.Close()
+}
+
+func TestMigration(t *testing.T) {
+	for _, tc := range []struct {
+		challenge, veto bool
+	}{{false, false}, {true, false}, {false, true}} {
+		port := int(atomic.AddUint32(&baseport, 1))
+		block, _ := NewSalsa20BlockCrypt(pass)
+		l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), block, 10, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var migrations int32
+		l.SetReplayProtection(true)
+		if err := l.SetMigration(true, tc.challenge, func(s *UDPSession, addr net.Addr) bool {
+			atomic.AddInt32(&migrations, 1)
+			return !tc.veto
+		}); err != nil {
+			t.Fatal(err)
+		}
+		accepted := make(chan *UDPSession, 1)
+		go func() {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			accepted <- s
+			handleEcho(s)
+		}()
+
+		conn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		next, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		mconn := newMovingPacketConn(conn, next)
+		cli, err := NewConn(fmt.Sprintf("127.0.0.1:%v", port), block, 10, 3, mconn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.SetReplayProtection(true)
+		if err := echo_tester(cli, 4096, 16); err != nil {
+			t.Fatal(err)
+		}
+		s := <-accepted
+
+		// the client moves to the other socket
+		atomic.StoreInt32(&mconn.moved, 1)
+		if err := echo_tester(cli, 4096, 16); err != nil {
+			t.Fatal(err)
+		}
+		want := next.LocalAddr().String()
+		if tc.veto {
+			want = conn.LocalAddr().String()
+		}
+		for i := 0; i < 100 && s.RemoteAddr().String() != want; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if s.RemoteAddr().String() != want || atomic.LoadInt32(&migrations) == 0 {
+			t.Fatal("session not migrated as expected", tc.challenge, tc.veto, s.RemoteAddr(), atomic.LoadInt32(&migrations))
+		}
+
+		cli.Close()
+		l.Close()
+		mconn.Close()
+	}
+}
+
+func TestMigrationAuthentication(t *testing.T) {
+	aead, _ := NewAESGCMBlockCrypt(pass[:32])
+	salsa, _ := NewSalsa20BlockCrypt(pass)
+	wrong, _ := NewSalsa20BlockCrypt(pass[1:])
+	for _, tc := range []struct {
+		name    string
+		block   BlockCrypt // of the listener and the client
+		noauth  bool       // the integrity check removed
+		forged  BlockCrypt // the key of the packets from the new address
+		migrate bool
+	}{
+		{"wrong key", salsa, false, wrong, false},
+		{"no key", salsa, false, nil, false},
+		{"unauthenticated", nil, false, nil, false},
+		{"aead", aead, true, aead, true},
+	} {
+		port := int(atomic.AddUint32(&baseport, 1))
+		raddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%v", port))
+		l, err := ListenWithOptions(raddr.String(), tc.block, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.noauth {
+			l.SetPacketAuthenticator(nil)
+		}
+		if err := l.SetMigration(true, false, nil); err == nil {
+			t.Fatal("migration without the challenge and the replay protection")
+		}
+		l.SetReplayProtection(true)
+		if err := l.SetMigration(true, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		accepted := make(chan *UDPSession, 2)
+		go func() {
+			for {
+				s, err := l.AcceptKCP()
+				if err != nil {
+					return
+				}
+				accepted <- s
+				go handleEcho(s)
+			}
+		}()
+
+		cli, err := DialWithOptions(raddr.String(), tc.block, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.noauth {
+			cli.SetPacketAuthenticator(nil)
+		}
+		cli.SetReplayProtection(true)
+		if err := echo_tester(cli, 1024, 4); err != nil {
+			t.Fatal(tc.name, err)
+		}
+		s := <-accepted
+		origin := s.RemoteAddr().String()
+
+		// the packets of the session's conv from a new address, keyed by 'forged'
+		conn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		forger, err := NewConn3(s.GetConv(), raddr, tc.forged, 0, 0, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.noauth {
+			forger.SetPacketAuthenticator(nil)
+		}
+		forger.SetReplayProtection(true)
+		forger.mu.Lock()
+		forger.txCounter = 1 << 32 // carrying on beyond the counters of the client
+		forger.mu.Unlock()
+		forger.Write([]byte("hijack"))
+		want := origin
+		if tc.migrate {
+			want = conn.LocalAddr().String()
+			for i := 0; i < 50 && s.RemoteAddr().String() != want; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+		} else {
+			time.Sleep(200 * time.Millisecond)
+		}
+		if got := s.RemoteAddr().String(); got != want {
+			t.Fatal(tc.name, "the remote moved to", got, "expect", want)
+		}
+		if !tc.migrate {
+			if err := echo_tester(cli, 1024, 4); err != nil {
+				t.Fatal(tc.name, "the session broken by the forged packets", err)
+			}
+		}
+
+		forger.Close()
+		cli.Close()
+		l.Close()
+	}
+}
+
+type capturePacketConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	last []byte
+}
+
+func (c *capturePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.last = append(c.last[:0], p...)
+	c.mu.Unlock()
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func TestMigrationReplay(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	raddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%v", port))
+	block, _ := NewSalsa20BlockCrypt(pass)
+	l, err := ListenWithOptions(raddr.String(), block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetReplayProtection(true)
+	if err := l.SetMigration(true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan *UDPSession, 1)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		accepted <- s
+		handleEcho(s)
+	}()
+
+	conn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	capture := &capturePacketConn{PacketConn: conn}
+	cli, err := NewConn(raddr.String(), block, 0, 0, capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetReplayProtection(true)
+	if err := echo_tester(cli, 1024, 4); err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	origin := s.RemoteAddr().String()
+
+	// a captured packet resent from elsewhere
+	capture.mu.Lock()
+	packet := append([]byte(nil), capture.last...)
+	capture.mu.Unlock()
+	attacker, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer attacker.Close()
+	attacker.WriteTo(packet, raddr)
+	time.Sleep(200 * time.Millisecond)
+	if got := s.RemoteAddr().String(); got != origin {
+		t.Fatal("the session hijacked by a replayed packet", got)
+	}
+}
+
+func TestGetConv(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	raddr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%v", port))
+	const conv = 0x12345678
+	cli, err := NewConn3(conv, raddr, nil, 0, 0, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if cli.GetConv() != conv {
+		t.Fatal("conv mismatch on the dialer", cli.GetConv())
+	}
+	cli.Write([]byte("hello"))
+
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.GetConv() != conv {
+		t.Fatal("conv mismatch on the acceptor", s.GetConv())
+	}
+}
+
+func TestConvNegotiation(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+	raddr := fmt.Sprintf("127.0.0.1:%v", port)
+	block, _ := NewSalsa20BlockCrypt(pass)
+
+	// not answered unless enabled
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := DialNegotiated(ctx, raddr, block, 10, 3); err == nil {
+		t.Fatal("conv negotiated with the option disabled")
+	}
+
+	l.(*Listener).SetConvNegotiation(true)
+	convs := make(map[uint32]bool)
+	for i := 0; i < 3; i++ {
+		cli, err := DialNegotiated(context.Background(), raddr, block, 10, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		if err := echo_tester(cli, 4096, 16); err != nil {
+			t.Fatal(err)
+		}
+		convs[cli.GetConv()] = true
+	}
+
+	l.(*Listener).sessionLock.RLock()
+	for conv := range convs {
+		if _, ok := l.(*Listener).convs[conv]; !ok {
+			t.Fatal("negotiated conv not served", conv)
+		}
+	}
+	offers := len(l.(*Listener).offers)
+	l.(*Listener).sessionLock.RUnlock()
+	if len(convs) != 3 || offers != 0 || len(l.(*Listener).offerConvs) != 0 {
+		t.Fatal("convs not unique or offers left", len(convs), offers)
+	}
+}
+
+func TestConvNegotiationRate(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+	l.(*Listener).SetConvNegotiation(true)
+	l.(*Listener).SetSessionRate(0, 1)
+	raddr := fmt.Sprintf("127.0.0.1:%v", port)
+	block, _ := NewSalsa20BlockCrypt(pass)
+
+	// the request takes the token of the session, which isn't charged again
+	limited := atomic.LoadUint64(&DefaultSnmp.RateLimited)
+	cli, err := DialNegotiated(context.Background(), raddr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := echo_tester(cli, 1024, 4); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadUint64(&DefaultSnmp.RateLimited) - limited; n != 0 {
+		t.Fatal("negotiated session limited", n)
+	}
+
+	// a request beyond the rate is dropped
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := DialNegotiated(ctx, raddr, block, 10, 3); err == nil {
+		t.Fatal("request beyond the rate answered")
+	}
+	if atomic.LoadUint64(&DefaultSnmp.RateLimited) == limited {
+		t.Fatal("request not counted in RateLimited")
+	}
+}
+
+func TestNoDelayParams(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+
+	cli, err := dialEcho(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	cli.SetNoDelay(1, 20, 2, 1)
+	cli.SetInterval(1)
+	if nodelay, interval, resend, nc := cli.GetNoDelay(); nodelay != 1 || interval != 10 || resend != 2 || nc != 1 {
+		t.Fatal("interval not clamped to 10", nodelay, interval, resend, nc)
+	}
+	cli.SetInterval(10000)
+	cli.SetResend(0)
+	cli.SetNC(false)
+	if nodelay, interval, resend, nc := cli.GetNoDelay(); nodelay != 1 || interval != 5000 || resend != 0 || nc != 0 {
+		t.Fatal("parameters not applied", nodelay, interval, resend, nc)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Write([]byte("hello"))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registered := func(sess *UDPSession) bool {
+		for _, s := range Sessions() {
+			if s == sess {
+				return true
+			}
+		}
+		return false
+	}
+	if !registered(cli) || !registered(s) {
+		t.Fatal("open sessions not listed")
+	}
+	if cli.Uptime() <= 0 || cli.Uptime() < s.Uptime() {
+		t.Fatal("uptime", cli.Uptime(), s.Uptime())
+	}
+
+	cli.Close()
+	s.Close()
+	if registered(cli) || registered(s) {
+		t.Fatal("closed sessions listed")
+	}
+}
+
+func TestRTOBounds(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		handleEcho(s)
+	}()
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dconn := &dropPacketConn{PacketConn: conn}
+	cli, err := NewConn(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0, dconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	defer conn.Close()
+	cli.SetNoDelay(1, 10, 0, 1)
+
+	if cli.SetRTOBounds(5*time.Millisecond, time.Second) == nil {
+		t.Fatal("accepted a lower bound below the interval")
+	}
+	if cli.SetRTOBounds(time.Second, 200*time.Millisecond) == nil {
+		t.Fatal("accepted a lower bound above the upper bound")
+	}
+	const floor = 300 * time.Millisecond
+	if err := cli.SetRTOBounds(floor, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for i := 0; i < 10; i++ {
+		if _, err := cli.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(cli, buf[:4]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rto := cli.GetRTO(); rto != uint32(floor/time.Millisecond) {
+		t.Fatalf("rto %v, want the floor %v", rto, floor)
+	}
+
+	// the lost segment is retransmitted no earlier than the floor
+	atomic.StoreInt32(&dconn.drop, 1)
+	start := time.Now()
+	if _, err := cli.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(cli, buf[:4]); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < floor-time.Millisecond { // the clock of KCP ticks in ms
+		t.Fatalf("retransmitted after %v, below the floor %v", elapsed, floor)
+	}
+}
+
+func TestFECFlushTimeout(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	dconn := &dropPacketConn{PacketConn: conn}
+	cli, err := NewConn(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3, dconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetFECFlushTimeout(20 * time.Millisecond)
+
+	if _, err := cli.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	if _, err := s.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// a single message, lost on wire, in a partially filled shard group
+	atomic.StoreInt32(&dconn.drop, 1)
+	if _, err := cli.Write([]byte("trickle")); err != nil {
+		t.Fatal(err)
+	}
+	n, err := s.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "trickle" {
+		t.Fatal("message mismatch", string(buf[:n]))
+	}
+	if stats := s.FECStats(); stats.Recovered == 0 {
+		t.Fatalf("the message is not recovered by FEC %+v %+v", stats, s.GetSnmp())
+	}
+	if s.GetSnmp().KCPInErrors != 0 {
+		t.Fatal("padding segments counted as errors", s.GetSnmp().KCPInErrors)
+	}
+}
+
+func TestWriteBufferLimit(t *testing.T) {
+	// nothing will be acknowledged without a server
+	port := int(atomic.AddUint32(&baseport, 1))
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetWriteBufferLimit(10000)
+
+	// a write larger than the limit passes if nothing is waiting
+	if _, err := cli.Write(make([]byte, 20000)); err != nil {
+		t.Fatal(err)
+	}
+
+	cli.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	start := time.Now()
+	if _, err := cli.Write(make([]byte, 100)); !errors.Is(err, ErrTimeout) {
+		t.Fatal("write not blocked by the limit", err)
+	}
+	if time.Since(start) < 150*time.Millisecond {
+		t.Fatal("write returned before the deadline")
+	}
+
+	cli.mu.Lock()
+	pending := cli.kcp.WaitSndBytes()
+	cli.mu.Unlock()
+	if pending != 20000 {
+		t.Fatal("bytes accepted by the timed out write", pending)
+	}
+}
+
+func TestAsymmetricFEC(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan *UDPSession, 1)
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			accepted <- s
+			go handleEcho(s)
+		}
+	}()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.SetTxFEC(4, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.SetRxFEC(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := echo_tester(cli, 4096, 16); err != nil {
+		t.Fatal(err)
+	}
+	srv := <-accepted
+
+	// the client sends parity, and drops the parity from the server
+	if stats := cli.FECStats(); stats.ParitySent == 0 || stats.ParityReceived == 0 || stats.Recovered != 0 {
+		t.Fatalf("client FEC stats %+v", stats)
+	}
+	if stats := srv.FECStats(); stats.ParityReceived == 0 {
+		t.Fatalf("server FEC stats %+v", stats)
+	}
+	cli.mu.Lock()
+	decoder := cli.fecDecoder
+	cli.mu.Unlock()
+	if decoder != nil {
+		t.Fatal("decoder created with RX FEC off")
+	}
+	if ds, ps := cli.GetFECShards(); ds != 4 || ps != 2 {
+		t.Fatal("TX shards", ds, ps)
+	}
+}
+
+func TestFECRecoveryCallback(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	dconn := &dropPacketConn{PacketConn: conn}
+	cli, err := NewConn(fmt.Sprintf("127.0.0.1:%v", port), nil, 4, 2, dconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetFECFlushTimeout(20 * time.Millisecond)
+
+	if _, err := cli.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetFECAutoTune(false)
+	recovered := make(chan int, 16)
+	s.SetFECRecoveryCallback(func(n, lost int) {
+		recovered <- n
+	})
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	if _, err := s.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	atomic.StoreInt32(&dconn.drop, 1)
+	if _, err := cli.Write([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-recovered:
+		if n != 1 {
+			t.Fatal("recovered shards", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback not invoked")
+	}
+}
+
+// A wrapper for net.PacketConn that drops bursts of consecutive packets.
+type burstLossPacketConn struct {
+	net.PacketConn
+	count int64
+}
+
+func (c *burstLossPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if n := atomic.AddInt64(&c.count, 1); n%50 >= 20 && n%50 < 24 {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// burstRecovered returns the shards recovered by the remote under the burst loss
+func burstRecovered(t *testing.T, depth int) uint64 {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetFECWindow(2*depth+1, 0)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cli, err := NewConn(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3, &burstLossPacketConn{PacketConn: conn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetWindowSize(1024, 1024)
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetFECInterleave(depth)
+	cli.SetFECFlushTimeout(50 * time.Millisecond)
+
+	const msglen, msgcount = 1000, 1000
+	go func() {
+		msg := make([]byte, msglen)
+		for i := 0; i < msgcount; i++ {
+			cli.Write(msg)
+		}
+	}()
+
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetReadDeadline(time.Now().Add(30 * time.Second))
+	buf := make([]byte, msglen)
+	for i := 0; i < msgcount; i++ {
+		if _, err := io.ReadFull(s, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s.FECStats().Recovered
+}
+
+func TestFECInterleave(t *testing.T) {
+	plain := burstRecovered(t, 0)
+	interleaved := burstRecovered(t, 4)
+	t.Log("recovered without interleaving:", plain, "with:", interleaved)
+	if interleaved <= plain {
+		t.Fatal("interleaving doesn't improve the recovery under burst loss")
+	}
+}
+
+func TestAutoPacing(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l := echoServer(port)
+	defer l.Close()
+
+	cli, err := dialEcho(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetAutoPacing(true)
+	if err := echo_tester(cli, 65536, 16); err != nil {
+		t.Fatal(err)
+	}
+	cli.mu.Lock()
+	if cli.kcp.rx_srtt <= 0 { // sub-millisecond on loopback
+		cli.kcp.rx_srtt = 1
+	}
+	rate := cli.paceRate()
+	cli.mu.Unlock()
+	if rate <= 0 {
+		t.Fatal("no pacing rate derived", rate)
+	}
+}
+
+func TestPacingBypassAcks(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			// the acks are not delayed by the rate
+			s.SetMaxSendRate(1)
+			go handleSink(s)
+		}
+	}()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+
+	// more acks than the burst of pacing
+	for i := 0; i < 100; i++ {
+		if _, err := cli.Write(make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(time.Second)
+		for {
+			cli.mu.Lock()
+			waitsnd := cli.kcp.WaitSnd()
+			cli.mu.Unlock()
+			if waitsnd == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("acks delayed by pacing", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestStreamPartialRead(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetStreamMode(true)
+	cli.SetWindowSize(1024, 1024)
+
+	data := make([]byte, 256*1024)
+	for k := range data {
+		data[k] = byte(k * 7)
+	}
+	go cli.Write(data)
+
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetStreamMode(true)
+	s.SetWindowSize(1024, 1024)
+	s.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	// the reads end within and across the segments
+	sizes := []int{1, 7, 1000, 1400, 3001, 65536}
+	received := make([]byte, 0, len(data))
+	for i := 0; len(received) < len(data); i++ {
+		buf := make([]byte, sizes[i%len(sizes)])
+		n, err := s.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, buf[:n]...)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("stream data mismatch")
+	}
+}
+
+func BenchmarkStreamRead1M(b *testing.B) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 0, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetStreamMode(true)
+	cli.SetWindowSize(1024, 1024)
+	cli.SetNoDelay(1, 10, 2, 1)
+
+	const size = 1024 * 1024
+	count := b.N
+	go func() {
+		data := make([]byte, size)
+		for i := 0; i < count; i++ {
+			if _, err := cli.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	s, err := l.AcceptKCP()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	s.SetStreamMode(true)
+	s.SetWindowSize(1024, 1024)
+	s.SetNoDelay(1, 10, 2, 1)
+
+	b.ReportAllocs()
+	b.SetBytes(size)
+	b.ResetTimer()
+	buf := make([]byte, 1000) // smaller than a segment
+	for remain := count * size; remain > 0; {
+		n, err := s.Read(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+		remain -= n
+	}
+}
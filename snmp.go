@@ -31,6 +31,64 @@ type Snmp struct {
 	FECErrs          uint64 // incorrect packets recovered from FEC
 	FECParityShards  uint64 // FEC segments received
 	FECShortShards   uint64 // number of data shards that's not enough for recovery
+	AcceptOverflow   uint64 // new sessions refused for a full accept backlog
+	ConnFiltered     uint64 // packets of unknown addresses dropped by the connection filter
+	RateLimited      uint64 // new sessions dropped by the session rate limits
+	IdleClosed       uint64 // sessions closed by idle timeout
+	InAuthErrors     uint64 // packets failed the AEAD authentication
+	ReplayDrops      uint64 // packets dropped by replay protection
+	UnknownEpochs    uint64 // packets dropped for an unknown key epoch
+	CompressErrors   uint64 // packets dropped for a compression mismatch or corrupt data
+	InDgrams         uint64 // unreliable datagrams received
+	OutDgrams        uint64 // unreliable datagrams sent
+	DgramDrops       uint64 // unreliable datagrams dropped for a full queue
+	TLPSegs          uint64 // accmulated segments retransmitted by tail loss probes
+	OutOfWindow      uint64 // number of segs beyond the receive window
+	RcvLimitDrops    uint64 // number of segs dropped by the receive buffer limit
+	InCEMarks        uint64 // packets received with the ECN congestion experienced mark
+	KeepAlives       uint64 // keepalive probes sent
+	FECParitySent    uint64 // FEC parity shards sent
+	FECGroupFails    uint64 // FEC shard groups failed the reconstruction
+	FECEvicted       uint64 // FEC shards evicted by the receive queue limit
+}
+
+// FECStats defines the FEC statistics of a session, the same as the FEC counters of Snmp
+type FECStats struct {
+	ParitySent     uint64 // parity shards sent
+	ParityReceived uint64 // parity shards received
+	Recovered      uint64 // data shards recovered
+	RecoverErrors  uint64 // incorrect data shards recovered
+	GroupFails     uint64 // shard groups failed the reconstruction
+	ShortShards    uint64 // data shards evicted before their groups were complete
+	Evicted        uint64 // shards evicted by the receive queue limit
+}
+
+// SessionStats defines a snapshot of the counters and the protocol state of a session
+type SessionStats struct {
+	BytesSent        uint64 // bytes sent from upper level
+	BytesReceived    uint64 // bytes received to upper level
+	InSegs           uint64 // incoming KCP segments
+	OutSegs          uint64 // outgoing KCP segments
+	RetransSegs      uint64 // retransmitted segments
+	FastRetransSegs  uint64 // fast retransmitted segments
+	EarlyRetransSegs uint64 // early retransmitted segments
+	TLPSegs          uint64 // segments retransmitted by tail loss probes
+	LostSegs         uint64 // segments retransmitted by timeout
+	RepeatSegs       uint64 // duplicate segments received
+	OutOfWindow      uint64 // segments received beyond the receive window
+	FECRecovered     uint64 // data shards recovered by FEC
+	InCsumErrors     uint64 // packets dropped by the checksum
+	InAuthErrors     uint64 // packets dropped by the AEAD authentication
+
+	Cwnd     uint32 // congestion window in segments, 0 with the congestion control off
+	SndWnd   uint32 // send window in segments
+	RmtWnd   uint32 // remote receive window in segments
+	SRTT     int32  // smoothed RTT in milliseconds
+	RTTVar   int32  // RTT variance in milliseconds
+	RTO      uint32 // retransmission timeout in milliseconds
+	InFlight int    // bytes sent and not yet acknowledged
+	SndQueue int    // segments waiting to be sent
+	RcvQueue int    // segments waiting to be read
 }
 
 func newSnmp() *Snmp {
@@ -64,6 +122,25 @@ func (s *Snmp) Header() []string {
 		"FECErrs",
 		"FECRecovered",
 		"FECShortShards",
+		"AcceptOverflow",
+		"ConnFiltered",
+		"RateLimited",
+		"IdleClosed",
+		"InAuthErrors",
+		"ReplayDrops",
+		"UnknownEpochs",
+		"CompressErrors",
+		"InDgrams",
+		"OutDgrams",
+		"DgramDrops",
+		"TLPSegs",
+		"OutOfWindow",
+		"RcvLimitDrops",
+		"InCEMarks",
+		"KeepAlives",
+		"FECParitySent",
+		"FECGroupFails",
+		"FECEvicted",
 	}
 }
 
@@ -95,6 +172,25 @@ func (s *Snmp) ToSlice() []string {
 		fmt.Sprint(snmp.FECErrs),
 		fmt.Sprint(snmp.FECRecovered),
 		fmt.Sprint(snmp.FECShortShards),
+		fmt.Sprint(snmp.AcceptOverflow),
+		fmt.Sprint(snmp.ConnFiltered),
+		fmt.Sprint(snmp.RateLimited),
+		fmt.Sprint(snmp.IdleClosed),
+		fmt.Sprint(snmp.InAuthErrors),
+		fmt.Sprint(snmp.ReplayDrops),
+		fmt.Sprint(snmp.UnknownEpochs),
+		fmt.Sprint(snmp.CompressErrors),
+		fmt.Sprint(snmp.InDgrams),
+		fmt.Sprint(snmp.OutDgrams),
+		fmt.Sprint(snmp.DgramDrops),
+		fmt.Sprint(snmp.TLPSegs),
+		fmt.Sprint(snmp.OutOfWindow),
+		fmt.Sprint(snmp.RcvLimitDrops),
+		fmt.Sprint(snmp.InCEMarks),
+		fmt.Sprint(snmp.KeepAlives),
+		fmt.Sprint(snmp.FECParitySent),
+		fmt.Sprint(snmp.FECGroupFails),
+		fmt.Sprint(snmp.FECEvicted),
 	}
 }
 
@@ -125,6 +221,25 @@ func (s *Snmp) Copy() *Snmp {
 	d.FECErrs = atomic.LoadUint64(&s.FECErrs)
 	d.FECRecovered = atomic.LoadUint64(&s.FECRecovered)
 	d.FECShortShards = atomic.LoadUint64(&s.FECShortShards)
+	d.AcceptOverflow = atomic.LoadUint64(&s.AcceptOverflow)
+	d.ConnFiltered = atomic.LoadUint64(&s.ConnFiltered)
+	d.RateLimited = atomic.LoadUint64(&s.RateLimited)
+	d.IdleClosed = atomic.LoadUint64(&s.IdleClosed)
+	d.InAuthErrors = atomic.LoadUint64(&s.InAuthErrors)
+	d.ReplayDrops = atomic.LoadUint64(&s.ReplayDrops)
+	d.UnknownEpochs = atomic.LoadUint64(&s.UnknownEpochs)
+	d.CompressErrors = atomic.LoadUint64(&s.CompressErrors)
+	d.InDgrams = atomic.LoadUint64(&s.InDgrams)
+	d.OutDgrams = atomic.LoadUint64(&s.OutDgrams)
+	d.DgramDrops = atomic.LoadUint64(&s.DgramDrops)
+	d.TLPSegs = atomic.LoadUint64(&s.TLPSegs)
+	d.OutOfWindow = atomic.LoadUint64(&s.OutOfWindow)
+	d.RcvLimitDrops = atomic.LoadUint64(&s.RcvLimitDrops)
+	d.InCEMarks = atomic.LoadUint64(&s.InCEMarks)
+	d.KeepAlives = atomic.LoadUint64(&s.KeepAlives)
+	d.FECParitySent = atomic.LoadUint64(&s.FECParitySent)
+	d.FECGroupFails = atomic.LoadUint64(&s.FECGroupFails)
+	d.FECEvicted = atomic.LoadUint64(&s.FECEvicted)
 	return d
 }
 
@@ -154,6 +269,25 @@ func (s *Snmp) Reset() {
 	atomic.StoreUint64(&s.FECErrs, 0)
 	atomic.StoreUint64(&s.FECRecovered, 0)
 	atomic.StoreUint64(&s.FECShortShards, 0)
+	atomic.StoreUint64(&s.AcceptOverflow, 0)
+	atomic.StoreUint64(&s.ConnFiltered, 0)
+	atomic.StoreUint64(&s.RateLimited, 0)
+	atomic.StoreUint64(&s.IdleClosed, 0)
+	atomic.StoreUint64(&s.InAuthErrors, 0)
+	atomic.StoreUint64(&s.ReplayDrops, 0)
+	atomic.StoreUint64(&s.UnknownEpochs, 0)
+	atomic.StoreUint64(&s.CompressErrors, 0)
+	atomic.StoreUint64(&s.InDgrams, 0)
+	atomic.StoreUint64(&s.OutDgrams, 0)
+	atomic.StoreUint64(&s.DgramDrops, 0)
+	atomic.StoreUint64(&s.TLPSegs, 0)
+	atomic.StoreUint64(&s.OutOfWindow, 0)
+	atomic.StoreUint64(&s.RcvLimitDrops, 0)
+	atomic.StoreUint64(&s.InCEMarks, 0)
+	atomic.StoreUint64(&s.KeepAlives, 0)
+	atomic.StoreUint64(&s.FECParitySent, 0)
+	atomic.StoreUint64(&s.FECGroupFails, 0)
+	atomic.StoreUint64(&s.FECEvicted, 0)
 }
 
 // DefaultSnmp is the global KCP connection statistics collector
@@ -0,0 +1,11 @@
+// +build !linux
+
+package kcp
+
+import "net"
+
+// getReadBuffer is not supported
+func getReadBuffer(conn net.PacketConn) (int, error) { return 0, ErrInvalidOperation }
+
+// getWriteBuffer is not supported
+func getWriteBuffer(conn net.PacketConn) (int, error) { return 0, ErrInvalidOperation }
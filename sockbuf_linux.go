@@ -0,0 +1,38 @@
+// +build linux
+
+package kcp
+
+import (
+	"net"
+	"syscall"
+)
+
+// getReadBuffer returns SO_RCVBUF of 'conn' as granted by the kernel
+func getReadBuffer(conn net.PacketConn) (int, error) {
+	return getSocketBuffer(conn, syscall.SO_RCVBUF)
+}
+
+// getWriteBuffer returns SO_SNDBUF of 'conn' as granted by the kernel
+func getWriteBuffer(conn net.PacketConn) (int, error) {
+	return getSocketBuffer(conn, syscall.SO_SNDBUF)
+}
+
+func getSocketBuffer(conn net.PacketConn, opt int) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, ErrInvalidOperation
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		size, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	}); err != nil {
+		return 0, err
+	}
+	return size, sockErr
+}
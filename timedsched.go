@@ -4,29 +4,62 @@ import (
 	"container/heap"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// SystemTimedSched is the library level timed-scheduler
+// SystemTimedSched is the library level timed-scheduler, the default of the
+// sessions and listeners, its workers start on the first function scheduled
 var SystemTimedSched *TimedSched = NewTimedSched(runtime.NumCPU())
 
 type timedFunc struct {
 	execute func()
 	ts      time.Time
+	handle  *TimedHandle // nil if not cancellable
 }
 
+// TimedHandle refers to a function scheduled by PutWithCancel
+type TimedHandle struct {
+	canceled int32
+	index    int // index in the heap or the wheel slot of the holding worker, -1 if not held
+	slot     int // the wheel slot, level<<wheelBits | slot
+
+	mu       sync.Mutex
+	chCancel chan *TimedHandle // cancel channel of the holding worker
+}
+
+func (h *TimedHandle) isCanceled() bool { return h != nil && atomic.LoadInt32(&h.canceled) != 0 }
+
 // a heap for sorted timed function
 type timedFuncHeap []timedFunc
 
-func (h timedFuncHeap) Len() int            { return len(h) }
-func (h timedFuncHeap) Less(i, j int) bool  { return h[i].ts.Before(h[j].ts) }
-func (h timedFuncHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
-func (h *timedFuncHeap) Push(x interface{}) { *h = append(*h, x.(timedFunc)) }
+func (h timedFuncHeap) Len() int           { return len(h) }
+func (h timedFuncHeap) Less(i, j int) bool { return h[i].ts.Before(h[j].ts) }
+func (h timedFuncHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	if h[i].handle != nil {
+		h[i].handle.index = i
+	}
+	if h[j].handle != nil {
+		h[j].handle.index = j
+	}
+}
+func (h *timedFuncHeap) Push(x interface{}) {
+	task := x.(timedFunc)
+	if task.handle != nil {
+		task.handle.index = len(*h)
+	}
+	*h = append(*h, task)
+}
 func (h *timedFuncHeap) Pop() interface{} {
 	old := *h
 	n := len(old)
 	x := old[n-1]
+	if x.handle != nil {
+		x.handle.index = -1
+	}
 	old[n-1].execute = nil // avoid memory leak
+	old[n-1].handle = nil
 	*h = old[0 : n-1]
 	return x
 }
@@ -41,36 +74,84 @@ type TimedSched struct {
 	// tasks will be distributed through chTask
 	chTask chan timedFunc
 
+	// the number of workers, and the signal for the excess ones to return
+	parallel     int
+	parallelLock sync.Mutex
+	chShrink     chan struct{}
+	startOnce    sync.Once
+
+	tick time.Duration // the tick of the timing wheels, 0 for the heaps
+
 	dieOnce sync.Once
 	die     chan struct{}
 }
 
-// NewTimedSched creates a parallel-scheduler with given parallelization
+// NewTimedSched creates a parallel-scheduler with given parallelization, the
+// workers start on the first function scheduled
 func NewTimedSched(parallel int) *TimedSched {
 	ts := new(TimedSched)
 	ts.chTask = make(chan timedFunc)
 	ts.die = make(chan struct{})
 	ts.chPrependNotify = make(chan struct{}, 1)
+	ts.chShrink = make(chan struct{})
+	ts.parallel = parallel
+	return ts
+}
 
-	for i := 0; i < parallel; i++ {
-		go ts.sched()
+// NewTimedSchedWheel creates a parallel-scheduler whose workers hold the functions
+// in timing wheels of 'tick' instead of heaps, inserting and expiring in O(1) with
+// a ticker per busy worker rather than a timer reset per function, for lots of
+// functions at the cost of running up to a tick late.
+func NewTimedSchedWheel(parallel int, tick time.Duration) *TimedSched {
+	ts := NewTimedSched(parallel)
+	if tick <= 0 {
+		tick = time.Millisecond
 	}
-	go ts.prepend()
+	ts.tick = tick
 	return ts
 }
 
+// worker runs a worker of the kind of the scheduler
+func (ts *TimedSched) worker() {
+	if ts.tick > 0 {
+		ts.schedWheel()
+	} else {
+		ts.sched()
+	}
+}
+
+// start starts the workers once
+func (ts *TimedSched) start() {
+	ts.startOnce.Do(func() {
+		ts.parallelLock.Lock()
+		for i := 0; i < ts.parallel; i++ {
+			go ts.worker()
+		}
+		ts.parallelLock.Unlock()
+		go ts.prepend()
+	})
+}
+
 func (ts *TimedSched) sched() {
 	var tasks timedFuncHeap
+	chCancel := make(chan *TimedHandle, 128)
 	timer := time.NewTimer(0)
 	drained := false
 	for {
 		select {
 		case task := <-ts.chTask:
 			now := time.Now()
-			if now.After(task.ts) {
+			if task.handle.isCanceled() {
+				// cancelled before dispatched
+			} else if now.After(task.ts) {
 				// already delayed! execute immediately
 				task.execute()
 			} else {
+				if task.handle != nil {
+					task.handle.mu.Lock()
+					task.handle.chCancel = chCancel
+					task.handle.mu.Unlock()
+				}
 				heap.Push(&tasks, task)
 				// properly reset timer to trigger based on the top element
 				stopped := timer.Stop()
@@ -84,13 +165,55 @@ func (ts *TimedSched) sched() {
 			drained = true
 			for tasks.Len() > 0 {
 				if now.After(tasks[0].ts) {
-					heap.Pop(&tasks).(timedFunc).execute()
+					if task := heap.Pop(&tasks).(timedFunc); !task.handle.isCanceled() {
+						task.execute()
+					}
 				} else {
 					timer.Reset(tasks[0].ts.Sub(now))
 					drained = false
 					break
 				}
 			}
+		case h := <-chCancel:
+			// the timer may fire earlier than the new top, which is harmless
+			if h.index >= 0 {
+				heap.Remove(&tasks, h.index)
+			}
+		case <-ts.chShrink:
+			// migrate the pending tasks to the surviving workers
+			timer.Stop()
+			for k := range tasks {
+				if h := tasks[k].handle; h != nil {
+					h.mu.Lock()
+					h.chCancel = nil
+					h.mu.Unlock()
+					h.index = -1
+				}
+				ts.put(tasks[k])
+			}
+			return
+		case <-ts.die:
+			return
+		}
+	}
+}
+
+// SetParallelism grows or shrinks the workers to 'n', the pending tasks of the
+// removed workers are migrated to the others, it's a no-op if 'n' <= 0.
+func (ts *TimedSched) SetParallelism(n int) {
+	if n <= 0 {
+		return
+	}
+
+	ts.start()
+	ts.parallelLock.Lock()
+	defer ts.parallelLock.Unlock()
+	for ; ts.parallel < n; ts.parallel++ {
+		go ts.worker()
+	}
+	for ; ts.parallel > n; ts.parallel-- {
+		select {
+		case ts.chShrink <- struct{}{}:
 		case <-ts.die:
 			return
 		}
@@ -111,6 +234,7 @@ func (ts *TimedSched) prepend() {
 			copy(tasks, ts.prependTasks)
 			for k := range ts.prependTasks {
 				ts.prependTasks[k].execute = nil // avoid memory leak
+				ts.prependTasks[k].handle = nil
 			}
 			ts.prependTasks = ts.prependTasks[:0]
 			ts.prependLock.Unlock()
@@ -119,6 +243,7 @@ func (ts *TimedSched) prepend() {
 				select {
 				case ts.chTask <- tasks[k]:
 					tasks[k].execute = nil // avoid memory leak
+					tasks[k].handle = nil
 				case <-ts.die:
 					return
 				}
@@ -130,10 +255,26 @@ func (ts *TimedSched) prepend() {
 	}
 }
 
-// Put a function 'f' awaiting to be executed at 'deadline'
-func (ts *TimedSched) Put(f func(), deadline time.Time) {
+// Put a function 'f' awaiting to be executed at 'deadline', same as PutAt
+func (ts *TimedSched) Put(f func(), deadline time.Time) { ts.PutAt(f, deadline) }
+
+// PutAt schedules a function 'f' to be executed at the absolute time 'deadline',
+// 'f' is executed immediately by a worker if 'deadline' has already passed.
+func (ts *TimedSched) PutAt(f func(), deadline time.Time) {
+	ts.put(timedFunc{execute: f, ts: deadline})
+}
+
+// PutWithCancel is like Put, and returns a handle to cancel 'f' via Cancel
+func (ts *TimedSched) PutWithCancel(f func(), deadline time.Time) *TimedHandle {
+	h := &TimedHandle{index: -1}
+	ts.put(timedFunc{execute: f, ts: deadline, handle: h})
+	return h
+}
+
+func (ts *TimedSched) put(task timedFunc) {
+	ts.start()
 	ts.prependLock.Lock()
-	ts.prependTasks = append(ts.prependTasks, timedFunc{f, deadline})
+	ts.prependTasks = append(ts.prependTasks, task)
 	ts.prependLock.Unlock()
 
 	select {
@@ -142,5 +283,26 @@ func (ts *TimedSched) Put(f func(), deadline time.Time) {
 	}
 }
 
+// Cancel prevents the function referred by 'h' from being executed, the function
+// is removed from the scheduler if it's still pending, it's a no-op if the function
+// has been executed already.
+//
+// Cancel is safe to call concurrently and after Close.
+func (ts *TimedSched) Cancel(h *TimedHandle) {
+	if h == nil || !atomic.CompareAndSwapInt32(&h.canceled, 0, 1) {
+		return
+	}
+
+	h.mu.Lock()
+	chCancel := h.chCancel
+	h.mu.Unlock()
+	if chCancel != nil {
+		select {
+		case chCancel <- h: // remove from heap
+		default: // the worker is busy, skip it at dispatching
+		}
+	}
+}
+
 // Close terminates this scheduler
 func (ts *TimedSched) Close() { ts.dieOnce.Do(func() { close(ts.die) }) }
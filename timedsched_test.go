@@ -0,0 +1,209 @@
+package kcp
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimedSchedCancel(t *testing.T) {
+	ts := NewTimedSched(2)
+	defer ts.Close()
+
+	var fired, canceled int32
+	var handles []*TimedHandle
+	for i := 0; i < 100; i++ {
+		deadline := time.Now().Add(100 * time.Millisecond)
+		if i%2 == 0 {
+			handles = append(handles, ts.PutWithCancel(func() { atomic.AddInt32(&canceled, 1) }, deadline))
+		} else {
+			ts.Put(func() { atomic.AddInt32(&fired, 1) }, deadline)
+		}
+	}
+
+	for _, h := range handles {
+		ts.Cancel(h)
+		ts.Cancel(h)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&canceled); n != 0 {
+		t.Fatal("cancelled functions executed", n)
+	}
+	if n := atomic.LoadInt32(&fired); n != 50 {
+		t.Fatal("functions lost", n)
+	}
+
+	// cancel after execution and after close
+	h := ts.PutWithCancel(func() { atomic.AddInt32(&fired, 1) }, time.Now())
+	time.Sleep(50 * time.Millisecond)
+	ts.Cancel(h)
+	if n := atomic.LoadInt32(&fired); n != 51 {
+		t.Fatal("function not executed", n)
+	}
+	ts.Close()
+	ts.Cancel(h)
+	ts.Cancel(ts.PutWithCancel(func() {}, time.Now()))
+}
+
+func TestTimedSchedPutAt(t *testing.T) {
+	ts := NewTimedSched(1)
+	defer ts.Close()
+
+	ch := make(chan int, 8)
+	now := time.Now()
+	ts.PutAt(func() { ch <- 3 }, now.Add(60*time.Millisecond))
+	ts.Put(func() { ch <- 2 }, now.Add(40*time.Millisecond))
+	ts.PutAt(func() { ch <- 1 }, now.Add(20*time.Millisecond))
+	ts.Put(func() { ch <- 4 }, now.Add(80*time.Millisecond))
+	ts.PutAt(func() { ch <- 0 }, now.Add(-time.Second)) // already expired
+
+	for i := 0; i < 5; i++ {
+		select {
+		case n := <-ch:
+			if n != i {
+				t.Fatal("out of order", i, n)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestTimedSchedSetParallelism(t *testing.T) {
+	ts := NewTimedSched(4)
+	defer ts.Close()
+
+	var fired int32
+	var handles []*TimedHandle
+	for i := 0; i < 100; i++ {
+		deadline := time.Now().Add(100 * time.Millisecond)
+		if i%2 == 0 {
+			handles = append(handles, ts.PutWithCancel(func() { t.Error("cancelled function executed") }, deadline))
+		} else {
+			ts.Put(func() { atomic.AddInt32(&fired, 1) }, deadline)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// the pending tasks survive the shrinking
+	ts.SetParallelism(1)
+	ts.SetParallelism(0)
+	for _, h := range handles {
+		ts.Cancel(h)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&fired); n != 50 {
+		t.Fatal("functions lost", n)
+	}
+
+	ts.SetParallelism(8)
+	for i := 0; i < 100; i++ {
+		ts.Put(func() { atomic.AddInt32(&fired, 1) }, time.Now().Add(20*time.Millisecond))
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&fired); n != 150 {
+		t.Fatal("functions lost", n)
+	}
+}
+
+func TestTimedSchedLazyStart(t *testing.T) {
+	// a margin for the goroutines of the other tests coming and going
+	const parallel = 512
+	n := runtime.NumGoroutine()
+	ts := NewTimedSched(parallel)
+	defer ts.Close()
+	if runtime.NumGoroutine() >= n+parallel/2 {
+		t.Fatal("workers started before any function scheduled")
+	}
+
+	done := make(chan struct{})
+	ts.Put(func() { close(done) }, time.Now())
+	<-done
+	if runtime.NumGoroutine() < n+parallel/2 {
+		t.Fatal("workers not started")
+	}
+}
+
+func TestTimedSchedWheel(t *testing.T) {
+	ts := NewTimedSchedWheel(2, 5*time.Millisecond)
+	defer ts.Close()
+
+	ch := make(chan int, 8)
+	now := time.Now()
+	ts.PutAt(func() { ch <- 3 }, now.Add(60*time.Millisecond))
+	ts.Put(func() { ch <- 2 }, now.Add(40*time.Millisecond))
+	ts.PutAt(func() { ch <- 1 }, now.Add(20*time.Millisecond))
+	ts.Put(func() { ch <- 4 }, now.Add(1500*time.Millisecond)) // beyond level 0
+	ts.PutAt(func() { ch <- 0 }, now.Add(-time.Second))        // already expired
+	h := ts.PutWithCancel(func() { ch <- -1 }, now.Add(30*time.Millisecond))
+	ts.Cancel(h)
+
+	for i := 0; i < 5; i++ {
+		select {
+		case n := <-ch:
+			if n != i {
+				t.Fatal("out of order", i, n)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	if time.Since(now) < 1500*time.Millisecond {
+		t.Fatal("executed early")
+	}
+}
+
+func TestTimingWheelCascade(t *testing.T) {
+	w := newTimingWheel(time.Millisecond)
+	var fired []int
+	for _, n := range []int{70000, 10, 300, 65536, 256} {
+		n := n
+		task := timedFunc{execute: func() { fired = append(fired, n) }, ts: w.start.Add(time.Duration(n) * time.Millisecond)}
+		if !w.add(task) {
+			t.Fatal("not held", n)
+		}
+	}
+	h := &TimedHandle{index: -1}
+	w.add(timedFunc{execute: func() { t.Fatal("removed function executed") }, ts: w.start.Add(300 * time.Millisecond), handle: h})
+	w.remove(h)
+
+	for _, n := range []int{9, 10, 256, 300, 65535, 65536, 69999, 70000} {
+		w.advance(w.start.Add(time.Duration(n) * time.Millisecond))
+		if len(fired) > 0 && fired[len(fired)-1] > n {
+			t.Fatal("executed early", fired, n)
+		}
+	}
+	if len(fired) != 5 || w.count != 0 {
+		t.Fatal("functions lost", fired, w.count)
+	}
+	for i := 1; i < len(fired); i++ {
+		if fired[i] < fired[i-1] {
+			t.Fatal("out of order", fired)
+		}
+	}
+}
+
+func benchmarkTimedSched(b *testing.B, ts *TimedSched) {
+	defer ts.Close()
+	var wg sync.WaitGroup
+	wg.Add(b.N)
+	f := func() { wg.Done() }
+	b.ReportAllocs()
+	b.ResetTimer()
+	now := time.Now()
+	for i := 0; i < b.N; i++ {
+		ts.Put(f, now.Add(time.Duration(i%100)*time.Millisecond))
+	}
+	wg.Wait()
+}
+
+func BenchmarkTimedSchedHeap(b *testing.B) {
+	benchmarkTimedSched(b, NewTimedSched(runtime.NumCPU()))
+}
+
+func BenchmarkTimedSchedWheel(b *testing.B) {
+	benchmarkTimedSched(b, NewTimedSchedWheel(runtime.NumCPU(), time.Millisecond))
+}
@@ -0,0 +1,200 @@
+package kcp
+
+import (
+	"time"
+)
+
+const (
+	wheelBits  = 8
+	wheelSlots = 1 << wheelBits // the slots of each level
+	wheelMask  = wheelSlots - 1
+)
+
+// timingWheel is the 2-level hierarchical timing wheel of a worker, in place of
+// the heap if the scheduler has a tick. Level 0 holds the functions due within
+// wheelSlots ticks, a slot per tick, level 1 the ones due within wheelSlots^2
+// ticks, a slot per wheelSlots ticks, cascaded into level 0 when it comes round,
+// and the later ones wait in the last slot of level 1 to be cascaded again.
+type timingWheel struct {
+	tick    time.Duration
+	start   time.Time // the time of tick 0
+	current int64     // the ticks passed
+	count   int       // the functions held
+	slots   [2][wheelSlots][]timedFunc
+	spare   []timedFunc // the memory of the slot taken last, for the next one
+}
+
+func newTimingWheel(tick time.Duration) *timingWheel {
+	return &timingWheel{tick: tick, start: time.Now()}
+}
+
+// ticks returns the tick of 't', rounded up so the functions never run early
+func (w *timingWheel) ticks(t time.Time) int64 {
+	d := t.Sub(w.start)
+	return int64((d + w.tick - 1) / w.tick)
+}
+
+// add holds 'task' in the slot of its tick, it returns false if it's due already
+func (w *timingWheel) add(task timedFunc) bool {
+	due := w.ticks(task.ts)
+	delta := due - w.current
+	if delta <= 0 {
+		return false
+	}
+
+	var level, slot int
+	switch {
+	case delta < wheelSlots:
+		slot = int(due & wheelMask)
+	case delta < wheelSlots*wheelSlots:
+		level, slot = 1, int(due>>wheelBits&wheelMask)
+	default:
+		level, slot = 1, int((w.current>>wheelBits+wheelMask)&wheelMask)
+	}
+	s := &w.slots[level][slot]
+	if task.handle != nil {
+		task.handle.index = len(*s)
+		task.handle.slot = level<<wheelBits | slot
+	}
+	*s = append(*s, task)
+	w.count++
+	return true
+}
+
+// remove drops the task of 'h' from its slot, after it's canceled
+func (w *timingWheel) remove(h *TimedHandle) {
+	if h.index < 0 {
+		return
+	}
+	s := &w.slots[h.slot>>wheelBits][h.slot&wheelMask]
+	last := len(*s) - 1
+	(*s)[h.index] = (*s)[last]
+	if moved := (*s)[h.index].handle; moved != nil {
+		moved.index = h.index
+	}
+	(*s)[last] = timedFunc{} // avoid memory leak
+	*s = (*s)[:last]
+	h.index = -1
+	w.count--
+}
+
+// take empties a slot, the tasks are handed over to 'f'
+func (w *timingWheel) take(level, slot int, f func(task timedFunc)) {
+	s := &w.slots[level][slot]
+	tasks := *s
+	*s = w.spare[:0] // the cascade may add to the slot again
+	w.count -= len(tasks)
+	for k := range tasks {
+		task := tasks[k]
+		tasks[k] = timedFunc{} // avoid memory leak
+		if task.handle != nil {
+			task.handle.index = -1
+		}
+		f(task)
+	}
+	w.spare = tasks[:0]
+}
+
+// advance runs the functions due by 'now' tick by tick, and cascades level 1
+// into level 0 when it comes round
+func (w *timingWheel) advance(now time.Time) {
+	target := int64(now.Sub(w.start) / w.tick) // the last tick passed
+	if w.count == 0 {
+		if target > w.current {
+			w.current = target
+		}
+		return
+	}
+
+	for w.current < target && w.count > 0 {
+		w.current++
+		if w.current&wheelMask == 0 {
+			w.take(1, int(w.current>>wheelBits&wheelMask), w.cascade)
+		}
+		w.take(0, int(w.current&wheelMask), w.execute)
+	}
+	if w.current < target {
+		w.current = target
+	}
+}
+
+func (w *timingWheel) cascade(task timedFunc) {
+	if !w.add(task) {
+		w.execute(task)
+	}
+}
+
+func (w *timingWheel) execute(task timedFunc) {
+	if !task.handle.isCanceled() {
+		task.execute()
+	}
+}
+
+// drain empties the wheel, the tasks are handed over to 'f'
+func (w *timingWheel) drain(f func(task timedFunc)) {
+	for level := range w.slots {
+		for slot := range w.slots[level] {
+			w.take(level, slot, f)
+		}
+	}
+}
+
+// schedWheel is the worker of a scheduler with a tick, see NewTimedSchedWheel.
+// The ticker runs only while the wheel holds any function.
+func (ts *TimedSched) schedWheel() {
+	w := newTimingWheel(ts.tick)
+	chCancel := make(chan *TimedHandle, 128)
+	var ticker *time.Ticker
+	var chTick <-chan time.Time
+	for {
+		select {
+		case task := <-ts.chTask:
+			if task.handle.isCanceled() {
+				continue // cancelled before dispatched
+			}
+			w.advance(time.Now())
+			if task.handle != nil {
+				task.handle.mu.Lock()
+				task.handle.chCancel = chCancel
+				task.handle.mu.Unlock()
+			}
+			if !w.add(task) { // already delayed! execute immediately
+				if task.handle != nil {
+					task.handle.index = -1
+				}
+				task.execute()
+			}
+		case now := <-chTick:
+			w.advance(now)
+		case h := <-chCancel:
+			w.remove(h)
+		case <-ts.chShrink:
+			// migrate the pending tasks to the surviving workers
+			if ticker != nil {
+				ticker.Stop()
+			}
+			w.drain(func(task timedFunc) {
+				if h := task.handle; h != nil {
+					h.mu.Lock()
+					h.chCancel = nil
+					h.mu.Unlock()
+				}
+				ts.put(task)
+			})
+			return
+		case <-ts.die:
+			if ticker != nil {
+				ticker.Stop()
+			}
+			return
+		}
+
+		if w.count > 0 && ticker == nil {
+			ticker = time.NewTicker(w.tick)
+			chTick = ticker.C
+		} else if w.count == 0 && ticker != nil {
+			ticker.Stop()
+			ticker, chTick = nil, nil
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package kcp
 
 import (
+	"net"
 	"sync/atomic"
 
 	"github.com/pkg/errors"
@@ -11,7 +12,7 @@ func (s *UDPSession) defaultTx(txqueue []ipv4.Message) {
 	nbytes := 0
 	npkts := 0
 	for k := range txqueue {
-		if n, err := s.conn.WriteTo(txqueue[k].Buffers[0], txqueue[k].Addr); err == nil {
+		if n, err := s.writeTo(txqueue[k].Buffers[0], txqueue[k].Addr); err == nil {
 			nbytes += n
 			npkts++
 		} else {
@@ -21,4 +22,15 @@ func (s *UDPSession) defaultTx(txqueue []ipv4.Message) {
 	}
 	atomic.AddUint64(&DefaultSnmp.OutPkts, uint64(npkts))
 	atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(nbytes))
+	atomic.AddUint64(&s.snmp.OutPkts, uint64(npkts))
+	atomic.AddUint64(&s.snmp.OutBytes, uint64(nbytes))
+}
+
+// writeTo sends a packet to 'addr', by Write on the socket connected for the flow
+// label, where the kernel takes the label only without a destination address
+func (s *UDPSession) writeTo(b []byte, addr net.Addr) (int, error) {
+	if atomic.LoadUint32(&s.flowLabel) != 0 {
+		return s.conn.(*net.UDPConn).Write(b)
+	}
+	return s.conn.WriteTo(b, addr)
 }
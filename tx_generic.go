@@ -3,9 +3,14 @@
 package kcp
 
 import (
+	"net"
+
 	"golang.org/x/net/ipv4"
 )
 
 func (s *UDPSession) tx(txqueue []ipv4.Message) {
-	s.defaultTx(txqueue)
+	s.defaultTx(s.outputHooked(txqueue))
 }
+
+// gsoSupported returns false, UDP GSO is supported on Linux only
+func gsoSupported(conn net.PacketConn) bool { return false }
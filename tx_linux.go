@@ -5,24 +5,74 @@ package kcp
 import (
 	"net"
 	"os"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"unsafe"
 
 	"github.com/pkg/errors"
 	"golang.org/x/net/ipv4"
 )
 
+const (
+	udpSegment     = 103   // UDP_SEGMENT of linux/udp.h, since Linux 4.18
+	gsoMaxSegments = 64    // UDP_MAX_SEGMENTS of the kernel
+	gsoMaxBytes    = 65507 // the largest UDP payload
+)
+
+// gsoBuf holds the packets coalesced for GSO, pooled as pointers so Put doesn't
+// allocate
+var gsoBuf = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, gsoMaxBytes)
+		return &buf
+	},
+}
+
 func (s *UDPSession) tx(txqueue []ipv4.Message) {
-	// default version
-	if s.xconn == nil || s.xconnWriteError != nil {
+	if txqueue = s.outputHooked(txqueue); len(txqueue) == 0 {
+		return
+	}
+
+	// default version, also for the flow label, see writeTo
+	if s.xconn == nil || s.xconnWriteError != nil || atomic.LoadUint32(&s.flowLabel) != 0 {
 		s.defaultTx(txqueue)
 		return
 	}
 
-	// x/net version
+	// x/net version, with the runs of equal-sized packets by GSO if supported
+	if s.gso == 0 {
+		s.gso = -1
+		if gsoSupported(s.conn) {
+			s.gso = 1
+		}
+	}
+
 	nbytes := 0
 	npkts := 0
 	for len(txqueue) > 0 {
-		if n, err := s.xconn.WriteBatch(txqueue, 0); err == nil {
+		if n := s.gsoRun(txqueue); n > 1 {
+			if nb, err := s.gsoTx(txqueue[:n]); err == nil {
+				nbytes += nb
+				npkts += n
+				txqueue = txqueue[n:]
+				continue
+			}
+			// e.g. no checksum offload on the device, or the segments exceed its MTU
+			s.gso = -1
+		}
+
+		// the packets ahead of the next run for GSO go in a batch
+		batch := len(txqueue)
+		if s.gso > 0 {
+			for batch = 1; batch < len(txqueue); batch++ {
+				if s.gsoRun(txqueue[batch:]) > 1 {
+					break
+				}
+			}
+		}
+
+		if n, err := s.xconn.WriteBatch(txqueue[:batch], 0); err == nil {
 			for k := range txqueue[:n] {
 				nbytes += len(txqueue[k].Buffers[0])
 			}
@@ -48,4 +98,79 @@ func (s *UDPSession) tx(txqueue []ipv4.Message) {
 
 	atomic.AddUint64(&DefaultSnmp.OutPkts, uint64(npkts))
 	atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(nbytes))
+	atomic.AddUint64(&s.snmp.OutPkts, uint64(npkts))
+	atomic.AddUint64(&s.snmp.OutBytes, uint64(nbytes))
+}
+
+// gsoRun returns the number of the packets leading txqueue to be sent by GSO, the
+// packets of equal size to the same address, the last of which may be shorter
+func (s *UDPSession) gsoRun(txqueue []ipv4.Message) int {
+	if s.gso <= 0 || len(txqueue) < 2 {
+		return 0
+	}
+	size := len(txqueue[0].Buffers[0])
+	max := gsoMaxBytes / size
+	if max > gsoMaxSegments {
+		max = gsoMaxSegments
+	}
+
+	n := 1
+	for n < len(txqueue) && n < max && txqueue[n].Addr == txqueue[0].Addr {
+		if sz := len(txqueue[n].Buffers[0]); sz != size {
+			if sz < size {
+				n++
+			}
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// gsoTx sends the packets in a single buffer segmented by the kernel
+func (s *UDPSession) gsoTx(txqueue []ipv4.Message) (int, error) {
+	conn, ok := s.conn.(*net.UDPConn)
+	if !ok {
+		return 0, ErrInvalidOperation
+	}
+	addr, ok := txqueue[0].Addr.(*net.UDPAddr)
+	if !ok {
+		return 0, ErrInvalidOperation
+	}
+
+	pbuf := gsoBuf.Get().(*[]byte)
+	defer gsoBuf.Put(pbuf)
+	buf := (*pbuf)[:0]
+	for k := range txqueue {
+		buf = append(buf, txqueue[k].Buffers[0]...)
+	}
+
+	var oob [32]byte // the space of a cmsg of uint16
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.IPPROTO_UDP
+	h.Type = udpSegment
+	h.SetLen(syscall.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = uint16(len(txqueue[0].Buffers[0]))
+
+	n, _, err := conn.WriteMsgUDP(buf, oob[:syscall.CmsgSpace(2)], addr)
+	return n, err
+}
+
+// gsoSupported checks if the socket supports UDP_SEGMENT
+func gsoSupported(conn net.PacketConn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var supported bool
+	rc.Control(func(fd uintptr) {
+		_, err := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_UDP, udpSegment)
+		supported = err == nil
+	})
+	return supported
 }